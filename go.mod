@@ -4,8 +4,12 @@ go 1.24.0
 
 require (
 	github.com/flynn/noise v1.1.0
+	github.com/quic-go/quic-go v0.59.1
 	golang.org/x/crypto v0.47.0
 	nhooyr.io/websocket v1.8.17
 )
 
-require golang.org/x/sys v0.40.0 // indirect
+require (
+	golang.org/x/net v0.48.0 // indirect
+	golang.org/x/sys v0.40.0 // indirect
+)
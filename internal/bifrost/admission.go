@@ -0,0 +1,310 @@
+package bifrost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+var (
+	// ErrSlowFrame is returned, and the connection closed, when a peer
+	// starts a frame but does not finish it within the frame timeout.
+	ErrSlowFrame = errors.New("bifrost: frame not completed within deadline")
+	// ErrFrameLimitsUnsupported is returned by LimitedListener.Accept for
+	// a connection that cannot enforce MaxFrameSize and FrameTimeout.
+	ErrFrameLimitsUnsupported = errors.New("bifrost: connection cannot enforce frame limits")
+)
+
+// AdmissionConfig limits what strangers can cost a listener. Zero fields
+// disable the corresponding limit.
+type AdmissionConfig struct {
+	// MaxConns caps concurrently open accepted connections.
+	MaxConns int
+	// MaxConnsPerIP caps concurrent connections from one remote IP.
+	MaxConnsPerIP int
+
+	// FramesPerSecond and FrameBurst bound each connection's inbound
+	// frame rate. Receive stalls once the bucket is empty, pushing
+	// back on the sender through the transport's flow control.
+	FramesPerSecond float64
+	FrameBurst      int
+	// BytesPerSecond and ByteBurst bound inbound payload bytes likewise.
+	BytesPerSecond float64
+	ByteBurst      int
+
+	// FrameTimeout is how long a peer may take to deliver a frame once
+	// its first byte has arrived (the slow-loris guard). UDP frames are
+	// bounded by UDPConfig.ReassemblyTimeout instead.
+	FrameTimeout time.Duration
+	// MaxFrameSize rejects larger frames before their payload is
+	// allocated.
+	MaxFrameSize uint32
+}
+
+// DefaultAdmissionConfig returns limits suited to a public node.
+func DefaultAdmissionConfig() AdmissionConfig {
+	return AdmissionConfig{
+		MaxConns:        1024,
+		MaxConnsPerIP:   16,
+		FramesPerSecond: 1000,
+		FrameBurst:      200,
+		BytesPerSecond:  8 << 20,
+		ByteBurst:       4 << 20,
+		FrameTimeout:    30 * time.Second,
+		MaxFrameSize:    1 << 20,
+	}
+}
+
+// frameLimiter is implemented by connections that can enforce frame size
+// and frame deadlines while decoding. Wrappers forward to the conn they
+// wrap and report false if it cannot.
+type frameLimiter interface {
+	setFrameLimits(maxPayload uint32, frameTimeout time.Duration) bool
+}
+
+// applyFrameLimits sets the limits on conn, reporting false if conn cannot
+// enforce them.
+func applyFrameLimits(conn Conn, maxPayload uint32, frameTimeout time.Duration) bool {
+	fl, ok := conn.(frameLimiter)
+	return ok && fl.setFrameLimits(maxPayload, frameTimeout)
+}
+
+// LimitedTransport applies admission control to every listener it opens.
+type LimitedTransport struct {
+	Transport
+	config AdmissionConfig
+}
+
+// NewLimitedTransport wraps t so its listeners enforce config.
+func NewLimitedTransport(t Transport, config AdmissionConfig) *LimitedTransport {
+	return &LimitedTransport{Transport: t, config: config}
+}
+
+// Protocol returns the wrapped transport's protocol, if it has one.
+func (t *LimitedTransport) Protocol() string { return transportProtocol(t.Transport) }
+
+// Listen returns a LimitedListener.
+func (t *LimitedTransport) Listen(ctx context.Context, addr string) (Listener, error) {
+	ln, err := t.Transport.Listen(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewLimitedListener(ln, t.config), nil
+}
+
+// LimitedListener enforces an AdmissionConfig on a Listener. Connections
+// over a cap are sent a FrameClose and dropped without surfacing from
+// Accept; admitted ones are rate limited and count against the caps until
+// closed. If the config sets MaxFrameSize or FrameTimeout, Accept fails
+// with ErrFrameLimitsUnsupported rather than hand out a connection that
+// cannot enforce them.
+type LimitedListener struct {
+	Listener
+	config AdmissionConfig
+
+	mu       sync.Mutex
+	active   int
+	perIP    map[string]int
+	rejected atomic.Uint64
+}
+
+// NewLimitedListener wraps ln with admission control.
+func NewLimitedListener(ln Listener, config AdmissionConfig) *LimitedListener {
+	return &LimitedListener{Listener: ln, config: config, perIP: make(map[string]int)}
+}
+
+// Active returns the number of admitted connections not yet closed.
+func (l *LimitedListener) Active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// Rejected returns how many connections were refused by the caps.
+func (l *LimitedListener) Rejected() uint64 {
+	return l.rejected.Load()
+}
+
+func (l *LimitedListener) Accept(ctx context.Context) (Conn, error) {
+	for {
+		conn, err := l.Listener.Accept(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn.RemoteAddr())
+		if !l.admit(ip) {
+			l.rejected.Add(1)
+			conn.Send(closeFrame(0, CloseGoingAway, "connection limit reached"))
+			conn.Close()
+			continue
+		}
+
+		if l.config.MaxFrameSize > 0 || l.config.FrameTimeout > 0 {
+			if !applyFrameLimits(conn, l.config.MaxFrameSize, l.config.FrameTimeout) {
+				l.release(ip)
+				conn.Close()
+				return nil, fmt.Errorf("%w: %T", ErrFrameLimitsUnsupported, conn)
+			}
+		}
+		return &limitedConn{
+			Conn:    conn,
+			frames:  newTokenBucket(l.config.FramesPerSecond, l.config.FrameBurst),
+			bytes:   newTokenBucket(l.config.BytesPerSecond, l.config.ByteBurst),
+			release: func() { l.release(ip) },
+			closed:  make(chan struct{}),
+		}, nil
+	}
+}
+
+func (l *LimitedListener) admit(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.config.MaxConns > 0 && l.active >= l.config.MaxConns {
+		return false
+	}
+	if l.config.MaxConnsPerIP > 0 && l.perIP[ip] >= l.config.MaxConnsPerIP {
+		return false
+	}
+	l.active++
+	l.perIP[ip]++
+	return true
+}
+
+func (l *LimitedListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// remoteIP strips the port from a RemoteAddr.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// limitedConn rate limits Receive and releases its admission slot on Close.
+type limitedConn struct {
+	Conn
+	frames  *tokenBucket // nil when unlimited
+	bytes   *tokenBucket
+	release func()
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func (c *limitedConn) Receive() (*types.BifrostFrame, error) {
+	f, err := c.Conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.throttle(len(f.Payload)); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *limitedConn) ReceivePooled() (*PooledFrame, error) {
+	var f *PooledFrame
+	if pr, ok := c.Conn.(PooledReceiver); ok {
+		var err error
+		if f, err = pr.ReceivePooled(); err != nil {
+			return nil, err
+		}
+	} else {
+		frame, err := c.Conn.Receive()
+		if err != nil {
+			return nil, err
+		}
+		f = framePool.Get().(*PooledFrame)
+		f.BifrostFrame = *frame
+	}
+	if err := c.throttle(len(f.Payload)); err != nil {
+		f.Release()
+		return nil, err
+	}
+	return f, nil
+}
+
+// throttle charges one frame of n bytes and sleeps off any deficit.
+func (c *limitedConn) throttle(n int) error {
+	now := time.Now()
+	wait := c.frames.reserve(now, 1)
+	if w := c.bytes.reserve(now, float64(n)); w > wait {
+		wait = w
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+// NegotiatedParams forwards to the wrapped conn.
+func (c *limitedConn) NegotiatedParams() (Params, bool) {
+	return NegotiatedParams(c.Conn)
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.release()
+	})
+	return c.Conn.Close()
+}
+
+// tokenBucket is a token bucket that may go into debt: a reservation
+// always succeeds and reports how long the caller must wait for the
+// bucket to refill to zero. It is only used from one Receive at a time.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,375 @@
+package bifrost_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+	"nhooyr.io/websocket"
+)
+
+// limitedTCP listens on loopback TCP with admission control and accepts
+// in the background.
+func limitedTCP(t *testing.T, cfg bifrost.AdmissionConfig) (*bifrost.LimitedListener, <-chan bifrost.Conn) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ln, err := bifrost.NewTCPTransport().Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	l := bifrost.NewLimitedListener(ln, cfg)
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan bifrost.Conn, 8)
+	go func() {
+		for {
+			c, err := l.Accept(ctx)
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	return l, accepted
+}
+
+func dialTCP(t *testing.T, addr string) bifrost.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := bifrost.NewTCPTransport().Dial(ctx, addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestLimitedListenerConnectionCaps(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  bifrost.AdmissionConfig
+	}{
+		{"max conns", bifrost.AdmissionConfig{MaxConns: 2}},
+		{"per ip", bifrost.AdmissionConfig{MaxConnsPerIP: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, accepted := limitedTCP(t, tt.cfg)
+
+			var servers []bifrost.Conn
+			for i := 0; i < 2; i++ {
+				dialTCP(t, ln.Addr())
+				servers = append(servers, <-accepted)
+			}
+
+			// The third connection is told why and dropped.
+			over := dialTCP(t, ln.Addr())
+			f, err := over.Receive()
+			if err != nil || f.Type != types.FrameClose {
+				t.Fatalf("over-cap conn got %v, %v; want FrameClose", f, err)
+			}
+			if ln.Rejected() != 1 || ln.Active() != 2 {
+				t.Fatalf("rejected=%d active=%d, want 1/2", ln.Rejected(), ln.Active())
+			}
+
+			// Closing an admitted conn frees its slot.
+			servers[0].Close()
+			dialTCP(t, ln.Addr())
+			select {
+			case c := <-accepted:
+				c.Close()
+			case <-time.After(2 * time.Second):
+				t.Fatal("slot was not released")
+			}
+			servers[1].Close()
+		})
+	}
+}
+
+func TestLimitedListenerRateLimit(t *testing.T) {
+	ln, accepted := limitedTCP(t, bifrost.AdmissionConfig{FramesPerSecond: 50, FrameBurst: 5})
+	client := dialTCP(t, ln.Addr())
+	server := <-accepted
+	defer server.Close()
+
+	const frames = 15
+	go func() {
+		for i := 0; i < frames; i++ {
+			client.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("x")})
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < frames; i++ {
+		if _, err := server.Receive(); err != nil {
+			t.Fatalf("Receive %d: %v", i, err)
+		}
+	}
+	// 5 frames of burst, then 10 more at 50/s: at least 200ms.
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Fatalf("received %d frames in %v, limiter did not throttle", frames, elapsed)
+	}
+}
+
+func TestLimitedListenerMaxFrameSize(t *testing.T) {
+	ln, accepted := limitedTCP(t, bifrost.AdmissionConfig{MaxFrameSize: 1024})
+	client := dialTCP(t, ln.Addr())
+	server := <-accepted
+	defer server.Close()
+
+	if err := client.Send(&types.BifrostFrame{Type: types.FrameData, Payload: make([]byte, 1024)}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := server.Receive(); err != nil {
+		t.Fatalf("Receive at limit: %v", err)
+	}
+	if err := client.Send(&types.BifrostFrame{Type: types.FrameData, Payload: make([]byte, 1025)}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := server.Receive(); !errors.Is(err, bifrost.ErrPayloadTooLong) {
+		t.Fatalf("Receive over limit = %v, want ErrPayloadTooLong", err)
+	}
+}
+
+func TestLimitedListenerSlowLoris(t *testing.T) {
+	ln, accepted := limitedTCP(t, bifrost.AdmissionConfig{FrameTimeout: 100 * time.Millisecond})
+
+	raw, err := net.Dial("tcp", ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer raw.Close()
+	server := <-accepted
+	defer server.Close()
+
+	// Idling between frames is allowed.
+	time.Sleep(150 * time.Millisecond)
+	frame, _ := (&types.BifrostFrame{Type: types.FrameData, Payload: []byte("hello")}).MarshalBinary()
+	raw.Write(frame)
+	if f, err := server.Receive(); err != nil || string(f.Payload) != "hello" {
+		t.Fatalf("Receive after idle = %v, %v", f, err)
+	}
+
+	// Trickling a frame is not.
+	raw.Write(frame[:3])
+	errc := make(chan error, 1)
+	go func() {
+		_, err := server.Receive()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, bifrost.ErrSlowFrame) {
+			t.Fatalf("Receive = %v, want ErrSlowFrame", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("slow frame was not cut off")
+	}
+}
+
+// rawPeer writes Bifrost bytes straight onto a transport, bypassing its
+// Conn: send delivers a whole frame, trickle starts one and stops.
+type rawPeer struct {
+	send    func(frame []byte) error
+	trickle func(frame []byte) error
+}
+
+func TestLimitedListenerSlowFrameStreams(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport bifrost.Transport
+		dial      func(ctx context.Context, addr string) (rawPeer, error)
+	}{
+		{"ws", bifrost.NewWSTransport(), func(ctx context.Context, addr string) (rawPeer, error) {
+			wc, _, err := websocket.Dial(ctx, "ws://"+addr, nil)
+			if err != nil {
+				return rawPeer{}, err
+			}
+			t.Cleanup(func() { wc.CloseNow() })
+			return rawPeer{
+				send: func(frame []byte) error {
+					return wc.Write(ctx, websocket.MessageBinary, frame)
+				},
+				// A message left open after more than the write buffer
+				// has gone out.
+				trickle: func(frame []byte) error {
+					w, err := wc.Writer(ctx, websocket.MessageBinary)
+					if err != nil {
+						return err
+					}
+					_, err = w.Write(frame[:len(frame)-1])
+					return err
+				},
+			}, nil
+		}},
+		{"quic", bifrost.NewQUICTransport(), func(ctx context.Context, addr string) (rawPeer, error) {
+			qc, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{bifrost.QUICALPN}}, nil)
+			if err != nil {
+				return rawPeer{}, err
+			}
+			t.Cleanup(func() { qc.CloseWithError(0, "") })
+			stream, err := qc.OpenStreamSync(ctx)
+			if err != nil {
+				return rawPeer{}, err
+			}
+			if _, err := stream.Write([]byte{0x01}); err != nil { // stream header
+				return rawPeer{}, err
+			}
+			return rawPeer{
+				send:    func(frame []byte) error { _, err := stream.Write(frame); return err },
+				trickle: func(frame []byte) error { _, err := stream.Write(frame[:3]); return err },
+			}, nil
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			ln, err := bifrost.NewLimitedTransport(tt.transport, bifrost.AdmissionConfig{FrameTimeout: 100 * time.Millisecond}).Listen(ctx, "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen: %v", err)
+			}
+			defer ln.Close()
+
+			raw, err := tt.dial(ctx, ln.Addr())
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			server, err := ln.Accept(ctx)
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			defer server.Close()
+
+			// Idling between frames is allowed.
+			time.Sleep(150 * time.Millisecond)
+			frame, _ := (&types.BifrostFrame{Type: types.FrameData, Payload: make([]byte, 16<<10)}).MarshalBinary()
+			if err := raw.send(frame); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			if f, err := server.Receive(); err != nil || len(f.Payload) != 16<<10 {
+				t.Fatalf("Receive after idle = %v, %v", f, err)
+			}
+
+			// Trickling a frame is not.
+			if err := raw.trickle(frame); err != nil {
+				t.Fatalf("trickle: %v", err)
+			}
+			errc := make(chan error, 1)
+			go func() {
+				_, err := server.Receive()
+				errc <- err
+			}()
+			select {
+			case err := <-errc:
+				if !errors.Is(err, bifrost.ErrSlowFrame) {
+					t.Fatalf("Receive = %v, want ErrSlowFrame", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("slow frame was not cut off")
+			}
+		})
+	}
+}
+
+func TestLimitedListenerLimitsNegotiatedConns(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cfg := bifrost.AdmissionConfig{MaxFrameSize: 4096, FrameTimeout: 100 * time.Millisecond}
+	ln, err := bifrost.NewLimitedTransport(bifrost.NewNegotiatingTransport(bifrost.NewTCPTransport(), bifrost.DefaultHelloConfig()), cfg).Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	t.Run("compressed frame expanding past the limit", func(t *testing.T) {
+		client, err := bifrost.NewNegotiatingTransport(bifrost.NewTCPTransport(), bifrost.DefaultHelloConfig()).Dial(ctx, ln.Addr())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer client.Close()
+		server, err := ln.Accept(ctx)
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		defer server.Close()
+		if _, ok := bifrost.NegotiatedParams(server); !ok {
+			t.Fatal("limited conn hides the negotiated params")
+		}
+
+		// Well under the limit on the wire, 16 times over it inflated.
+		if err := client.Send(&types.BifrostFrame{Type: types.FrameData, Payload: make([]byte, 64<<10)}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if _, err := server.Receive(); !errors.Is(err, bifrost.ErrDecompressedTooLarge) {
+			t.Fatalf("Receive = %v, want ErrDecompressedTooLarge", err)
+		}
+	})
+
+	t.Run("slow frame", func(t *testing.T) {
+		raw, err := net.Dial("tcp", ln.Addr())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer raw.Close()
+		// A hello with no extensions: version 1, min 1, 4 KiB frames.
+		hello, _ := (&types.BifrostFrame{Type: types.FrameControl, Payload: []byte{0x02, 0, 1, 0, 1, 0, 0, 0, 0, 0, 0, 0x10, 0, 0}}).MarshalBinary()
+		if _, err := raw.Write(hello); err != nil {
+			t.Fatalf("hello: %v", err)
+		}
+		server, err := ln.Accept(ctx)
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		defer server.Close()
+
+		frame, _ := (&types.BifrostFrame{Type: types.FrameData, Payload: []byte("trickled")}).MarshalBinary()
+		if _, err := raw.Write(frame[:3]); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		errc := make(chan error, 1)
+		go func() {
+			_, err := server.Receive()
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			if !errors.Is(err, bifrost.ErrSlowFrame) {
+				t.Fatalf("Receive = %v, want ErrSlowFrame", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("slow frame was not cut off")
+		}
+	})
+}
+
+func TestLimitedListenerRefusesUnlimitableConns(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	network := bifrost.NewSimNetwork(1)
+	inner, err := network.Transport("server").Listen(ctx, "server:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ln := bifrost.NewLimitedListener(inner, bifrost.AdmissionConfig{FrameTimeout: time.Second})
+	defer ln.Close()
+
+	if _, err := network.Transport("client").Dial(ctx, ln.Addr()); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if _, err := ln.Accept(ctx); !errors.Is(err, bifrost.ErrFrameLimitsUnsupported) {
+		t.Fatalf("Accept = %v, want ErrFrameLimitsUnsupported", err)
+	}
+	if ln.Active() != 0 {
+		t.Errorf("Active = %d after refusing the conn", ln.Active())
+	}
+}
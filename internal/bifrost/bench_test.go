@@ -3,6 +3,8 @@ package bifrost_test
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"io"
 	"testing"
 
 	"github.com/valhalla/valhalla/internal/bifrost"
@@ -15,6 +17,7 @@ func BenchmarkFrameEncode(b *testing.B) {
 		Payload: bytes.Repeat([]byte("X"), 1024),
 	}
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		var buf bytes.Buffer
@@ -24,16 +27,64 @@ func BenchmarkFrameEncode(b *testing.B) {
 	}
 }
 
-func BenchmarkFrameDecode(b *testing.B) {
+// BenchmarkFrameEncodeReusedWriter isolates Encode from the per-iteration
+// buffer setup in BenchmarkFrameEncode.
+func BenchmarkFrameEncodeReusedWriter(b *testing.B) {
 	frame := &types.BifrostFrame{
 		Type:    types.FrameData,
 		Payload: bytes.Repeat([]byte("X"), 1024),
 	}
+	w := bufio.NewWriter(io.Discard)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bifrost.Encode(w, frame)
+	}
+}
+
+func BenchmarkFrameMarshalBinary(b *testing.B) {
+	frame := &types.BifrostFrame{
+		Type:    types.FrameData,
+		Payload: bytes.Repeat([]byte("X"), 64*1024),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame.MarshalBinary()
+	}
+}
+
+func BenchmarkFrameAppend(b *testing.B) {
+	frame := &types.BifrostFrame{
+		Type:    types.FrameData,
+		Payload: bytes.Repeat([]byte("X"), 64*1024),
+	}
+	buf := make([]byte, 0, types.BifrostFrameHeaderSize+len(frame.Payload))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = bifrost.AppendFrame(buf[:0], frame)
+	}
+}
+
+func encodedFrame(b *testing.B, size int) []byte {
+	b.Helper()
+	frame := &types.BifrostFrame{
+		Type:    types.FrameData,
+		Payload: bytes.Repeat([]byte("X"), size),
+	}
 	var encoded bytes.Buffer
 	w := bufio.NewWriter(&encoded)
 	bifrost.Encode(w, frame)
 	w.Flush()
-	raw := encoded.Bytes()
+	return encoded.Bytes()
+}
+
+func BenchmarkFrameDecode(b *testing.B) {
+	raw := encodedFrame(b, 1024)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -42,12 +93,48 @@ func BenchmarkFrameDecode(b *testing.B) {
 	}
 }
 
+// BenchmarkFrameDecodeReusedReader isolates Decode from the per-iteration
+// reader setup in BenchmarkFrameDecode, for comparison with
+// BenchmarkFrameDecodePooled.
+func BenchmarkFrameDecodeReusedReader(b *testing.B) {
+	raw := encodedFrame(b, 1024)
+	src := bytes.NewReader(raw)
+	reader := bufio.NewReader(src)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.Reset(raw)
+		reader.Reset(src)
+		bifrost.Decode(reader)
+	}
+}
+
+func BenchmarkFrameDecodePooled(b *testing.B) {
+	raw := encodedFrame(b, 1024)
+	src := bytes.NewReader(raw)
+	reader := bufio.NewReader(src)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.Reset(raw)
+		reader.Reset(src)
+		f, err := bifrost.DecodePooled(reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.Release()
+	}
+}
+
 func BenchmarkFrameRoundtrip(b *testing.B) {
 	frame := &types.BifrostFrame{
 		Type:    types.FrameData,
 		Payload: bytes.Repeat([]byte("X"), 4096),
 	}
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		var buf bytes.Buffer
@@ -58,3 +145,55 @@ func BenchmarkFrameRoundtrip(b *testing.B) {
 		bifrost.Decode(r)
 	}
 }
+
+// BenchmarkTCPRelay64K sends 64 KB frames over loopback and receives them
+// into pooled buffers, exercising the writev send path.
+func BenchmarkTCPRelay64K(b *testing.B) {
+	ctx := context.Background()
+	transport := bifrost.NewTCPTransport()
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan bifrost.Conn, 1)
+	go func() {
+		c, _ := ln.Accept(ctx)
+		accepted <- c
+	}()
+	client, err := transport.Dial(ctx, ln.Addr())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+	defer server.Close()
+	pr := server.(bifrost.PooledReceiver)
+
+	frame := &types.BifrostFrame{Type: types.FrameData, Payload: bytes.Repeat([]byte("X"), 64*1024)}
+	done := make(chan error, 1)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame.Payload)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			f, err := pr.ReceivePooled()
+			if err != nil {
+				done <- err
+				return
+			}
+			f.Release()
+		}
+		done <- nil
+	}()
+	for i := 0; i < b.N; i++ {
+		if err := client.Send(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
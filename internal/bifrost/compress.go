@@ -0,0 +1,258 @@
+package bifrost
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// Compression identifies a payload codec. A compressed frame sets
+// types.FrameFlagCompressed in its type byte and carries
+// [codec:1][compressed payload].
+type Compression byte
+
+const (
+	CompressionNone    Compression = 0x00
+	CompressionDeflate Compression = 0x01
+	CompressionZlib    Compression = 0x02
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionDeflate:
+		return "deflate"
+	case CompressionZlib:
+		return "zlib"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// DefaultCompressionThreshold is the payload size below which frames are
+// sent uncompressed; tiny frames rarely shrink enough to pay for the codec.
+const DefaultCompressionThreshold = 256
+
+var (
+	ErrUnknownCompression   = errors.New("bifrost: unknown compression codec")
+	ErrDecompressedTooLarge = errors.New("bifrost: decompressed payload exceeds maximum size")
+)
+
+// pooledWriter is a reusable compressor: *flate.Writer or *zlib.Writer.
+type pooledWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var (
+	deflateWriters = sync.Pool{
+		New: func() any {
+			w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return w
+		},
+	}
+	zlibWriters = sync.Pool{
+		New: func() any { return zlib.NewWriter(nil) },
+	}
+)
+
+// CompressFrame returns a copy of f with its payload compressed by codec.
+// If compression does not shrink the payload, f is returned unchanged.
+func CompressFrame(f *types.BifrostFrame, codec Compression) (*types.BifrostFrame, error) {
+	if codec == CompressionNone || len(f.Payload) == 0 {
+		return f, nil
+	}
+
+	var pool *sync.Pool
+	switch codec {
+	case CompressionDeflate:
+		pool = &deflateWriters
+	case CompressionZlib:
+		pool = &zlibWriters
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnknownCompression, codec)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(f.Payload)/2 + 1)
+	buf.WriteByte(byte(codec))
+
+	w := pool.Get().(pooledWriter)
+	w.Reset(&buf)
+	_, err := w.Write(f.Payload)
+	if err == nil {
+		err = w.Close()
+	}
+	pool.Put(w)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost compress: %w", err)
+	}
+
+	if buf.Len() >= len(f.Payload) {
+		return f, nil
+	}
+	return &types.BifrostFrame{
+		Type:    f.Type | types.FrameFlagCompressed,
+		Payload: buf.Bytes(),
+	}, nil
+}
+
+// DecompressFrame reverses CompressFrame. Frames without the compressed
+// flag are returned unchanged. Output is capped at MaxPayloadSize so a
+// small malicious frame cannot expand without bound.
+func DecompressFrame(f *types.BifrostFrame) (*types.BifrostFrame, error) {
+	return decompressFrame(f, MaxPayloadSize)
+}
+
+// decompressFrame is DecompressFrame with output capped at limit bytes.
+func decompressFrame(f *types.BifrostFrame, limit int) (*types.BifrostFrame, error) {
+	if f.Type&types.FrameFlagCompressed == 0 {
+		return f, nil
+	}
+	if len(f.Payload) < 1 {
+		return nil, fmt.Errorf("bifrost decompress: missing codec byte")
+	}
+
+	src := bytes.NewReader(f.Payload[1:])
+	var r io.ReadCloser
+	switch Compression(f.Payload[0]) {
+	case CompressionDeflate:
+		r = flate.NewReader(src)
+	case CompressionZlib:
+		zr, err := zlib.NewReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("bifrost decompress: %w", err)
+		}
+		r = zr
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnknownCompression, f.Payload[0])
+	}
+	defer r.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("bifrost decompress: %w", err)
+	}
+	if len(payload) > limit {
+		return nil, ErrDecompressedTooLarge
+	}
+	return &types.BifrostFrame{
+		Type:    f.Type &^ types.FrameFlagCompressed,
+		Payload: payload,
+	}, nil
+}
+
+// CompressionConfig describes a node's compression capabilities.
+type CompressionConfig struct {
+	// Codecs lists supported codecs in order of preference.
+	Codecs []Compression
+	// Threshold is the smallest payload that is compressed.
+	Threshold int
+}
+
+// DefaultCompressionConfig prefers raw DEFLATE, then zlib.
+func DefaultCompressionConfig() CompressionConfig {
+	return CompressionConfig{
+		Codecs:    []Compression{CompressionDeflate, CompressionZlib},
+		Threshold: DefaultCompressionThreshold,
+	}
+}
+
+// CompressedConn compresses outgoing payloads with a codec the peer
+// accepted and transparently decompresses incoming ones, up to the
+// connection's frame size limit.
+type CompressedConn struct {
+	Conn
+	codec      Compression
+	threshold  int
+	maxPayload uint32 // decompressed; MaxPayloadSize if zero
+}
+
+// NewCompressedConn wraps conn to send with codec, which must already be
+// agreed: Handshake negotiates it in the hello exchange.
+func NewCompressedConn(conn Conn, codec Compression, threshold int) *CompressedConn {
+	return &CompressedConn{Conn: conn, codec: codec, threshold: threshold}
+}
+
+// Codec returns the codec used for outgoing frames.
+func (c *CompressedConn) Codec() Compression {
+	return c.codec
+}
+
+func (c *CompressedConn) Send(frame *types.BifrostFrame) error {
+	if len(frame.Payload) >= c.threshold {
+		compressed, err := CompressFrame(frame, c.codec)
+		if err != nil {
+			return err
+		}
+		frame = compressed
+	}
+	return c.Conn.Send(frame)
+}
+
+func (c *CompressedConn) Receive() (*types.BifrostFrame, error) {
+	frame, err := c.Conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+	limit := MaxPayloadSize
+	if c.maxPayload > 0 && c.maxPayload < MaxPayloadSize {
+		limit = int(c.maxPayload)
+	}
+	return decompressFrame(frame, limit)
+}
+
+// NegotiatedParams forwards to the wrapped conn.
+func (c *CompressedConn) NegotiatedParams() (Params, bool) {
+	return NegotiatedParams(c.Conn)
+}
+
+// setFrameLimits caps decompressed payloads too, so a small compressed
+// frame cannot expand past maxPayload, and forwards to the wrapped conn.
+func (c *CompressedConn) setFrameLimits(maxPayload uint32, frameTimeout time.Duration) bool {
+	if maxPayload > 0 && (c.maxPayload == 0 || maxPayload < c.maxPayload) {
+		c.maxPayload = maxPayload
+	}
+	return applyFrameLimits(c.Conn, maxPayload, frameTimeout)
+}
+
+// chooseCompression picks the first of ours that appears in theirs.
+func chooseCompression(ours []Compression, theirs []byte) Compression {
+	for _, c := range ours {
+		if bytes.IndexByte(theirs, byte(c)) >= 0 {
+			return c
+		}
+	}
+	return CompressionNone
+}
+
+// receiveContext reads one frame, closing conn if ctx ends first so the
+// blocked Receive returns.
+func receiveContext(ctx context.Context, conn Conn) (*types.BifrostFrame, error) {
+	type result struct {
+		frame *types.BifrostFrame
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		f, err := conn.Receive()
+		ch <- result{f, err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.frame, res.err
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
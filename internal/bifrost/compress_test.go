@@ -0,0 +1,99 @@
+package bifrost
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"testing"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+func TestCompressFrameRoundtrip(t *testing.T) {
+	jsonish := bytes.Repeat([]byte(`{"type":1,"from":"VH5dJk7Gx3nR9wQm","payload":"aGVsbG8="}`), 64)
+
+	tests := []struct {
+		name           string
+		codec          Compression
+		payload        []byte
+		wantCompressed bool
+	}{
+		{"deflate", CompressionDeflate, jsonish, true},
+		{"zlib", CompressionZlib, jsonish, true},
+		{"none", CompressionNone, jsonish, false},
+		{"incompressible stays raw", CompressionDeflate, []byte{0x01}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := &types.BifrostFrame{Type: types.FrameData, Payload: tt.payload}
+			out, err := CompressFrame(in, tt.codec)
+			if err != nil {
+				t.Fatalf("CompressFrame: %v", err)
+			}
+			compressed := out.Type&types.FrameFlagCompressed != 0
+			if compressed != tt.wantCompressed {
+				t.Fatalf("compressed flag: got %v, want %v", compressed, tt.wantCompressed)
+			}
+			if compressed && len(out.Payload) >= len(tt.payload) {
+				t.Errorf("compressed size %d not smaller than %d", len(out.Payload), len(tt.payload))
+			}
+
+			got, err := DecompressFrame(out)
+			if err != nil {
+				t.Fatalf("DecompressFrame: %v", err)
+			}
+			if got.Type != types.FrameData {
+				t.Errorf("Type: got %v, want DATA", got.Type)
+			}
+			if !bytes.Equal(got.Payload, tt.payload) {
+				t.Error("payload mismatch after round trip")
+			}
+		})
+	}
+}
+
+func TestDecompressFrameBombLimit(t *testing.T) {
+	// A few KB of deflate that expands past MaxPayloadSize.
+	var buf bytes.Buffer
+	buf.WriteByte(byte(CompressionDeflate))
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	zeros := make([]byte, 1024*1024)
+	for i := 0; i < MaxPayloadSize/len(zeros)+1; i++ {
+		w.Write(zeros)
+	}
+	w.Close()
+
+	bomb := &types.BifrostFrame{Type: types.FrameData | types.FrameFlagCompressed, Payload: buf.Bytes()}
+	if _, err := DecompressFrame(bomb); !errors.Is(err, ErrDecompressedTooLarge) {
+		t.Fatalf("got %v, want ErrDecompressedTooLarge", err)
+	}
+}
+
+func TestDecompressFrameUnknownCodec(t *testing.T) {
+	f := &types.BifrostFrame{Type: types.FrameData | types.FrameFlagCompressed, Payload: []byte{0x7F, 0x00}}
+	if _, err := DecompressFrame(f); !errors.Is(err, ErrUnknownCompression) {
+		t.Fatalf("got %v, want ErrUnknownCompression", err)
+	}
+}
+
+func TestChooseCompression(t *testing.T) {
+	tests := []struct {
+		name   string
+		ours   []Compression
+		theirs []byte
+		want   Compression
+	}{
+		{"first shared preference", []Compression{CompressionDeflate, CompressionZlib}, []byte{0x02, 0x01}, CompressionDeflate},
+		{"fallback to second", []Compression{CompressionDeflate, CompressionZlib}, []byte{0x02}, CompressionZlib},
+		{"nothing shared", []Compression{CompressionDeflate}, []byte{0x02}, CompressionNone},
+		{"peer offers nothing", []Compression{CompressionDeflate}, nil, CompressionNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chooseCompression(tt.ours, tt.theirs); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -22,19 +22,10 @@ const MaxPayloadSize = 16 * 1024 * 1024
 
 // Encode writes a BifrostFrame to a buffered writer.
 func Encode(w *bufio.Writer, f *types.BifrostFrame) error {
-	// Magic bytes
-	if _, err := w.Write(types.BifrostMagic[:]); err != nil {
-		return fmt.Errorf("bifrost encode magic: %w", err)
-	}
-	// Payload length (4 bytes, big-endian)
-	var lenBuf [4]byte
-	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(f.Payload)))
-	if _, err := w.Write(lenBuf[:]); err != nil {
-		return fmt.Errorf("bifrost encode length: %w", err)
-	}
-	// Frame type
-	if err := w.WriteByte(byte(f.Type)); err != nil {
-		return fmt.Errorf("bifrost encode type: %w", err)
+	// Magic bytes, payload length (4 bytes, big-endian), frame type
+	hdr := appendHeader(w.AvailableBuffer(), f)
+	if _, err := w.Write(hdr); err != nil {
+		return fmt.Errorf("bifrost encode header: %w", err)
 	}
 	// Payload
 	if len(f.Payload) > 0 {
@@ -45,31 +36,30 @@ func Encode(w *bufio.Writer, f *types.BifrostFrame) error {
 	return w.Flush()
 }
 
+// AppendFrame appends the wire encoding of f to dst, letting callers
+// encode into a reused buffer instead of MarshalBinary's fresh allocation.
+func AppendFrame(dst []byte, f *types.BifrostFrame) []byte {
+	dst = appendHeader(dst, f)
+	return append(dst, f.Payload...)
+}
+
+func appendHeader(dst []byte, f *types.BifrostFrame) []byte {
+	dst = append(dst, types.BifrostMagic[0], types.BifrostMagic[1])
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(f.Payload)))
+	return append(dst, byte(f.Type))
+}
+
 // Decode reads a BifrostFrame from a buffered reader.
 func Decode(r *bufio.Reader) (*types.BifrostFrame, error) {
-	// Read magic bytes
-	var magic [2]byte
-	if _, err := io.ReadFull(r, magic[:]); err != nil {
-		return nil, fmt.Errorf("bifrost decode magic: %w", err)
-	}
-	if magic != types.BifrostMagic {
-		return nil, ErrInvalidMagic
-	}
-
-	// Read payload length
-	var lenBuf [4]byte
-	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
-		return nil, fmt.Errorf("bifrost decode length: %w", err)
-	}
-	payloadLen := binary.BigEndian.Uint32(lenBuf[:])
-	if payloadLen > MaxPayloadSize {
-		return nil, ErrPayloadTooLong
-	}
+	return decodeLimit(r, MaxPayloadSize)
+}
 
-	// Read frame type
-	typeByte, err := r.ReadByte()
+// decodeLimit is Decode with a payload limit below MaxPayloadSize. The
+// length is checked before the payload buffer is allocated.
+func decodeLimit(r *bufio.Reader, maxPayload uint32) (*types.BifrostFrame, error) {
+	frameType, payloadLen, err := readHeader(r, maxPayload)
 	if err != nil {
-		return nil, fmt.Errorf("bifrost decode type: %w", err)
+		return nil, err
 	}
 
 	// Read payload
@@ -82,7 +72,93 @@ func Decode(r *bufio.Reader) (*types.BifrostFrame, error) {
 	}
 
 	return &types.BifrostFrame{
-		Type:    types.FrameType(typeByte),
+		Type:    frameType,
 		Payload: payload,
 	}, nil
 }
+
+// DecodePooled is like Decode but reads the payload into a pooled buffer.
+// The caller must Release the returned frame.
+func DecodePooled(r *bufio.Reader) (*PooledFrame, error) {
+	return decodePooledLimit(r, MaxPayloadSize)
+}
+
+func decodePooledLimit(r *bufio.Reader, maxPayload uint32) (*PooledFrame, error) {
+	frameType, payloadLen, err := readHeader(r, maxPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	f := framePool.Get().(*PooledFrame)
+	f.Type = frameType
+	if payloadLen > 0 {
+		f.buf = getBuffer(int(payloadLen))
+		f.Payload = *f.buf
+		if _, err := io.ReadFull(r, f.Payload); err != nil {
+			f.Release()
+			return nil, fmt.Errorf("bifrost decode payload: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// readHeader parses the fixed frame header in place from r's buffer, so
+// decoding a header never allocates.
+func readHeader(r *bufio.Reader, maxPayload uint32) (types.FrameType, uint32, error) {
+	// Read magic bytes
+	hdr, err := r.Peek(2)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bifrost decode magic: %w", unexpectedEOF(err, len(hdr)))
+	}
+	if hdr[0] != types.BifrostMagic[0] || hdr[1] != types.BifrostMagic[1] {
+		return 0, 0, ErrInvalidMagic
+	}
+
+	// Read payload length and frame type
+	hdr, err = r.Peek(types.BifrostFrameHeaderSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bifrost decode header: %w", unexpectedEOF(err, len(hdr)))
+	}
+	payloadLen := binary.BigEndian.Uint32(hdr[2:6])
+	frameType := types.FrameType(hdr[6])
+	r.Discard(types.BifrostFrameHeaderSize)
+
+	if payloadLen > maxPayload {
+		return 0, 0, ErrPayloadTooLong
+	}
+	return frameType, payloadLen, nil
+}
+
+// unexpectedEOF maps a short Peek to io.ErrUnexpectedEOF, matching what
+// io.ReadFull reports for a partially read header.
+func unexpectedEOF(err error, n int) error {
+	if err == io.EOF && n > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// decodeBytes parses a single BifrostFrame from a complete wire-format buffer,
+// as delivered by message-oriented transports (WebSocket, UDP). The returned
+// payload aliases data.
+func decodeBytes(data []byte) (*types.BifrostFrame, error) {
+	if len(data) < types.BifrostFrameHeaderSize {
+		return nil, fmt.Errorf("bifrost: message too short (%d bytes)", len(data))
+	}
+	if data[0] != types.BifrostMagic[0] || data[1] != types.BifrostMagic[1] {
+		return nil, ErrInvalidMagic
+	}
+	payloadLen := binary.BigEndian.Uint32(data[2:6])
+	if payloadLen > MaxPayloadSize {
+		return nil, ErrPayloadTooLong
+	}
+	if int(payloadLen) != len(data)-types.BifrostFrameHeaderSize {
+		return nil, fmt.Errorf("bifrost: length mismatch (header %d, body %d)",
+			payloadLen, len(data)-types.BifrostFrameHeaderSize)
+	}
+
+	return &types.BifrostFrame{
+		Type:    types.FrameType(data[6]),
+		Payload: data[types.BifrostFrameHeaderSize:],
+	}, nil
+}
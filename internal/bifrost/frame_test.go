@@ -128,3 +128,62 @@ func TestMultipleFramesSequential(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodePooledRoundtrip(t *testing.T) {
+	sizes := []int{0, 1, 511, 512, 513, 64 * 1024}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, n := range sizes {
+		payload := make([]byte, n)
+		rand.Read(payload)
+		if err := Encode(w, &types.BifrostFrame{Type: types.FrameData, Payload: payload}); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+	}
+	raw := buf.Bytes()
+
+	r := bufio.NewReader(bytes.NewReader(raw))
+	for _, n := range sizes {
+		f, err := DecodePooled(r)
+		if err != nil {
+			t.Fatalf("DecodePooled(%d): %v", n, err)
+		}
+		if len(f.Payload) != n {
+			t.Errorf("payload len: got %d, want %d", len(f.Payload), n)
+		}
+		f.Release()
+	}
+	if _, err := DecodePooled(r); err == nil {
+		t.Error("expected error at end of stream")
+	}
+}
+
+func TestAppendFrameMatchesMarshalBinary(t *testing.T) {
+	f := &types.BifrostFrame{Type: types.FrameControl, Payload: []byte("control payload")}
+	want, _ := f.MarshalBinary()
+	got := AppendFrame(nil, f)
+	if !bytes.Equal(got, want) {
+		t.Errorf("AppendFrame = %x, want %x", got, want)
+	}
+}
+
+func TestPoolClass(t *testing.T) {
+	tests := []struct {
+		n    int
+		want int
+	}{
+		{0, 0}, {1, 0}, {512, 0}, {513, 1}, {1024, 1}, {1025, 2},
+		{MaxPayloadSize + types.BifrostFrameHeaderSize, 16},
+	}
+	for _, tt := range tests {
+		if got := poolClass(tt.n); got != tt.want {
+			t.Errorf("poolClass(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+		b := getBuffer(tt.n)
+		if len(*b) != tt.n {
+			t.Errorf("getBuffer(%d) len = %d", tt.n, len(*b))
+		}
+		putBuffer(b)
+	}
+}
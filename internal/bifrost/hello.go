@@ -0,0 +1,373 @@
+package bifrost
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// ProtocolVersion is the Bifrost wire protocol version spoken by this build.
+// MinProtocolVersion is the oldest version it can still talk to.
+const (
+	ProtocolVersion    uint16 = 1
+	MinProtocolVersion uint16 = 1
+)
+
+// Extension is a bitmask of optional frame features. Keepalive is not
+// one: KeepaliveConn is applied by whoever owns the connection, on both
+// ends, and bit 0 stays reserved.
+type Extension uint32
+
+const (
+	// ExtCompression: the peer accepts FrameFlagCompressed payloads.
+	ExtCompression Extension = 1 << 1
+)
+
+// controlHello is the FrameControl opcode of the hello exchange:
+//
+//	[opcode:1][version:2][min_version:2][extensions:4][max_frame:4]
+//	[codec_count:1][codec:1]...
+//
+// Trailing bytes are ignored so later versions can append fields.
+const (
+	controlHello   byte = 0x02
+	helloFixedSize      = 14
+)
+
+// DefaultHelloTimeout bounds a hello exchange when HelloConfig.Timeout is
+// zero.
+const DefaultHelloTimeout = 10 * time.Second
+
+var (
+	ErrIncompatibleVersion = errors.New("bifrost: incompatible protocol version")
+	ErrNoHello             = errors.New("bifrost: peer did not send hello")
+	ErrInvalidHello        = errors.New("bifrost: invalid hello")
+	ErrFrameTooLarge       = errors.New("bifrost: frame exceeds negotiated maximum size")
+)
+
+// HelloConfig is what a node advertises at connection start.
+type HelloConfig struct {
+	Version      uint16
+	MinVersion   uint16
+	Extensions   Extension
+	MaxFrameSize uint32
+	Compression  CompressionConfig
+	// Timeout bounds the exchange on accepted connections, and on dialed
+	// ones whose context has no deadline.
+	Timeout time.Duration
+}
+
+// DefaultHelloConfig advertises everything this build supports.
+func DefaultHelloConfig() HelloConfig {
+	return HelloConfig{
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Extensions:   ExtCompression,
+		MaxFrameSize: MaxPayloadSize,
+		Compression:  DefaultCompressionConfig(),
+		Timeout:      DefaultHelloTimeout,
+	}
+}
+
+func (c HelloConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultHelloTimeout
+	}
+	return c.Timeout
+}
+
+// Params are the connection parameters both sides agreed on.
+type Params struct {
+	Version      uint16
+	Extensions   Extension // supported by both sides
+	MaxFrameSize uint32
+	Compression  Compression // codec used for frames we send
+}
+
+// Has reports whether both sides support ext.
+func (p Params) Has(ext Extension) bool {
+	return p.Extensions&ext == ext
+}
+
+type hello struct {
+	version      uint16
+	minVersion   uint16
+	extensions   Extension
+	maxFrameSize uint32
+	codecs       []byte
+}
+
+func (h *hello) marshal() []byte {
+	buf := make([]byte, 0, helloFixedSize+len(h.codecs))
+	buf = append(buf, controlHello)
+	buf = binary.BigEndian.AppendUint16(buf, h.version)
+	buf = binary.BigEndian.AppendUint16(buf, h.minVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(h.extensions))
+	buf = binary.BigEndian.AppendUint32(buf, h.maxFrameSize)
+	buf = append(buf, byte(len(h.codecs)))
+	return append(buf, h.codecs...)
+}
+
+func parseHello(payload []byte) (*hello, error) {
+	if len(payload) < helloFixedSize || payload[0] != controlHello {
+		return nil, ErrNoHello
+	}
+	h := &hello{
+		version:      binary.BigEndian.Uint16(payload[1:3]),
+		minVersion:   binary.BigEndian.Uint16(payload[3:5]),
+		extensions:   Extension(binary.BigEndian.Uint32(payload[5:9])),
+		maxFrameSize: binary.BigEndian.Uint32(payload[9:13]),
+	}
+	n := int(payload[13])
+	if len(payload) < helloFixedSize+n {
+		return nil, fmt.Errorf("bifrost: truncated hello")
+	}
+	h.codecs = payload[helloFixedSize : helloFixedSize+n]
+	return h, nil
+}
+
+// negotiate combines our config with the peer's hello.
+func negotiate(ours HelloConfig, theirs *hello) (Params, error) {
+	if theirs.maxFrameSize == 0 {
+		return Params{}, fmt.Errorf("%w: zero max frame size", ErrInvalidHello)
+	}
+	version := min(ours.Version, theirs.version)
+	if version < ours.MinVersion || version < theirs.minVersion {
+		return Params{}, fmt.Errorf("%w: local %d (min %d), remote %d (min %d)",
+			ErrIncompatibleVersion, ours.Version, ours.MinVersion, theirs.version, theirs.minVersion)
+	}
+
+	p := Params{
+		Version:      version,
+		Extensions:   ours.Extensions & theirs.extensions,
+		MaxFrameSize: min(ours.MaxFrameSize, theirs.maxFrameSize),
+	}
+	if p.Has(ExtCompression) {
+		p.Compression = chooseCompression(ours.Compression.Codecs, theirs.codecs)
+	}
+	return p, nil
+}
+
+// SessionConn is a Conn whose parameters were negotiated by Handshake. It
+// compresses with the agreed codec and enforces the agreed frame size.
+type SessionConn struct {
+	Conn
+	params Params
+}
+
+// Params returns the negotiated connection parameters.
+func (c *SessionConn) Params() Params {
+	return c.params
+}
+
+func (c *SessionConn) Send(frame *types.BifrostFrame) error {
+	if uint32(len(frame.Payload)) > c.params.MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	return c.Conn.Send(frame)
+}
+
+func (c *SessionConn) Receive() (*types.BifrostFrame, error) {
+	frame, err := c.Conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(frame.Payload)) > c.params.MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	return frame, nil
+}
+
+func (c *SessionConn) setFrameLimits(maxPayload uint32, frameTimeout time.Duration) bool {
+	return applyFrameLimits(c.Conn, maxPayload, frameTimeout)
+}
+
+// NegotiatedParams implements NegotiatedConn.
+func (c *SessionConn) NegotiatedParams() (Params, bool) {
+	return c.params, true
+}
+
+// NegotiatedConn is implemented by SessionConn and by wrappers, which
+// forward to the conn they wrap so its parameters stay visible.
+type NegotiatedConn interface {
+	NegotiatedParams() (Params, bool)
+}
+
+// NegotiatedParams returns the parameters of a connection established
+// through Handshake, or false for connections that skipped it.
+func NegotiatedParams(conn Conn) (Params, bool) {
+	if nc, ok := conn.(NegotiatedConn); ok {
+		return nc.NegotiatedParams()
+	}
+	return Params{}, false
+}
+
+// Handshake exchanges hellos over a freshly dialed or accepted conn. Both
+// sides send first and then read, so neither blocks on the other. On an
+// incompatible peer the conn is closed and ErrIncompatibleVersion returned;
+// on any other failure it is closed as well.
+func Handshake(ctx context.Context, conn Conn, config HelloConfig) (*SessionConn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.timeout())
+		defer cancel()
+	}
+
+	ours := &hello{
+		version:      config.Version,
+		minVersion:   config.MinVersion,
+		extensions:   config.Extensions,
+		maxFrameSize: config.MaxFrameSize,
+	}
+	if config.Extensions&ExtCompression != 0 {
+		for _, c := range config.Compression.Codecs {
+			ours.codecs = append(ours.codecs, byte(c))
+		}
+	}
+	if err := conn.Send(&types.BifrostFrame{Type: types.FrameControl, Payload: ours.marshal()}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("bifrost hello: %w", err)
+	}
+
+	frame, err := receiveContext(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("bifrost hello: %w", err)
+	}
+	if frame.Type != types.FrameControl {
+		conn.Close()
+		return nil, ErrNoHello
+	}
+	theirs, err := parseHello(frame.Payload)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	params, err := negotiate(config, theirs)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	inner := conn
+	if params.Compression != CompressionNone {
+		cc := NewCompressedConn(conn, params.Compression, config.Compression.Threshold)
+		cc.maxPayload = params.MaxFrameSize
+		inner = cc
+	}
+	return &SessionConn{Conn: inner, params: params}, nil
+}
+
+// NegotiatingTransport wraps a Transport so every dialed and accepted
+// connection performs the hello exchange before it is returned.
+type NegotiatingTransport struct {
+	Transport
+	config HelloConfig
+}
+
+// NewNegotiatingTransport wraps t with the hello exchange.
+func NewNegotiatingTransport(t Transport, config HelloConfig) *NegotiatingTransport {
+	return &NegotiatingTransport{Transport: t, config: config}
+}
+
+// Protocol returns the wrapped transport's protocol, if it has one.
+func (t *NegotiatingTransport) Protocol() string { return transportProtocol(t.Transport) }
+
+// Dial connects and negotiates.
+func (t *NegotiatingTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return Handshake(ctx, conn, t.config)
+}
+
+// Listen returns a listener whose Accept yields negotiated connections.
+// Each accepted connection says hello in its own goroutine, bounded by
+// the config's Timeout, so a silent peer cannot hold up the others.
+func (t *NegotiatingTransport) Listen(ctx context.Context, addr string) (Listener, error) {
+	ln, err := t.Transport.Listen(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newNegotiatingListener(ln, t.config), nil
+}
+
+type negotiatingListener struct {
+	Listener
+	config   HelloConfig
+	sessions chan *SessionConn
+
+	cancel context.CancelFunc
+	done   chan struct{} // closed by Close
+	once   sync.Once
+	failed chan struct{} // closed when the accept loop stops
+	err    error         // why it stopped; read after failed is closed
+}
+
+func newNegotiatingListener(ln Listener, config HelloConfig) *negotiatingListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &negotiatingListener{
+		Listener: ln,
+		config:   config,
+		sessions: make(chan *SessionConn),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		failed:   make(chan struct{}),
+	}
+	go l.acceptLoop(ctx)
+	return l
+}
+
+func (l *negotiatingListener) acceptLoop(ctx context.Context) {
+	defer close(l.failed)
+	for {
+		conn, err := l.Listener.Accept(ctx)
+		if err != nil {
+			l.err = err
+			return
+		}
+		go l.handshake(ctx, conn)
+	}
+}
+
+// handshake negotiates one accepted conn and hands the session to Accept,
+// or drops it if the hello fails or the listener closes first.
+func (l *negotiatingListener) handshake(ctx context.Context, conn Conn) {
+	hctx, cancel := context.WithTimeout(ctx, l.config.timeout())
+	sc, err := Handshake(hctx, conn, l.config)
+	cancel()
+	if err != nil {
+		return
+	}
+	select {
+	case l.sessions <- sc:
+	case <-l.done:
+		sc.Close()
+	}
+}
+
+func (l *negotiatingListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case sc := <-l.sessions:
+		return sc, nil
+	case <-l.failed:
+		return nil, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *negotiatingListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.cancel()
+	})
+	return l.Listener.Close()
+}
@@ -0,0 +1,276 @@
+package bifrost_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// handshakePair runs Handshake on both ends of a TCP pair concurrently.
+func handshakePair(t *testing.T, clientCfg, serverCfg bifrost.HelloConfig) (client, server *bifrost.SessionConn, clientErr, serverErr error) {
+	t.Helper()
+	a, b := tcpPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type result struct {
+		conn *bifrost.SessionConn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := bifrost.Handshake(ctx, b, serverCfg)
+		ch <- result{c, err}
+	}()
+	client, clientErr = bifrost.Handshake(ctx, a, clientCfg)
+	res := <-ch
+	return client, res.conn, clientErr, res.err
+}
+
+func TestHandshakeNegotiatesParams(t *testing.T) {
+	clientCfg := bifrost.DefaultHelloConfig()
+	serverCfg := bifrost.DefaultHelloConfig()
+	serverCfg.Extensions = 0
+	serverCfg.MaxFrameSize = 4096
+
+	client, server, err1, err2 := handshakePair(t, clientCfg, serverCfg)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Handshake: client=%v server=%v", err1, err2)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	for name, conn := range map[string]bifrost.Conn{"client": client, "server": server} {
+		p, ok := bifrost.NegotiatedParams(conn)
+		if !ok {
+			t.Fatalf("%s: no negotiated params", name)
+		}
+		if p.Version != bifrost.ProtocolVersion {
+			t.Errorf("%s: version %d, want %d", name, p.Version, bifrost.ProtocolVersion)
+		}
+		if p.MaxFrameSize != 4096 {
+			t.Errorf("%s: max frame %d, want 4096", name, p.MaxFrameSize)
+		}
+		if p.Extensions != 0 {
+			t.Errorf("%s: extensions %b", name, p.Extensions)
+		}
+		if p.Compression != bifrost.CompressionNone {
+			t.Errorf("%s: compression %s without ExtCompression", name, p.Compression)
+		}
+	}
+
+	big := &types.BifrostFrame{Type: types.FrameData, Payload: make([]byte, 4097)}
+	if err := client.Send(big); !errors.Is(err, bifrost.ErrFrameTooLarge) {
+		t.Fatalf("Send oversized: %v, want ErrFrameTooLarge", err)
+	}
+
+	msg := &types.BifrostFrame{Type: types.FrameData, Payload: []byte("after hello")}
+	if err := client.Send(msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	got, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if !bytes.Equal(got.Payload, msg.Payload) {
+		t.Fatalf("payload = %q", got.Payload)
+	}
+}
+
+func TestHandshakeCompression(t *testing.T) {
+	clientCfg := bifrost.DefaultHelloConfig()
+	serverCfg := bifrost.DefaultHelloConfig()
+	serverCfg.Compression.Codecs = []bifrost.Compression{bifrost.CompressionZlib}
+
+	client, server, err1, err2 := handshakePair(t, clientCfg, serverCfg)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Handshake: client=%v server=%v", err1, err2)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	if c := client.Params().Compression; c != bifrost.CompressionZlib {
+		t.Fatalf("client codec = %s, want zlib", c)
+	}
+	payload := bytes.Repeat([]byte("valhalla "), 1000)
+	if err := client.Send(&types.BifrostFrame{Type: types.FrameData, Payload: payload}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	got, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if got.Type != types.FrameData || !bytes.Equal(got.Payload, payload) {
+		t.Fatalf("compressed roundtrip mismatch")
+	}
+}
+
+func TestHandshakeIncompatibleVersion(t *testing.T) {
+	tests := []struct {
+		name           string
+		client, server [2]uint16 // version, min version
+		wantErr        bool
+		wantVersion    uint16
+	}{
+		{"same", [2]uint16{1, 1}, [2]uint16{1, 1}, false, 1},
+		{"older peer within range", [2]uint16{3, 1}, [2]uint16{2, 1}, false, 2},
+		{"peer too old", [2]uint16{3, 3}, [2]uint16{2, 1}, true, 0},
+		{"peer too new", [2]uint16{1, 1}, [2]uint16{4, 2}, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientCfg := bifrost.DefaultHelloConfig()
+			clientCfg.Version, clientCfg.MinVersion = tt.client[0], tt.client[1]
+			serverCfg := bifrost.DefaultHelloConfig()
+			serverCfg.Version, serverCfg.MinVersion = tt.server[0], tt.server[1]
+
+			client, server, err1, err2 := handshakePair(t, clientCfg, serverCfg)
+			if tt.wantErr {
+				if !errors.Is(err1, bifrost.ErrIncompatibleVersion) || !errors.Is(err2, bifrost.ErrIncompatibleVersion) {
+					t.Fatalf("errors = %v / %v, want ErrIncompatibleVersion", err1, err2)
+				}
+				return
+			}
+			if err1 != nil || err2 != nil {
+				t.Fatalf("Handshake: client=%v server=%v", err1, err2)
+			}
+			defer client.Close()
+			defer server.Close()
+			if client.Params().Version != tt.wantVersion || server.Params().Version != tt.wantVersion {
+				t.Fatalf("versions %d/%d, want %d", client.Params().Version, server.Params().Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsMissingHello(t *testing.T) {
+	a, b := tcpPair(t)
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go b.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("legacy")})
+	if _, err := bifrost.Handshake(ctx, a, bifrost.DefaultHelloConfig()); !errors.Is(err, bifrost.ErrNoHello) {
+		t.Fatalf("Handshake = %v, want ErrNoHello", err)
+	}
+}
+
+func TestNegotiatingTransport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transport := bifrost.NewNegotiatingTransport(bifrost.NewTCPTransport(), bifrost.DefaultHelloConfig())
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan bifrost.Conn, 1)
+	go func() {
+		c, _ := ln.Accept(ctx)
+		accepted <- c
+	}()
+
+	client, err := transport.Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	server := <-accepted
+	if server == nil {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+
+	if _, ok := bifrost.NegotiatedParams(client); !ok {
+		t.Fatal("dialed conn has no negotiated params")
+	}
+	if _, ok := bifrost.NegotiatedParams(server); !ok {
+		t.Fatal("accepted conn has no negotiated params")
+	}
+
+	// Wrappers keep the params visible.
+	wrapped := bifrost.NewKeepaliveConn(bifrost.NewCompressedConn(client, bifrost.CompressionDeflate, 0), bifrost.KeepaliveConfig{})
+	if p, ok := bifrost.NegotiatedParams(wrapped); !ok || p.Version != bifrost.ProtocolVersion {
+		t.Fatalf("wrapped conn params = %+v, %v", p, ok)
+	}
+}
+
+func TestHandshakeRejectsZeroMaxFrameSize(t *testing.T) {
+	a, b := tcpPair(t)
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// version 1, min 1, no extensions, max_frame 0, no codecs
+	hello := []byte{0x02, 0, 1, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	go b.Send(&types.BifrostFrame{Type: types.FrameControl, Payload: hello})
+	if _, err := bifrost.Handshake(ctx, a, bifrost.DefaultHelloConfig()); !errors.Is(err, bifrost.ErrInvalidHello) {
+		t.Fatalf("Handshake = %v, want ErrInvalidHello", err)
+	}
+}
+
+func TestNegotiatingListenerSilentPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := bifrost.DefaultHelloConfig()
+	config.Timeout = time.Second
+	raw := bifrost.NewTCPTransport()
+	transport := bifrost.NewNegotiatingTransport(raw, config)
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	// A peer that connects and never says hello.
+	silent, err := raw.Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial silent: %v", err)
+	}
+	defer silent.Close()
+
+	accepted := make(chan bifrost.Conn, 1)
+	go func() {
+		c, _ := ln.Accept(ctx)
+		accepted <- c
+	}()
+
+	client, err := transport.Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	select {
+	case server := <-accepted:
+		if server == nil {
+			t.Fatal("Accept failed")
+		}
+		server.Close()
+	case <-time.After(config.Timeout / 2):
+		t.Fatal("silent peer blocked Accept")
+	}
+
+	// The silent peer is sent our hello and then dropped at the timeout.
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := silent.Receive(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("silent peer was not disconnected")
+	}
+}
@@ -171,3 +171,40 @@ func TestTCPTransportFrameTypes(t *testing.T) {
 		}
 	}
 }
+
+func TestNegotiatedCompressionOverTCP(t *testing.T) {
+	serverCfg := bifrost.DefaultHelloConfig()
+	serverCfg.Compression = bifrost.CompressionConfig{
+		Codecs:    []bifrost.Compression{bifrost.CompressionZlib},
+		Threshold: 64,
+	}
+	ca, cb, err1, err2 := handshakePair(t, bifrost.DefaultHelloConfig(), serverCfg)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Handshake: a=%v b=%v", err1, err2)
+	}
+	defer ca.Close()
+	defer cb.Close()
+
+	if a, b := ca.Params().Compression, cb.Params().Compression; a != bifrost.CompressionZlib || b != bifrost.CompressionZlib {
+		t.Fatalf("codecs: a=%v b=%v, want zlib on both", a, b)
+	}
+
+	payloads := [][]byte{
+		[]byte("tiny"),
+		bytes.Repeat([]byte(`{"to":"VH5dJk7Gx3nR9wQm","ttl":10}`), 200),
+	}
+	for _, p := range payloads {
+		for _, pair := range [][2]bifrost.Conn{{ca, cb}, {cb, ca}} {
+			if err := pair[0].Send(&types.BifrostFrame{Type: types.FrameData, Payload: p}); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			f, err := pair[1].Receive()
+			if err != nil {
+				t.Fatalf("Receive: %v", err)
+			}
+			if f.Type != types.FrameData || !bytes.Equal(f.Payload, p) {
+				t.Errorf("got %v len %d, want DATA len %d", f.Type, len(f.Payload), len(p))
+			}
+		}
+	}
+}
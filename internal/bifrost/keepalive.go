@@ -0,0 +1,343 @@
+package bifrost
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// CloseCode is the reason code carried by a FrameClose.
+type CloseCode uint16
+
+const (
+	CloseNormal        CloseCode = 0
+	CloseGoingAway     CloseCode = 1
+	CloseIdleTimeout   CloseCode = 2
+	CloseProtocolError CloseCode = 3
+)
+
+func (c CloseCode) String() string {
+	switch c {
+	case CloseNormal:
+		return "normal"
+	case CloseGoingAway:
+		return "going away"
+	case CloseIdleTimeout:
+		return "idle timeout"
+	case CloseProtocolError:
+		return "protocol error"
+	default:
+		return fmt.Sprintf("code(%d)", uint16(c))
+	}
+}
+
+// CloseError is returned by Receive and Send once a KeepaliveConn has shut
+// down. Remote reports whether the peer initiated the close.
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+	Remote bool
+}
+
+func (e *CloseError) Error() string {
+	side := "local"
+	if e.Remote {
+		side = "remote"
+	}
+	if e.Reason == "" {
+		return fmt.Sprintf("bifrost: connection closed by %s (%s)", side, e.Code)
+	}
+	return fmt.Sprintf("bifrost: connection closed by %s (%s: %s)", side, e.Code, e.Reason)
+}
+
+// ErrIdleTimeout is wrapped, together with a CloseError, in the error
+// returned once the peer has been silent for longer than the idle timeout.
+var ErrIdleTimeout = errors.New("bifrost: peer idle timeout")
+
+// Keepalive payload: [kind:1][nonce:8]. Close payload: [flags:1][code:2][reason].
+const (
+	keepalivePing byte = 0x01
+	keepalivePong byte = 0x02
+
+	closeFlagAck byte = 0x01
+
+	keepalivePayloadSize = 9
+	closeHeaderSize      = 3
+)
+
+// KeepaliveConfig tunes liveness detection on a KeepaliveConn.
+type KeepaliveConfig struct {
+	// Interval between keepalive probes.
+	Interval time.Duration
+	// IdleTimeout tears the connection down after this long without
+	// receiving any frame from the peer.
+	IdleTimeout time.Duration
+	// CloseTimeout bounds how long Close waits for the peer to
+	// acknowledge the close handshake.
+	CloseTimeout time.Duration
+}
+
+// DefaultKeepaliveConfig detects a dead peer within 15 seconds.
+func DefaultKeepaliveConfig() KeepaliveConfig {
+	return KeepaliveConfig{
+		Interval:     5 * time.Second,
+		IdleTimeout:  15 * time.Second,
+		CloseTimeout: 2 * time.Second,
+	}
+}
+
+// KeepaliveConn wraps a Conn with FrameKeepalive probes, round-trip time
+// measurement, idle teardown and a FrameClose handshake. Keepalive and
+// close frames are consumed internally; Receive returns only data and
+// control frames. Both ends of a connection should be wrapped.
+type KeepaliveConn struct {
+	conn   Conn
+	config KeepaliveConfig
+
+	recvCh   chan *types.BifrostFrame
+	done     chan struct{}
+	closeAck chan struct{}
+	once     sync.Once
+	ackOnce  sync.Once
+	err      error // set before done is closed
+	closing  atomic.Pointer[CloseError]
+
+	lastRecv atomic.Int64 // unix nanos
+	rtt      atomic.Int64 // nanos, 0 until the first pong
+
+	mu      sync.Mutex
+	nonce   uint64
+	pending map[uint64]time.Time
+}
+
+// NewKeepaliveConn wraps conn and starts its read and probe loops. Zero
+// config fields fall back to the defaults.
+func NewKeepaliveConn(conn Conn, config KeepaliveConfig) *KeepaliveConn {
+	def := DefaultKeepaliveConfig()
+	if config.Interval <= 0 {
+		config.Interval = def.Interval
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = def.IdleTimeout
+	}
+	if config.CloseTimeout <= 0 {
+		config.CloseTimeout = def.CloseTimeout
+	}
+
+	c := &KeepaliveConn{
+		conn:     conn,
+		config:   config,
+		recvCh:   make(chan *types.BifrostFrame, 64),
+		done:     make(chan struct{}),
+		closeAck: make(chan struct{}),
+		pending:  make(map[uint64]time.Time),
+	}
+	c.lastRecv.Store(time.Now().UnixNano())
+	go c.readLoop()
+	go c.probeLoop()
+	return c
+}
+
+// RTT returns the most recent keepalive round-trip time, or 0 if no probe
+// has been answered yet.
+func (c *KeepaliveConn) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// LastSeen returns when the last frame of any type arrived from the peer.
+func (c *KeepaliveConn) LastSeen() time.Time {
+	return time.Unix(0, c.lastRecv.Load())
+}
+
+// NegotiatedParams forwards to the wrapped conn.
+func (c *KeepaliveConn) NegotiatedParams() (Params, bool) {
+	return NegotiatedParams(c.conn)
+}
+
+// Done is closed once the connection has shut down.
+func (c *KeepaliveConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *KeepaliveConn) Send(frame *types.BifrostFrame) error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+	return c.conn.Send(frame)
+}
+
+func (c *KeepaliveConn) Receive() (*types.BifrostFrame, error) {
+	select {
+	case f := <-c.recvCh:
+		return f, nil
+	case <-c.done:
+		// Deliver frames that arrived before the shutdown first.
+		select {
+		case f := <-c.recvCh:
+			return f, nil
+		default:
+			return nil, c.err
+		}
+	}
+}
+
+func (c *KeepaliveConn) RemoteAddr() string {
+	return c.conn.RemoteAddr()
+}
+
+// Close performs a graceful close with CloseNormal.
+func (c *KeepaliveConn) Close() error {
+	return c.CloseWithReason(CloseNormal, "")
+}
+
+// CloseWithReason sends a FrameClose carrying code and reason, waits up to
+// CloseTimeout for the peer's acknowledgement, then closes the underlying
+// connection.
+func (c *KeepaliveConn) CloseWithReason(code CloseCode, reason string) error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+
+	local := &CloseError{Code: code, Reason: reason}
+	c.closing.Store(local)
+	if err := c.conn.Send(closeFrame(0, code, reason)); err == nil {
+		timer := time.NewTimer(c.config.CloseTimeout)
+		select {
+		case <-c.closeAck:
+		case <-c.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	c.shutdown(local)
+	return nil
+}
+
+func (c *KeepaliveConn) shutdown(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *KeepaliveConn) readLoop() {
+	for {
+		frame, err := c.conn.Receive()
+		if err != nil {
+			if local := c.closing.Load(); local != nil {
+				c.shutdown(local) // peer hung up mid-handshake
+			} else {
+				c.shutdown(fmt.Errorf("bifrost keepalive: %w", err))
+			}
+			return
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+
+		switch frame.Type {
+		case types.FrameKeepalive:
+			c.handleKeepalive(frame.Payload)
+		case types.FrameClose:
+			c.handleClose(frame.Payload)
+		default:
+			select {
+			case c.recvCh <- frame:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+func (c *KeepaliveConn) handleKeepalive(payload []byte) {
+	if len(payload) != keepalivePayloadSize {
+		return
+	}
+	nonce := binary.BigEndian.Uint64(payload[1:])
+	switch payload[0] {
+	case keepalivePing:
+		c.conn.Send(keepaliveFrame(keepalivePong, nonce))
+	case keepalivePong:
+		c.mu.Lock()
+		sent, ok := c.pending[nonce]
+		delete(c.pending, nonce)
+		c.mu.Unlock()
+		if ok {
+			c.rtt.Store(int64(time.Since(sent)))
+		}
+	}
+}
+
+func (c *KeepaliveConn) handleClose(payload []byte) {
+	if len(payload) < closeHeaderSize {
+		c.shutdown(&CloseError{Code: CloseProtocolError, Remote: true})
+		return
+	}
+	flags := payload[0]
+	code := CloseCode(binary.BigEndian.Uint16(payload[1:3]))
+	reason := string(payload[closeHeaderSize:])
+
+	if flags&closeFlagAck != 0 {
+		c.ackOnce.Do(func() { close(c.closeAck) })
+		return
+	}
+	c.conn.Send(closeFrame(closeFlagAck, code, ""))
+	c.shutdown(&CloseError{Code: code, Reason: reason, Remote: true})
+}
+
+func (c *KeepaliveConn) probeLoop() {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if now.Sub(c.LastSeen()) > c.config.IdleTimeout {
+				c.conn.Send(closeFrame(0, CloseIdleTimeout, ""))
+				c.shutdown(fmt.Errorf("%w: %w", ErrIdleTimeout,
+					&CloseError{Code: CloseIdleTimeout, Reason: "no frames received"}))
+				return
+			}
+
+			c.mu.Lock()
+			c.nonce++
+			nonce := c.nonce
+			c.pending[nonce] = now
+			// Forget probes that will never be answered.
+			for n, sent := range c.pending {
+				if now.Sub(sent) > c.config.IdleTimeout {
+					delete(c.pending, n)
+				}
+			}
+			c.mu.Unlock()
+
+			c.conn.Send(keepaliveFrame(keepalivePing, nonce))
+		}
+	}
+}
+
+func keepaliveFrame(kind byte, nonce uint64) *types.BifrostFrame {
+	payload := make([]byte, keepalivePayloadSize)
+	payload[0] = kind
+	binary.BigEndian.PutUint64(payload[1:], nonce)
+	return &types.BifrostFrame{Type: types.FrameKeepalive, Payload: payload}
+}
+
+func closeFrame(flags byte, code CloseCode, reason string) *types.BifrostFrame {
+	payload := make([]byte, closeHeaderSize+len(reason))
+	payload[0] = flags
+	binary.BigEndian.PutUint16(payload[1:3], uint16(code))
+	copy(payload[closeHeaderSize:], reason)
+	return &types.BifrostFrame{Type: types.FrameClose, Payload: payload}
+}
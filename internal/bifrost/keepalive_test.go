@@ -0,0 +1,121 @@
+package bifrost_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// tcpPair returns both ends of a loopback TCP Bifrost connection.
+func tcpPair(t *testing.T) (client, server bifrost.Conn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transport := bifrost.NewTCPTransport()
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan bifrost.Conn, 1)
+	go func() {
+		c, err := ln.Accept(ctx)
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- c
+	}()
+
+	client, err = transport.Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("Accept failed")
+	}
+	return client, server
+}
+
+func TestKeepaliveMeasuresRTT(t *testing.T) {
+	a, b := tcpPair(t)
+	cfg := bifrost.KeepaliveConfig{Interval: 20 * time.Millisecond, IdleTimeout: time.Second}
+	ka := bifrost.NewKeepaliveConn(a, cfg)
+	kb := bifrost.NewKeepaliveConn(b, cfg)
+	defer ka.Close()
+	defer kb.Close()
+
+	// Data frames pass through; keepalives are consumed.
+	if err := ka.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("hi")}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	f, err := kb.Receive()
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if f.Type != types.FrameData || string(f.Payload) != "hi" {
+		t.Errorf("got %v %q, want DATA \"hi\"", f.Type, f.Payload)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for ka.RTT() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ka.RTT() == 0 {
+		t.Error("RTT should be measured after keepalive echoes")
+	}
+}
+
+func TestKeepaliveIdleTimeout(t *testing.T) {
+	a, b := tcpPair(t)
+	defer b.Close() // raw peer never answers probes
+
+	ka := bifrost.NewKeepaliveConn(a, bifrost.KeepaliveConfig{
+		Interval:    20 * time.Millisecond,
+		IdleTimeout: 100 * time.Millisecond,
+	})
+
+	select {
+	case <-ka.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection should be torn down after idle timeout")
+	}
+	_, err := ka.Receive()
+	if !errors.Is(err, bifrost.ErrIdleTimeout) {
+		t.Errorf("Receive error: got %v, want ErrIdleTimeout", err)
+	}
+}
+
+func TestKeepaliveGracefulClose(t *testing.T) {
+	a, b := tcpPair(t)
+	ka := bifrost.NewKeepaliveConn(a, bifrost.KeepaliveConfig{})
+	kb := bifrost.NewKeepaliveConn(b, bifrost.KeepaliveConfig{})
+
+	start := time.Now()
+	if err := ka.CloseWithReason(bifrost.CloseGoingAway, "shutting down"); err != nil {
+		t.Fatalf("CloseWithReason: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("close handshake took %v, should be acknowledged promptly", elapsed)
+	}
+
+	_, err := kb.Receive()
+	var ce *bifrost.CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("peer Receive error: got %v, want *CloseError", err)
+	}
+	if !ce.Remote || ce.Code != bifrost.CloseGoingAway || ce.Reason != "shutting down" {
+		t.Errorf("peer saw %+v, want remote going away \"shutting down\"", ce)
+	}
+
+	if err := ka.Send(&types.BifrostFrame{Type: types.FrameData}); err == nil {
+		t.Error("Send after close should fail")
+	}
+}
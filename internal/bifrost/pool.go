@@ -0,0 +1,78 @@
+package bifrost
+
+import (
+	"math/bits"
+	"sync"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// Buffers are pooled in power-of-two size classes from 512 B up to the
+// class that holds a full MaxPayloadSize frame.
+const (
+	minPoolShift = 9
+	maxPoolShift = 25 // 32 MB, the first class above MaxPayloadSize+header
+)
+
+var bufferPools [maxPoolShift - minPoolShift + 1]sync.Pool
+
+// poolClass returns the size-class index for a buffer of n bytes.
+func poolClass(n int) int {
+	if n <= 1<<minPoolShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minPoolShift
+}
+
+// getBuffer returns a pooled buffer with len n.
+func getBuffer(n int) *[]byte {
+	class := poolClass(n)
+	if class >= len(bufferPools) {
+		b := make([]byte, n)
+		return &b
+	}
+	if p, ok := bufferPools[class].Get().(*[]byte); ok {
+		*p = (*p)[:n]
+		return p
+	}
+	b := make([]byte, n, 1<<(class+minPoolShift))
+	return &b
+}
+
+// putBuffer returns a buffer obtained from getBuffer to its pool.
+func putBuffer(p *[]byte) {
+	c := cap(*p)
+	if c < 1<<minPoolShift || c&(c-1) != 0 {
+		return // not one of ours
+	}
+	class := poolClass(c)
+	if class < len(bufferPools) {
+		bufferPools[class].Put(p)
+	}
+}
+
+// PooledFrame is a decoded frame whose payload lives in a pooled buffer.
+// Call Release once the payload is no longer referenced; neither the frame
+// nor its payload may be used afterwards.
+type PooledFrame struct {
+	types.BifrostFrame
+	buf *[]byte
+}
+
+var framePool = sync.Pool{New: func() any { return new(PooledFrame) }}
+
+// Release returns the frame and its buffer to their pools.
+func (f *PooledFrame) Release() {
+	if f.buf != nil {
+		putBuffer(f.buf)
+	}
+	*f = PooledFrame{}
+	framePool.Put(f)
+}
+
+// PooledReceiver is implemented by connections that can decode into pooled
+// buffers. Relays that forward frames without retaining them should prefer
+// ReceivePooled to avoid a payload allocation per frame.
+type PooledReceiver interface {
+	ReceivePooled() (*PooledFrame, error)
+}
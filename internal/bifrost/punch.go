@@ -0,0 +1,106 @@
+package bifrost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	ErrPunchFailed     = errors.New("bifrost: hole punch failed")
+	ErrUDPNotListening = errors.New("bifrost udp: not listening")
+)
+
+// HolePuncher is a Transport that can open a path to a peer behind a NAT.
+// Both peers call Punch with the other's externally observed addresses at
+// about the same time, typically after a rendezvous peer has told each of
+// them where the other is. Each side's outgoing probes open its own NAT
+// for the other's probes; once one gets through, the path is open in both
+// directions and either side may Dial the returned address.
+type HolePuncher interface {
+	Transport
+	Punch(ctx context.Context, addrs []string) (string, error)
+}
+
+// Punch probes each of addrs from the shared listening socket, the one
+// whose external mapping a rendezvous peer observed, until one of them
+// answers or ctx is done. It returns the address that answered.
+func (t *UDPTransport) Punch(ctx context.Context, addrs []string) (string, error) {
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("bifrost udp punch: no addresses")
+	}
+	t.mu.Lock()
+	mux := t.mux
+	t.mu.Unlock()
+	if mux == nil {
+		return "", fmt.Errorf("bifrost udp punch: %w", ErrUDPNotListening)
+	}
+
+	targets := make([]net.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return "", fmt.Errorf("bifrost udp punch: %w", err)
+		}
+		targets = append(targets, udpAddr)
+	}
+
+	answered := make(chan string, 1)
+	mux.mu.Lock()
+	for _, addr := range targets {
+		mux.punches[addr.String()] = answered
+	}
+	mux.mu.Unlock()
+	defer func() {
+		mux.mu.Lock()
+		for _, addr := range targets {
+			if mux.punches[addr.String()] == answered {
+				delete(mux.punches, addr.String())
+			}
+		}
+		mux.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(t.config.PunchInterval)
+	defer ticker.Stop()
+	for {
+		for _, addr := range targets {
+			mux.writeControl(udpKindPunch, addr)
+		}
+		select {
+		case addr := <-answered:
+			return addr, nil
+		case <-ticker.C:
+		case <-mux.done:
+			return "", fmt.Errorf("bifrost udp punch: %w", ErrUDPConnClosed)
+		case <-ctx.Done():
+			return "", fmt.Errorf("%w: %v", ErrPunchFailed, ctx.Err())
+		}
+	}
+}
+
+// handlePunch answers a probe and wakes any Punch waiting on its sender.
+// Probes are always answered, so a peer that is still punching completes
+// even after our own Punch has returned.
+func (m *udpMux) handlePunch(kind byte, raddr net.Addr) {
+	if kind == udpKindPunch {
+		m.writeControl(udpKindPunchAck, raddr)
+	}
+	m.mu.Lock()
+	answered := m.punches[raddr.String()]
+	m.mu.Unlock()
+	if answered != nil {
+		select {
+		case answered <- raddr.String():
+		default:
+		}
+	}
+}
+
+func (m *udpMux) writeControl(kind byte, raddr net.Addr) {
+	var d [udpHeaderSize]byte
+	putUDPHeader(d[:], kind, 0, 0, 1)
+	m.pc.WriteTo(d[:], raddr)
+}
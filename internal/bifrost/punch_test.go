@@ -0,0 +1,157 @@
+package bifrost_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// natHost is a UDP transport listening on a host of a SimPacketNetwork.
+type natHost struct {
+	transport *bifrost.UDPTransport
+	ln        bifrost.Listener
+}
+
+func newNATHost(t *testing.T, ctx context.Context, n *bifrost.SimPacketNetwork, ip string) *natHost {
+	t.Helper()
+	transport := bifrost.NewUDPTransportWithConfig(bifrost.UDPConfig{
+		Reliable:           true,
+		RetransmitInterval: 20 * time.Millisecond,
+		MaxRetransmits:     3,
+		PunchInterval:      10 * time.Millisecond,
+		ListenPacket:       n.Host(ip).ListenPacket,
+	})
+	ln, err := transport.Listen(ctx, ip+":0")
+	if err != nil {
+		t.Fatalf("%s listen: %v", ip, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &natHost{transport: transport, ln: ln}
+}
+
+// observe connects h to a public host and returns h's address as the
+// public host sees it.
+func (h *natHost) observe(t *testing.T, ctx context.Context, public *natHost) string {
+	t.Helper()
+	conn, err := h.transport.Dial(ctx, public.ln.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("hi")}); err != nil {
+		t.Fatalf("Send to public host: %v", err)
+	}
+	seen, err := public.ln.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seen.RemoteAddr()
+}
+
+func TestSimNATFiltersUnsolicited(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n := bifrost.NewSimPacketNetwork()
+	if err := n.AddNAT("203.0.113.1", "192.168.1.2"); err != nil {
+		t.Fatal(err)
+	}
+	inside := newNATHost(t, ctx, n, "192.168.1.2")
+	server := newNATHost(t, ctx, n, "198.51.100.7")
+	other := newNATHost(t, ctx, n, "198.51.100.8")
+
+	external := inside.observe(t, ctx, server)
+	if external == inside.ln.Addr() {
+		t.Fatalf("server saw the private address %s", external)
+	}
+
+	// The server was sent to, so it may answer; another host may not.
+	reply, _ := server.transport.Dial(ctx, external)
+	if err := reply.Send(&types.BifrostFrame{Type: types.FrameData}); err != nil {
+		t.Errorf("reply from contacted host: %v", err)
+	}
+	stranger, _ := other.transport.Dial(ctx, external)
+	if err := stranger.Send(&types.BifrostFrame{Type: types.FrameData}); !errors.Is(err, bifrost.ErrUDPNoAck) {
+		t.Errorf("unsolicited send = %v, want ErrUDPNoAck", err)
+	}
+	if n.Dropped() == 0 {
+		t.Error("NAT dropped nothing")
+	}
+}
+
+func TestUDPPunchThroughNATs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n := bifrost.NewSimPacketNetwork()
+	n.AddNAT("203.0.113.1", "192.168.1.2")
+	n.AddNAT("203.0.113.2", "10.0.0.2")
+	a := newNATHost(t, ctx, n, "192.168.1.2")
+	b := newNATHost(t, ctx, n, "10.0.0.2")
+	rendezvous := newNATHost(t, ctx, n, "198.51.100.7")
+
+	aExternal := a.observe(t, ctx, rendezvous)
+	bExternal := b.observe(t, ctx, rendezvous)
+
+	direct, _ := a.transport.Dial(ctx, bExternal)
+	if err := direct.Send(&types.BifrostFrame{Type: types.FrameData}); !errors.Is(err, bifrost.ErrUDPNoAck) {
+		t.Fatalf("direct send through NAT = %v, want ErrUDPNoAck", err)
+	}
+
+	bDone := make(chan error, 1)
+	go func() {
+		_, err := b.transport.Punch(ctx, []string{aExternal})
+		bDone <- err
+	}()
+	addr, err := a.transport.Punch(ctx, []string{bExternal})
+	if err != nil {
+		t.Fatalf("Punch: %v", err)
+	}
+	if addr != bExternal {
+		t.Errorf("Punch answered by %s, want %s", addr, bExternal)
+	}
+	if err := <-bDone; err != nil {
+		t.Fatalf("peer Punch: %v", err)
+	}
+
+	conn, err := a.transport.Dial(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("through")}); err != nil {
+		t.Fatalf("Send after punch: %v", err)
+	}
+	accepted, err := b.ln.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := accepted.Receive()
+		if err != nil {
+			t.Fatalf("Receive: %v", err)
+		}
+		if string(f.Payload) == "through" {
+			break
+		}
+	}
+}
+
+func TestUDPPunchTimesOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n := bifrost.NewSimPacketNetwork()
+	n.AddNAT("203.0.113.1", "192.168.1.2")
+	a := newNATHost(t, ctx, n, "192.168.1.2")
+
+	punchCtx, punchCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer punchCancel()
+	if _, err := a.transport.Punch(punchCtx, []string{"203.0.113.9:40001"}); !errors.Is(err, bifrost.ErrPunchFailed) {
+		t.Errorf("Punch to silent peer = %v, want ErrPunchFailed", err)
+	}
+
+	idle := bifrost.NewUDPTransport()
+	if _, err := idle.Punch(ctx, []string{"203.0.113.9:40001"}); !errors.Is(err, bifrost.ErrUDPNotListening) {
+		t.Errorf("Punch before Listen = %v, want ErrUDPNotListening", err)
+	}
+}
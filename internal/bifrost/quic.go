@@ -0,0 +1,298 @@
+package bifrost
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// QUICALPN is the TLS application protocol negotiated by the QUIC transport.
+const QUICALPN = "valhalla-bifrost"
+
+// quicStreamHeader is written by the dialer when it opens the Bifrost
+// stream. QUIC only announces a stream to the peer once it carries data, so
+// without it Accept would block until the dialer sent its first frame.
+const quicStreamHeader byte = 0x01
+
+// QUICConfig tunes the QUIC transport.
+type QUICConfig struct {
+	// TLSConfig is used by Listen. If nil, an ephemeral self-signed
+	// certificate is generated; peers are authenticated by Veil, not TLS.
+	TLSConfig *tls.Config
+	// KeepAlivePeriod is how often QUIC PINGs an idle connection.
+	KeepAlivePeriod time.Duration
+	// MaxIdleTimeout closes a connection after this long without traffic.
+	MaxIdleTimeout time.Duration
+}
+
+// DefaultQUICConfig returns the default QUIC settings.
+func DefaultQUICConfig() QUICConfig {
+	return QUICConfig{
+		KeepAlivePeriod: 15 * time.Second,
+		MaxIdleTimeout:  60 * time.Second,
+	}
+}
+
+// QUICTransport implements Transport over QUIC. Each Bifrost connection is
+// a single bidirectional QUIC stream carrying the standard Encode/Decode
+// wire format, so it gains QUIC's congestion control and connection
+// migration. Session tickets are cached per transport, and repeat dials to
+// the same server resume with 0-RTT.
+type QUICTransport struct {
+	config       QUICConfig
+	sessionCache tls.ClientSessionCache
+}
+
+// NewQUICTransport creates a QUIC transport with default settings.
+func NewQUICTransport() *QUICTransport {
+	return NewQUICTransportWithConfig(DefaultQUICConfig())
+}
+
+// NewQUICTransportWithConfig creates a QUIC transport with custom settings.
+func NewQUICTransportWithConfig(config QUICConfig) *QUICTransport {
+	return &QUICTransport{
+		config:       config,
+		sessionCache: tls.NewLRUClientSessionCache(64),
+	}
+}
+
+func (t *QUICTransport) quicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod: t.config.KeepAlivePeriod,
+		MaxIdleTimeout:  t.config.MaxIdleTimeout,
+		Allow0RTT:       true,
+	}
+}
+
+// Listen starts a QUIC listener on the given UDP address.
+func (t *QUICTransport) Listen(ctx context.Context, addr string) (Listener, error) {
+	tlsConf := t.config.TLSConfig
+	if tlsConf == nil {
+		cert, err := generateSelfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("bifrost quic listen: %w", err)
+		}
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else {
+		tlsConf = tlsConf.Clone()
+	}
+	tlsConf.NextProtos = []string{QUICALPN}
+
+	ln, err := quic.ListenAddrEarly(addr, tlsConf, t.quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("bifrost quic listen: %w", err)
+	}
+	return newQUICListener(ln), nil
+}
+
+// Protocol returns "quic", the PathAddr protocol the transport dials.
+func (t *QUICTransport) Protocol() string { return "quic" }
+
+// Dial connects to a QUIC listener and opens the Bifrost stream.
+func (t *QUICTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true, // peers are authenticated by Veil
+		NextProtos:         []string{QUICALPN},
+		ClientSessionCache: t.sessionCache,
+	}
+
+	qc, err := quic.DialAddrEarly(ctx, addr, tlsConf, t.quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("bifrost quic dial: %w", err)
+	}
+
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return nil, fmt.Errorf("bifrost quic open stream: %w", err)
+	}
+	if _, err := stream.Write([]byte{quicStreamHeader}); err != nil {
+		qc.CloseWithError(0, "")
+		return nil, fmt.Errorf("bifrost quic stream header: %w", err)
+	}
+	return newQUICConn(qc, stream), nil
+}
+
+// quicStreamTimeout bounds how long an accepted connection may take to
+// open its Bifrost stream.
+const quicStreamTimeout = 10 * time.Second
+
+type quicListener struct {
+	ln     *quic.EarlyListener
+	connCh chan *quicConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newQUICListener(ln *quic.EarlyListener) *quicListener {
+	l := &quicListener{
+		ln:     ln,
+		connCh: make(chan *quicConn, 16),
+		done:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts QUIC connections and waits for each one's Bifrost
+// stream in its own goroutine, so a slow dialer cannot stall Accept.
+func (l *quicListener) acceptLoop() {
+	for {
+		qc, err := l.ln.Accept(context.Background())
+		if err != nil {
+			l.shutdown()
+			return
+		}
+		go l.acceptStream(qc)
+	}
+}
+
+func (l *quicListener) acceptStream(qc *quic.Conn) {
+	ctx, cancel := context.WithTimeout(qc.Context(), quicStreamTimeout)
+	defer cancel()
+
+	stream, err := qc.AcceptStream(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "no stream")
+		return
+	}
+	stream.SetReadDeadline(time.Now().Add(quicStreamTimeout))
+	var hdr [1]byte
+	if _, err := io.ReadFull(stream, hdr[:]); err != nil || hdr[0] != quicStreamHeader {
+		qc.CloseWithError(0, "bad stream header")
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	select {
+	case l.connCh <- newQUICConn(qc, stream):
+	case <-l.done:
+		qc.CloseWithError(0, "listener closed")
+	}
+}
+
+func (l *quicListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+		return nil, fmt.Errorf("bifrost quic listener closed")
+	}
+}
+
+func (l *quicListener) Addr() string {
+	return l.ln.Addr().String()
+}
+
+func (l *quicListener) Close() error {
+	l.shutdown()
+	return l.ln.Close()
+}
+
+func (l *quicListener) shutdown() {
+	l.once.Do(func() { close(l.done) })
+}
+
+// quicConn carries Bifrost frames over one bidirectional QUIC stream.
+type quicConn struct {
+	qc     *quic.Conn
+	stream *quic.Stream
+	reader *bufio.Reader
+	writer *bufio.Writer
+	mu     sync.Mutex // protects writer
+
+	// Set by setFrameLimits before the conn is handed out.
+	maxPayload   uint32
+	frameTimeout time.Duration
+}
+
+func newQUICConn(qc *quic.Conn, stream *quic.Stream) *quicConn {
+	return &quicConn{
+		qc:         qc,
+		stream:     stream,
+		reader:     bufio.NewReaderSize(stream, 64*1024),
+		writer:     bufio.NewWriterSize(stream, 64*1024),
+		maxPayload: MaxPayloadSize,
+	}
+}
+
+func (c *quicConn) setFrameLimits(maxPayload uint32, frameTimeout time.Duration) bool {
+	if maxPayload > 0 && maxPayload < MaxPayloadSize {
+		c.maxPayload = maxPayload
+	}
+	c.frameTimeout = frameTimeout
+	return true
+}
+
+// beginFrame and endFrame arm and clear the frame deadline on the stream,
+// as tcpConn does on its socket.
+func (c *quicConn) beginFrame() error {
+	if c.frameTimeout <= 0 {
+		return nil
+	}
+	if _, err := c.reader.Peek(1); err != nil {
+		return fmt.Errorf("bifrost decode magic: %w", err)
+	}
+	return c.stream.SetReadDeadline(time.Now().Add(c.frameTimeout))
+}
+
+func (c *quicConn) endFrame(err error) error {
+	if c.frameTimeout <= 0 {
+		return err
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		c.Close()
+		return ErrSlowFrame
+	}
+	c.stream.SetReadDeadline(time.Time{})
+	return err
+}
+
+func (c *quicConn) Send(frame *types.BifrostFrame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Encode(c.writer, frame)
+}
+
+func (c *quicConn) Receive() (*types.BifrostFrame, error) {
+	if err := c.beginFrame(); err != nil {
+		return nil, err
+	}
+	f, err := decodeLimit(c.reader, c.maxPayload)
+	if err = c.endFrame(err); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *quicConn) ReceivePooled() (*PooledFrame, error) {
+	if err := c.beginFrame(); err != nil {
+		return nil, err
+	}
+	f, err := decodePooledLimit(c.reader, c.maxPayload)
+	if err = c.endFrame(err); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *quicConn) RemoteAddr() string {
+	return c.qc.RemoteAddr().String()
+}
+
+func (c *quicConn) Close() error {
+	c.stream.Close()
+	return c.qc.CloseWithError(0, "")
+}
@@ -0,0 +1,76 @@
+package bifrost_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+func TestQUICTransportLoopback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transport := bifrost.NewQUICTransport()
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := transport.Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	// The listener surfaces the connection before any frame is sent.
+	server, err := ln.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer server.Close()
+
+	const numFrames = 100
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < numFrames; i++ {
+			f := &types.BifrostFrame{Type: types.FrameData, Payload: []byte(fmt.Sprintf("frame-%04d", i))}
+			if err := client.Send(f); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	for i := 0; i < numFrames; i++ {
+		f, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive %d: %v", i, err)
+		}
+		want := []byte(fmt.Sprintf("frame-%04d", i))
+		if !bytes.Equal(f.Payload, want) {
+			t.Errorf("frame %d: payload %q, want %q", i, f.Payload, want)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	// Server-initiated frames travel back over the same stream.
+	if err := server.Send(&types.BifrostFrame{Type: types.FrameControl, Payload: []byte("pong")}); err != nil {
+		t.Fatalf("server Send: %v", err)
+	}
+	f, err := client.Receive()
+	if err != nil {
+		t.Fatalf("client Receive: %v", err)
+	}
+	if f.Type != types.FrameControl || string(f.Payload) != "pong" {
+		t.Errorf("got %v %q, want CONTROL \"pong\"", f.Type, f.Payload)
+	}
+}
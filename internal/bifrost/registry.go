@@ -0,0 +1,188 @@
+package bifrost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// ErrUnsupportedProtocol is returned when no transport handles a PathAddr.
+var ErrUnsupportedProtocol = errors.New("bifrost: unsupported protocol")
+
+// protocolTransport is implemented by transports that dial a single
+// PathAddr protocol.
+type protocolTransport interface {
+	Protocol() string
+}
+
+// transportProtocol returns the protocol t dials, or "" if it does not
+// say.
+func transportProtocol(t Transport) string {
+	if pt, ok := t.(protocolTransport); ok {
+		return pt.Protocol()
+	}
+	return ""
+}
+
+// Registry dispatches PathAddrs to the Transport registered for their
+// protocol prefix. It implements Transport itself, taking PathAddr strings
+// ("/tcp/127.0.0.1:9001") wherever a plain transport takes host:port.
+type Registry struct {
+	mu         sync.RWMutex
+	transports map[string]Transport
+}
+
+// NewRegistry creates an empty transport registry.
+func NewRegistry() *Registry {
+	return &Registry{transports: make(map[string]Transport)}
+}
+
+// NewDefaultRegistry returns a registry with the built-in transports. It
+// has no "wss" entry: register one with a WSConfig carrying the pins or
+// CA the deployment trusts.
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register("tcp", NewTCPTransport())
+	r.Register("ws", NewWSTransport())
+	r.Register("udp", NewUDPTransport())
+	r.Register("quic", NewQUICTransport())
+	return r
+}
+
+// Register associates a transport with a protocol prefix, replacing any
+// previous registration.
+func (r *Registry) Register(protocol string, t Transport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transports[protocol] = t
+}
+
+// Lookup returns the transport registered for a protocol.
+func (r *Registry) Lookup(protocol string) (Transport, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.transports[protocol]
+	return t, ok
+}
+
+// Protocols returns the registered protocol prefixes in sorted order.
+func (r *Registry) Protocols() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	protos := make([]string, 0, len(r.transports))
+	for p := range r.transports {
+		protos = append(protos, p)
+	}
+	sort.Strings(protos)
+	return protos
+}
+
+// Supports reports whether addr parses and has a registered transport.
+func (r *Registry) Supports(addr types.PathAddr) bool {
+	_, _, err := r.resolve(addr)
+	return err == nil
+}
+
+func (r *Registry) resolve(addr types.PathAddr) (Transport, types.PathAddrParts, error) {
+	parts, err := types.ParsePathAddr(addr)
+	if err != nil {
+		return nil, parts, fmt.Errorf("bifrost: %w", err)
+	}
+	t, ok := r.Lookup(parts.Protocol)
+	if !ok {
+		return nil, parts, fmt.Errorf("%w %q", ErrUnsupportedProtocol, parts.Protocol)
+	}
+	return t, parts, nil
+}
+
+// Dial connects to a PathAddr using the transport for its protocol. The
+// transport receives host:port, followed by any path segments for
+// WebSocket, the only path-aware transport.
+func (r *Registry) Dial(ctx context.Context, addr string) (Conn, error) {
+	t, parts, err := r.resolve(types.PathAddr(addr))
+	if err != nil {
+		return nil, err
+	}
+	return t.Dial(ctx, dialTarget(parts))
+}
+
+// DialAny tries each address in order, skipping unsupported protocols, and
+// returns the first connection established along with the address used.
+func (r *Registry) DialAny(ctx context.Context, addrs []types.PathAddr) (Conn, types.PathAddr, error) {
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := r.Dial(ctx, string(addr))
+		if err == nil {
+			return conn, addr, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, "", fmt.Errorf("bifrost: no addresses to dial")
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// Listen listens on a PathAddr. The returned listener reports its address
+// in PathAddr form.
+func (r *Registry) Listen(ctx context.Context, addr string) (Listener, error) {
+	parts, err := types.ParseListenAddr(types.PathAddr(addr))
+	if err != nil {
+		return nil, fmt.Errorf("bifrost: %w", err)
+	}
+	t, ok := r.Lookup(parts.Protocol)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedProtocol, parts.Protocol)
+	}
+	ln, err := t.Listen(ctx, parts.HostPort())
+	if err != nil {
+		return nil, err
+	}
+	return &pathListener{Listener: ln, protocol: parts.Protocol}, nil
+}
+
+// pathListener reports the wrapped listener's address as a PathAddr.
+type pathListener struct {
+	Listener
+	protocol string
+}
+
+func (l *pathListener) Addr() string {
+	return string(types.NewPathAddr(l.protocol, l.Listener.Addr()))
+}
+
+// DialPath dials a PathAddr through any Transport. A Registry receives the
+// full PathAddr; a single transport receives what Registry.Dial would pass
+// it, or the raw string for legacy addresses without a protocol prefix.
+// A transport that names its protocol refuses addresses for any other
+// with ErrUnsupportedProtocol.
+func DialPath(ctx context.Context, t Transport, addr types.PathAddr) (Conn, error) {
+	if _, ok := t.(*Registry); ok {
+		return t.Dial(ctx, string(addr))
+	}
+	if addr.Protocol() == "" {
+		return t.Dial(ctx, string(addr))
+	}
+	parts, err := types.ParsePathAddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost: %w", err)
+	}
+	if p := transportProtocol(t); p != "" && p != parts.Protocol {
+		return nil, fmt.Errorf("%w %q on a %s transport", ErrUnsupportedProtocol, parts.Protocol, p)
+	}
+	return t.Dial(ctx, dialTarget(parts))
+}
+
+// dialTarget is the address a transport for parts.Protocol dials: the
+// host:port, plus the path for ws and wss.
+func dialTarget(parts types.PathAddrParts) string {
+	switch parts.Protocol {
+	case "ws", "wss":
+		return parts.HostPort() + parts.Path
+	}
+	return parts.HostPort()
+}
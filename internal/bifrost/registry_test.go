@@ -0,0 +1,163 @@
+package bifrost_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+func TestRegistryDispatchesByProtocol(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	newRegistry := func() *bifrost.Registry {
+		reg := bifrost.NewRegistry()
+		reg.Register("tcp", bifrost.NewTCPTransport())
+		reg.Register("udp", bifrost.NewUDPTransport())
+		return reg
+	}
+	// Separate registries, since a UDP transport dials from its own
+	// listening socket.
+	serverReg, clientReg := newRegistry(), newRegistry()
+
+	tests := []struct {
+		name   string
+		listen string
+	}{
+		{"tcp", "/tcp/127.0.0.1:0"},
+		{"udp", "/udp/127.0.0.1:0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := serverReg.Listen(ctx, tt.listen)
+			if err != nil {
+				t.Fatalf("Listen: %v", err)
+			}
+			defer ln.Close()
+
+			addr := types.PathAddr(ln.Addr())
+			if addr.Protocol() != tt.name {
+				t.Fatalf("listener addr %q: want protocol %q", addr, tt.name)
+			}
+			if !clientReg.Supports(addr) {
+				t.Fatalf("registry should support its own listener addr %q", addr)
+			}
+
+			conn, err := clientReg.Dial(ctx, string(addr))
+			if err != nil {
+				t.Fatalf("Dial %s: %v", addr, err)
+			}
+			defer conn.Close()
+			if err := conn.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte(tt.name)}); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+
+			server, err := ln.Accept(ctx)
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			defer server.Close()
+			f, err := server.Receive()
+			if err != nil {
+				t.Fatalf("Receive: %v", err)
+			}
+			if string(f.Payload) != tt.name {
+				t.Errorf("payload %q, want %q", f.Payload, tt.name)
+			}
+		})
+	}
+}
+
+func TestRegistryDialAnySkipsUnsupported(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reg := bifrost.NewRegistry()
+	reg.Register("tcp", bifrost.NewTCPTransport())
+
+	ln, err := reg.Listen(ctx, "/tcp/127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	addrs := []types.PathAddr{"/ws/example.invalid:443", "/udp/127.0.0.1:9", types.PathAddr(ln.Addr())}
+	conn, used, err := reg.DialAny(ctx, addrs)
+	if err != nil {
+		t.Fatalf("DialAny: %v", err)
+	}
+	defer conn.Close()
+	if used != addrs[2] {
+		t.Errorf("dialed %q, want %q", used, addrs[2])
+	}
+
+	_, err = reg.Dial(ctx, "/ws/example.invalid:443")
+	if !errors.Is(err, bifrost.ErrUnsupportedProtocol) {
+		t.Errorf("Dial unsupported: got %v, want ErrUnsupportedProtocol", err)
+	}
+	if _, err := reg.Dial(ctx, "/tcp/missing-port"); err == nil || !strings.Contains(err.Error(), "invalid path address") {
+		t.Errorf("Dial malformed: got %v, want invalid path address", err)
+	}
+}
+
+func TestDialPathWithPlainTransport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transport := bifrost.NewTCPTransport()
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	for _, addr := range []types.PathAddr{
+		types.NewPathAddr("tcp", ln.Addr()),
+		types.PathAddr(ln.Addr()),                        // legacy bare host:port
+		types.NewPathAddr("tcp", ln.Addr()) + "/bifrost", // path only means something to ws
+	} {
+		conn, err := bifrost.DialPath(ctx, transport, addr)
+		if err != nil {
+			t.Fatalf("DialPath %q: %v", addr, err)
+		}
+		conn.Close()
+	}
+
+	reg := bifrost.NewRegistry()
+	reg.Register("tcp", transport)
+	conn, err := reg.Dial(ctx, string(types.NewPathAddr("tcp", ln.Addr())+"/bifrost"))
+	if err != nil {
+		t.Fatalf("Registry.Dial with path: %v", err)
+	}
+	conn.Close()
+}
+
+func TestDialPathRejectsOtherProtocols(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name      string
+		transport bifrost.Transport
+		addr      types.PathAddr
+	}{
+		{"udp on tcp", bifrost.NewTCPTransport(), "/udp/127.0.0.1:9"},
+		{"quic on tcp", bifrost.NewTCPTransport(), "/quic/127.0.0.1:9"},
+		{"tcp on udp", bifrost.NewUDPTransport(), "/tcp/127.0.0.1:9"},
+		{"wss on ws", bifrost.NewWSTransport(), "/wss/127.0.0.1:9"},
+		{"udp on wrapped tcp", bifrost.NewLimitedTransport(bifrost.NewTCPTransport(), bifrost.DefaultAdmissionConfig()), "/udp/127.0.0.1:9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := bifrost.DialPath(ctx, tt.transport, tt.addr); !errors.Is(err, bifrost.ErrUnsupportedProtocol) {
+				t.Errorf("DialPath = %v, want ErrUnsupportedProtocol", err)
+			}
+		})
+	}
+}
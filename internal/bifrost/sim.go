@@ -0,0 +1,537 @@
+package bifrost
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+var (
+	ErrSimUnreachable = errors.New("bifrost: sim host unreachable")
+	ErrSimRefused     = errors.New("bifrost: sim connection refused")
+	ErrSimAddrInUse   = errors.New("bifrost: sim address in use")
+)
+
+// LinkConfig describes the behavior of a simulated link in one direction.
+type LinkConfig struct {
+	// Latency is the one-way propagation delay.
+	Latency time.Duration
+	// Jitter adds a uniformly random delay in [0, Jitter).
+	Jitter time.Duration
+	// Bandwidth in bytes per second serializes frames on the link; 0 is
+	// unlimited.
+	Bandwidth int
+	// Loss is the probability that a frame is silently dropped.
+	Loss float64
+	// Reorder is the probability that a frame is held back by
+	// ReorderDelay, letting frames sent after it overtake it.
+	Reorder      float64
+	ReorderDelay time.Duration
+}
+
+// SimStats counts frames handled by a SimNetwork.
+type SimStats struct {
+	Sent      uint64
+	Delivered uint64
+	Dropped   uint64
+}
+
+// SimNetwork is an in-process virtual network. Each host gets a Transport
+// from Transport(host); connections between hosts pass frames through
+// simulated links instead of sockets. All random decisions (loss, jitter,
+// reordering) come from one seeded source, so a given sequence of sends
+// sees the same fate on every run.
+type SimNetwork struct {
+	mu          sync.Mutex
+	rng         *rand.Rand
+	defaultLink LinkConfig
+	links       map[[2]string]LinkConfig
+	partition   map[string]int // host -> group; hosts in different groups are cut off
+	listeners   map[string]*simListener
+	nextPort    map[string]int
+	stats       SimStats
+}
+
+// NewSimNetwork creates an empty virtual network with perfect links.
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		rng:       rand.New(rand.NewSource(seed)),
+		links:     make(map[[2]string]LinkConfig),
+		listeners: make(map[string]*simListener),
+		nextPort:  make(map[string]int),
+	}
+}
+
+// Transport returns the transport for a host. Listen and Dial addresses
+// are "host:port"; the host part of a listen address is ignored.
+func (n *SimNetwork) Transport(host string) *SimTransport {
+	return &SimTransport{net: n, host: host}
+}
+
+// SetDefaultLink sets the behavior of links without their own config.
+func (n *SimNetwork) SetDefaultLink(cfg LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.defaultLink = cfg
+}
+
+// SetLink configures the link between hosts a and b in both directions.
+func (n *SimNetwork) SetLink(a, b string, cfg LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[[2]string{a, b}] = cfg
+	n.links[[2]string{b, a}] = cfg
+}
+
+// Partition splits the network: hosts in different groups cannot reach
+// each other, and frames in flight between them are lost. Hosts not named
+// in any group stay reachable from everyone.
+func (n *SimNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partition = make(map[string]int)
+	for i, g := range groups {
+		for _, h := range g {
+			n.partition[h] = i
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *SimNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partition = nil
+}
+
+// Stats returns frame counters.
+func (n *SimNetwork) Stats() SimStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+// reachable reports whether a can talk to b. Called with n.mu held.
+func (n *SimNetwork) reachable(a, b string) bool {
+	ga, okA := n.partition[a]
+	gb, okB := n.partition[b]
+	return !okA || !okB || ga == gb
+}
+
+func (n *SimNetwork) link(from, to string) LinkConfig {
+	if cfg, ok := n.links[[2]string{from, to}]; ok {
+		return cfg
+	}
+	return n.defaultLink
+}
+
+func (n *SimNetwork) allocPort(host string) int {
+	for {
+		n.nextPort[host]++
+		port := 40000 + n.nextPort[host]
+		if _, used := n.listeners[net.JoinHostPort(host, strconv.Itoa(port))]; !used {
+			return port
+		}
+	}
+}
+
+// schedule decides the fate of a frame of size bytes sent on p and
+// returns when it arrives, or false if it is lost.
+func (n *SimNetwork) schedule(p *simPipe, size int) (time.Time, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stats.Sent++
+
+	cfg := n.link(p.from, p.to)
+	if !n.reachable(p.from, p.to) || (cfg.Loss > 0 && n.rng.Float64() < cfg.Loss) {
+		n.stats.Dropped++
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	depart := now
+	if cfg.Bandwidth > 0 {
+		if p.busyUntil.After(depart) {
+			depart = p.busyUntil
+		}
+		depart = depart.Add(time.Duration(float64(size) / float64(cfg.Bandwidth) * float64(time.Second)))
+		p.busyUntil = depart
+	}
+
+	at := depart.Add(cfg.Latency)
+	if cfg.Jitter > 0 {
+		at = at.Add(time.Duration(n.rng.Int63n(int64(cfg.Jitter))))
+	}
+	if cfg.Reorder > 0 && n.rng.Float64() < cfg.Reorder {
+		delay := cfg.ReorderDelay
+		if delay <= 0 {
+			delay = max(cfg.Latency, time.Millisecond)
+		}
+		return at.Add(delay), true
+	}
+	// In-order frames never overtake each other, even with jitter.
+	if at.Before(p.lastArrival) {
+		at = p.lastArrival
+	}
+	p.lastArrival = at
+	return at, true
+}
+
+// delivered records the arrival of a frame, reporting false if a
+// partition went up while it was in flight.
+func (n *SimNetwork) delivered(p *simPipe) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.reachable(p.from, p.to) {
+		n.stats.Dropped++
+		return false
+	}
+	n.stats.Delivered++
+	return true
+}
+
+// SimTransport is one host's view of a SimNetwork.
+type SimTransport struct {
+	net  *SimNetwork
+	host string
+}
+
+// Listen registers a listener on this host. Port 0 picks a free port.
+func (t *SimTransport) Listen(ctx context.Context, addr string) (Listener, error) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost sim listen: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost sim listen: bad port %q", portStr)
+	}
+
+	n := t.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if port == 0 {
+		port = n.allocPort(t.host)
+	}
+	bound := net.JoinHostPort(t.host, strconv.Itoa(port))
+	if _, used := n.listeners[bound]; used {
+		return nil, fmt.Errorf("%w: %s", ErrSimAddrInUse, bound)
+	}
+
+	l := &simListener{
+		net:    n,
+		addr:   bound,
+		connCh: make(chan *simConn, 128),
+		done:   make(chan struct{}),
+	}
+	n.listeners[bound] = l
+	return l, nil
+}
+
+// Dial connects to a listener on another (or the same) host. It waits
+// for room in the listener's accept backlog.
+func (t *SimTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost sim dial: %w", err)
+	}
+
+	n := t.net
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	if !n.reachable(t.host, host) {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrSimUnreachable, addr)
+	}
+	if !ok {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrSimRefused, addr)
+	}
+	local := net.JoinHostPort(t.host, strconv.Itoa(n.allocPort(t.host)))
+	n.mu.Unlock()
+
+	out := newSimPipe(n, t.host, host)
+	in := newSimPipe(n, host, t.host)
+	client := &simConn{out: out, in: in, remote: addr}
+	server := &simConn{out: in, in: out, remote: local}
+
+	select {
+	case l.connCh <- server:
+		return client, nil
+	case <-l.done:
+		err = fmt.Errorf("%w: %s", ErrSimRefused, addr)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	out.abort()
+	in.abort()
+	return nil, err
+}
+
+type simListener struct {
+	net    *SimNetwork
+	addr   string
+	connCh chan *simConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *simListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+		return nil, fmt.Errorf("bifrost sim listener closed")
+	}
+}
+
+func (l *simListener) Addr() string { return l.addr }
+
+func (l *simListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.net.mu.Lock()
+		delete(l.net.listeners, l.addr)
+		l.net.mu.Unlock()
+	})
+	return nil
+}
+
+// simConn is one end of a simulated connection: it sends on out and
+// receives from in.
+type simConn struct {
+	out, in *simPipe
+	remote  string
+}
+
+func (c *simConn) Send(frame *types.BifrostFrame) error {
+	if len(frame.Payload) > MaxPayloadSize {
+		return ErrPayloadTooLong
+	}
+	// Copy: the caller may reuse the payload once Send returns.
+	f := &types.BifrostFrame{Type: frame.Type, Payload: append([]byte(nil), frame.Payload...)}
+	return c.out.send(f)
+}
+
+func (c *simConn) Receive() (*types.BifrostFrame, error) {
+	return c.in.receive()
+}
+
+func (c *simConn) RemoteAddr() string { return c.remote }
+
+// Close stops local receives at once; the peer sees EOF once the frames
+// already in flight have arrived.
+func (c *simConn) Close() error {
+	c.in.abort()
+	c.out.finish()
+	return nil
+}
+
+// simPipe carries frames in one direction. Frames wait in a heap ordered
+// by arrival time; a goroutine moves them to ready as they come due.
+type simPipe struct {
+	net      *SimNetwork
+	from, to string
+
+	// Guarded by net.mu, as schedule computes them.
+	busyUntil   time.Time
+	lastArrival time.Time
+
+	mu        sync.Mutex
+	pending   simQueue
+	ready     []*types.BifrostFrame
+	seq       uint64
+	finishing bool // sender closed; EOF after pending drains
+	eof       bool // receiver sees io.EOF once ready drains
+	aborted   bool // receiver closed
+
+	wake    chan struct{}
+	readyCh chan struct{}
+	done    chan struct{}
+}
+
+func newSimPipe(n *SimNetwork, from, to string) *simPipe {
+	p := &simPipe{
+		net:     n,
+		from:    from,
+		to:      to,
+		wake:    make(chan struct{}, 1),
+		readyCh: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *simPipe) send(f *types.BifrostFrame) error {
+	p.mu.Lock()
+	closed := p.finishing || p.aborted
+	p.mu.Unlock()
+	if closed {
+		return net.ErrClosed
+	}
+
+	at, ok := p.net.schedule(p, types.BifrostFrameHeaderSize+len(f.Payload))
+	if !ok {
+		return nil // lost, as on a real network
+	}
+
+	p.mu.Lock()
+	p.seq++
+	heap.Push(&p.pending, &simItem{frame: f, at: at, seq: p.seq})
+	p.mu.Unlock()
+	notify(p.wake)
+	return nil
+}
+
+func (p *simPipe) receive() (*types.BifrostFrame, error) {
+	for {
+		p.mu.Lock()
+		if p.aborted {
+			p.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		if len(p.ready) > 0 {
+			f := p.ready[0]
+			p.ready[0] = nil
+			p.ready = p.ready[1:]
+			p.mu.Unlock()
+			return f, nil
+		}
+		if p.eof {
+			p.mu.Unlock()
+			return nil, io.EOF
+		}
+		p.mu.Unlock()
+		<-p.readyCh
+	}
+}
+
+// finish is called by the sending side's Close. The EOF marker arrives
+// after every frame already sent.
+func (p *simPipe) finish() {
+	p.net.mu.Lock()
+	at := time.Now()
+	if p.lastArrival.After(at) {
+		at = p.lastArrival
+	}
+	p.net.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finishing {
+		return
+	}
+	p.finishing = true
+	for _, item := range p.pending {
+		if item.at.After(at) {
+			at = item.at // held-back frames still arrive
+		}
+	}
+	p.seq++
+	heap.Push(&p.pending, &simItem{at: at, seq: p.seq})
+	notify(p.wake)
+}
+
+// abort is called by the receiving side's Close.
+func (p *simPipe) abort() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.aborted {
+		return
+	}
+	p.aborted = true
+	p.pending = nil
+	p.ready = nil
+	close(p.done)
+	notify(p.readyCh)
+}
+
+func (p *simPipe) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		p.mu.Lock()
+		now := time.Now()
+		for len(p.pending) > 0 && !p.pending[0].at.After(now) {
+			item := heap.Pop(&p.pending).(*simItem)
+			if item.frame == nil {
+				p.eof = true
+			} else if p.net.delivered(p) {
+				p.ready = append(p.ready, item.frame)
+			}
+		}
+		if len(p.ready) > 0 || p.eof {
+			notify(p.readyCh)
+		}
+		if p.eof {
+			p.mu.Unlock()
+			return
+		}
+		wait := time.Hour
+		if len(p.pending) > 0 {
+			wait = p.pending[0].at.Sub(now)
+		}
+		p.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-p.wake:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// notify does a non-blocking send on a 1-buffered signal channel.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+type simItem struct {
+	frame *types.BifrostFrame // nil marks EOF
+	at    time.Time
+	seq   uint64
+}
+
+// simQueue is a min-heap of simItems by arrival time, then send order.
+type simQueue []*simItem
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q simQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x any)   { *q = append(*q, x.(*simItem)) }
+func (q *simQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
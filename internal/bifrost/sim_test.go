@@ -0,0 +1,207 @@
+package bifrost_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// simPair connects host a to a listener on host b.
+func simPair(t *testing.T, n *bifrost.SimNetwork, a, b string) (client, server bifrost.Conn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ln, err := n.Transport(b).Listen(ctx, ":0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	client, err = n.Transport(a).Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	server, err = ln.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func sendSeq(t *testing.T, c bifrost.Conn, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		f := &types.BifrostFrame{Type: types.FrameData, Payload: []byte(fmt.Sprintf("%04d", i))}
+		if err := c.Send(f); err != nil {
+			t.Fatalf("Send %d: %v", i, err)
+		}
+	}
+}
+
+// recvUntilEOF collects payloads until the peer's close arrives.
+func recvUntilEOF(t *testing.T, c bifrost.Conn) []string {
+	t.Helper()
+	var got []string
+	for {
+		f, err := c.Receive()
+		if errors.Is(err, io.EOF) {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("Receive: %v", err)
+		}
+		got = append(got, string(f.Payload))
+	}
+}
+
+func TestSimLatencyAndBandwidth(t *testing.T) {
+	tests := []struct {
+		name    string
+		link    bifrost.LinkConfig
+		frames  int
+		minTime time.Duration
+	}{
+		{"latency", bifrost.LinkConfig{Latency: 50 * time.Millisecond}, 1, 50 * time.Millisecond},
+		// 10 frames of 1007 bytes at 100 KB/s take ~100ms to serialize.
+		{"bandwidth", bifrost.LinkConfig{Bandwidth: 100_000}, 10, 95 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := bifrost.NewSimNetwork(1)
+			n.SetLink("a", "b", tt.link)
+			client, server := simPair(t, n, "a", "b")
+
+			start := time.Now()
+			for i := 0; i < tt.frames; i++ {
+				client.Send(&types.BifrostFrame{Type: types.FrameData, Payload: make([]byte, 1000)})
+			}
+			for i := 0; i < tt.frames; i++ {
+				if _, err := server.Receive(); err != nil {
+					t.Fatalf("Receive: %v", err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed < tt.minTime {
+				t.Fatalf("delivered in %v, want at least %v", elapsed, tt.minTime)
+			}
+		})
+	}
+}
+
+func TestSimLossIsDeterministic(t *testing.T) {
+	run := func(seed int64) []string {
+		n := bifrost.NewSimNetwork(seed)
+		n.SetDefaultLink(bifrost.LinkConfig{Loss: 0.3})
+		client, server := simPair(t, n, "a", "b")
+		sendSeq(t, client, 200)
+		client.Close()
+		got := recvUntilEOF(t, server)
+
+		stats := n.Stats()
+		if stats.Sent != 200 || stats.Delivered+stats.Dropped != 200 {
+			t.Fatalf("stats = %+v", stats)
+		}
+		return got
+	}
+
+	first, second := run(42), run(42)
+	if !slices.Equal(first, second) {
+		t.Fatal("same seed produced different losses")
+	}
+	if len(first) < 100 || len(first) > 180 {
+		t.Fatalf("delivered %d of 200 at 30%% loss", len(first))
+	}
+	if !slices.IsSorted(first) {
+		t.Fatal("lossy link without reordering delivered out of order")
+	}
+}
+
+func TestSimReorder(t *testing.T) {
+	n := bifrost.NewSimNetwork(7)
+	n.SetDefaultLink(bifrost.LinkConfig{Latency: time.Millisecond, Reorder: 0.2, ReorderDelay: 20 * time.Millisecond})
+	client, server := simPair(t, n, "a", "b")
+
+	sendSeq(t, client, 100)
+	client.Close()
+	got := recvUntilEOF(t, server)
+
+	if len(got) != 100 {
+		t.Fatalf("delivered %d frames, want 100", len(got))
+	}
+	if slices.IsSorted(got) {
+		t.Fatal("frames arrived in order despite reordering")
+	}
+}
+
+func TestSimPartition(t *testing.T) {
+	n := bifrost.NewSimNetwork(1)
+	client, server := simPair(t, n, "a", "b")
+	ctx := context.Background()
+
+	ln, err := n.Transport("b").Listen(ctx, ":0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	n.Partition([]string{"a"}, []string{"b"})
+	if _, err := n.Transport("a").Dial(ctx, ln.Addr()); !errors.Is(err, bifrost.ErrSimUnreachable) {
+		t.Fatalf("Dial across partition = %v, want ErrSimUnreachable", err)
+	}
+	// Frames on an existing connection vanish.
+	sendSeq(t, client, 5)
+
+	n.Heal()
+	if err := client.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("healed")}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	f, err := server.Receive()
+	if err != nil || string(f.Payload) != "healed" {
+		t.Fatalf("Receive after heal = %v, %v", f, err)
+	}
+	if stats := n.Stats(); stats.Dropped != 5 {
+		t.Fatalf("dropped %d frames, want 5", stats.Dropped)
+	}
+}
+
+func TestSimRegistry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n := bifrost.NewSimNetwork(1)
+
+	server := bifrost.NewRegistry()
+	server.Register("mem", n.Transport("node-b"))
+	ln, err := server.Listen(ctx, "/mem/node-b:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	client := bifrost.NewRegistry()
+	client.Register("mem", n.Transport("node-a"))
+	conn, err := client.Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial %s: %v", ln.Addr(), err)
+	}
+	defer conn.Close()
+	accepted, err := ln.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer accepted.Close()
+	if !strings.HasPrefix(ln.Addr(), "/mem/node-b:") || !strings.HasPrefix(accepted.RemoteAddr(), "node-a:") {
+		t.Fatalf("addrs: listener %q, server remote %q", ln.Addr(), accepted.RemoteAddr())
+	}
+}
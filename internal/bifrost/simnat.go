@@ -0,0 +1,250 @@
+package bifrost
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// simPacketBuffer is how many datagrams a simulated socket queues before
+// dropping, as a real socket's receive buffer would.
+const simPacketBuffer = 256
+
+// SimPacketNetwork is an in-process datagram network for running the UDP
+// transport without sockets, optionally with hosts behind NATs. Hosts are
+// named by IP address.
+//
+// A NAT maps each private socket to one public port for every destination
+// (endpoint-independent mapping) but only admits datagrams from addresses
+// that socket has sent to (address- and port-dependent filtering), as most
+// home routers do. Two hosts behind such NATs cannot reach each other
+// until both have sent first, which is what hole punching arranges.
+type SimPacketNetwork struct {
+	mu       sync.Mutex
+	sockets  map[netip.AddrPort]*simPacketConn // bound addresses
+	nats     map[netip.Addr]*simNAT            // by public IP
+	behind   map[netip.Addr]*simNAT            // by private IP
+	nextPort map[netip.Addr]uint16
+	dropped  uint64
+}
+
+type simNAT struct {
+	public   netip.Addr
+	mappings map[netip.AddrPort]*simMapping // by private socket
+	ports    map[uint16]*simMapping         // by public port
+}
+
+type simMapping struct {
+	private netip.AddrPort
+	public  netip.AddrPort
+	allowed map[netip.AddrPort]bool // remotes the private socket sent to
+}
+
+// NewSimPacketNetwork creates an empty datagram network.
+func NewSimPacketNetwork() *SimPacketNetwork {
+	return &SimPacketNetwork{
+		sockets:  make(map[netip.AddrPort]*simPacketConn),
+		nats:     make(map[netip.Addr]*simNAT),
+		behind:   make(map[netip.Addr]*simNAT),
+		nextPort: make(map[netip.Addr]uint16),
+	}
+}
+
+// AddNAT places the hosts with the given private IPs behind a NAT whose
+// external address is publicIP.
+func (n *SimPacketNetwork) AddNAT(publicIP string, privateIPs ...string) error {
+	public, err := netip.ParseAddr(publicIP)
+	if err != nil {
+		return fmt.Errorf("bifrost sim nat: %w", err)
+	}
+	nat := &simNAT{
+		public:   public,
+		mappings: make(map[netip.AddrPort]*simMapping),
+		ports:    make(map[uint16]*simMapping),
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, ip := range privateIPs {
+		private, err := netip.ParseAddr(ip)
+		if err != nil {
+			return fmt.Errorf("bifrost sim nat: %w", err)
+		}
+		n.behind[private] = nat
+	}
+	n.nats[public] = nat
+	return nil
+}
+
+// Dropped returns how many datagrams were lost: filtered by a NAT, sent
+// to an unbound address or overflowing a receive buffer.
+func (n *SimPacketNetwork) Dropped() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.dropped
+}
+
+// Host returns the host with the given IP address.
+func (n *SimPacketNetwork) Host(ip string) *SimPacketHost {
+	return &SimPacketHost{net: n, ip: ip}
+}
+
+// SimPacketHost is one host's view of a SimPacketNetwork. Its ListenPacket
+// method fits UDPConfig.ListenPacket.
+type SimPacketHost struct {
+	net *SimPacketNetwork
+	ip  string
+}
+
+// ListenPacket binds a socket on this host. The host part of addr is
+// ignored; port 0 picks a free port.
+func (h *SimPacketHost) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	ip, err := netip.ParseAddr(h.ip)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost sim listen: %w", err)
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost sim listen: %w", err)
+	}
+	var port uint16
+	if _, err := fmt.Sscan(portStr, &port); err != nil {
+		return nil, fmt.Errorf("bifrost sim listen: bad port %q", portStr)
+	}
+
+	n := h.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if port == 0 {
+		port = n.allocPort(ip)
+	}
+	local := netip.AddrPortFrom(ip, port)
+	if _, used := n.sockets[local]; used {
+		return nil, fmt.Errorf("%w: %s", ErrSimAddrInUse, local)
+	}
+	c := &simPacketConn{
+		net:    n,
+		local:  local,
+		recvCh: make(chan simPacket, simPacketBuffer),
+		done:   make(chan struct{}),
+	}
+	n.sockets[local] = c
+	return c, nil
+}
+
+// allocPort picks an unused port on ip. Called with n.mu held.
+func (n *SimPacketNetwork) allocPort(ip netip.Addr) uint16 {
+	for {
+		n.nextPort[ip]++
+		port := 40000 + n.nextPort[ip]
+		if _, used := n.sockets[netip.AddrPortFrom(ip, port)]; !used {
+			return port
+		}
+	}
+}
+
+// deliver carries a datagram from src to dst through any NATs on the way.
+func (n *SimPacketNetwork) deliver(src, dst netip.AddrPort, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Private addresses are only reachable from behind the same NAT.
+	srcNAT, dstNAT := n.behind[src.Addr()], n.behind[dst.Addr()]
+	if dstNAT != nil && dstNAT != srcNAT {
+		n.dropped++
+		return
+	}
+	if srcNAT != nil && dstNAT == nil {
+		m := srcNAT.mappings[src]
+		if m == nil {
+			m = &simMapping{
+				private: src,
+				public:  netip.AddrPortFrom(srcNAT.public, n.allocPort(srcNAT.public)),
+				allowed: make(map[netip.AddrPort]bool),
+			}
+			srcNAT.mappings[src] = m
+			srcNAT.ports[m.public.Port()] = m
+		}
+		m.allowed[dst] = true
+		src = m.public
+	}
+
+	if nat, ok := n.nats[dst.Addr()]; ok {
+		m := nat.ports[dst.Port()]
+		if m == nil || !m.allowed[src] {
+			n.dropped++
+			return
+		}
+		dst = m.private
+	}
+
+	c, ok := n.sockets[dst]
+	if !ok {
+		n.dropped++
+		return
+	}
+	select {
+	case c.recvCh <- simPacket{data: append([]byte(nil), data...), from: src}:
+	default:
+		n.dropped++
+	}
+}
+
+type simPacket struct {
+	data []byte
+	from netip.AddrPort
+}
+
+// simPacketConn is a socket on a SimPacketNetwork.
+type simPacketConn struct {
+	net    *SimPacketNetwork
+	local  netip.AddrPort
+	recvCh chan simPacket
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *simPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.recvCh:
+		return copy(p, pkt.data), net.UDPAddrFromAddrPort(pkt.from), nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *simPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	dst, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return 0, fmt.Errorf("bifrost sim write: %w", err)
+	}
+	c.net.deliver(c.local, dst, p)
+	return len(p), nil
+}
+
+func (c *simPacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.net.mu.Lock()
+		delete(c.net.sockets, c.local)
+		c.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *simPacketConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.local)
+}
+
+// Deadlines are not simulated; the UDP transport does not use them.
+func (c *simPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *simPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *simPacketConn) SetWriteDeadline(t time.Time) error { return nil }
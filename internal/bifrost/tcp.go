@@ -3,9 +3,11 @@ package bifrost
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/valhalla/valhalla/internal/types"
 )
@@ -28,6 +30,9 @@ func (t *TCPTransport) Listen(ctx context.Context, addr string) (Listener, error
 	return &tcpListener{ln: ln}, nil
 }
 
+// Protocol returns "tcp", the PathAddr protocol the transport dials.
+func (t *TCPTransport) Protocol() string { return "tcp" }
+
 // Dial connects to a TCP address.
 func (t *TCPTransport) Dial(ctx context.Context, addr string) (Conn, error) {
 	var d net.Dialer
@@ -80,24 +85,98 @@ type tcpConn struct {
 	reader *bufio.Reader
 	writer *bufio.Writer
 	mu     sync.Mutex // protects writer
+
+	// Set by setFrameLimits before the conn is handed out.
+	maxPayload   uint32
+	frameTimeout time.Duration
 }
 
 func newTCPConn(conn net.Conn) *tcpConn {
 	return &tcpConn{
-		conn:   conn,
-		reader: bufio.NewReaderSize(conn, 64*1024),
-		writer: bufio.NewWriterSize(conn, 64*1024),
+		conn:       conn,
+		reader:     bufio.NewReaderSize(conn, 64*1024),
+		writer:     bufio.NewWriterSize(conn, 64*1024),
+		maxPayload: MaxPayloadSize,
+	}
+}
+
+func (c *tcpConn) setFrameLimits(maxPayload uint32, frameTimeout time.Duration) bool {
+	if maxPayload > 0 && maxPayload < MaxPayloadSize {
+		c.maxPayload = maxPayload
+	}
+	c.frameTimeout = frameTimeout
+	return true
+}
+
+// beginFrame waits, without a deadline, for the first byte of the next
+// frame and then arms the frame deadline: an idle peer is fine, one that
+// trickles a frame in byte by byte is not.
+func (c *tcpConn) beginFrame() error {
+	if c.frameTimeout <= 0 {
+		return nil
+	}
+	if _, err := c.reader.Peek(1); err != nil {
+		return fmt.Errorf("bifrost decode magic: %w", err)
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(c.frameTimeout))
+}
+
+// endFrame clears the frame deadline. A frame that missed it leaves the
+// stream mid-frame, so the conn is closed.
+func (c *tcpConn) endFrame(err error) error {
+	if c.frameTimeout <= 0 {
+		return err
 	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		c.conn.Close()
+		return ErrSlowFrame
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	return err
 }
 
+// writevThreshold is the payload size above which Send skips the bufio
+// copy and hands header and payload to the kernel in one writev call.
+const writevThreshold = 16 * 1024
+
 func (c *tcpConn) Send(frame *types.BifrostFrame) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return Encode(c.writer, frame)
+
+	if len(frame.Payload) < writevThreshold {
+		return Encode(c.writer, frame)
+	}
+
+	// Encode always flushes, so the bufio writer is empty here.
+	var hdr [types.BifrostFrameHeaderSize]byte
+	bufs := net.Buffers{appendHeader(hdr[:0], frame), frame.Payload}
+	if _, err := bufs.WriteTo(c.conn); err != nil {
+		return fmt.Errorf("bifrost tcp send: %w", err)
+	}
+	return nil
 }
 
 func (c *tcpConn) Receive() (*types.BifrostFrame, error) {
-	return Decode(c.reader)
+	if err := c.beginFrame(); err != nil {
+		return nil, err
+	}
+	f, err := decodeLimit(c.reader, c.maxPayload)
+	if err = c.endFrame(err); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *tcpConn) ReceivePooled() (*PooledFrame, error) {
+	if err := c.beginFrame(); err != nil {
+		return nil, err
+	}
+	f, err := decodePooledLimit(c.reader, c.maxPayload)
+	if err = c.endFrame(err); err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
 func (c *tcpConn) RemoteAddr() string {
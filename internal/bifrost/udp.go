@@ -0,0 +1,722 @@
+package bifrost
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// UDP datagram layout. Every Bifrost frame is serialized to wire format and
+// split into one or more fragments that each fit in a single datagram:
+//
+//	┌──────┬──────┬───────┬───────┬───────┬──────────┐
+//	│Magic │ Kind │ MsgID │ Index │ Count │ Fragment │
+//	│ 2B   │ 1B   │ 4B    │ 2B    │ 2B    │ Variable │
+//	└──────┴──────┴───────┴───────┴───────┴──────────┘
+const udpHeaderSize = 11
+
+// udpMagic distinguishes Bifrost datagrams ("VU") from stray UDP traffic.
+var udpMagic = [2]byte{0x56, 0x55}
+
+const (
+	udpKindData  byte = 0x01
+	udpKindAck   byte = 0x02
+	udpKindClose byte = 0x03
+	// udpKindPunch and udpKindPunchAck open NAT mappings; see Punch.
+	udpKindPunch    byte = 0x04
+	udpKindPunchAck byte = 0x05
+
+	// udpFlagAckRequested is OR-ed into the kind byte of data fragments
+	// when the sender wants the reassembled message acknowledged.
+	udpFlagAckRequested byte = 0x80
+)
+
+const (
+	// DefaultUDPMTU keeps datagrams below the IPv6 minimum path MTU.
+	DefaultUDPMTU = 1200
+	// DefaultUDPReassemblyBytes bounds the fragments a socket buffers for
+	// frames that are not yet complete, across all peers.
+	DefaultUDPReassemblyBytes = 32 << 20
+
+	// minUDPMTU is the smallest MTU that carries a MaxPayloadSize frame in
+	// the 65,535 fragments the Count field can number.
+	minUDPMTU = udpHeaderSize + (MaxPayloadSize+types.BifrostFrameHeaderSize+math.MaxUint16-1)/math.MaxUint16
+
+	udpMaxPartials  = 64   // in-flight reassemblies per peer
+	udpDedupHistory = 1024 // delivered message IDs remembered per peer
+	udpRecvBuffer   = 256
+)
+
+var (
+	ErrUDPNoAck      = errors.New("bifrost udp: message not acknowledged")
+	ErrUDPConnClosed = errors.New("bifrost udp: connection closed")
+)
+
+// UDPConfig tunes the UDP transport.
+type UDPConfig struct {
+	// MTU is the largest datagram sent, including the fragment header. It
+	// must leave room to send a MaxPayloadSize frame in 65,535 fragments.
+	MTU int
+	// Reliable makes Send wait for the peer to acknowledge each frame,
+	// retransmitting until MaxRetransmits is exhausted. When false,
+	// delivery is best-effort and frames may be lost.
+	Reliable           bool
+	RetransmitInterval time.Duration
+	MaxRetransmits     int
+	// ReassemblyTimeout discards partially received frames whose
+	// remaining fragments never arrived.
+	ReassemblyTimeout time.Duration
+	// MaxReassemblyBytes bounds the fragments buffered for incomplete
+	// frames across every peer of a socket. Fragments over the budget are
+	// dropped; a reliable sender retransmits them.
+	MaxReassemblyBytes int
+	// MaxPayload is the largest frame payload reassembled, which also
+	// bounds the fragments accepted per frame. Admission control may lower
+	// it per connection.
+	MaxPayload uint32
+	// PunchInterval is how often Punch probes the peer's addresses.
+	PunchInterval time.Duration
+	// ListenPacket opens the transport's sockets. Nil uses the operating
+	// system; a SimPacketHost runs the transport over a simulated network.
+	ListenPacket func(ctx context.Context, addr string) (net.PacketConn, error)
+}
+
+// DefaultUDPConfig returns best-effort delivery with a conservative MTU.
+func DefaultUDPConfig() UDPConfig {
+	return UDPConfig{
+		MTU:                DefaultUDPMTU,
+		RetransmitInterval: 200 * time.Millisecond,
+		MaxRetransmits:     5,
+		ReassemblyTimeout:  5 * time.Second,
+		MaxReassemblyBytes: DefaultUDPReassemblyBytes,
+		MaxPayload:         MaxPayloadSize,
+		PunchInterval:      50 * time.Millisecond,
+	}
+}
+
+// UDPTransport implements Transport over UDP.
+//
+// All connections created by a transport after Listen share the listening
+// socket and are demultiplexed by remote address, so a node needs a single
+// UDP port for both inbound and outbound peers. Before Listen, each Dial
+// opens its own ephemeral socket.
+type UDPTransport struct {
+	config UDPConfig
+	mu     sync.Mutex
+	mux    *udpMux // shared listening socket, nil until Listen
+}
+
+// NewUDPTransport creates a best-effort UDP transport.
+func NewUDPTransport() *UDPTransport {
+	return NewUDPTransportWithConfig(DefaultUDPConfig())
+}
+
+// NewUDPTransportWithConfig creates a UDP transport with custom settings.
+// Zero fields, and an MTU too small to fragment a MaxPayloadSize frame,
+// fall back to the defaults.
+func NewUDPTransportWithConfig(config UDPConfig) *UDPTransport {
+	def := DefaultUDPConfig()
+	if config.MTU < minUDPMTU {
+		config.MTU = def.MTU
+	}
+	if config.RetransmitInterval <= 0 {
+		config.RetransmitInterval = def.RetransmitInterval
+	}
+	if config.MaxRetransmits <= 0 {
+		config.MaxRetransmits = def.MaxRetransmits
+	}
+	if config.ReassemblyTimeout <= 0 {
+		config.ReassemblyTimeout = def.ReassemblyTimeout
+	}
+	if config.MaxReassemblyBytes <= 0 {
+		config.MaxReassemblyBytes = def.MaxReassemblyBytes
+	}
+	if config.MaxPayload == 0 || config.MaxPayload > MaxPayloadSize {
+		config.MaxPayload = def.MaxPayload
+	}
+	if config.PunchInterval <= 0 {
+		config.PunchInterval = def.PunchInterval
+	}
+	return &UDPTransport{config: config}
+}
+
+// Listen binds the transport's shared UDP socket.
+func (t *UDPTransport) Listen(ctx context.Context, addr string) (Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.mux != nil {
+		return nil, fmt.Errorf("bifrost udp listen: already listening on %s", t.mux.pc.LocalAddr())
+	}
+
+	pc, err := t.listenPacket(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost udp listen: %w", err)
+	}
+	t.mux = newUDPMux(pc, t.config, true)
+	return &udpListener{transport: t, mux: t.mux}, nil
+}
+
+// Protocol returns "udp", the PathAddr protocol the transport dials.
+func (t *UDPTransport) Protocol() string { return "udp" }
+
+// Dial returns a connection to a UDP peer. No datagram is exchanged until
+// the first Send; the remote side surfaces the connection from Accept when
+// that first frame arrives.
+func (t *UDPTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost udp dial: %w", err)
+	}
+
+	t.mu.Lock()
+	mux := t.mux
+	t.mu.Unlock()
+
+	if mux == nil {
+		pc, err := t.listenPacket(ctx, ":0")
+		if err != nil {
+			return nil, fmt.Errorf("bifrost udp dial: %w", err)
+		}
+		mux = newUDPMux(pc, t.config, false)
+	}
+
+	conn, _ := mux.getOrCreate(udpAddr)
+	if conn == nil {
+		return nil, fmt.Errorf("bifrost udp dial: %w", ErrUDPConnClosed)
+	}
+	return conn, nil
+}
+
+func (t *UDPTransport) listenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	if t.config.ListenPacket != nil {
+		return t.config.ListenPacket(ctx, addr)
+	}
+	lc := net.ListenConfig{}
+	return lc.ListenPacket(ctx, "udp", addr)
+}
+
+type udpListener struct {
+	transport *UDPTransport
+	mux       *udpMux
+}
+
+func (l *udpListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case c := <-l.mux.acceptCh:
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.mux.done:
+		return nil, fmt.Errorf("bifrost udp listener closed")
+	}
+}
+
+func (l *udpListener) Addr() string {
+	return l.mux.pc.LocalAddr().String()
+}
+
+func (l *udpListener) Close() error {
+	l.transport.mu.Lock()
+	if l.transport.mux == l.mux {
+		l.transport.mux = nil
+	}
+	l.transport.mu.Unlock()
+	return l.mux.close()
+}
+
+// udpMux owns a UDP socket and dispatches datagrams to per-peer conns.
+type udpMux struct {
+	pc        net.PacketConn
+	config    UDPConfig
+	listening bool
+	conns     map[string]*udpConn
+	punches   map[string]chan string // remote addr -> waiting Punch
+	acceptCh  chan *udpConn
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+
+	// pending counts fragment bytes buffered in partials of every conn,
+	// bounded by config.MaxReassemblyBytes.
+	pending atomic.Int64
+}
+
+func newUDPMux(pc net.PacketConn, config UDPConfig, listening bool) *udpMux {
+	m := &udpMux{
+		pc:        pc,
+		config:    config,
+		listening: listening,
+		conns:     make(map[string]*udpConn),
+		punches:   make(map[string]chan string),
+		acceptCh:  make(chan *udpConn, 16),
+		done:      make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+// getOrCreate returns the conn for a remote address, creating it if needed.
+// The boolean reports whether the conn was newly created.
+func (m *udpMux) getOrCreate(raddr net.Addr) (*udpConn, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.done:
+		return nil, false
+	default:
+	}
+
+	key := raddr.String()
+	if c, ok := m.conns[key]; ok {
+		return c, false
+	}
+	c := newUDPConn(m, raddr)
+	m.conns[key] = c
+	return c, true
+}
+
+func (m *udpMux) lookup(raddr net.Addr) (*udpConn, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.conns[raddr.String()]
+	return c, ok
+}
+
+func (m *udpMux) remove(c *udpConn) {
+	m.mu.Lock()
+	if m.conns[c.raddr.String()] == c {
+		delete(m.conns, c.raddr.String())
+	}
+	empty := len(m.conns) == 0
+	m.mu.Unlock()
+
+	select {
+	case <-m.done:
+		return // already shutting down
+	default:
+	}
+	// A dial-only socket exists solely for its conn.
+	if empty && !m.listening {
+		m.close()
+	}
+}
+
+func (m *udpMux) readLoop() {
+	buf := make([]byte, 64*1024)
+	lastSweep := time.Now()
+	for {
+		n, raddr, err := m.pc.ReadFrom(buf)
+		if err != nil {
+			m.close()
+			return
+		}
+		if time.Since(lastSweep) > m.config.ReassemblyTimeout {
+			m.expirePartials()
+			lastSweep = time.Now()
+		}
+		if n < udpHeaderSize || buf[0] != udpMagic[0] || buf[1] != udpMagic[1] {
+			continue // not a Bifrost datagram
+		}
+
+		kind := buf[2]
+		if kind == udpKindPunch || kind == udpKindPunchAck {
+			m.handlePunch(kind, raddr)
+			continue
+		}
+		c, ok := m.lookup(raddr)
+		if !ok {
+			if kind&^udpFlagAckRequested != udpKindData || !m.listening {
+				continue
+			}
+			var created bool
+			c, created = m.getOrCreate(raddr)
+			if c == nil {
+				return
+			}
+			if created {
+				select {
+				case m.acceptCh <- c:
+				default:
+					// Accept backlog full: forget the peer, it will retry.
+					m.remove(c)
+					continue
+				}
+			}
+		}
+
+		// Copy out of the shared read buffer before handing off.
+		dgram := make([]byte, n)
+		copy(dgram, buf[:n])
+		c.handleDatagram(dgram)
+	}
+}
+
+// expirePartials drops timed-out reassemblies of every conn, returning
+// their bytes to the budget even for peers that went quiet.
+func (m *udpMux) expirePartials() {
+	m.mu.Lock()
+	conns := make([]*udpConn, 0, len(m.conns))
+	for _, c := range m.conns {
+		conns = append(conns, c)
+	}
+	m.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		c.expirePartialsLocked()
+		c.mu.Unlock()
+	}
+}
+
+// reserve charges n fragment bytes to the reassembly budget, reporting
+// false if they do not fit.
+func (m *udpMux) reserve(n int) bool {
+	if m.pending.Add(int64(n)) > int64(m.config.MaxReassemblyBytes) {
+		m.pending.Add(-int64(n))
+		return false
+	}
+	return true
+}
+
+func (m *udpMux) close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		err = m.pc.Close()
+
+		m.mu.Lock()
+		conns := make([]*udpConn, 0, len(m.conns))
+		for _, c := range m.conns {
+			conns = append(conns, c)
+		}
+		m.conns = make(map[string]*udpConn)
+		m.mu.Unlock()
+
+		for _, c := range conns {
+			c.shutdown()
+		}
+	})
+	return err
+}
+
+// udpConn is one peer's view of a shared UDP socket.
+type udpConn struct {
+	mux    *udpMux
+	raddr  net.Addr
+	recvCh chan *types.BifrostFrame
+	closed chan struct{}
+	once   sync.Once
+	nextID atomic.Uint32
+	sendMu sync.Mutex // serializes Send so reliable mode is stop-and-wait
+
+	maxPayload atomic.Uint32 // largest payload reassembled
+
+	mu        sync.Mutex
+	partials  map[uint32]*udpPartial
+	acks      map[uint32]chan struct{}
+	delivered map[uint32]struct{}
+	history   []uint32 // FIFO of delivered IDs, bounds the dedup set
+}
+
+type udpPartial struct {
+	frags    [][]byte
+	received int
+	bytes    int // charged to the mux's reassembly budget
+	started  time.Time
+}
+
+func newUDPConn(mux *udpMux, raddr net.Addr) *udpConn {
+	c := &udpConn{
+		mux:       mux,
+		raddr:     raddr,
+		recvCh:    make(chan *types.BifrostFrame, udpRecvBuffer),
+		closed:    make(chan struct{}),
+		partials:  make(map[uint32]*udpPartial),
+		acks:      make(map[uint32]chan struct{}),
+		delivered: make(map[uint32]struct{}),
+	}
+	c.maxPayload.Store(mux.config.MaxPayload)
+	return c
+}
+
+// setFrameLimits lowers the largest payload reassembled. Datagrams have
+// no partial-frame stream to stall, so frameTimeout does not apply;
+// ReassemblyTimeout bounds incomplete frames instead.
+func (c *udpConn) setFrameLimits(maxPayload uint32, _ time.Duration) bool {
+	if maxPayload > 0 && maxPayload < c.maxPayload.Load() {
+		c.maxPayload.Store(maxPayload)
+	}
+	return true
+}
+
+func (c *udpConn) Send(frame *types.BifrostFrame) error {
+	if len(frame.Payload) > MaxPayloadSize {
+		return ErrPayloadTooLong
+	}
+	select {
+	case <-c.closed:
+		return ErrUDPConnClosed
+	default:
+	}
+
+	buf := getBuffer(types.BifrostFrameHeaderSize + len(frame.Payload))
+	defer putBuffer(buf)
+	wire := AppendFrame((*buf)[:0], frame)
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	id := c.nextID.Add(1)
+	dgrams := c.fragment(id, wire)
+
+	if !c.mux.config.Reliable {
+		return c.writeAll(dgrams)
+	}
+
+	ack := make(chan struct{})
+	c.mu.Lock()
+	c.acks[id] = ack
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.acks, id)
+		c.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(c.mux.config.RetransmitInterval)
+	defer timer.Stop()
+	for attempt := 0; attempt <= c.mux.config.MaxRetransmits; attempt++ {
+		if err := c.writeAll(dgrams); err != nil {
+			return err
+		}
+		timer.Reset(c.mux.config.RetransmitInterval)
+		select {
+		case <-ack:
+			return nil
+		case <-c.closed:
+			return ErrUDPConnClosed
+		case <-timer.C:
+		}
+	}
+	return ErrUDPNoAck
+}
+
+// fragment splits a wire-format frame into datagrams of at most MTU bytes.
+func (c *udpConn) fragment(id uint32, wire []byte) [][]byte {
+	chunk := c.mux.config.MTU - udpHeaderSize
+	count := (len(wire) + chunk - 1) / chunk
+
+	kind := udpKindData
+	if c.mux.config.Reliable {
+		kind |= udpFlagAckRequested
+	}
+
+	dgrams := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := min((i+1)*chunk, len(wire))
+		d := make([]byte, udpHeaderSize+end-i*chunk)
+		putUDPHeader(d, kind, id, uint16(i), uint16(count))
+		copy(d[udpHeaderSize:], wire[i*chunk:end])
+		dgrams = append(dgrams, d)
+	}
+	return dgrams
+}
+
+func putUDPHeader(d []byte, kind byte, id uint32, index, count uint16) {
+	d[0], d[1] = udpMagic[0], udpMagic[1]
+	d[2] = kind
+	binary.BigEndian.PutUint32(d[3:7], id)
+	binary.BigEndian.PutUint16(d[7:9], index)
+	binary.BigEndian.PutUint16(d[9:11], count)
+}
+
+func (c *udpConn) writeAll(dgrams [][]byte) error {
+	for _, d := range dgrams {
+		if _, err := c.mux.pc.WriteTo(d, c.raddr); err != nil {
+			return fmt.Errorf("bifrost udp send: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *udpConn) writeControl(kind byte, id uint32) {
+	var d [udpHeaderSize]byte
+	putUDPHeader(d[:], kind, id, 0, 1)
+	c.mux.pc.WriteTo(d[:], c.raddr)
+}
+
+func (c *udpConn) handleDatagram(d []byte) {
+	kind := d[2]
+	id := binary.BigEndian.Uint32(d[3:7])
+	index := binary.BigEndian.Uint16(d[7:9])
+	count := binary.BigEndian.Uint16(d[9:11])
+
+	switch kind &^ udpFlagAckRequested {
+	case udpKindAck:
+		c.mu.Lock()
+		if ack, ok := c.acks[id]; ok {
+			close(ack)
+			delete(c.acks, id)
+		}
+		c.mu.Unlock()
+	case udpKindClose:
+		c.shutdown()
+	case udpKindData:
+		c.handleFragment(kind&udpFlagAckRequested != 0, id, index, count, d[udpHeaderSize:])
+	}
+}
+
+func (c *udpConn) handleFragment(wantAck bool, id uint32, index, count uint16, frag []byte) {
+	chunk := c.mux.config.MTU - udpHeaderSize
+	maxPayload := c.maxPayload.Load()
+	maxFrags := (int(maxPayload)+types.BifrostFrameHeaderSize)/chunk + 1
+	if count == 0 || index >= count || int(count) > maxFrags {
+		return
+	}
+
+	c.mu.Lock()
+	if _, dup := c.delivered[id]; dup {
+		c.mu.Unlock()
+		if wantAck {
+			c.writeControl(udpKindAck, id) // our earlier ack was lost
+		}
+		return
+	}
+
+	c.expirePartialsLocked()
+	p, ok := c.partials[id]
+	if !ok {
+		if len(c.partials) >= udpMaxPartials {
+			c.mu.Unlock()
+			return
+		}
+		p = &udpPartial{frags: make([][]byte, count), started: time.Now()}
+		c.partials[id] = p
+	}
+	if len(p.frags) != int(count) || p.frags[index] != nil {
+		c.mu.Unlock()
+		return
+	}
+	if !c.mux.reserve(len(frag)) {
+		c.mu.Unlock()
+		return
+	}
+	p.frags[index] = frag
+	p.bytes += len(frag)
+	p.received++
+	if p.received < int(count) {
+		c.mu.Unlock()
+		return
+	}
+	c.dropPartialLocked(id, p)
+	c.mu.Unlock()
+
+	size := 0
+	for _, f := range p.frags {
+		size += len(f)
+	}
+	wire := make([]byte, 0, size)
+	for _, f := range p.frags {
+		wire = append(wire, f...)
+	}
+	frame, err := decodeBytes(wire)
+	if err != nil || uint32(len(frame.Payload)) > maxPayload {
+		return
+	}
+
+	select {
+	case c.recvCh <- frame:
+	default:
+		// Receiver is not keeping up. Drop without acking so a reliable
+		// sender retransmits.
+		return
+	}
+
+	c.mu.Lock()
+	c.markDeliveredLocked(id)
+	c.mu.Unlock()
+	if wantAck {
+		c.writeControl(udpKindAck, id)
+	}
+}
+
+func (c *udpConn) expirePartialsLocked() {
+	cutoff := time.Now().Add(-c.mux.config.ReassemblyTimeout)
+	for id, p := range c.partials {
+		if p.started.Before(cutoff) {
+			c.dropPartialLocked(id, p)
+		}
+	}
+}
+
+// dropPartialLocked forgets a reassembly and returns its bytes to the
+// mux's budget.
+func (c *udpConn) dropPartialLocked(id uint32, p *udpPartial) {
+	delete(c.partials, id)
+	c.mux.pending.Add(-int64(p.bytes))
+}
+
+func (c *udpConn) markDeliveredLocked(id uint32) {
+	c.delivered[id] = struct{}{}
+	c.history = append(c.history, id)
+	if len(c.history) > udpDedupHistory {
+		delete(c.delivered, c.history[0])
+		c.history = c.history[1:]
+	}
+}
+
+func (c *udpConn) Receive() (*types.BifrostFrame, error) {
+	select {
+	case f := <-c.recvCh:
+		return f, nil
+	case <-c.closed:
+		// Drain frames that arrived before the close.
+		select {
+		case f := <-c.recvCh:
+			return f, nil
+		default:
+			return nil, fmt.Errorf("bifrost udp receive: %w", io.EOF)
+		}
+	}
+}
+
+func (c *udpConn) RemoteAddr() string {
+	return c.raddr.String()
+}
+
+func (c *udpConn) Close() error {
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	c.writeControl(udpKindClose, 0)
+	c.shutdown()
+	return nil
+}
+
+// shutdown marks the conn closed and detaches it from the mux.
+func (c *udpConn) shutdown() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		for id, p := range c.partials {
+			c.dropPartialLocked(id, p)
+		}
+		c.mu.Unlock()
+		c.mux.remove(c)
+	})
+}
@@ -0,0 +1,266 @@
+package bifrost_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+func TestUDPTransportFragmentation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transport := bifrost.NewUDPTransportWithConfig(bifrost.UDPConfig{Reliable: true})
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	client := bifrost.NewUDPTransportWithConfig(bifrost.UDPConfig{Reliable: true})
+	conn, err := client.Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"single datagram", 100},
+		{"exactly one fragment boundary", bifrost.DefaultUDPMTU - 11 - types.BifrostFrameHeaderSize},
+		{"many fragments", 64 * 1024},
+	}
+
+	var server bifrost.Conn
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := make([]byte, tt.size)
+			rand.Read(payload)
+			if err := conn.Send(&types.BifrostFrame{Type: types.FrameData, Payload: payload}); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+
+			if server == nil {
+				server, err = ln.Accept(ctx)
+				if err != nil {
+					t.Fatalf("Accept: %v", err)
+				}
+			}
+			got, err := server.Receive()
+			if err != nil {
+				t.Fatalf("Receive: %v", err)
+			}
+			if got.Type != types.FrameData {
+				t.Errorf("Type: got %v, want DATA", got.Type)
+			}
+			if !bytes.Equal(got.Payload, payload) {
+				t.Errorf("payload mismatch (len got=%d, want=%d)", len(got.Payload), len(payload))
+			}
+		})
+	}
+}
+
+func TestUDPTransportSharedSocketDemux(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transport := bifrost.NewUDPTransportWithConfig(bifrost.UDPConfig{Reliable: true})
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	const numPeers = 3
+	for i := 0; i < numPeers; i++ {
+		c, err := bifrost.NewUDPTransportWithConfig(bifrost.UDPConfig{Reliable: true}).Dial(ctx, ln.Addr())
+		if err != nil {
+			t.Fatalf("peer %d dial: %v", i, err)
+		}
+		defer c.Close()
+		if err := c.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte(fmt.Sprintf("peer-%d", i))}); err != nil {
+			t.Fatalf("peer %d send: %v", i, err)
+		}
+	}
+
+	seen := make(map[string]string)
+	for i := 0; i < numPeers; i++ {
+		c, err := ln.Accept(ctx)
+		if err != nil {
+			t.Fatalf("Accept %d: %v", i, err)
+		}
+		f, err := c.Receive()
+		if err != nil {
+			t.Fatalf("Receive %d: %v", i, err)
+		}
+		if prev, dup := seen[c.RemoteAddr()]; dup {
+			t.Fatalf("remote %s accepted twice (%q, %q)", c.RemoteAddr(), prev, f.Payload)
+		}
+		seen[c.RemoteAddr()] = string(f.Payload)
+
+		// Reply over the shared listening socket.
+		if err := c.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("ack")}); err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+	}
+	if len(seen) != numPeers {
+		t.Errorf("accepted %d distinct peers, want %d", len(seen), numPeers)
+	}
+}
+
+func TestUDPTransportCloseSignalsPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transport := bifrost.NewUDPTransport()
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := bifrost.NewUDPTransport().Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if err := client.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("hi")}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	server, err := ln.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if _, err := server.Receive(); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+
+	client.Close()
+	if _, err := server.Receive(); err == nil {
+		t.Fatal("expected error after peer closed")
+	}
+}
+
+func TestUDPTransportBoundsReassembly(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transport := bifrost.NewUDPTransportWithConfig(bifrost.UDPConfig{
+		Reliable:           true,
+		MaxReassemblyBytes: 16 * 1024,
+		MaxPayload:         32 * 1024,
+		ReassemblyTimeout:  200 * time.Millisecond,
+	})
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	client := bifrost.NewUDPTransportWithConfig(bifrost.UDPConfig{
+		Reliable:           true,
+		RetransmitInterval: 50 * time.Millisecond,
+		MaxRetransmits:     2,
+	})
+	send := func(size int) error {
+		conn, err := client.Dial(ctx, ln.Addr())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		return conn.Send(&types.BifrostFrame{Type: types.FrameData, Payload: make([]byte, size)})
+	}
+
+	tests := []struct {
+		name string
+		size int
+		ok   bool
+	}{
+		{"over the reassembly budget", 24 * 1024, false},
+		{"over the max payload", 64 * 1024, false},
+		{"fits both", 8 * 1024, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Let the previous case's partial expire.
+			time.Sleep(250 * time.Millisecond)
+			err := send(tt.size)
+			if tt.ok && err != nil {
+				t.Errorf("Send = %v", err)
+			}
+			if !tt.ok && !errors.Is(err, bifrost.ErrUDPNoAck) {
+				t.Errorf("Send = %v, want ErrUDPNoAck", err)
+			}
+		})
+	}
+}
+
+// sizeRecorder remembers the largest datagram written through it.
+type sizeRecorder struct {
+	net.PacketConn
+	max atomic.Int64
+}
+
+func (r *sizeRecorder) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if n := int64(len(p)); n > r.max.Load() {
+		r.max.Store(n)
+	}
+	return r.PacketConn.WriteTo(p, addr)
+}
+
+func TestUDPTransportRejectsTinyMTU(t *testing.T) {
+	tests := []struct {
+		name    string
+		mtu     int
+		wantMax int64
+	}{
+		// 16 MiB in 89-byte chunks needs more fragments than Count holds.
+		{"too small for max payload", 100, bifrost.DefaultUDPMTU},
+		{"smallest that fits", 268, 268},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			ln, err := bifrost.NewUDPTransport().Listen(ctx, "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen: %v", err)
+			}
+			defer ln.Close()
+
+			rec := &sizeRecorder{}
+			client := bifrost.NewUDPTransportWithConfig(bifrost.UDPConfig{
+				MTU: tt.mtu,
+				ListenPacket: func(ctx context.Context, addr string) (net.PacketConn, error) {
+					pc, err := net.ListenPacket("udp", addr)
+					rec.PacketConn = pc
+					return rec, err
+				},
+			})
+			conn, err := client.Dial(ctx, ln.Addr())
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.Close()
+
+			if err := conn.Send(&types.BifrostFrame{Type: types.FrameData, Payload: make([]byte, 4000)}); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if got := rec.max.Load(); got != tt.wantMax {
+				t.Errorf("largest datagram = %d, want %d", got, tt.wantMax)
+			}
+		})
+	}
+}
@@ -1,42 +1,205 @@
 package bifrost
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/valhalla/valhalla/internal/types"
 	"nhooyr.io/websocket"
 )
 
+var (
+	ErrWSNoCertificate  = errors.New("bifrost: wss listener has no certificate")
+	ErrWSPinMismatch    = errors.New("bifrost: server certificate does not match any pinned fingerprint")
+	ErrWSBadFingerprint = errors.New("bifrost: malformed certificate fingerprint")
+)
+
+// WSConfig configures the WebSocket transport.
+type WSConfig struct {
+	// Path is the HTTP path Bifrost is served on and dialed at. Dial
+	// addresses of the form "host:port/path" override it.
+	Path string
+	// Fallback serves requests for any other path, so Bifrost can share a
+	// port with another HTTP service.
+	Fallback http.Handler
+
+	// TLS switches the transport to wss://.
+	TLS bool
+	// CertFile and KeyFile are the PEM certificate and key Listen serves.
+	CertFile string
+	KeyFile  string
+	// SelfSigned generates an ephemeral certificate at Listen when no
+	// certificate files are configured.
+	SelfSigned bool
+
+	// PinnedFingerprints are hex SHA-256 fingerprints of acceptable server
+	// certificates (colons allowed). When set, Dial accepts exactly these
+	// certificates and skips CA verification; otherwise the server is
+	// verified against RootCAs, or the system roots if nil.
+	PinnedFingerprints []string
+	RootCAs            *x509.CertPool
+	ServerName         string
+}
+
+// DefaultWSConfig returns a plain ws:// configuration serving on "/".
+func DefaultWSConfig() WSConfig {
+	return WSConfig{Path: "/"}
+}
+
+// DefaultWSSConfig returns a wss:// configuration that serves an
+// ephemeral self-signed certificate unless certificate files are set.
+func DefaultWSSConfig() WSConfig {
+	return WSConfig{Path: "/", TLS: true, SelfSigned: true}
+}
+
+// wsUpgradeTimeout bounds how long a client may take to send the upgrade
+// request headers.
+const wsUpgradeTimeout = 10 * time.Second
+
 // WSTransport implements Transport over WebSocket.
-type WSTransport struct{}
+type WSTransport struct {
+	config WSConfig
+}
 
 // NewWSTransport creates a new WebSocket transport.
 func NewWSTransport() *WSTransport {
-	return &WSTransport{}
+	return NewWSTransportWithConfig(DefaultWSConfig())
+}
+
+// NewWSTransportWithConfig creates a WebSocket transport with custom settings.
+func NewWSTransportWithConfig(config WSConfig) *WSTransport {
+	if config.Path == "" {
+		config.Path = "/"
+	}
+	return &WSTransport{config: config}
+}
+
+// CertFingerprint returns the hex SHA-256 fingerprint of a DER certificate,
+// in the form accepted by WSConfig.PinnedFingerprints.
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func parseFingerprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("%w %q", ErrWSBadFingerprint, s)
+	}
+	return b, nil
+}
+
+func (t *WSTransport) serverTLS() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case t.config.CertFile != "" || t.config.KeyFile != "":
+		cert, err = tls.LoadX509KeyPair(t.config.CertFile, t.config.KeyFile)
+	case t.config.SelfSigned:
+		cert, err = generateSelfSignedCert()
+	default:
+		return nil, ErrWSNoCertificate
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
 }
 
-// Listen starts an HTTP server that upgrades connections to WebSocket.
+func (t *WSTransport) clientTLS(host string) (*tls.Config, error) {
+	conf := &tls.Config{
+		RootCAs:    t.config.RootCAs,
+		ServerName: t.config.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = host
+	}
+	if len(t.config.PinnedFingerprints) == 0 {
+		return conf, nil
+	}
+
+	pins := make([][]byte, 0, len(t.config.PinnedFingerprints))
+	for _, s := range t.config.PinnedFingerprints {
+		pin, err := parseFingerprint(s)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	// The pin replaces chain verification: self-signed certificates are
+	// the common case for nodes without a public hostname.
+	conf.InsecureSkipVerify = true
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrWSPinMismatch
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+		return ErrWSPinMismatch
+	}
+	return conf, nil
+}
+
+// Listen starts an HTTP server that upgrades connections on the configured
+// path to WebSocket.
 func (t *WSTransport) Listen(ctx context.Context, addr string) (Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost ws listen: %w", err)
+	}
+
 	l := &wsListener{
-		addr:   addr,
+		ln:     ln,
+		path:   t.config.Path,
 		connCh: make(chan *wsConn, 16),
 		done:   make(chan struct{}),
 	}
 
+	if t.config.TLS {
+		tlsConf, err := t.serverTLS()
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("bifrost ws listen: %w", err)
+		}
+		l.fingerprint = CertFingerprint(tlsConf.Certificates[0].Certificate[0])
+		ln = tls.NewListener(ln, tlsConf)
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(t.config.Path, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != t.config.Path {
+			l.fallback(t.config.Fallback, w, r)
+			return
+		}
 		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-			InsecureSkipVerify: true, // PoC only
+			// Bifrost peers are not browsers; Veil authenticates them.
+			InsecureSkipVerify: true,
 		})
 		if err != nil {
 			return
 		}
+		c.SetReadLimit(types.BifrostFrameHeaderSize + MaxPayloadSize)
 		wc := &wsConn{
 			conn:       c,
-			ctx:        r.Context(),
+			ctx:        context.Background(), // r.Context ends with this handler
 			remoteAddr: func() string { return r.RemoteAddr },
 		}
 		select {
@@ -45,10 +208,20 @@ func (t *WSTransport) Listen(ctx context.Context, addr string) (Listener, error)
 			c.Close(websocket.StatusGoingAway, "listener closed")
 		}
 	})
+	if t.config.Path != "/" {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			l.fallback(t.config.Fallback, w, r)
+		})
+	}
 
-	l.server = &http.Server{Addr: addr, Handler: mux}
+	l.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: wsUpgradeTimeout,
+		// Failed TLS handshakes from scanners are routine on a public port.
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
 	go func() {
-		if err := l.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := l.server.Serve(ln); err != nil && err != http.ErrServerClosed {
 			// Log error in production; for PoC we silently ignore
 		}
 	}()
@@ -56,21 +229,63 @@ func (t *WSTransport) Listen(ctx context.Context, addr string) (Listener, error)
 	return l, nil
 }
 
-// Dial connects to a WebSocket server.
+// Protocol returns "wss" when the transport uses TLS and "ws" otherwise.
+func (t *WSTransport) Protocol() string {
+	if t.config.TLS {
+		return "wss"
+	}
+	return "ws"
+}
+
+// Dial connects to a WebSocket server. addr is "host:port" or
+// "host:port/path".
 func (t *WSTransport) Dial(ctx context.Context, addr string) (Conn, error) {
-	url := fmt.Sprintf("ws://%s/", addr)
-	c, _, err := websocket.Dial(ctx, url, nil)
+	hostPort, path := addr, t.config.Path
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		hostPort, path = addr[:i], addr[i:]
+	}
+
+	scheme := "ws"
+	opts := &websocket.DialOptions{}
+	if t.config.TLS {
+		scheme = "wss"
+		host, _, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("bifrost ws dial: %w", err)
+		}
+		tlsConf, err := t.clientTLS(host)
+		if err != nil {
+			return nil, fmt.Errorf("bifrost ws dial: %w", err)
+		}
+		opts.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConf},
+		}
+	}
+
+	url := fmt.Sprintf("%s://%s%s", scheme, hostPort, path)
+	c, _, err := websocket.Dial(ctx, url, opts)
 	if err != nil {
 		return nil, fmt.Errorf("bifrost ws dial: %w", err)
 	}
-	return &wsConn{conn: c, ctx: ctx, remoteAddr: func() string { return addr }}, nil
+	c.SetReadLimit(types.BifrostFrameHeaderSize + MaxPayloadSize)
+	return &wsConn{conn: c, ctx: context.Background(), remoteAddr: func() string { return addr }}, nil
 }
 
 type wsListener struct {
-	addr   string
-	server *http.Server
-	connCh chan *wsConn
-	done   chan struct{}
+	ln          net.Listener
+	path        string
+	fingerprint string
+	server      *http.Server
+	connCh      chan *wsConn
+	done        chan struct{}
+}
+
+func (l *wsListener) fallback(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
 }
 
 func (l *wsListener) Accept(ctx context.Context) (Conn, error) {
@@ -84,7 +299,18 @@ func (l *wsListener) Accept(ctx context.Context) (Conn, error) {
 	}
 }
 
-func (l *wsListener) Addr() string { return l.addr }
+// Addr returns the bound address, with the path appended when it is not
+// "/" so the result can be passed straight to Dial.
+func (l *wsListener) Addr() string {
+	if l.path == "/" {
+		return l.ln.Addr().String()
+	}
+	return l.ln.Addr().String() + l.path
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate served by
+// a wss listener, or "" for plain ws.
+func (l *wsListener) Fingerprint() string { return l.fingerprint }
 
 func (l *wsListener) Close() error {
 	close(l.done)
@@ -98,36 +324,59 @@ type wsConn struct {
 	ctx        context.Context
 	remoteAddr func() string
 	mu         sync.Mutex
+
+	// Set by setFrameLimits before the conn is handed out.
+	frameTimeout time.Duration
+}
+
+// setFrameLimits caps the WebSocket message size and how long a message
+// may take to arrive once its header has been read.
+func (c *wsConn) setFrameLimits(maxPayload uint32, frameTimeout time.Duration) bool {
+	if maxPayload > 0 && maxPayload < MaxPayloadSize {
+		c.conn.SetReadLimit(types.BifrostFrameHeaderSize + int64(maxPayload))
+	}
+	c.frameTimeout = frameTimeout
+	return true
 }
 
 func (c *wsConn) Send(frame *types.BifrostFrame) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	data, err := frame.MarshalBinary()
-	if err != nil {
-		return err
-	}
+	buf := getBuffer(types.BifrostFrameHeaderSize + len(frame.Payload))
+	defer putBuffer(buf)
+	data := AppendFrame((*buf)[:0], frame)
 	return c.conn.Write(c.ctx, websocket.MessageBinary, data)
 }
 
 func (c *wsConn) Receive() (*types.BifrostFrame, error) {
-	_, data, err := c.conn.Read(c.ctx)
-	if err != nil {
-		return nil, fmt.Errorf("bifrost ws receive: %w", err)
+	if c.frameTimeout <= 0 {
+		_, data, err := c.conn.Read(c.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("bifrost ws receive: %w", err)
+		}
+		return decodeBytes(data)
 	}
 
-	if len(data) < types.BifrostFrameHeaderSize {
-		return nil, fmt.Errorf("bifrost ws: message too short (%d bytes)", len(data))
+	// Wait for the next message without a deadline, then give its body
+	// frameTimeout to arrive. The library closes the conn when a read's
+	// context ends.
+	ctx, cancel := context.WithCancelCause(c.ctx)
+	defer cancel(nil)
+	_, r, err := c.conn.Reader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("bifrost ws receive: %w", err)
 	}
-	if data[0] != types.BifrostMagic[0] || data[1] != types.BifrostMagic[1] {
-		return nil, ErrInvalidMagic
+	timer := time.AfterFunc(c.frameTimeout, func() { cancel(ErrSlowFrame) })
+	data, err := io.ReadAll(r)
+	timer.Stop()
+	if err != nil {
+		if context.Cause(ctx) == ErrSlowFrame {
+			return nil, ErrSlowFrame
+		}
+		return nil, fmt.Errorf("bifrost ws receive: %w", err)
 	}
-
-	return &types.BifrostFrame{
-		Type:    types.FrameType(data[6]),
-		Payload: data[types.BifrostFrameHeaderSize:],
-	}, nil
+	return decodeBytes(data)
 }
 
 func (c *wsConn) RemoteAddr() string {
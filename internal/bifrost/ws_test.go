@@ -0,0 +1,197 @@
+package bifrost_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// wsRoundtrip dials ln with client, accepts, and checks one frame each way.
+func wsRoundtrip(t *testing.T, ctx context.Context, client bifrost.Transport, ln bifrost.Listener) {
+	t.Helper()
+	accepted := make(chan bifrost.Conn, 1)
+	go func() {
+		c, _ := ln.Accept(ctx)
+		accepted <- c
+	}()
+
+	conn, err := client.Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("Accept failed")
+	}
+	// A WebSocket close waits for the peer's close frame, so close both
+	// ends together.
+	defer func() {
+		go server.Close()
+		conn.Close()
+	}()
+
+	if err := conn.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("ping")}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	f, err := server.Receive()
+	if err != nil || string(f.Payload) != "ping" {
+		t.Fatalf("server Receive = %v, %v", f, err)
+	}
+	if err := server.Send(&types.BifrostFrame{Type: types.FrameData, Payload: []byte("pong")}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	f, err = conn.Receive()
+	if err != nil || string(f.Payload) != "pong" {
+		t.Fatalf("client Receive = %v, %v", f, err)
+	}
+}
+
+func fingerprint(t *testing.T, ln bifrost.Listener) string {
+	t.Helper()
+	fp, ok := ln.(interface{ Fingerprint() string })
+	if !ok || fp.Fingerprint() == "" {
+		t.Fatal("listener has no certificate fingerprint")
+	}
+	return fp.Fingerprint()
+}
+
+func TestWSTransportPathAndFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := bifrost.DefaultWSConfig()
+	cfg.Path = "/bifrost"
+	cfg.Fallback = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "other service")
+	})
+	transport := bifrost.NewWSTransportWithConfig(cfg)
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	if !strings.HasSuffix(ln.Addr(), "/bifrost") || strings.HasSuffix(ln.Addr(), ":0/bifrost") {
+		t.Fatalf("Addr = %q, want bound port and path", ln.Addr())
+	}
+	wsRoundtrip(t, ctx, bifrost.NewWSTransport(), ln)
+
+	resp, err := http.Get("http://" + strings.TrimSuffix(ln.Addr(), "/bifrost") + "/health")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "other service" {
+		t.Fatalf("fallback body = %q", body)
+	}
+}
+
+func TestWSSTransportPinnedCertificate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ln, err := bifrost.NewWSTransportWithConfig(bifrost.DefaultWSSConfig()).Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	pinned := bifrost.DefaultWSSConfig()
+	pinned.PinnedFingerprints = []string{fingerprint(t, ln)}
+	wsRoundtrip(t, ctx, bifrost.NewWSTransportWithConfig(pinned), ln)
+
+	wrong := bifrost.DefaultWSSConfig()
+	wrong.PinnedFingerprints = []string{strings.Repeat("ab", 32)}
+	if _, err := bifrost.NewWSTransportWithConfig(wrong).Dial(ctx, ln.Addr()); !errors.Is(err, bifrost.ErrWSPinMismatch) {
+		t.Fatalf("Dial with wrong pin = %v, want ErrWSPinMismatch", err)
+	}
+
+	// Without a pin the self-signed certificate fails CA verification.
+	if _, err := bifrost.NewWSTransportWithConfig(bifrost.DefaultWSSConfig()).Dial(ctx, ln.Addr()); err == nil {
+		t.Fatal("Dial without pin accepted a self-signed certificate")
+	}
+}
+
+func TestWSSTransportCertificateFiles(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	certFile, keyFile, der := writeTestCert(t)
+	cfg := bifrost.WSConfig{TLS: true, CertFile: certFile, KeyFile: keyFile}
+	ln, err := bifrost.NewWSTransportWithConfig(cfg).Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	if got, want := fingerprint(t, ln), bifrost.CertFingerprint(der); got != want {
+		t.Fatalf("fingerprint = %s, want %s", got, want)
+	}
+
+	// Trust the certificate through a CA pool instead of a pin.
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := bifrost.WSConfig{TLS: true, RootCAs: pool, ServerName: "localhost"}
+	wsRoundtrip(t, ctx, bifrost.NewWSTransportWithConfig(client), ln)
+
+	if _, err := bifrost.NewWSTransportWithConfig(bifrost.WSConfig{TLS: true}).Listen(ctx, "127.0.0.1:0"); !errors.Is(err, bifrost.ErrWSNoCertificate) {
+		t.Fatalf("Listen without certificate = %v, want ErrWSNoCertificate", err)
+	}
+}
+
+// writeTestCert writes a self-signed localhost certificate and key as PEM.
+func writeTestCert(t *testing.T) (certFile, keyFile string, der []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, der
+}
@@ -103,3 +103,33 @@ func TestNodeInfoSerialization(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeStateShowsRoutes(t *testing.T) {
+	net, err := demo.NewNetwork(3, 19301)
+	if err != nil {
+		t.Fatalf("NewNetwork: %v", err)
+	}
+	if err := net.DisconnectPair(0, 2); err != nil {
+		t.Fatalf("DisconnectPair: %v", err)
+	}
+	first, last := net.NodeByIndex(0), net.NodeByIndex(2)
+
+	// With the direct link gone, the ping travels through node 1 and the
+	// far end learns the route back.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		if _, err := first.Router.Ping(ctx, last.NodeID()); err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("ping across the mesh never answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	routes := last.GetFullState().Routes
+	if len(routes) != 1 || routes[0].Dest != first.ShortID() || routes[0].NextHop != net.NodeByIndex(1).ShortID() {
+		t.Errorf("routes in node state = %+v", routes)
+	}
+}
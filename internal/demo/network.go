@@ -1,9 +1,11 @@
 package demo
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
+	"github.com/valhalla/valhalla/internal/bifrost"
 	"github.com/valhalla/valhalla/internal/node"
 	"github.com/valhalla/valhalla/internal/types"
 )
@@ -15,26 +17,36 @@ type Network struct {
 	base  int
 }
 
-// NewNetwork creates and connects N nodes starting at basePort.
+// NewNetwork creates and connects N nodes starting at basePort. Their
+// routers talk over an in-process simulated network, each listening at
+// its node's ListenAddr.
 func NewNetwork(count, basePort int) (*Network, error) {
 	net := &Network{
 		Nodes: make([]*node.Node, 0, count),
 		base:  basePort,
 	}
 
+	transport := bifrost.NewRegistry()
+	transport.Register("mem", bifrost.NewSimNetwork(1).Transport("127.0.0.1"))
 	for i := 0; i < count; i++ {
 		n, err := node.NewNode(basePort + i)
 		if err != nil {
 			return nil, fmt.Errorf("create node %d: %w", i, err)
 		}
+		if err := n.Listen(context.Background(), transport, types.NewPathAddr("mem", n.ListenAddr)); err != nil {
+			return nil, fmt.Errorf("start node %d: %w", i, err)
+		}
 		net.Nodes = append(net.Nodes, n)
 	}
 
 	// Connect nodes in a mesh (every node connects to every other)
 	for i, n := range net.Nodes {
 		for j, peer := range net.Nodes {
-			if i != j {
-				n.ConnectPeer(peer)
+			if i == j {
+				continue
+			}
+			if err := n.ConnectPeer(peer); err != nil {
+				return nil, fmt.Errorf("connect node %d: %w", i, err)
 			}
 		}
 	}
@@ -90,9 +102,10 @@ func (n *Network) ReconnectPair(i, j int) error {
 	if i < 0 || i >= len(n.Nodes) || j < 0 || j >= len(n.Nodes) || i == j {
 		return fmt.Errorf("invalid node indices: %d, %d", i, j)
 	}
-	n.Nodes[i].ConnectPeer(n.Nodes[j])
-	n.Nodes[j].ConnectPeer(n.Nodes[i])
-	return nil
+	if err := n.Nodes[i].ConnectPeer(n.Nodes[j]); err != nil {
+		return err
+	}
+	return n.Nodes[j].ConnectPeer(n.Nodes[i])
 }
 
 // NodeInfo returns summary info about a node suitable for API responses.
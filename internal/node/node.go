@@ -1,9 +1,11 @@
 package node
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
+	"github.com/valhalla/valhalla/internal/bifrost"
 	"github.com/valhalla/valhalla/internal/realm"
 	vrune "github.com/valhalla/valhalla/internal/rune"
 	"github.com/valhalla/valhalla/internal/saga"
@@ -16,6 +18,7 @@ type Node struct {
 	Identity    *yggdrasil.Identity
 	PeerTable   *yggdrasil.PeerTable
 	DHT         *yggdrasil.DHT
+	Router      *yggdrasil.Router
 	Cache       *saga.Cache
 	Services    *saga.ServiceRegistry
 	RPCRouter   *realm.RPCRouter
@@ -28,6 +31,7 @@ type Node struct {
 	mu          sync.RWMutex
 	peers       map[types.NodeID]*Node // direct references for in-process demo
 	events      chan types.StackEvent
+	transport   bifrost.Transport // set by Listen
 }
 
 // NewNode creates a new Valhalla node with all layers initialized.
@@ -52,10 +56,41 @@ func NewNode(port int) (*Node, error) {
 		peers:      make(map[types.NodeID]*Node),
 		events:     make(chan types.StackEvent, 256),
 	}
+	n.Router = yggdrasil.NewRouter(id, n.PeerTable, n.DHT, n.events)
 
 	return n, nil
 }
 
+// Listen serves the node's router on transport at addr, which must be a
+// PathAddr the transport accepts, such as a bifrost.Registry's. Peers are
+// accepted until ctx ends, and ConnectPeer dials peers from then on.
+func (n *Node) Listen(ctx context.Context, transport bifrost.Transport, addr types.PathAddr) error {
+	ln, err := transport.Listen(ctx, string(addr))
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", addr, err)
+	}
+	n.Router.SetTransport(transport)
+	n.Router.SetAddrs([]types.PathAddr{types.PathAddr(ln.Addr())})
+	n.mu.Lock()
+	n.transport = transport
+	n.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept(ctx)
+			if err != nil {
+				return
+			}
+			go n.Router.AcceptPeer(ctx, conn)
+		}
+	}()
+	return nil
+}
+
 // NodeID returns this node's identity.
 func (n *Node) NodeID() types.NodeID {
 	return n.Identity.NodeID
@@ -67,20 +102,42 @@ func (n *Node) ShortID() string {
 }
 
 // ConnectPeer establishes a direct in-process connection to another node.
-func (n *Node) ConnectPeer(peer *Node) {
-	n.mu.Lock()
-	n.peers[peer.NodeID()] = peer
-	n.mu.Unlock()
-
-	n.PeerTable.AddPeer(yggdrasil.PeerInfo{
+// Once the node is listening, the router also dials the peer. A peer the
+// peer table refuses is not connected.
+func (n *Node) ConnectPeer(peer *Node) error {
+	addrs := peer.Router.Self().Addrs
+	if len(addrs) == 0 {
+		addrs = []types.PathAddr{types.PathAddr(fmt.Sprintf("/tcp/%s", peer.ListenAddr))}
+	}
+	err := n.PeerTable.AddPeer(yggdrasil.PeerInfo{
 		NodeID:    peer.NodeID(),
 		PublicKey: peer.Identity.PublicKey,
-		Addrs:     []types.PathAddr{types.PathAddr(fmt.Sprintf("/tcp/%s", peer.ListenAddr))},
+		Addrs:     addrs,
 	})
+	if err != nil {
+		return fmt.Errorf("connect peer %s: %w", peer.ShortID(), err)
+	}
+
+	n.mu.Lock()
+	transport := n.transport
+	n.mu.Unlock()
+	if _, ok := n.Router.GetConnection(peer.NodeID()); transport != nil && !ok {
+		ctx, cancel := context.WithTimeout(context.Background(), yggdrasil.DefaultExchangeTimeout)
+		_, err := n.Router.Connect(ctx, addrs[0], peer.NodeID())
+		cancel()
+		if err != nil {
+			return fmt.Errorf("connect peer %s: %w", peer.ShortID(), err)
+		}
+	}
+
+	n.mu.Lock()
+	n.peers[peer.NodeID()] = peer
+	n.mu.Unlock()
 
 	n.EmitEvent("yggdrasil", "peer_connected", map[string]string{
 		"peer": peer.ShortID(),
 	})
+	return nil
 }
 
 // DisconnectPeer removes a peer from this node's connections.
@@ -92,6 +149,9 @@ func (n *Node) DisconnectPeer(peerID types.NodeID) bool {
 
 	if existed {
 		n.PeerTable.RemovePeer(peerID)
+		if conn, ok := n.Router.GetConnection(peerID); ok {
+			conn.Close()
+		}
 		n.EmitEvent("bifrost", "peer_disconnected", map[string]string{
 			"peer": peerID.String()[:12],
 		})
@@ -189,6 +249,7 @@ type FullNodeState struct {
 	TrustOut     []TrustSummary    `json:"trust_out"`
 	CacheSize    int               `json:"cache_size"`
 	PubSubTopics []string          `json:"pubsub_topics"`
+	Routes       []RouteSummary    `json:"routes"`
 }
 
 // PeerSummary is a short summary of a connected peer.
@@ -197,6 +258,15 @@ type PeerSummary struct {
 	NodeID  string `json:"node_id"`
 }
 
+// RouteSummary is a short summary of a learned route.
+type RouteSummary struct {
+	Dest     string  `json:"dest"`
+	NextHop  string  `json:"next_hop"`
+	Hops     int     `json:"hops"`
+	RTTMs    float64 `json:"rtt_ms"`
+	Failures int     `json:"failures"`
+}
+
 // TrustSummary is a short summary of a trust attestation.
 type TrustSummary struct {
 	Attester   string  `json:"attester"`
@@ -235,6 +305,17 @@ func (n *Node) GetFullState() FullNodeState {
 		})
 	}
 
+	var routes []RouteSummary
+	for _, rt := range n.Router.Routes() {
+		routes = append(routes, RouteSummary{
+			Dest:     rt.Dest.String()[:12],
+			NextHop:  rt.NextHop.String()[:12],
+			Hops:     rt.Hops,
+			RTTMs:    float64(rt.RTT.Microseconds()) / 1000,
+			Failures: rt.Failures,
+		})
+	}
+
 	return FullNodeState{
 		NodeID:       n.NodeID().String(),
 		ShortID:      n.ShortID(),
@@ -246,5 +327,6 @@ func (n *Node) GetFullState() FullNodeState {
 		TrustOut:     trustOut,
 		CacheSize:    n.Cache.Size(),
 		PubSubTopics: n.PubSub.Topics(),
+		Routes:       routes,
 	}
 }
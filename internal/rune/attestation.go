@@ -78,16 +78,41 @@ func (a *Attestation) sigBytes() []byte {
 // AttestationStore holds attestations indexed by subject.
 type AttestationStore struct {
 	bySubject map[types.NodeID][]*Attestation
-	mu        sync.RWMutex
+	// predecessor maps a rotated-to NodeID to the identity it succeeded.
+	predecessor map[types.NodeID]types.NodeID
+	mu          sync.RWMutex
 }
 
 // NewAttestationStore creates a new attestation store.
 func NewAttestationStore() *AttestationStore {
 	return &AttestationStore{
-		bySubject: make(map[types.NodeID][]*Attestation),
+		bySubject:   make(map[types.NodeID][]*Attestation),
+		predecessor: make(map[types.NodeID]types.NodeID),
 	}
 }
 
+// AddSuccession records a verified key rotation, so attestations about
+// the old identity also count for its successor. The statement must be
+// signed by the old key and countersigned by the new one: the old key's
+// word alone cannot hand its trust to a key that never claimed it. An
+// identity keeps the first predecessor recorded for it.
+func (s *AttestationStore) AddSuccession(st *yggdrasil.SuccessionStatement) error {
+	if err := st.VerifySuccessor(); err != nil {
+		return fmt.Errorf("rune: succession not countersigned by %s: %w", st.NewID.Short(), err)
+	}
+	if err := st.Verify(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.predecessor[st.NewID]; ok && old != st.OldID {
+		return fmt.Errorf("rune: %s already succeeded %s", st.NewID.Short(), old.Short())
+	}
+	s.predecessor[st.NewID] = st.OldID
+	return nil
+}
+
 // Add stores an attestation after verification.
 func (s *AttestationStore) Add(att *Attestation) error {
 	if err := att.Verify(); err != nil {
@@ -100,18 +125,27 @@ func (s *AttestationStore) Add(att *Attestation) error {
 	return nil
 }
 
-// GetBySubject returns all attestations about a subject.
+// GetBySubject returns all attestations about a subject, including those
+// about identities it succeeded.
 func (s *AttestationStore) GetBySubject(subject types.NodeID) []*Attestation {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	atts := s.bySubject[subject]
-	result := make([]*Attestation, 0, len(atts))
+	result := make([]*Attestation, 0)
 	now := time.Now().UnixMilli()
-	for _, a := range atts {
-		if a.Expires > now {
-			result = append(result, a)
+	seen := make(map[types.NodeID]bool)
+	for id := subject; !seen[id] && len(seen) <= yggdrasil.MaxSuccessionHops; {
+		seen[id] = true
+		for _, a := range s.bySubject[id] {
+			if a.Expires > now {
+				result = append(result, a)
+			}
+		}
+		prev, ok := s.predecessor[id]
+		if !ok {
+			break
 		}
+		id = prev
 	}
 	return result
 }
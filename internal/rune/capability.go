@@ -76,6 +76,15 @@ func (c *Capability) CheckAction(holder types.NodeID, action string) error {
 	return fmt.Errorf("rune: action %q not permitted", action)
 }
 
+// CheckActionVia is CheckAction for a holder that has rotated its key:
+// chain must hand the capability's holder over to holder.
+func (c *Capability) CheckActionVia(holder types.NodeID, action string, chain []*yggdrasil.SuccessionStatement) error {
+	if err := yggdrasil.VerifySuccessionChain(chain, c.Holder, holder); err != nil {
+		return fmt.Errorf("rune: holder mismatch: %w", err)
+	}
+	return c.CheckAction(c.Holder, action)
+}
+
 func (c *Capability) sigBytes() []byte {
 	data := fmt.Appendf(nil, "%x:%x:%s:%v:%d:%d",
 		c.Issuer, c.Holder, c.Resource, c.Delegatable, c.Expires, c.CreatedAt)
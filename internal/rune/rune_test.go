@@ -1,6 +1,7 @@
 package rune_test
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -148,3 +149,76 @@ func TestAttestationStore(t *testing.T) {
 		t.Errorf("claim: got %q, want %q", atts[0].Claim, "is-human")
 	}
 }
+
+func TestTrustFollowsSuccession(t *testing.T) {
+	alice, _ := yggdrasil.GenerateIdentity()
+	bob, _ := yggdrasil.GenerateIdentity()
+	store := vrune.NewAttestationStore()
+	if err := store.Add(vrune.CreateAttestation(alice, bob.NodeID, "is-trusted", 0.9, time.Hour)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	newBob, st, err := bob.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if got := vrune.ComputeTrust(store, alice.NodeID, newBob.NodeID); got != 0 {
+		t.Errorf("trust before succession: got %f, want 0", got)
+	}
+	if err := store.AddSuccession(st); err != nil {
+		t.Fatalf("AddSuccession: %v", err)
+	}
+	if got := len(store.GetBySubject(newBob.NodeID)); got != 1 {
+		t.Errorf("GetBySubject(successor): got %d, want 1", got)
+	}
+	if got, want := vrune.ComputeTrust(store, alice.NodeID, newBob.NodeID), vrune.ComputeTrust(store, alice.NodeID, bob.NodeID); got != want {
+		t.Errorf("successor trust: got %f, want %f", got, want)
+	}
+
+	forged := *st
+	forged.Signature = append([]byte(nil), st.Signature...)
+	forged.Signature[0] ^= 0xff
+	if err := vrune.NewAttestationStore().AddSuccession(&forged); err == nil {
+		t.Error("should reject forged succession")
+	}
+
+	// The old key alone cannot name a successor: here bob re-signs a
+	// statement whose countersignature carol never made.
+	carol, _ := yggdrasil.GenerateIdentity()
+	unagreed, _ := bob.SignSuccession(carol)
+	unagreed.NewSignature = bob.Sign([]byte("not carol"))
+	data, err := unagreed.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	unagreed.Signature = bob.Sign(data)
+	if err := vrune.NewAttestationStore().AddSuccession(unagreed); !errors.Is(err, yggdrasil.ErrInvalidSuccession) {
+		t.Errorf("AddSuccession without countersignature = %v, want ErrInvalidSuccession", err)
+	}
+}
+
+func TestCapabilityFollowsSuccession(t *testing.T) {
+	alice, _ := yggdrasil.GenerateIdentity()
+	bob, _ := yggdrasil.GenerateIdentity()
+	grant := vrune.GrantCapability(alice, bob.NodeID, "/photos/*", []string{"read"}, false, time.Hour)
+
+	bob2, st1, _ := bob.Rotate()
+	bob3, st2, _ := bob2.Rotate()
+	chain := []*yggdrasil.SuccessionStatement{st1, st2}
+
+	if err := grant.CheckAction(bob3.NodeID, "read"); err == nil {
+		t.Error("CheckAction should reject the rotated holder without a chain")
+	}
+	if err := grant.CheckActionVia(bob3.NodeID, "read", chain); err != nil {
+		t.Fatalf("CheckActionVia: %v", err)
+	}
+	if err := grant.CheckActionVia(bob3.NodeID, "write", chain); err == nil {
+		t.Error("should reject unpermitted action")
+	}
+	if err := grant.CheckActionVia(bob3.NodeID, "read", chain[1:]); err == nil {
+		t.Error("should reject a chain not starting at the holder")
+	}
+	if err := grant.CheckActionVia(bob.NodeID, "read", nil); err != nil {
+		t.Errorf("CheckActionVia with empty chain: %v", err)
+	}
+}
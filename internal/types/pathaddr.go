@@ -0,0 +1,129 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidPathAddr is returned when a PathAddr cannot be parsed.
+var ErrInvalidPathAddr = errors.New("invalid path address")
+
+// hostPortProtocols are PathAddr protocols whose address component must be
+// a dialable host:port.
+var hostPortProtocols = map[string]bool{
+	"tcp":  true,
+	"udp":  true,
+	"ws":   true,
+	"wss":  true,
+	"quic": true,
+}
+
+// PathAddrParts are the typed components of a PathAddr.
+//
+//	/ws/example.com:443/bifrost
+//	 └┬┘└─────┬─────┘└┬┘└──┬──┘
+//	Protocol Host   Port  Path
+type PathAddrParts struct {
+	Protocol string
+	Host     string
+	Port     uint16
+	Path     string // remaining segments with leading "/", or ""
+}
+
+// ParsePathAddr splits a PathAddr into its components and validates them.
+// Network protocols (tcp, udp, ws, wss, quic) require a host:port; other
+// protocols take the second segment verbatim as Host.
+func ParsePathAddr(addr PathAddr) (PathAddrParts, error) {
+	return parsePathAddr(addr, false)
+}
+
+// ParseListenAddr is like ParsePathAddr but also accepts port 0, which asks
+// the OS for an ephemeral port.
+func ParseListenAddr(addr PathAddr) (PathAddrParts, error) {
+	return parsePathAddr(addr, true)
+}
+
+func parsePathAddr(addr PathAddr, allowZeroPort bool) (PathAddrParts, error) {
+	s := string(addr)
+	if !strings.HasPrefix(s, "/") {
+		return PathAddrParts{}, fmt.Errorf("%w %q: must start with /", ErrInvalidPathAddr, s)
+	}
+
+	segs := strings.SplitN(s[1:], "/", 3)
+	if len(segs) < 2 || segs[1] == "" {
+		return PathAddrParts{}, fmt.Errorf("%w %q: missing address", ErrInvalidPathAddr, s)
+	}
+
+	parts := PathAddrParts{Protocol: segs[0]}
+	if !validProtocol(parts.Protocol) {
+		return PathAddrParts{}, fmt.Errorf("%w %q: bad protocol %q", ErrInvalidPathAddr, s, parts.Protocol)
+	}
+	if len(segs) == 3 {
+		parts.Path = "/" + segs[2]
+	}
+
+	if !hostPortProtocols[parts.Protocol] {
+		parts.Host = segs[1]
+		return parts, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(segs[1])
+	if err != nil {
+		return PathAddrParts{}, fmt.Errorf("%w %q: %v", ErrInvalidPathAddr, s, err)
+	}
+	if host == "" {
+		return PathAddrParts{}, fmt.Errorf("%w %q: empty host", ErrInvalidPathAddr, s)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || (port == 0 && !allowZeroPort) {
+		return PathAddrParts{}, fmt.Errorf("%w %q: bad port %q", ErrInvalidPathAddr, s, portStr)
+	}
+	parts.Host = host
+	parts.Port = uint16(port)
+	return parts, nil
+}
+
+func validProtocol(p string) bool {
+	if p == "" {
+		return false
+	}
+	for _, c := range p {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Protocol returns the PathAddr's leading protocol segment, or "" if the
+// address is not path-formatted.
+func (p PathAddr) Protocol() string {
+	s := string(p)
+	if !strings.HasPrefix(s, "/") {
+		return ""
+	}
+	proto, _, _ := strings.Cut(s[1:], "/")
+	return proto
+}
+
+// HostPort returns the dialable "host:port" form, or Host alone for
+// protocols without a port.
+func (a PathAddrParts) HostPort() string {
+	if !hostPortProtocols[a.Protocol] {
+		return a.Host
+	}
+	return net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port)))
+}
+
+// PathAddr reassembles the components into canonical form.
+func (a PathAddrParts) PathAddr() PathAddr {
+	return PathAddr("/" + a.Protocol + "/" + a.HostPort() + a.Path)
+}
+
+// NewPathAddr builds a PathAddr from a protocol and a host:port address.
+func NewPathAddr(protocol, hostPort string) PathAddr {
+	return PathAddr("/" + protocol + "/" + hostPort)
+}
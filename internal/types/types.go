@@ -107,6 +107,10 @@ const (
 	FrameControl   FrameType = 0x02
 	FrameKeepalive FrameType = 0x03
 	FrameClose     FrameType = 0x04
+
+	// FrameFlagCompressed is OR-ed into the type byte when the payload is
+	// compressed with a codec negotiated by the Bifrost layer.
+	FrameFlagCompressed FrameType = 0x80
 )
 
 func (ft FrameType) String() string {
@@ -200,4 +204,17 @@ const (
 	MsgFindNode  ProtocolMessageType = 0x02
 	MsgFindValue ProtocolMessageType = 0x03
 	MsgStore     ProtocolMessageType = 0x04
+
+	// MsgPunchRequest asks a rendezvous peer to introduce us to a node for
+	// hole punching; MsgPunchIntro is the introduction it sends that node.
+	MsgPunchRequest ProtocolMessageType = 0x05
+	MsgPunchIntro   ProtocolMessageType = 0x06
+
+	// Circuit relay: a node reserves a slot at a relay, dialers ask the
+	// relay to connect them, the relay opens the circuit at the reserved
+	// node and then forwards data both ways.
+	MsgRelayReserve ProtocolMessageType = 0x07
+	MsgRelayConnect ProtocolMessageType = 0x08
+	MsgRelayOpen    ProtocolMessageType = 0x09
+	MsgRelayData    ProtocolMessageType = 0x0a
 )
@@ -185,3 +185,67 @@ func TestNewStackEvent(t *testing.T) {
 		t.Error("NodeID should be set")
 	}
 }
+
+func TestParsePathAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    PathAddr
+		want    PathAddrParts
+		wantErr bool
+	}{
+		{
+			name: "tcp ipv4",
+			addr: "/tcp/127.0.0.1:9001",
+			want: PathAddrParts{Protocol: "tcp", Host: "127.0.0.1", Port: 9001},
+		},
+		{
+			name: "ws hostname with path",
+			addr: "/ws/example.com:443/bifrost",
+			want: PathAddrParts{Protocol: "ws", Host: "example.com", Port: 443, Path: "/bifrost"},
+		},
+		{
+			name: "udp ipv6",
+			addr: "/udp/[::1]:5000",
+			want: PathAddrParts{Protocol: "udp", Host: "::1", Port: 5000},
+		},
+		{
+			name: "tcp with trailing relay segment",
+			addr: "/tcp/relay.valhalla.net:9000/relay",
+			want: PathAddrParts{Protocol: "tcp", Host: "relay.valhalla.net", Port: 9000, Path: "/relay"},
+		},
+		{
+			name: "non-network protocol keeps opaque host",
+			addr: "/mem/node-7",
+			want: PathAddrParts{Protocol: "mem", Host: "node-7"},
+		},
+		{name: "bare host:port", addr: "127.0.0.1:9001", wantErr: true},
+		{name: "missing address", addr: "/tcp", wantErr: true},
+		{name: "empty address", addr: "/tcp/", wantErr: true},
+		{name: "missing port", addr: "/tcp/127.0.0.1", wantErr: true},
+		{name: "port zero", addr: "/tcp/127.0.0.1:0", wantErr: true},
+		{name: "port out of range", addr: "/tcp/127.0.0.1:70000", wantErr: true},
+		{name: "empty host", addr: "/tcp/:9001", wantErr: true},
+		{name: "uppercase protocol", addr: "/TCP/127.0.0.1:9001", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePathAddr(tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePathAddr: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if rt := got.PathAddr(); rt != tt.addr {
+				t.Errorf("round trip: got %q, want %q", rt, tt.addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package veil
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+
+	"github.com/valhalla/valhalla/internal/types"
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+	"golang.org/x/crypto/curve25519"
+)
+
+// bindingMagic opens every encoded KeyBinding and the data it signs.
+const (
+	bindingMagic = "VBND"
+	bindingSize  = len(bindingMagic) + ed25519.PublicKeySize + ed25519.SignatureSize
+)
+
+var (
+	ErrInvalidBinding = errors.New("veil: invalid key binding")
+	ErrNodeIDMismatch = errors.New("veil: remote key does not belong to the dialed NodeID")
+)
+
+// NoiseKeypairFromIdentity derives the Noise static keypair of an
+// Ed25519 identity, so a node keeps one Noise key for as long as it keeps
+// its NodeID. The private key is the clamped first half of SHA-512(seed),
+// the standard Ed25519-to-X25519 conversion, and the keypair carries a
+// binding signed by the identity.
+func NoiseKeypairFromIdentity(id *yggdrasil.Identity) (*NoiseKeypair, error) {
+	h := sha512.Sum512(id.PrivateKey.Seed())
+	private := h[:curve25519.ScalarSize]
+	private[0] &= 248
+	private[31] &= 127
+	private[31] |= 64
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("veil: derive noise key: %w", err)
+	}
+	return &NoiseKeypair{
+		Private: bytes.Clone(private),
+		Public:  public,
+		Binding: NewKeyBinding(id, public),
+	}, nil
+}
+
+// KeyBinding is an identity's signature over a Noise static key. Peers
+// exchange bindings inside the handshake, so a completed handshake names
+// the NodeID on the other end.
+type KeyBinding struct {
+	PublicKey ed25519.PublicKey
+	Signature []byte
+}
+
+// NewKeyBinding signs noiseKey with id.
+func NewKeyBinding(id *yggdrasil.Identity, noiseKey []byte) *KeyBinding {
+	return &KeyBinding{
+		PublicKey: id.PublicKey,
+		Signature: id.Sign(bindingData(noiseKey)),
+	}
+}
+
+// NodeID returns the NodeID of the binding's identity key.
+func (b *KeyBinding) NodeID() types.NodeID {
+	return types.NodeIDFromPublicKey(b.PublicKey)
+}
+
+// Verify checks that the binding's identity signed noiseKey.
+func (b *KeyBinding) Verify(noiseKey []byte) error {
+	if len(b.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: bad identity key", ErrInvalidBinding)
+	}
+	if !yggdrasil.VerifyWithKey(b.PublicKey, bindingData(noiseKey), b.Signature) {
+		return fmt.Errorf("%w: bad signature", ErrInvalidBinding)
+	}
+	return nil
+}
+
+// MarshalBinary returns the encoding sent as a handshake payload:
+//
+//	"VBND" [identity_key:32] [signature:64]
+func (b *KeyBinding) MarshalBinary() ([]byte, error) {
+	if len(b.PublicKey) != ed25519.PublicKeySize || len(b.Signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: bad key or signature size", ErrInvalidBinding)
+	}
+	buf := make([]byte, 0, bindingSize)
+	buf = append(buf, bindingMagic...)
+	buf = append(buf, b.PublicKey...)
+	return append(buf, b.Signature...), nil
+}
+
+// UnmarshalBinary decodes the encoding produced by MarshalBinary.
+func (b *KeyBinding) UnmarshalBinary(data []byte) error {
+	if len(data) != bindingSize || !bytes.HasPrefix(data, []byte(bindingMagic)) {
+		return fmt.Errorf("%w: not a binding encoding", ErrInvalidBinding)
+	}
+	p := data[len(bindingMagic):]
+	b.PublicKey = ed25519.PublicKey(bytes.Clone(p[:ed25519.PublicKeySize]))
+	b.Signature = bytes.Clone(p[ed25519.PublicKeySize:])
+	return nil
+}
+
+func bindingData(noiseKey []byte) []byte {
+	return append([]byte(bindingMagic), noiseKey...)
+}
+
+// bindingPayload is the handshake payload carrying key's binding, if any.
+func bindingPayload(key *NoiseKeypair) ([]byte, error) {
+	if key.Binding == nil {
+		return nil, nil
+	}
+	return key.Binding.MarshalBinary()
+}
+
+// readBinding verifies the binding a peer sent for its static key. A peer
+// that sent none is anonymous: the zero NodeID.
+func readBinding(payload, peerStatic []byte) (types.NodeID, error) {
+	if len(payload) == 0 {
+		return types.NodeID{}, nil
+	}
+	var b KeyBinding
+	if err := b.UnmarshalBinary(payload); err != nil {
+		return types.NodeID{}, err
+	}
+	if err := b.Verify(peerStatic); err != nil {
+		return types.NodeID{}, err
+	}
+	return b.NodeID(), nil
+}
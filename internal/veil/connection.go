@@ -24,7 +24,9 @@ func NewConnectionManager(localKey *NoiseKeypair, events chan<- types.StackEvent
 	}
 }
 
-// GetOrDial returns an existing connection or establishes a new one.
+// GetOrDial returns an existing connection or establishes a new one. The
+// peer must present a binding proving its Noise key belongs to nodeID;
+// otherwise the connection is closed and ErrNodeIDMismatch returned.
 func (cm *ConnectionManager) GetOrDial(ctx context.Context, nodeID types.NodeID, addr string) (*StreamMux, error) {
 	// Check for existing connection
 	if mux, ok := cm.conns.Load(nodeID); ok {
@@ -43,6 +45,10 @@ func (cm *ConnectionManager) GetOrDial(ctx context.Context, nodeID types.NodeID,
 		rawConn.Close()
 		return nil, fmt.Errorf("veil: handshake with %s: %w", addr, err)
 	}
+	if hs.RemoteNodeID != nodeID {
+		rawConn.Close()
+		return nil, fmt.Errorf("%w: dialed %s at %s", ErrNodeIDMismatch, nodeID.Short(), addr)
+	}
 
 	encConn := NewEncryptedConn(rawConn, hs)
 	mux := NewStreamMux(encConn)
@@ -57,7 +63,8 @@ func (cm *ConnectionManager) GetOrDial(ctx context.Context, nodeID types.NodeID,
 	return mux, nil
 }
 
-// AcceptConnection handles an incoming connection.
+// AcceptConnection handles an incoming connection. The mux's
+// RemoteNodeID reports who the peer proved to be, if anyone.
 func (cm *ConnectionManager) AcceptConnection(rawConn net.Conn) (*StreamMux, []byte, error) {
 	hs, err := PerformHandshakeResponder(rawConn, cm.localKey)
 	if err != nil {
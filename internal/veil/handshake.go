@@ -3,13 +3,13 @@
 package veil
 
 import (
-	"crypto/ed25519"
 	"fmt"
 	"io"
 	"net"
 	"sync"
 
 	"github.com/flynn/noise"
+	"github.com/valhalla/valhalla/internal/types"
 )
 
 // CipherSuite defines the Noise protocol configuration.
@@ -20,16 +20,23 @@ type HandshakeResult struct {
 	SendCipher *noise.CipherState
 	RecvCipher *noise.CipherState
 	RemoteKey  []byte // peer's static public key (Curve25519)
+	// RemoteNodeID is the NodeID whose binding the peer presented for
+	// RemoteKey, or zero if it presented none.
+	RemoteNodeID types.NodeID
 }
 
-// noiseKeypair converts Ed25519 keys to Curve25519 for Noise.
-// For the PoC, we generate separate Noise keypairs.
+// NoiseKeypair is a Curve25519 static keypair for Noise.
 type NoiseKeypair struct {
 	Private []byte
 	Public  []byte
+	// Binding, if set, is sent during the handshake to prove which
+	// NodeID owns Public. NoiseKeypairFromIdentity sets it.
+	Binding *KeyBinding
 }
 
-// GenerateNoiseKeypair generates a Curve25519 keypair for Noise.
+// GenerateNoiseKeypair generates a random Curve25519 keypair for Noise,
+// bound to no identity. Use NoiseKeypairFromIdentity for a keypair
+// peers can tie to a NodeID.
 func GenerateNoiseKeypair() (*NoiseKeypair, error) {
 	kp, err := CipherSuite.GenerateKeypair(nil)
 	if err != nil {
@@ -68,13 +75,21 @@ func PerformHandshakeInitiator(conn net.Conn, localKey *NoiseKeypair) (*Handshak
 	if err != nil {
 		return nil, err
 	}
-	_, _, _, err = hs.ReadMessage(nil, msg2)
+	payload2, _, _, err := hs.ReadMessage(nil, msg2)
 	if err != nil {
 		return nil, fmt.Errorf("veil: read msg2: %w", err)
 	}
+	remoteID, err := readBinding(payload2, hs.PeerStatic())
+	if err != nil {
+		return nil, err
+	}
 
-	// Message 3: Initiator sends static key
-	msg3, sendCS, recvCS, err := hs.WriteMessage(nil, nil)
+	// Message 3: Initiator sends static key and its binding
+	binding, err := bindingPayload(localKey)
+	if err != nil {
+		return nil, err
+	}
+	msg3, sendCS, recvCS, err := hs.WriteMessage(nil, binding)
 	if err != nil {
 		return nil, fmt.Errorf("veil: write msg3: %w", err)
 	}
@@ -83,9 +98,10 @@ func PerformHandshakeInitiator(conn net.Conn, localKey *NoiseKeypair) (*Handshak
 	}
 
 	return &HandshakeResult{
-		SendCipher: sendCS,
-		RecvCipher: recvCS,
-		RemoteKey:  hs.PeerStatic(),
+		SendCipher:   sendCS,
+		RecvCipher:   recvCS,
+		RemoteKey:    hs.PeerStatic(),
+		RemoteNodeID: remoteID,
 	}, nil
 }
 
@@ -111,8 +127,12 @@ func PerformHandshakeResponder(conn net.Conn, localKey *NoiseKeypair) (*Handshak
 		return nil, fmt.Errorf("veil: read msg1: %w", err)
 	}
 
-	// Message 2: Responder sends ephemeral + static keys
-	msg2, _, _, err := hs.WriteMessage(nil, nil)
+	// Message 2: Responder sends ephemeral + static keys and its binding
+	binding, err := bindingPayload(localKey)
+	if err != nil {
+		return nil, err
+	}
+	msg2, _, _, err := hs.WriteMessage(nil, binding)
 	if err != nil {
 		return nil, fmt.Errorf("veil: write msg2: %w", err)
 	}
@@ -125,15 +145,20 @@ func PerformHandshakeResponder(conn net.Conn, localKey *NoiseKeypair) (*Handshak
 	if err != nil {
 		return nil, err
 	}
-	_, recvCS, sendCS, err := hs.ReadMessage(nil, msg3)
+	payload3, recvCS, sendCS, err := hs.ReadMessage(nil, msg3)
 	if err != nil {
 		return nil, fmt.Errorf("veil: read msg3: %w", err)
 	}
+	remoteID, err := readBinding(payload3, hs.PeerStatic())
+	if err != nil {
+		return nil, err
+	}
 
 	return &HandshakeResult{
-		SendCipher: sendCS,
-		RecvCipher: recvCS,
-		RemoteKey:  hs.PeerStatic(),
+		SendCipher:   sendCS,
+		RecvCipher:   recvCS,
+		RemoteKey:    hs.PeerStatic(),
+		RemoteNodeID: remoteID,
 	}, nil
 }
 
@@ -162,16 +187,13 @@ func readFrame(conn net.Conn) ([]byte, error) {
 	return data, nil
 }
 
-// Placeholder for mapping Noise keys to Ed25519 NodeIDs.
-// In production, you'd derive Curve25519 from Ed25519 or use a lookup.
-var _ ed25519.PublicKey
-
 // EncryptedConn wraps a net.Conn with Noise encryption.
 type EncryptedConn struct {
 	raw       net.Conn
 	sendCS    *noise.CipherState
 	recvCS    *noise.CipherState
 	remoteKey []byte
+	remoteID  types.NodeID
 	sendMu    sync.Mutex
 	recvMu    sync.Mutex
 }
@@ -183,6 +205,7 @@ func NewEncryptedConn(raw net.Conn, hs *HandshakeResult) *EncryptedConn {
 		sendCS:    hs.SendCipher,
 		recvCS:    hs.RecvCipher,
 		remoteKey: hs.RemoteKey,
+		remoteID:  hs.RemoteNodeID,
 	}
 }
 
@@ -219,6 +242,12 @@ func (c *EncryptedConn) Close() error {
 	return c.raw.Close()
 }
 
+// RemoteNodeID returns the NodeID the peer proved in the handshake, or
+// zero if it presented no binding.
+func (c *EncryptedConn) RemoteNodeID() types.NodeID {
+	return c.remoteID
+}
+
 // RemoteAddr returns the remote address of the underlying connection.
 func (c *EncryptedConn) RemoteAddr() string {
 	return c.raw.RemoteAddr().String()
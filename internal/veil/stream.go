@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+
+	"github.com/valhalla/valhalla/internal/types"
 )
 
 // Stream represents a multiplexed stream over an encrypted connection.
@@ -150,3 +152,9 @@ func (m *StreamMux) Close() error {
 func (m *StreamMux) Done() <-chan struct{} {
 	return m.done
 }
+
+// RemoteNodeID returns the NodeID the peer proved in the handshake, or
+// zero if it presented no binding.
+func (m *StreamMux) RemoteNodeID() types.NodeID {
+	return m.conn.RemoteNodeID()
+}
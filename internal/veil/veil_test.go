@@ -2,13 +2,17 @@ package veil_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/valhalla/valhalla/internal/types"
 	"github.com/valhalla/valhalla/internal/veil"
+	"github.com/valhalla/valhalla/internal/yggdrasil"
 )
 
 func TestNoiseHandshakeAndEncryption(t *testing.T) {
@@ -253,3 +257,164 @@ func TestDeriveStreamKey(t *testing.T) {
 		t.Errorf("key length: got %d, want 16", len(key16))
 	}
 }
+
+func TestNoiseKeypairFromIdentity(t *testing.T) {
+	id, _ := yggdrasil.GenerateIdentity()
+	a, err := veil.NoiseKeypairFromIdentity(id)
+	if err != nil {
+		t.Fatalf("NoiseKeypairFromIdentity: %v", err)
+	}
+	b, _ := veil.NoiseKeypairFromIdentity(id)
+	if !bytes.Equal(a.Private, b.Private) || !bytes.Equal(a.Public, b.Public) {
+		t.Error("same identity should derive the same Noise key")
+	}
+	other, _ := yggdrasil.GenerateIdentity()
+	c, _ := veil.NoiseKeypairFromIdentity(other)
+	if bytes.Equal(a.Public, c.Public) {
+		t.Error("different identities derived the same Noise key")
+	}
+
+	if err := a.Binding.Verify(a.Public); err != nil {
+		t.Errorf("binding: %v", err)
+	}
+	if a.Binding.NodeID() != id.NodeID {
+		t.Error("binding names the wrong NodeID")
+	}
+	if err := a.Binding.Verify(c.Public); err == nil {
+		t.Error("binding should not verify for another Noise key")
+	}
+}
+
+// handshake runs the initiator and responder handshakes over TCP.
+func handshake(t *testing.T, initiatorKey, responderKey *veil.NoiseKeypair) (init, resp *veil.HandshakeResult, initErr, respErr error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rawConn, err := ln.Accept()
+		if err != nil {
+			respErr = err
+			return
+		}
+		t.Cleanup(func() { rawConn.Close() })
+		resp, respErr = veil.PerformHandshakeResponder(rawConn, responderKey)
+		if respErr != nil {
+			rawConn.Close()
+		}
+	}()
+
+	rawConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { rawConn.Close() })
+	init, initErr = veil.PerformHandshakeInitiator(rawConn, initiatorKey)
+	if initErr != nil {
+		rawConn.Close()
+	}
+	wg.Wait()
+	return init, resp, initErr, respErr
+}
+
+func TestHandshakeBindsNodeIDs(t *testing.T) {
+	alice, _ := yggdrasil.GenerateIdentity()
+	bob, _ := yggdrasil.GenerateIdentity()
+	aliceKey, _ := veil.NoiseKeypairFromIdentity(alice)
+	bobKey, _ := veil.NoiseKeypairFromIdentity(bob)
+	anonKey, _ := veil.GenerateNoiseKeypair()
+
+	init, resp, initErr, respErr := handshake(t, aliceKey, bobKey)
+	if initErr != nil || respErr != nil {
+		t.Fatalf("handshake: %v, %v", initErr, respErr)
+	}
+	if init.RemoteNodeID != bob.NodeID || resp.RemoteNodeID != alice.NodeID {
+		t.Errorf("handshake proved %s and %s, want bob and alice", init.RemoteNodeID.Short(), resp.RemoteNodeID.Short())
+	}
+
+	init, _, initErr, respErr = handshake(t, aliceKey, anonKey)
+	if initErr != nil || respErr != nil {
+		t.Fatalf("handshake with unbound key: %v, %v", initErr, respErr)
+	}
+	if init.RemoteNodeID != (types.NodeID{}) {
+		t.Error("unbound peer should have the zero NodeID")
+	}
+
+	// Bob presents a binding for a Noise key he does not hold.
+	stolen := *bobKey
+	stolen.Binding = aliceKey.Binding
+	_, _, initErr, _ = handshake(t, anonKey, &stolen)
+	if !errors.Is(initErr, veil.ErrInvalidBinding) {
+		t.Errorf("handshake with stolen binding = %v, want ErrInvalidBinding", initErr)
+	}
+}
+
+func TestGetOrDialVerifiesNodeID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	serve := func(key *veil.NoiseKeypair) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		cm := veil.NewConnectionManager(key, nil)
+		go func() {
+			for {
+				rawConn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				// The mux closes when the dialer hangs up.
+				cm.AcceptConnection(rawConn)
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	alice, _ := yggdrasil.GenerateIdentity()
+	bob, _ := yggdrasil.GenerateIdentity()
+	carol, _ := yggdrasil.GenerateIdentity()
+	aliceKey, _ := veil.NoiseKeypairFromIdentity(alice)
+	bobKey, _ := veil.NoiseKeypairFromIdentity(bob)
+	anonKey, _ := veil.GenerateNoiseKeypair()
+	bobAddr := serve(bobKey)
+	anonAddr := serve(anonKey)
+
+	cm := veil.NewConnectionManager(aliceKey, nil)
+	tests := []struct {
+		name   string
+		nodeID types.NodeID
+		addr   string
+		ok     bool
+	}{
+		{"wrong NodeID", carol.NodeID, bobAddr, false},
+		{"unbound peer", bob.NodeID, anonAddr, false},
+		{"dialed NodeID", bob.NodeID, bobAddr, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, err := cm.GetOrDial(ctx, tt.nodeID, tt.addr)
+			if !tt.ok {
+				if !errors.Is(err, veil.ErrNodeIDMismatch) {
+					t.Errorf("GetOrDial = %v, want ErrNodeIDMismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetOrDial: %v", err)
+			}
+			defer mux.Close()
+			if mux.RemoteNodeID() != tt.nodeID {
+				t.Errorf("mux RemoteNodeID = %s", mux.RemoteNodeID().Short())
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package yggdrasil
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// messageDomain separates message signatures from every other use of a
+// node's key.
+const messageDomain = "valhalla-msg-v1"
+
+// MaxMessageAge is how far a message's Timestamp may be from our clock,
+// in either direction, before the message is rejected.
+const MaxMessageAge = 2 * time.Minute
+
+var (
+	ErrBadSignature = errors.New("yggdrasil: invalid message signature")
+	ErrStaleMessage = errors.New("yggdrasil: message timestamp out of range")
+	ErrReplay       = errors.New("yggdrasil: replayed message")
+)
+
+// signedBytes is the canonical encoding a message signature covers. TTL,
+// Via and Trace are left out because relays change them.
+//
+//	domain [type:1] [from:32] [to:32] [timestamp:8] [nonce:8] [id:8]
+//	[response:1] [error_len:4] [error] [payload_len:4] [payload]
+func (m *Message) signedBytes() []byte {
+	buf := make([]byte, 0, len(messageDomain)+98+len(m.Error)+len(m.Payload))
+	buf = append(buf, messageDomain...)
+	buf = append(buf, byte(m.Type))
+	buf = append(buf, m.From[:]...)
+	buf = append(buf, m.To[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(m.Timestamp))
+	buf = binary.BigEndian.AppendUint64(buf, m.Nonce)
+	buf = binary.BigEndian.AppendUint64(buf, m.ID)
+	if m.Response {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Error)))
+	buf = append(buf, m.Error...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Payload)))
+	return append(buf, m.Payload...)
+}
+
+// sign stamps msg with a fresh nonce and timestamp and signs it as id.
+func (m *Message) sign(id *Identity) {
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	m.From = id.NodeID
+	m.PubKey = id.PublicKey
+	m.Nonce = binary.BigEndian.Uint64(nonce[:])
+	m.Timestamp = time.Now().UnixMilli()
+	m.Sig = id.Sign(m.signedBytes())
+}
+
+// verifyMessage checks that msg was signed by the node in From, recently,
+// and has not been seen before.
+func (r *Router) verifyMessage(msg *Message) error {
+	if err := msg.verifySignature(); err != nil {
+		return err
+	}
+	now := time.Now()
+	sent := time.UnixMilli(msg.Timestamp)
+	age := now.Sub(sent)
+	if age > MaxMessageAge || age < -MaxMessageAge {
+		return fmt.Errorf("%w: %v old", ErrStaleMessage, age.Round(time.Second))
+	}
+	if !r.nonces.add(msg.From, msg.Nonce, sent, now) {
+		return fmt.Errorf("%w from %s", ErrReplay, msg.From.Short())
+	}
+	return nil
+}
+
+// verifySignature checks that msg was signed by the node in From.
+func (m *Message) verifySignature() error {
+	if len(m.PubKey) != ed25519.PublicKeySize || types.NodeIDFromPublicKey(m.PubKey) != m.From {
+		return fmt.Errorf("%w: key does not match sender %s", ErrBadSignature, m.From.Short())
+	}
+	if !VerifyWithKey(m.PubKey, m.signedBytes(), m.Sig) {
+		return fmt.Errorf("%w from %s", ErrBadSignature, m.From.Short())
+	}
+	return nil
+}
+
+// nonceCache remembers (sender, nonce) pairs until the message they came
+// with is older than MaxMessageAge. From then on verifyMessage rejects a
+// replay as stale, so the pair can be forgotten; nothing younger is ever
+// evicted.
+type nonceCache struct {
+	seen      map[nonceKey]time.Time // when each pair may be forgotten
+	nextSweep time.Time
+	mu        sync.Mutex
+}
+
+type nonceKey struct {
+	from  types.NodeID
+	nonce uint64
+}
+
+// nonceSweepInterval is how often add drops expired pairs.
+const nonceSweepInterval = MaxMessageAge / 4
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[nonceKey]time.Time)}
+}
+
+// add records a nonce from a message sent at sent and reports whether it
+// was new.
+func (c *nonceCache) add(from types.NodeID, nonce uint64, sent, now time.Time) bool {
+	key := nonceKey{from, nonce}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.nextSweep) {
+		for k, expires := range c.seen {
+			if now.After(expires) {
+				delete(c.seen, k)
+			}
+		}
+		c.nextSweep = now.Add(nonceSweepInterval)
+	}
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = sent.Add(MaxMessageAge)
+	return true
+}
@@ -0,0 +1,186 @@
+package yggdrasil
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+func TestHandleIncomingVerifiesSender(t *testing.T) {
+	self, _ := GenerateIdentity()
+	alice, _ := GenerateIdentity()
+	mallory, _ := GenerateIdentity()
+	const msgTest types.ProtocolMessageType = 0x70
+
+	signed := func(from *Identity) *Message {
+		msg := &Message{Type: msgTest, To: self.NodeID, Payload: []byte("hello"), TTL: 1}
+		msg.sign(from)
+		return msg
+	}
+
+	tests := []struct {
+		name    string
+		msg     func() *Message
+		wantErr error
+	}{
+		{
+			name:    "valid",
+			msg:     func() *Message { return signed(alice) },
+			wantErr: nil,
+		},
+		{
+			name:    "unsigned",
+			msg:     func() *Message { return &Message{Type: msgTest, From: alice.NodeID, To: self.NodeID} },
+			wantErr: ErrBadSignature,
+		},
+		{
+			name: "spoofed From",
+			msg: func() *Message {
+				msg := signed(mallory)
+				msg.From = alice.NodeID
+				return msg
+			},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name: "spoofed From with victim's key",
+			msg: func() *Message {
+				msg := signed(mallory)
+				msg.From, msg.PubKey = alice.NodeID, alice.PublicKey
+				return msg
+			},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name: "tampered payload",
+			msg: func() *Message {
+				msg := signed(alice)
+				msg.Payload = []byte("HELLO")
+				return msg
+			},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name: "flipped to response",
+			msg: func() *Message {
+				msg := signed(alice)
+				msg.Response = true
+				return msg
+			},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name: "stale",
+			msg: func() *Message {
+				msg := signed(alice)
+				msg.Timestamp = time.Now().Add(-2 * MaxMessageAge).UnixMilli()
+				msg.Sig = alice.Sign(msg.signedBytes())
+				return msg
+			},
+			wantErr: ErrStaleMessage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(self, NewPeerTable(self.NodeID), nil, nil)
+			handled := 0
+			r.RegisterHandler(msgTest, func(*Message) (*Message, error) {
+				handled++
+				return nil, nil
+			})
+
+			err := r.HandleIncoming(tt.msg())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("HandleIncoming = %v, want %v", err, tt.wantErr)
+			}
+			want := 0
+			if tt.wantErr == nil {
+				want = 1
+			}
+			if handled != want {
+				t.Errorf("handler ran %d times, want %d", handled, want)
+			}
+		})
+	}
+}
+
+func TestHandleIncomingRejectsReplay(t *testing.T) {
+	self, _ := GenerateIdentity()
+	alice, _ := GenerateIdentity()
+	r := NewRouter(self, NewPeerTable(self.NodeID), nil, nil)
+
+	msg := &Message{Type: types.MsgPing, To: self.NodeID}
+	msg.sign(alice)
+	if err := r.HandleIncoming(msg); err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	replay := *msg
+	replay.TTL = 7 // relays may change TTL without breaking the signature
+	if err := r.HandleIncoming(&replay); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replay = %v, want ErrReplay", err)
+	}
+}
+
+func TestNonceCacheExpiresByAge(t *testing.T) {
+	c := newNonceCache()
+	var from types.NodeID
+	start := time.Now()
+
+	// A burst far larger than any count bound must all stay remembered
+	// while the messages are fresh.
+	const burst = 100000
+	for n := uint64(0); n < burst; n++ {
+		if !c.add(from, n, start, start) {
+			t.Fatalf("nonce %d reported as seen", n)
+		}
+	}
+	later := start.Add(MaxMessageAge - time.Second)
+	if c.add(from, 0, start, later) {
+		t.Error("nonce forgotten inside MaxMessageAge")
+	}
+	if !c.add(from, burst, later, later) {
+		t.Error("new nonce reported as seen")
+	}
+
+	// Once the burst is stale it is swept; the younger nonce stays.
+	after := start.Add(MaxMessageAge + nonceSweepInterval + time.Second)
+	if !c.add(from, burst+1, after, after) {
+		t.Error("new nonce reported as seen")
+	}
+	if c.add(from, burst, later, after) {
+		t.Error("nonce still inside MaxMessageAge was forgotten")
+	}
+	if len(c.seen) != 2 {
+		t.Errorf("cache holds %d nonces, want 2", len(c.seen))
+	}
+}
+
+func TestTraceProbeVerifiedBeforeReply(t *testing.T) {
+	self, _ := GenerateIdentity()
+	alice, _ := GenerateIdentity()
+	mallory, _ := GenerateIdentity()
+	target, _ := GenerateIdentity()
+
+	probe := func(from *Identity) *Message {
+		msg := &Message{Type: types.MsgPing, To: target.NodeID, ID: 1, Trace: true}
+		msg.sign(from)
+		return msg
+	}
+	r := NewRouter(self, NewPeerTable(self.NodeID), nil, nil)
+
+	valid := probe(alice)
+	if err := r.HandleIncoming(valid); err != nil {
+		t.Fatalf("valid probe: %v", err)
+	}
+	if err := r.HandleIncoming(valid); !errors.Is(err, ErrReplay) {
+		t.Errorf("replayed probe = %v, want ErrReplay", err)
+	}
+	spoofed := probe(mallory)
+	spoofed.From = alice.NodeID
+	if err := r.HandleIncoming(spoofed); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("spoofed probe = %v, want ErrBadSignature", err)
+	}
+}
@@ -2,6 +2,7 @@ package yggdrasil
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,29 +14,129 @@ import (
 type BootstrapConfig struct {
 	BootstrapAddrs []types.PathAddr
 	Transport      bifrost.Transport
+
+	// MaxAttempts is how many times each bootstrap address is dialed
+	// before it is given up on.
+	MaxAttempts int
+	// InitialBackoff is the wait after the first failed attempt; each
+	// further failure doubles it, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
 }
 
-// Bootstrap connects to bootstrap nodes and populates the peer table.
-func Bootstrap(ctx context.Context, identity *Identity, peers *PeerTable, router *Router, config BootstrapConfig) error {
+// Bootstrap defaults, used for zero BootstrapConfig fields.
+const (
+	DefaultBootstrapAttempts = 5
+	DefaultBootstrapBackoff  = 500 * time.Millisecond
+	DefaultBootstrapMaxWait  = 30 * time.Second
+)
+
+// ErrBootstrapFailed is returned when no bootstrap node could be reached.
+var ErrBootstrapFailed = errors.New("yggdrasil: no bootstrap node reachable")
+
+// BootstrapResult describes what a Bootstrap run achieved.
+type BootstrapResult struct {
+	// Connected lists the bootstrap nodes whose identity was verified.
+	Connected []PeerInfo
+	// Failed lists bootstrap addresses that stayed unreachable.
+	Failed []types.PathAddr
+	// Discovered is how many peers the self-lookup added to the table.
+	Discovered int
+	// PeerCount is the size of the peer table afterwards.
+	PeerCount int
+}
+
+// Bootstrap connects to the bootstrap nodes, proving our identity and
+// verifying theirs, then runs a self-lookup (FIND_NODE on our own NodeID)
+// to fill the peer table. Bootstrap addresses are tried concurrently, each
+// with exponential backoff between attempts.
+func Bootstrap(ctx context.Context, identity *Identity, peers *PeerTable, router *Router, config BootstrapConfig) (*BootstrapResult, error) {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultBootstrapAttempts
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = DefaultBootstrapBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultBootstrapMaxWait
+	}
+	if config.Transport != nil {
+		router.SetTransport(config.Transport)
+	}
+
+	type outcome struct {
+		addr types.PathAddr
+		peer PeerInfo
+		err  error
+	}
+	results := make(chan outcome, len(config.BootstrapAddrs))
 	for _, addr := range config.BootstrapAddrs {
+		go func() {
+			peer, err := connectWithBackoff(ctx, router, addr, config)
+			results <- outcome{addr, peer, err}
+		}()
+	}
+
+	result := &BootstrapResult{}
+	for range config.BootstrapAddrs {
+		o := <-results
+		if o.err != nil {
+			result.Failed = append(result.Failed, o.addr)
+			continue
+		}
+		result.Connected = append(result.Connected, o.peer)
+		router.emitEvent("bootstrap_connected", map[string]string{
+			"peer": o.peer.NodeID.Short(),
+			"addr": string(o.addr),
+		})
+	}
+	if len(result.Connected) == 0 {
+		return result, ErrBootstrapFailed
+	}
+
+	before := peers.Size()
+	if router.dht != nil {
+		if _, err := router.dht.LookupNode(ctx, identity.NodeID); err != nil {
+			result.PeerCount = peers.Size()
+			return result, fmt.Errorf("yggdrasil: self-lookup: %w", err)
+		}
+	}
+	result.PeerCount = peers.Size()
+	result.Discovered = result.PeerCount - before
+	return result, nil
+}
+
+// connectWithBackoff retries router.Connect until it succeeds, attempts
+// run out or ctx ends.
+func connectWithBackoff(ctx context.Context, router *Router, addr types.PathAddr, config BootstrapConfig) (PeerInfo, error) {
+	backoff := config.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
 		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		conn, err := config.Transport.Dial(dialCtx, string(addr))
+		var peer PeerInfo
+		peer, err = router.Connect(dialCtx, addr, types.NodeID{})
 		cancel()
-
-		if err != nil {
-			continue // skip unreachable bootstrap nodes
+		if err == nil {
+			return peer, nil
+		}
+		if attempt == config.MaxAttempts {
+			return PeerInfo{}, err
 		}
 
-		// In a full implementation, we'd exchange identity info.
-		// For the PoC, we register the connection via the router
-		// and discovery happens through direct peer exchange.
-		_ = conn
-		fmt.Printf("Connected to bootstrap: %s\n", addr)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return PeerInfo{}, ctx.Err()
+		}
+		backoff = min(backoff*2, config.MaxBackoff)
 	}
-	return nil
 }
 
-// ConnectPeer establishes a Bifrost connection to a known peer.
+// ConnectPeer establishes a Bifrost connection to a known peer. Addresses
+// are PathAddrs; pass a bifrost.Registry to reach peers over any of the
+// protocols they advertise.
 func ConnectPeer(ctx context.Context, transport bifrost.Transport, router *Router, peer PeerInfo) error {
 	if len(peer.Addrs) == 0 {
 		return fmt.Errorf("yggdrasil: peer %s has no addresses", peer.NodeID.Short())
@@ -43,7 +144,7 @@ func ConnectPeer(ctx context.Context, transport bifrost.Transport, router *Route
 
 	for _, addr := range peer.Addrs {
 		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		conn, err := transport.Dial(dialCtx, string(addr))
+		conn, err := bifrost.DialPath(dialCtx, transport, addr)
 		cancel()
 
 		if err != nil {
@@ -0,0 +1,230 @@
+package yggdrasil_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+)
+
+// simPair returns both ends of a connection between two sim hosts.
+func simPair(t *testing.T, ctx context.Context) (bifrost.Conn, bifrost.Conn) {
+	t.Helper()
+	network := bifrost.NewSimNetwork(1)
+	ln, err := network.Transport("a").Listen(ctx, "a:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan bifrost.Conn, 1)
+	go func() {
+		conn, err := ln.Accept(ctx)
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	dialed, err := network.Transport("b").Dial(ctx, ln.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dialed.Close() })
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return dialed, conn
+	case <-ctx.Done():
+		t.Fatal("accept timed out")
+		return nil, nil
+	}
+}
+
+func TestExchangeIdentity(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a, _ := yggdrasil.GenerateIdentity()
+	b, _ := yggdrasil.GenerateIdentity()
+	connA, connB := simPair(t, ctx)
+
+	addrs := []types.PathAddr{"/mem/b:1"}
+	done := make(chan yggdrasil.PeerInfo, 1)
+	go func() {
+		peer, err := yggdrasil.ExchangeIdentity(ctx, b, addrs, connB)
+		if err != nil {
+			t.Errorf("b: %v", err)
+		}
+		done <- peer
+	}()
+
+	gotB, err := yggdrasil.ExchangeIdentity(ctx, a, nil, connA)
+	if err != nil {
+		t.Fatalf("a: %v", err)
+	}
+	gotA := <-done
+
+	if gotB.NodeID != b.NodeID || len(gotB.Addrs) != 1 || gotB.Addrs[0] != addrs[0] {
+		t.Errorf("a learned %+v, want b with %v", gotB, addrs)
+	}
+	if gotA.NodeID != a.NodeID {
+		t.Errorf("b learned %s, want %s", gotA.NodeID.Short(), a.NodeID.Short())
+	}
+}
+
+func TestExchangeIdentityRejectsImpostor(t *testing.T) {
+	victim, _ := yggdrasil.GenerateIdentity()
+	mallory, _ := yggdrasil.GenerateIdentity()
+
+	tests := []struct {
+		name  string
+		hello map[string]any
+	}{
+		{
+			name:  "NodeID not derived from key",
+			hello: map[string]any{"node_id": victim.NodeID, "public_key": mallory.PublicKey},
+		},
+		{
+			name:  "cannot sign for claimed key",
+			hello: map[string]any{"node_id": victim.NodeID, "public_key": victim.PublicKey},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			honest, _ := yggdrasil.GenerateIdentity()
+			connA, connB := simPair(t, ctx)
+
+			// Mallory plays the protocol by hand, signing with its own key.
+			go func() {
+				nonce := make([]byte, 32)
+				rand.Read(nonce)
+				tt.hello["nonce"] = nonce
+				sendTestJSON(connB, tt.hello)
+				frame, err := connB.Receive()
+				if err != nil {
+					return
+				}
+				var theirs struct {
+					Nonce []byte `json:"nonce"`
+				}
+				json.Unmarshal(frame.Payload, &theirs)
+				transcript := append([]byte("valhalla-identity-v1"), theirs.Nonce...)
+				transcript = append(transcript, nonce...)
+				sendTestJSON(connB, map[string]any{"signature": mallory.Sign(transcript)})
+			}()
+
+			_, err := yggdrasil.ExchangeIdentity(ctx, honest, nil, connA)
+			if !errors.Is(err, yggdrasil.ErrIdentityProof) {
+				t.Fatalf("err = %v, want ErrIdentityProof", err)
+			}
+		})
+	}
+}
+
+func sendTestJSON(conn bifrost.Conn, v any) {
+	data, _ := json.Marshal(v)
+	conn.Send(&types.BifrostFrame{Type: types.FrameData, Payload: data})
+}
+
+func TestConnectRejectsUnexpectedNodeID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 2)
+
+	other, _ := yggdrasil.GenerateIdentity()
+	_, err := nodes[1].router.Connect(ctx, nodes[0].addr, other.NodeID)
+	if !errors.Is(err, yggdrasil.ErrIdentityMismatch) {
+		t.Fatalf("err = %v, want ErrIdentityMismatch", err)
+	}
+	if _, ok := nodes[1].router.GetConnection(nodes[0].id.NodeID); ok {
+		t.Error("mismatched connection was registered")
+	}
+}
+
+func TestBootstrapDiscoversPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 20)
+	joiner := startSimNode(t, ctx, nodes[0].network, "joiner")
+
+	result, err := yggdrasil.Bootstrap(ctx, joiner.id, joiner.peers, joiner.router, yggdrasil.BootstrapConfig{
+		BootstrapAddrs: []types.PathAddr{nodes[0].addr, "/mem/nowhere:1"},
+		MaxAttempts:    2,
+		InitialBackoff: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+
+	if len(result.Connected) != 1 || result.Connected[0].NodeID != nodes[0].id.NodeID {
+		t.Errorf("Connected = %v, want node 0", result.Connected)
+	}
+	if len(result.Failed) != 1 || result.Failed[0] != "/mem/nowhere:1" {
+		t.Errorf("Failed = %v, want the unreachable address", result.Failed)
+	}
+	if result.Discovered == 0 {
+		t.Error("self-lookup discovered no peers")
+	}
+	if result.PeerCount != joiner.peers.Size() {
+		t.Errorf("PeerCount = %d, table has %d", result.PeerCount, joiner.peers.Size())
+	}
+
+	// The bootstrap node learned the joiner's verified identity.
+	if _, ok := nodes[0].peers.GetPeer(joiner.id.NodeID); !ok {
+		t.Error("bootstrap node did not add the joiner")
+	}
+}
+
+func TestBootstrapRetriesWithBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 2)
+	network := nodes[0].network
+	joiner := startSimNode(t, ctx, network, "joiner")
+
+	network.Partition([]string{"joiner"}, []string{"n0", "n1"})
+	time.AfterFunc(150*time.Millisecond, network.Heal)
+
+	start := time.Now()
+	result, err := yggdrasil.Bootstrap(ctx, joiner.id, joiner.peers, joiner.router, yggdrasil.BootstrapConfig{
+		BootstrapAddrs: []types.PathAddr{nodes[0].addr},
+		MaxAttempts:    10,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if len(result.Connected) != 1 {
+		t.Errorf("Connected = %v, want node 0", result.Connected)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("connected after %v, before the partition healed", elapsed)
+	}
+}
+
+func TestBootstrapFailsWhenUnreachable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	network := bifrost.NewSimNetwork(1)
+	joiner := startSimNode(t, ctx, network, "joiner")
+
+	result, err := yggdrasil.Bootstrap(ctx, joiner.id, joiner.peers, joiner.router, yggdrasil.BootstrapConfig{
+		BootstrapAddrs: []types.PathAddr{"/mem/nowhere:1", "/mem/joiner:9"},
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	})
+	if !errors.Is(err, yggdrasil.ErrBootstrapFailed) {
+		t.Fatalf("err = %v, want ErrBootstrapFailed", err)
+	}
+	if len(result.Failed) != 2 {
+		t.Errorf("Failed = %v, want both addresses", result.Failed)
+	}
+}
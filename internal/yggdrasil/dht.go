@@ -1,7 +1,11 @@
 package yggdrasil
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -9,6 +13,10 @@ import (
 	"github.com/valhalla/valhalla/internal/types"
 )
 
+// recordDomain separates DHT record signatures from every other use of a
+// node's key.
+const recordDomain = "valhalla-record-v1"
+
 // DHTRecord is a signed value stored in the DHT.
 type DHTRecord struct {
 	Key       [32]byte         `json:"key"`
@@ -18,92 +26,418 @@ type DHTRecord struct {
 	Signature []byte           `json:"signature"`
 	Sequence  uint64           `json:"sequence"`
 	Timestamp int64            `json:"timestamp"`
+	// Puzzle is the publisher's dynamic puzzle solution. It is public, so
+	// the signature does not cover it.
+	Puzzle    []byte           `json:"puzzle,omitempty"`
 }
 
-// LocationRecord maps a NodeID to its current PathAddrs.
-type LocationRecord struct {
-	NodeID    types.NodeID     `json:"node_id"`
-	Addrs     []types.PathAddr `json:"addrs"`
-	Sequence  uint64           `json:"sequence"`
-	Timestamp int64            `json:"timestamp"`
-	Signature []byte           `json:"signature"`
+// signedBytes is the canonical encoding a record signature covers.
+//
+//	domain [key:32] [sequence:8] [timestamp:8] [value_len:4] [value]
+func (r *DHTRecord) signedBytes() []byte {
+	buf := make([]byte, 0, len(recordDomain)+52+len(r.Value))
+	buf = append(buf, recordDomain...)
+	buf = append(buf, r.Key[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, r.Sequence)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.Timestamp))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(r.Value)))
+	return append(buf, r.Value...)
+}
+
+// Sign makes id the record's publisher and signs its Key, Value, Sequence
+// and Timestamp, which must already be set.
+func (r *DHTRecord) Sign(id *Identity) {
+	r.Publisher = id.NodeID
+	r.PubKey = id.PublicKey
+	r.Puzzle = id.puzzle()
+	r.Signature = id.Sign(r.signedBytes())
+}
+
+// Verify checks that the record was signed by the key its Publisher is
+// derived from.
+func (r *DHTRecord) Verify() error {
+	if len(r.PubKey) != ed25519.PublicKeySize || types.NodeIDFromPublicKey(r.PubKey) != r.Publisher {
+		return fmt.Errorf("%w: key does not match publisher %s", ErrInvalidRecord, r.Publisher.Short())
+	}
+	if !VerifyWithKey(r.PubKey, r.signedBytes(), r.Signature) {
+		return fmt.Errorf("%w: bad signature from %s", ErrInvalidRecord, r.Publisher.Short())
+	}
+	return nil
+}
+
+// DHTConfig controls record lifetime, maintenance and storage.
+type DHTConfig struct {
+	// RecordTTL is how long a record lives after its Timestamp.
+	RecordTTL time.Duration
+	// RepublishInterval is how often the original publisher re-stores its
+	// records with a fresh Timestamp, keeping them alive.
+	RepublishInterval time.Duration
+	// ReplicateInterval is how often a node pushes the records it holds
+	// for others to the nodes now closest to their keys.
+	ReplicateInterval time.Duration
+	// JanitorInterval is how often expired records are removed.
+	JanitorInterval time.Duration
+	// MaxRecordsPerPublisher caps the records kept for any one publisher
+	// other than this node; 0 means no limit.
+	MaxRecordsPerPublisher int
+	// DisjointPaths is how many node-disjoint paths a lookup runs, as in
+	// S/Kademlia; 0 or 1 runs a single path.
+	DisjointPaths int
+	// PathQuorum is how many paths must return the same record before a
+	// lookup accepts it; 0 means a majority of DisjointPaths.
+	PathQuorum int
+	// Store holds the records; nil selects a new MemoryStore.
+	Store Store
 }
 
-// DHT is a simplified distributed hash table for the PoC.
-// In a real implementation this would involve network RPCs;
-// here it uses an in-memory store per node with a registry
-// for cross-node lookups.
+// DefaultDHTConfig returns the Kademlia paper's timings: records expire
+// after a day unless republished daily, and held records are replicated
+// hourly.
+func DefaultDHTConfig() DHTConfig {
+	return DHTConfig{
+		RecordTTL:              24 * time.Hour,
+		RepublishInterval:      24*time.Hour - 10*time.Minute,
+		ReplicateInterval:      time.Hour,
+		JanitorInterval:        time.Minute,
+		MaxRecordsPerPublisher: 1024,
+	}
+}
+
+// maxRecordClockSkew is how far in the future a record's Timestamp may
+// be, so a publisher cannot extend a record's life by predating it.
+const maxRecordClockSkew = 5 * time.Minute
+
+var (
+	ErrInvalidRecord = errors.New("yggdrasil: invalid DHT record")
+	ErrRecordExpired = errors.New("yggdrasil: record expired")
+	ErrQuotaExceeded = errors.New("yggdrasil: publisher storage quota exceeded")
+)
+
+// DHT is a Kademlia distributed hash table. Records live in a Store until
+// they expire; once the DHT is attached to a Router (see NewRouter), Put
+// replicates to the k closest nodes and Get falls back to an iterative
+// network lookup.
 type DHT struct {
-	self    types.NodeID
-	records map[[32]byte]*DHTRecord
-	mu      sync.RWMutex
+	self         types.NodeID
+	config       DHTConfig
+	records      Store
+	perPublisher map[types.NodeID]int
+	minPuzzle    PuzzleDifficulty
+	router       *Router
+	mu           sync.RWMutex
 }
 
-// NewDHT creates a new DHT store for a node.
+// NewDHT creates a new in-memory DHT store for a node.
 func NewDHT(self types.NodeID) *DHT {
-	return &DHT{
-		self:    self,
-		records: make(map[[32]byte]*DHTRecord),
+	return NewDHTWithConfig(self, DefaultDHTConfig())
+}
+
+// NewDHTWithConfig creates a DHT with custom settings. Records already in
+// config.Store are served, except those that have expired.
+func NewDHTWithConfig(self types.NodeID, config DHTConfig) *DHT {
+	defaults := DefaultDHTConfig()
+	if config.RecordTTL <= 0 {
+		config.RecordTTL = defaults.RecordTTL
+	}
+	if config.RepublishInterval <= 0 {
+		config.RepublishInterval = defaults.RepublishInterval
+	}
+	if config.ReplicateInterval <= 0 {
+		config.ReplicateInterval = defaults.ReplicateInterval
 	}
+	if config.JanitorInterval <= 0 {
+		config.JanitorInterval = defaults.JanitorInterval
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryStore()
+	}
+
+	d := &DHT{
+		self:         self,
+		config:       config,
+		records:      config.Store,
+		perPublisher: make(map[types.NodeID]int),
+	}
+	d.records.Range(func(rec *DHTRecord) bool {
+		d.perPublisher[rec.Publisher]++
+		return true
+	})
+	d.Expire()
+	return d
+}
+
+// Close closes the underlying store.
+func (d *DHT) Close() error {
+	return d.records.Close()
+}
+
+// SetMinDifficulty makes the DHT refuse records from publishers whose
+// NodeID does not meet d, other than this node; see VerifyPuzzle.
+func (d *DHT) SetMinDifficulty(diff PuzzleDifficulty) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.minPuzzle = diff
+}
+
+// checkPublisher verifies the puzzle of a record's publisher. Only
+// records under our own key are exempt; callers check the signature with
+// Verify first, so those were signed by us.
+func (d *DHT) checkPublisher(record *DHTRecord) error {
+	if record.Publisher == d.self && types.NodeIDFromPublicKey(record.PubKey) == d.self {
+		return nil
+	}
+	d.mu.RLock()
+	required := d.minPuzzle
+	d.mu.RUnlock()
+	publisher := PeerInfo{NodeID: record.Publisher, PublicKey: record.PubKey, Puzzle: record.Puzzle}
+	if err := VerifyPuzzle(publisher, required); err != nil {
+		return fmt.Errorf("dht: %w", err)
+	}
+	return nil
 }
 
-// Put stores a signed record in the local DHT.
+// Put stores a signed record locally and, when attached to a router,
+// replicates it to the k nodes closest to its key. Replication is best
+// effort: Put fails only if the record is rejected locally.
 func (d *DHT) Put(record *DHTRecord) error {
-	if !VerifyWithKey(record.PubKey, record.Value, record.Signature) {
-		return fmt.Errorf("dht: invalid signature on record")
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLookupTimeout)
+	defer cancel()
+	return d.PutContext(ctx, record)
+}
+
+// PutContext is Put with a caller-supplied deadline for replication.
+func (d *DHT) PutContext(ctx context.Context, record *DHTRecord) error {
+	if err := d.store(record); err != nil {
+		return err
+	}
+	if d.getRouter() != nil {
+		d.replicate(ctx, record)
+	}
+	return nil
+}
+
+// store verifies a record and keeps it if it is newer than ours. A
+// record with our sequence number and value but a later Timestamp is a
+// republish and refreshes our copy; the Timestamp is signed, so only a
+// publisher can refresh.
+func (d *DHT) store(record *DHTRecord) error {
+	if err := record.Verify(); err != nil {
+		return fmt.Errorf("dht: %w", err)
+	}
+	if err := d.checkPublisher(record); err != nil {
+		return err
+	}
+	if isLocationValue(record.Value) {
+		if _, err := LocationFromRecord(record); err != nil {
+			return fmt.Errorf("dht: %w", err)
+		}
+	}
+	if isSuccessionValue(record.Value) {
+		if _, err := SuccessionFromRecord(record); err != nil {
+			return fmt.Errorf("dht: %w", err)
+		}
+	}
+	now := time.Now()
+	if d.expired(record, now) {
+		return ErrRecordExpired
+	}
+	if record.Timestamp > now.Add(maxRecordClockSkew).UnixMilli() {
+		return fmt.Errorf("dht: record timestamp is in the future")
 	}
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	// Only update if sequence is higher (prevents replay)
-	if existing, ok := d.records[record.Key]; ok {
-		if record.Sequence <= existing.Sequence {
+	existing, ok := d.records.Get(record.Key)
+	if ok && !d.expired(existing, now) {
+		// Only update if sequence is higher (prevents replay)
+		refresh := record.Sequence == existing.Sequence &&
+			record.Timestamp > existing.Timestamp && bytes.Equal(record.Value, existing.Value)
+		if record.Sequence < existing.Sequence || (record.Sequence == existing.Sequence && !refresh) {
 			return nil // stale record, ignore
 		}
 	}
 
-	d.records[record.Key] = record
+	replacesOwn := ok && existing.Publisher == record.Publisher
+	if !replacesOwn && record.Publisher != d.self && d.config.MaxRecordsPerPublisher > 0 &&
+		d.perPublisher[record.Publisher] >= d.config.MaxRecordsPerPublisher {
+		return fmt.Errorf("%w: %s", ErrQuotaExceeded, record.Publisher.Short())
+	}
+
+	if err := d.records.Put(record); err != nil {
+		return err
+	}
+	if !replacesOwn {
+		if ok {
+			d.uncount(existing.Publisher)
+		}
+		d.perPublisher[record.Publisher]++
+	}
 	return nil
 }
 
-// Get retrieves a record from the local DHT.
-func (d *DHT) Get(key [32]byte) (*DHTRecord, bool) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-	rec, ok := d.records[key]
-	return rec, ok
+func (d *DHT) succeededBySelf(rec *DHTRecord) bool {
+	if !isSuccessionValue(rec.Value) {
+		return false
+	}
+	s, err := SuccessionFromRecord(rec)
+	return err == nil && s.NewID == d.self
+}
+
+func (d *DHT) uncount(publisher types.NodeID) {
+	if d.perPublisher[publisher]--; d.perPublisher[publisher] <= 0 {
+		delete(d.perPublisher, publisher)
+	}
+}
+
+func (d *DHT) expired(rec *DHTRecord, now time.Time) bool {
+	return now.UnixMilli() >= rec.Timestamp+d.config.RecordTTL.Milliseconds()
 }
 
-// PutLocation stores a signed location record for a NodeID.
-func (d *DHT) PutLocation(id *Identity, addrs []types.PathAddr, seq uint64) error {
-	loc := &LocationRecord{
-		NodeID:    id.NodeID,
-		Addrs:     addrs,
-		Sequence:  seq,
-		Timestamp: time.Now().UnixMilli(),
+// Expire removes expired records and returns how many it removed.
+func (d *DHT) Expire() int {
+	now := time.Now()
+	var stale []*DHTRecord
+	d.records.Range(func(rec *DHTRecord) bool {
+		if d.expired(rec, now) {
+			stale = append(stale, rec)
+		}
+		return true
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	removed := 0
+	for _, rec := range stale {
+		// Skip records replaced since the scan.
+		if cur, ok := d.records.Get(rec.Key); !ok || cur != rec {
+			continue
+		}
+		if d.records.Delete(rec.Key) == nil {
+			d.uncount(rec.Publisher)
+			removed++
+		}
 	}
+	return removed
+}
 
-	// Sign the location data
-	data := fmt.Appendf(nil, "%x:%d:%d", loc.NodeID, loc.Sequence, loc.Timestamp)
-	for _, a := range addrs {
-		data = fmt.Appendf(data, ":%s", a)
+// Republish re-signs the records this node published, and succession
+// statements naming it as the successor, with a fresh Timestamp, and
+// pushes them to the k closest nodes. Records are signed with the
+// attached Router's identity, so a DHT without one republishes nothing.
+// It returns how many records it republished.
+func (d *DHT) Republish(ctx context.Context) int {
+	r := d.getRouter()
+	if r == nil {
+		return 0
 	}
-	loc.Signature = id.Sign(data)
+	var own []*DHTRecord
+	d.records.Range(func(rec *DHTRecord) bool {
+		if rec.Publisher == d.self || d.succeededBySelf(rec) {
+			own = append(own, rec)
+		}
+		return true
+	})
 
-	record := &DHTRecord{
-		Key:       loc.NodeID,
-		Value:     data,
-		Publisher: id.NodeID,
-		PubKey:    id.PublicKey,
-		Signature: loc.Signature,
-		Sequence:  seq,
-		Timestamp: loc.Timestamp,
+	republished := 0
+	for _, rec := range own {
+		if ctx.Err() != nil {
+			break
+		}
+		fresh := *rec
+		fresh.Timestamp = time.Now().UnixMilli()
+		fresh.Sign(r.identity)
+		if err := d.PutContext(ctx, &fresh); err == nil {
+			republished++
+		}
 	}
-	return d.Put(record)
+	return republished
 }
 
-// GetLocation retrieves the location record for a NodeID.
-func (d *DHT) GetLocation(nodeID types.NodeID) (*DHTRecord, bool) {
-	return d.Get(nodeID)
+// ReplicateStored pushes the records this node holds for other
+// publishers to the k nodes now closest to their keys, so records survive
+// as nodes join and leave. It returns how many records reached at least
+// one node.
+func (d *DHT) ReplicateStored(ctx context.Context) int {
+	if d.getRouter() == nil {
+		return 0
+	}
+	var held []*DHTRecord
+	now := time.Now()
+	d.records.Range(func(rec *DHTRecord) bool {
+		if rec.Publisher != d.self && !d.expired(rec, now) {
+			held = append(held, rec)
+		}
+		return true
+	})
+
+	replicated := 0
+	for _, rec := range held {
+		if ctx.Err() != nil {
+			break
+		}
+		if d.replicate(ctx, rec) > 0 {
+			replicated++
+		}
+	}
+	return replicated
+}
+
+// MaintenanceLoop expires, republishes and replicates records on the
+// configured intervals until ctx is done.
+func (d *DHT) MaintenanceLoop(ctx context.Context) {
+	janitor := time.NewTicker(d.config.JanitorInterval)
+	defer janitor.Stop()
+	republish := time.NewTicker(d.config.RepublishInterval)
+	defer republish.Stop()
+	replicate := time.NewTicker(d.config.ReplicateInterval)
+	defer replicate.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-janitor.C:
+			d.Expire()
+		case <-republish.C:
+			d.Republish(ctx)
+		case <-replicate.C:
+			d.ReplicateStored(ctx)
+		}
+	}
+}
+
+// Get retrieves a record, from the local store if present and otherwise,
+// when attached to a router, by an iterative lookup. Records found on the
+// network are cached locally.
+func (d *DHT) Get(key [32]byte) (*DHTRecord, bool) {
+	if rec, ok := d.getLocal(key); ok {
+		return rec, true
+	}
+	if d.getRouter() == nil {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLookupTimeout)
+	defer cancel()
+	rec, err := d.FindValue(ctx, key)
+	if err != nil {
+		return nil, false
+	}
+	d.store(rec)
+	return rec, true
+}
+
+func (d *DHT) getLocal(key [32]byte) (*DHTRecord, bool) {
+	rec, ok := d.records.Get(key)
+	if !ok || d.expired(rec, time.Now()) {
+		return nil, false
+	}
+	return rec, true
+}
+
+func (d *DHT) getRouter() *Router {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.router
 }
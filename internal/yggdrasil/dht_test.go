@@ -0,0 +1,358 @@
+package yggdrasil_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+)
+
+type simNode struct {
+	id      *yggdrasil.Identity
+	peers   *yggdrasil.PeerTable
+	dht     *yggdrasil.DHT
+	router  *yggdrasil.Router
+	addr    types.PathAddr
+	network *bifrost.SimNetwork
+}
+
+func (n *simNode) info() yggdrasil.PeerInfo {
+	return yggdrasil.PeerInfo{NodeID: n.id.NodeID, PublicKey: n.id.PublicKey, Addrs: []types.PathAddr{n.addr}}
+}
+
+// newSimCluster starts size nodes on a SimNetwork. Each node dials peers
+// on demand through a "mem" registry; node 0 knows everyone, and every
+// other node knows only node 0.
+func newSimCluster(t *testing.T, ctx context.Context, size int) []*simNode {
+	t.Helper()
+	network := bifrost.NewSimNetwork(1)
+	network.SetDefaultLink(bifrost.LinkConfig{Latency: time.Millisecond})
+
+	nodes := make([]*simNode, size)
+	for i := range nodes {
+		nodes[i] = startSimNode(t, ctx, network, fmt.Sprintf("n%d", i))
+	}
+	for _, n := range nodes[1:] {
+		n.peers.AddPeer(nodes[0].info())
+		nodes[0].peers.AddPeer(n.info())
+	}
+	return nodes
+}
+
+// startSimNode starts a node listening on host that accepts peers through
+// the identity exchange.
+func startSimNode(t *testing.T, ctx context.Context, network *bifrost.SimNetwork, host string) *simNode {
+	t.Helper()
+	return startSimNodeWithDHT(t, ctx, network, host, yggdrasil.DefaultDHTConfig())
+}
+
+// startSimNodeWithDHT is startSimNode with a custom DHT configuration.
+func startSimNodeWithDHT(t *testing.T, ctx context.Context, network *bifrost.SimNetwork, host string, config yggdrasil.DHTConfig) *simNode {
+	t.Helper()
+	id, err := yggdrasil.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := bifrost.NewRegistry()
+	reg.Register("mem", network.Transport(host))
+	ln, err := reg.Listen(ctx, "/mem/"+host+":0")
+	if err != nil {
+		t.Fatalf("%s listen: %v", host, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	pt := yggdrasil.NewPeerTable(id.NodeID)
+	dht := yggdrasil.NewDHTWithConfig(id.NodeID, config)
+	router := yggdrasil.NewRouter(id, pt, dht, nil)
+	router.SetTransport(reg)
+	router.SetAddrs([]types.PathAddr{types.PathAddr(ln.Addr())})
+
+	go func() {
+		for {
+			conn, err := ln.Accept(ctx)
+			if err != nil {
+				return
+			}
+			go router.AcceptPeer(ctx, conn)
+		}
+	}()
+	return &simNode{id: id, peers: pt, dht: dht, router: router, addr: types.PathAddr(ln.Addr()), network: network}
+}
+
+func closestNodes(nodes []*simNode, key types.NodeID, k int) []*simNode {
+	sorted := append([]*simNode(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		di := types.XORDistance(sorted[i].id.NodeID, key)
+		dj := types.XORDistance(sorted[j].id.NodeID, key)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+	return sorted[:k]
+}
+
+func TestDHTLookupNodeFindsClosest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 40)
+
+	// Self-lookups spread knowledge beyond node 0.
+	for i, n := range nodes[1:] {
+		if _, err := n.dht.LookupNode(ctx, n.id.NodeID); err != nil {
+			t.Fatalf("node %d self-lookup: %v", i+1, err)
+		}
+	}
+
+	target := nodes[17].id.NodeID
+	got, err := nodes[33].dht.LookupNode(ctx, target)
+	if err != nil {
+		t.Fatalf("LookupNode: %v", err)
+	}
+	if len(got) == 0 || got[0].NodeID != target {
+		t.Fatalf("closest result is not the target itself")
+	}
+
+	want := closestNodes(nodes, target, 5)
+	for i, w := range want {
+		if w == nodes[33] {
+			continue // the searcher never returns itself
+		}
+		found := false
+		for _, g := range got {
+			found = found || g.NodeID == w.id.NodeID
+		}
+		if !found {
+			t.Errorf("lookup missed the #%d closest node", i)
+		}
+	}
+}
+
+func TestDHTPutReplicatesAndGetLooksUp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 40)
+	for _, n := range nodes[1:] {
+		n.dht.LookupNode(ctx, n.id.NodeID)
+	}
+
+	publisher := nodes[5]
+	if err := publisher.dht.PutLocation(publisher.id, []types.PathAddr{publisher.addr}, 1); err != nil {
+		t.Fatalf("PutLocation: %v", err)
+	}
+
+	key := publisher.id.NodeID
+	replicas := 0
+	for _, n := range closestNodes(nodes, key, yggdrasil.KBucketSize) {
+		if _, ok := n.dht.Get(key); ok && n != publisher {
+			replicas++
+		}
+	}
+	if replicas < yggdrasil.KBucketSize-2 {
+		t.Fatalf("record reached %d of the %d closest nodes", replicas, yggdrasil.KBucketSize)
+	}
+
+	// A node outside the replica set finds the record over the network.
+	far := closestNodes(nodes, key, len(nodes))[len(nodes)-1]
+	if far == publisher {
+		far = closestNodes(nodes, key, len(nodes))[len(nodes)-2]
+	}
+	rec, err := far.dht.FindValue(ctx, key)
+	if err != nil {
+		t.Fatalf("FindValue: %v", err)
+	}
+	if rec.Publisher != publisher.id.NodeID {
+		t.Fatal("found record has the wrong publisher")
+	}
+
+	if _, err := far.dht.FindValue(ctx, [32]byte{0xff}); err != yggdrasil.ErrNotFound {
+		t.Fatalf("FindValue(missing) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDHTRefreshBuckets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 30)
+
+	n := nodes[1]
+	before := n.peers.Size()
+	if refreshed := n.dht.RefreshBuckets(ctx, time.Hour); refreshed != 0 {
+		t.Errorf("refreshed %d fresh buckets", refreshed)
+	}
+	if refreshed := n.dht.RefreshBuckets(ctx, 0); refreshed == 0 {
+		t.Fatal("no buckets refreshed")
+	}
+	if n.peers.Size() <= before {
+		t.Errorf("peer table did not grow: %d -> %d", before, n.peers.Size())
+	}
+}
+
+func signedRecord(t *testing.T, id *yggdrasil.Identity, key [32]byte, value string, seq uint64) *yggdrasil.DHTRecord {
+	t.Helper()
+	rec := &yggdrasil.DHTRecord{
+		Key:       key,
+		Value:     []byte(value),
+		Sequence:  seq,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	rec.Sign(id)
+	return rec
+}
+
+func TestDHTRecordExpiry(t *testing.T) {
+	self, _ := yggdrasil.GenerateIdentity()
+	pub, _ := yggdrasil.GenerateIdentity()
+	dht := yggdrasil.NewDHTWithConfig(self.NodeID, yggdrasil.DHTConfig{RecordTTL: 100 * time.Millisecond})
+
+	if err := dht.Put(signedRecord(t, pub, [32]byte{1}, "v", 1)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, ok := dht.Get([32]byte{1}); !ok {
+		t.Fatal("record missing before expiry")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, ok := dht.Get([32]byte{1}); ok {
+		t.Error("expired record still served")
+	}
+	if n := dht.Expire(); n != 1 {
+		t.Errorf("Expire removed %d records, want 1", n)
+	}
+
+	old := signedRecord(t, pub, [32]byte{2}, "v", 1)
+	old.Timestamp = time.Now().Add(-time.Second).UnixMilli()
+	old.Sign(pub)
+	if err := dht.Put(old); !errors.Is(err, yggdrasil.ErrRecordExpired) {
+		t.Errorf("Put(expired) = %v, want ErrRecordExpired", err)
+	}
+	future := signedRecord(t, pub, [32]byte{3}, "v", 1)
+	future.Timestamp = time.Now().Add(time.Hour).UnixMilli()
+	future.Sign(pub)
+	if err := dht.Put(future); err == nil {
+		t.Error("Put accepted a record timestamped an hour ahead")
+	}
+}
+
+func TestDHTRepublishKeepsOwnRecordsAlive(t *testing.T) {
+	self, _ := yggdrasil.GenerateIdentity()
+	other, _ := yggdrasil.GenerateIdentity()
+	dht := yggdrasil.NewDHTWithConfig(self.NodeID, yggdrasil.DHTConfig{RecordTTL: 200 * time.Millisecond})
+	yggdrasil.NewRouter(self, yggdrasil.NewPeerTable(self.NodeID), dht, nil)
+
+	dht.Put(signedRecord(t, self, [32]byte{1}, "mine", 1))
+	dht.Put(signedRecord(t, other, [32]byte{2}, "theirs", 1))
+
+	time.Sleep(120 * time.Millisecond)
+	if n := dht.Republish(context.Background()); n != 1 {
+		t.Errorf("Republish = %d, want 1 (own records only)", n)
+	}
+	time.Sleep(120 * time.Millisecond)
+
+	if _, ok := dht.Get([32]byte{1}); !ok {
+		t.Error("republished record expired")
+	}
+	if _, ok := dht.Get([32]byte{2}); ok {
+		t.Error("another publisher's record outlived its TTL")
+	}
+}
+
+func TestDHTPublisherQuota(t *testing.T) {
+	self, _ := yggdrasil.GenerateIdentity()
+	pub, _ := yggdrasil.GenerateIdentity()
+	dht := yggdrasil.NewDHTWithConfig(self.NodeID, yggdrasil.DHTConfig{MaxRecordsPerPublisher: 2})
+
+	for i := byte(1); i <= 2; i++ {
+		if err := dht.Put(signedRecord(t, pub, [32]byte{i}, "v", 1)); err != nil {
+			t.Fatalf("Put %d: %v", i, err)
+		}
+	}
+	if err := dht.Put(signedRecord(t, pub, [32]byte{3}, "v", 1)); !errors.Is(err, yggdrasil.ErrQuotaExceeded) {
+		t.Fatalf("Put over quota = %v, want ErrQuotaExceeded", err)
+	}
+	if err := dht.Put(signedRecord(t, pub, [32]byte{1}, "v2", 2)); err != nil {
+		t.Errorf("updating a held record: %v", err)
+	}
+	for i := byte(1); i <= 3; i++ {
+		if err := dht.Put(signedRecord(t, self, [32]byte{10 + i}, "v", 1)); err != nil {
+			t.Errorf("own record %d: %v", i, err)
+		}
+	}
+}
+
+func TestDHTRejectsSpoofedPublisher(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	network := bifrost.NewSimNetwork(1)
+	receiver := startSimNodeWithDHT(t, ctx, network, "receiver", yggdrasil.DHTConfig{MaxRecordsPerPublisher: 1})
+	attacker := startSimNode(t, ctx, network, "attacker")
+	receiver.dht.SetMinDifficulty(testDifficulty)
+	attacker.peers.AddPeer(receiver.info())
+
+	// Records signed by the attacker but naming the receiver as publisher,
+	// which would skip the receiver's puzzle check and quota.
+	tests := []struct {
+		name  string
+		forge func(rec *yggdrasil.DHTRecord)
+	}{
+		{"attacker key", func(rec *yggdrasil.DHTRecord) { rec.Publisher = receiver.id.NodeID }},
+		{"receiver key", func(rec *yggdrasil.DHTRecord) {
+			rec.Publisher, rec.PubKey = receiver.id.NodeID, receiver.id.PublicKey
+		}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := [32]byte{byte(i + 1)}
+			rec := signedRecord(t, attacker.id, key, "spoofed", 1)
+			tt.forge(rec)
+			payload, _ := json.Marshal(map[string]any{"record": rec, "sender": attacker.info()})
+			if _, err := attacker.router.Request(ctx, receiver.id.NodeID, types.MsgStore, payload); err == nil {
+				t.Error("STORE with a spoofed publisher succeeded")
+			}
+			if err := receiver.dht.Put(rec); !errors.Is(err, yggdrasil.ErrInvalidRecord) {
+				t.Errorf("Put = %v, want ErrInvalidRecord", err)
+			}
+			if _, ok := receiver.dht.Get(key); ok {
+				t.Error("spoofed record stored")
+			}
+		})
+	}
+}
+
+func TestDHTReplicateStoredReachesNewNodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 10)
+	network := nodes[0].network
+	joiner := startSimNode(t, ctx, network, "joiner")
+
+	// The record lives at the joiner's own NodeID, so once the joiner is
+	// in the network it is the closest node to the key.
+	outsider, _ := yggdrasil.GenerateIdentity()
+	rec := signedRecord(t, outsider, joiner.id.NodeID, "v", 1)
+	holder := nodes[1]
+	if err := holder.dht.PutContext(ctx, rec); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if _, err := yggdrasil.Bootstrap(ctx, joiner.id, joiner.peers, joiner.router, yggdrasil.BootstrapConfig{
+		BootstrapAddrs: []types.PathAddr{nodes[0].addr},
+	}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	holder.dht.LookupNode(ctx, joiner.id.NodeID)
+	if n := holder.dht.ReplicateStored(ctx); n != 1 {
+		t.Fatalf("ReplicateStored = %d, want 1", n)
+	}
+
+	// Cut the joiner off so Get can only answer from its own store.
+	network.Partition([]string{"joiner"})
+	if _, ok := joiner.dht.Get(rec.Key); !ok {
+		t.Error("joiner did not receive the replicated record")
+	}
+}
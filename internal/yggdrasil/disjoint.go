@@ -0,0 +1,150 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// ErrNoPathAgreement is returned when too few disjoint lookup paths agree
+// on a record for it to be trusted.
+var ErrNoPathAgreement = errors.New("yggdrasil: lookup paths disagree")
+
+// PathResult is what one disjoint lookup path did.
+type PathResult struct {
+	// Queried lists the nodes the path queried, in order.
+	Queried []types.NodeID `json:"queried"`
+	// Record is the record the path found, or nil.
+	Record *DHTRecord `json:"record,omitempty"`
+}
+
+// LookupReport describes a lookup across disjoint paths.
+type LookupReport struct {
+	Paths []PathResult `json:"paths"`
+	// Disagreed lists the indexes of paths that found a record other than
+	// the one accepted, or other than the most common one if none was.
+	Disagreed []int `json:"disagreed,omitempty"`
+}
+
+// lookupPaths runs the configured number of disjoint lookup paths from
+// seeds, dealt out round-robin, with no node queried by two paths. An
+// adversary must then control a node on every path to steer them all.
+func (d *DHT) lookupPaths(ctx context.Context, r *Router, target types.NodeID, valid func(*DHTRecord) bool, seeds []PeerInfo) ([]PeerInfo, *DHTRecord, *LookupReport, error) {
+	paths := max(d.config.DisjointPaths, 1)
+	quorum := d.config.PathQuorum
+	if quorum <= 0 {
+		quorum = paths/2 + 1
+	}
+
+	var mu sync.Mutex
+	claimed := make(map[types.NodeID]int)
+	lists := make([]*shortlist, paths)
+	for i := range lists {
+		lists[i] = newShortlist(target, d.self)
+		if paths > 1 {
+			lists[i].claim = func(id types.NodeID) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				if owner, ok := claimed[id]; ok {
+					return owner == i
+				}
+				claimed[id] = i
+				return true
+			}
+		}
+	}
+	for i, seed := range seeds {
+		lists[i%paths].add(seed)
+	}
+
+	report := &LookupReport{Paths: make([]PathResult, paths)}
+	errs := make([]error, paths)
+	var wg sync.WaitGroup
+	for i, sl := range lists {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec, queried, err := d.walk(ctx, r, sl, valid)
+			report.Paths[i] = PathResult{Queried: queried, Record: rec}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+
+	closest := mergeClosest(target, lists)
+	if err := errors.Join(errs...); err != nil {
+		return closest, nil, report, err
+	}
+	if valid == nil {
+		return closest, nil, report, nil
+	}
+
+	rec, votes := agree(report)
+	if len(report.Disagreed) > 0 {
+		r.emitEvent("dht_paths_disagree", map[string]string{
+			"key":   target.Short(),
+			"paths": fmt.Sprint(report.Disagreed),
+		})
+	}
+	if rec != nil && votes < quorum {
+		return closest, nil, report, fmt.Errorf("%w: %d of %d paths agree, need %d", ErrNoPathAgreement, votes, paths, quorum)
+	}
+	return closest, rec, report, nil
+}
+
+// agree picks the record found by the most paths, preferring the lower
+// path index on a tie, and marks the paths that found another record as
+// disagreeing. Republished copies of one record count as the same.
+func agree(report *LookupReport) (*DHTRecord, int) {
+	var best *DHTRecord
+	votes := 0
+	for _, p := range report.Paths {
+		if p.Record == nil {
+			continue
+		}
+		n := 0
+		for _, q := range report.Paths {
+			if q.Record != nil && sameRecord(p.Record, q.Record) {
+				n++
+			}
+		}
+		if n > votes {
+			best, votes = p.Record, n
+		}
+	}
+	for i, p := range report.Paths {
+		if p.Record != nil && !sameRecord(p.Record, best) {
+			report.Disagreed = append(report.Disagreed, i)
+		}
+	}
+	return best, votes
+}
+
+func sameRecord(a, b *DHTRecord) bool {
+	return a.Publisher == b.Publisher && a.Sequence == b.Sequence && bytes.Equal(a.Value, b.Value)
+}
+
+// mergeClosest returns the k nodes closest to target that answered on
+// any path, nearest first.
+func mergeClosest(target types.NodeID, lists []*shortlist) []PeerInfo {
+	seen := make(map[types.NodeID]bool)
+	var all []PeerInfo
+	for _, sl := range lists {
+		for _, p := range sl.closest(KBucketSize) {
+			if !seen[p.NodeID] {
+				seen[p.NodeID] = true
+				all = append(all, p)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return closerTo(target, all[i].NodeID, all[j].NodeID) })
+	if len(all) > KBucketSize {
+		all = all[:KBucketSize]
+	}
+	return all
+}
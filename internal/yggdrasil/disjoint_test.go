@@ -0,0 +1,105 @@
+package yggdrasil_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+)
+
+// poisonedLookup gives a searcher running three disjoint paths one seed
+// each: two honest nodes holding the current record and one that answers
+// every FIND_VALUE with a stale but validly signed copy.
+func poisonedLookup(t *testing.T, ctx context.Context, config yggdrasil.DHTConfig) (searcher, evil *simNode, key [32]byte) {
+	t.Helper()
+	network := bifrost.NewSimNetwork(1)
+	publisher, _ := yggdrasil.GenerateIdentity()
+	key = sha256.Sum256([]byte("poisoned"))
+	current := signedRecord(t, publisher, key, "v2", 2)
+	stale := signedRecord(t, publisher, key, "v1", 1)
+
+	searcher = startSimNodeWithDHT(t, ctx, network, "searcher", config)
+	for _, host := range []string{"a", "b"} {
+		honest := startSimNode(t, ctx, network, host)
+		if err := honest.dht.Put(current); err != nil {
+			t.Fatal(err)
+		}
+		searcher.peers.AddPeer(honest.info())
+	}
+	evil = startSimNode(t, ctx, network, "evil")
+	evil.router.RegisterHandler(types.MsgFindValue, func(msg *yggdrasil.Message) (*yggdrasil.Message, error) {
+		payload, err := json.Marshal(map[string]any{"record": stale})
+		return &yggdrasil.Message{Payload: payload}, err
+	})
+	searcher.peers.AddPeer(evil.info())
+	return searcher, evil, key
+}
+
+func TestDisjointLookupOutvotesPoisonedPath(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	searcher, evil, key := poisonedLookup(t, ctx, yggdrasil.DHTConfig{DisjointPaths: 3})
+
+	rec, report, err := searcher.dht.LookupValue(ctx, key)
+	if err != nil {
+		t.Fatalf("LookupValue: %v", err)
+	}
+	if rec.Sequence != 2 {
+		t.Errorf("accepted sequence %d, want the current 2", rec.Sequence)
+	}
+	if len(report.Paths) != 3 || len(report.Disagreed) != 1 {
+		t.Fatalf("report = %+v, want 3 paths with 1 disagreeing", report)
+	}
+	if bad := report.Paths[report.Disagreed[0]]; !slices.Contains(bad.Queried, evil.id.NodeID) {
+		t.Errorf("disagreeing path queried %v, not the poisoner", bad.Queried)
+	}
+}
+
+func TestDisjointLookupRequiresQuorum(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	searcher, _, key := poisonedLookup(t, ctx, yggdrasil.DHTConfig{DisjointPaths: 3, PathQuorum: 3})
+
+	rec, report, err := searcher.dht.LookupValue(ctx, key)
+	if !errors.Is(err, yggdrasil.ErrNoPathAgreement) {
+		t.Fatalf("LookupValue = %v, %v, want ErrNoPathAgreement", rec, err)
+	}
+	if report == nil || len(report.Disagreed) != 1 {
+		t.Errorf("report = %+v, want the disagreeing path", report)
+	}
+}
+
+func TestDisjointLookupPathsShareNoNodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 16)
+	searcher := startSimNodeWithDHT(t, ctx, nodes[0].network, "searcher", yggdrasil.DHTConfig{DisjointPaths: 3})
+	for _, n := range nodes {
+		searcher.peers.AddPeer(n.info())
+		n.peers.AddPeer(searcher.info())
+	}
+
+	_, report, err := searcher.dht.LookupValue(ctx, sha256.Sum256([]byte("missing")))
+	if !errors.Is(err, yggdrasil.ErrNotFound) {
+		t.Fatalf("LookupValue = %v, want ErrNotFound", err)
+	}
+	seen := make(map[types.NodeID]int)
+	for i, path := range report.Paths {
+		if len(path.Queried) == 0 {
+			t.Errorf("path %d queried nobody", i)
+		}
+		for _, id := range path.Queried {
+			if prev, ok := seen[id]; ok {
+				t.Errorf("%s queried by paths %d and %d", id.Short(), prev, i)
+			}
+			seen[id] = i
+		}
+	}
+}
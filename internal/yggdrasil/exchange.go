@@ -0,0 +1,291 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// identityDomain separates identity-exchange signatures from every other
+// use of a node's key.
+const identityDomain = "valhalla-identity-v1"
+
+// DefaultExchangeTimeout bounds an identity exchange whose context has no
+// deadline.
+const DefaultExchangeTimeout = 10 * time.Second
+
+var (
+	ErrIdentityProof    = errors.New("yggdrasil: peer failed to prove its identity")
+	ErrIdentityMismatch = errors.New("yggdrasil: peer NodeID does not match")
+	ErrSelfConnection   = errors.New("yggdrasil: connected to ourselves")
+)
+
+// identityHello opens the exchange: who we are, where we listen, the
+// message encodings we accept, our puzzle solution and the difficulty we
+// demand of it, and a fresh challenge for the peer to sign.
+type identityHello struct {
+	NodeID        types.NodeID      `json:"node_id"`
+	PublicKey     ed25519.PublicKey `json:"public_key"`
+	Addrs         []types.PathAddr  `json:"addrs,omitempty"`
+	Encodings     []Encoding        `json:"encodings,omitempty"`
+	Puzzle        []byte            `json:"puzzle,omitempty"`
+	MinDifficulty PuzzleDifficulty  `json:"min_difficulty"`
+	Nonce         []byte            `json:"nonce"`
+}
+
+// identityProof answers the peer's challenge.
+type identityProof struct {
+	Signature []byte `json:"signature"`
+}
+
+// ExchangeIdentity proves possession of our key to the peer on a fresh
+// connection and verifies the peer's proof in return. The exchange is
+// symmetric: both sides send a hello carrying a random nonce, then sign
+// the peer's nonce together with their own. It must run before any other
+// traffic on conn. The returned PeerInfo has been verified.
+func ExchangeIdentity(ctx context.Context, identity *Identity, addrs []types.PathAddr, conn bifrost.Conn) (PeerInfo, error) {
+	peer, _, err := exchangeIdentity(ctx, identity, addrs, nil, PuzzleDifficulty{}, conn)
+	return peer, err
+}
+
+// exchangeIdentity is ExchangeIdentity that also offers encodings and
+// returns the one both sides accept. A peer whose NodeID falls short of
+// required is refused, and so is one demanding more than ours meets.
+func exchangeIdentity(ctx context.Context, identity *Identity, addrs []types.PathAddr, encodings []Encoding, required PuzzleDifficulty, conn bifrost.Conn) (PeerInfo, Encoding, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultExchangeTimeout)
+		defer cancel()
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return PeerInfo{}, "", fmt.Errorf("yggdrasil: identity nonce: %w", err)
+	}
+	hello := identityHello{
+		NodeID:        identity.NodeID,
+		PublicKey:     identity.PublicKey,
+		Addrs:         addrs,
+		Encodings:     encodings,
+		Puzzle:        identity.puzzle(),
+		MinDifficulty: required,
+		Nonce:         nonce,
+	}
+	if err := sendJSON(conn, hello); err != nil {
+		return PeerInfo{}, "", err
+	}
+
+	var theirs identityHello
+	if err := receiveJSON(ctx, conn, &theirs); err != nil {
+		return PeerInfo{}, "", err
+	}
+	if len(theirs.PublicKey) != ed25519.PublicKeySize || len(theirs.Nonce) != len(nonce) {
+		return PeerInfo{}, "", fmt.Errorf("%w: malformed hello", ErrIdentityProof)
+	}
+	if types.NodeIDFromPublicKey(theirs.PublicKey) != theirs.NodeID {
+		return PeerInfo{}, "", fmt.Errorf("%w: NodeID is not derived from its key", ErrIdentityProof)
+	}
+	if err := VerifyPuzzle(PeerInfo{NodeID: theirs.NodeID, PublicKey: theirs.PublicKey, Puzzle: theirs.Puzzle}, required); err != nil {
+		return PeerInfo{}, "", err
+	}
+	if err := VerifyPuzzle(PeerInfo{NodeID: identity.NodeID, PublicKey: identity.PublicKey, Puzzle: hello.Puzzle}, theirs.MinDifficulty); err != nil {
+		return PeerInfo{}, "", fmt.Errorf("yggdrasil: peer requires %+v: %w", theirs.MinDifficulty, err)
+	}
+
+	proof := identityProof{Signature: identity.Sign(identityTranscript(theirs.Nonce, nonce))}
+	if err := sendJSON(conn, proof); err != nil {
+		return PeerInfo{}, "", err
+	}
+
+	var theirProof identityProof
+	if err := receiveJSON(ctx, conn, &theirProof); err != nil {
+		return PeerInfo{}, "", err
+	}
+	if !VerifyWithKey(theirs.PublicKey, identityTranscript(nonce, theirs.Nonce), theirProof.Signature) {
+		return PeerInfo{}, "", ErrIdentityProof
+	}
+
+	peer := PeerInfo{
+		NodeID:    theirs.NodeID,
+		PublicKey: theirs.PublicKey,
+		Addrs:     theirs.Addrs,
+		LastSeen:  time.Now().UnixMilli(),
+		Puzzle:    theirs.Puzzle,
+	}
+	return peer, negotiateEncoding(encodings, theirs.Encodings), nil
+}
+
+// identityTranscript is what a node signs: the challenge it was given,
+// followed by its own nonce so the signature is bound to this exchange.
+func identityTranscript(challenge, own []byte) []byte {
+	data := make([]byte, 0, len(identityDomain)+len(challenge)+len(own))
+	data = append(data, identityDomain...)
+	data = append(data, challenge...)
+	return append(data, own...)
+}
+
+func sendJSON(conn bifrost.Conn, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("yggdrasil: identity exchange: %w", err)
+	}
+	if err := conn.Send(&types.BifrostFrame{Type: types.FrameData, Payload: data}); err != nil {
+		return fmt.Errorf("yggdrasil: identity exchange: %w", err)
+	}
+	return nil
+}
+
+// receiveJSON reads one frame into v, closing conn if ctx ends first so
+// the blocked Receive returns.
+func receiveJSON(ctx context.Context, conn bifrost.Conn, v any) error {
+	type result struct {
+		frame *types.BifrostFrame
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		f, err := conn.Receive()
+		ch <- result{f, err}
+	}()
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return fmt.Errorf("yggdrasil: identity exchange: %w", res.err)
+		}
+		if err := json.Unmarshal(res.frame.Payload, v); err != nil {
+			return fmt.Errorf("%w: %v", ErrIdentityProof, err)
+		}
+		return nil
+	case <-ctx.Done():
+		conn.Close()
+		return fmt.Errorf("yggdrasil: identity exchange: %w", ctx.Err())
+	}
+}
+
+// AcceptPeer runs the identity exchange on an accepted connection, adds
+// the verified peer to the peer table, registers the connection and
+// starts its receive loop. The connection is closed on failure, including
+// when the peer table refuses the peer.
+func (r *Router) AcceptPeer(ctx context.Context, conn bifrost.Conn) (PeerInfo, error) {
+	peer, enc, err := r.exchange(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return PeerInfo{}, err
+	}
+	if err := r.register(peer, conn, enc, false); err != nil {
+		return PeerInfo{}, err
+	}
+	return peer, nil
+}
+
+// exchange runs the identity exchange with this router's addresses,
+// encodings and puzzle difficulty.
+func (r *Router) exchange(ctx context.Context, conn bifrost.Conn) (PeerInfo, Encoding, error) {
+	r.mu.RLock()
+	required := r.minPuzzle
+	r.mu.RUnlock()
+	return exchangeIdentity(ctx, r.identity, r.Self().Addrs, r.offeredEncodings(), required, conn)
+}
+
+// Connect dials addr, runs the identity exchange and registers the peer
+// as AcceptPeer does. If expect is non-zero the peer must have that
+// NodeID. Relayed addresses (see RelayAddr) are dialed through their
+// relay.
+func (r *Router) Connect(ctx context.Context, addr types.PathAddr, expect types.NodeID) (PeerInfo, error) {
+	if addr.Protocol() == relayProtocol {
+		conn, err := r.dialRelay(ctx, addr)
+		if err != nil {
+			return PeerInfo{}, err
+		}
+		return r.handshake(ctx, conn, addr, expect)
+	}
+
+	r.mu.RLock()
+	transport := r.transport
+	r.mu.RUnlock()
+	if transport == nil {
+		return PeerInfo{}, fmt.Errorf("yggdrasil: router has no transport")
+	}
+
+	conn, err := bifrost.DialPath(ctx, transport, addr)
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	return r.handshake(ctx, conn, addr, expect)
+}
+
+// handshake runs the identity exchange on a connection we opened to addr
+// and registers the peer if it is expect, or anyone when expect is zero.
+func (r *Router) handshake(ctx context.Context, conn bifrost.Conn, addr types.PathAddr, expect types.NodeID) (PeerInfo, error) {
+	peer, enc, err := r.exchange(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return PeerInfo{}, err
+	}
+	if expect != (types.NodeID{}) && peer.NodeID != expect {
+		conn.Close()
+		return PeerInfo{}, fmt.Errorf("%w: dialed %s, got %s", ErrIdentityMismatch, expect.Short(), peer.NodeID.Short())
+	}
+	if len(peer.Addrs) == 0 {
+		peer.Addrs = []types.PathAddr{addr}
+	}
+	if err := r.register(peer, conn, enc, true); err != nil {
+		return PeerInfo{}, err
+	}
+	return peer, nil
+}
+
+// register records a verified peer and serves its connection in the
+// agreed encoding, wrapped in keepalive probes so a silent peer is
+// dropped. The receive loop outlives whatever context established the
+// connection. A peer the peer table refuses is not served: conn is closed
+// and the table's error returned.
+//
+// A peer has one connection. When it already has another, the one opened
+// by the lower NodeID is kept, so two nodes that dial each other at once
+// settle on the same connection; a redial from the same side replaces the
+// old connection. The connection given up is closed.
+func (r *Router) register(peer PeerInfo, conn bifrost.Conn, enc Encoding, dialed bool) error {
+	if peer.NodeID == r.identity.NodeID {
+		conn.Close()
+		return ErrSelfConnection
+	}
+	if err := r.peers.AddPeer(peer); err != nil {
+		conn.Close()
+		return fmt.Errorf("yggdrasil: register %s: %w", peer.NodeID.Short(), err)
+	}
+
+	r.mu.Lock()
+	old, exists := r.conns[peer.NodeID]
+	if exists && r.dialed[peer.NodeID] != dialed && !r.openedByLower(peer.NodeID, dialed) {
+		r.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	kc := bifrost.NewKeepaliveConn(conn, r.keepalive)
+	r.conns[peer.NodeID] = kc
+	r.wire[peer.NodeID] = enc
+	r.dialed[peer.NodeID] = dialed
+	r.mu.Unlock()
+	if exists {
+		old.Close()
+	}
+	go r.ReceiveLoop(context.Background(), peer.NodeID, kc)
+	return nil
+}
+
+// openedByLower reports whether a connection with peer was opened by the
+// lower of our two NodeIDs, given whether we dialed it.
+func (r *Router) openedByLower(peer types.NodeID, dialed bool) bool {
+	weAreLower := bytes.Compare(r.identity.NodeID[:], peer[:]) < 0
+	return dialed == weAreLower
+}
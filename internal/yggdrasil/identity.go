@@ -18,6 +18,8 @@ type Identity struct {
 	PrivateKey ed25519.PrivateKey `json:"private_key"`
 	PublicKey  ed25519.PublicKey  `json:"public_key"`
 	NodeID    types.NodeID       `json:"node_id"`
+	// Puzzle is the dynamic puzzle solution set by SolvePuzzle.
+	Puzzle    []byte             `json:"puzzle,omitempty"`
 	mu        sync.RWMutex
 }
 
@@ -53,7 +55,8 @@ func VerifyWithKey(pubKey ed25519.PublicKey, data, sig []byte) bool {
 	return ed25519.Verify(pubKey, data, sig)
 }
 
-// SaveToFile persists the identity to a JSON file.
+// SaveToFile persists the identity to a JSON file. The private key is
+// stored in the clear; SaveEncrypted protects it with a passphrase.
 func (id *Identity) SaveToFile(path string) error {
 	id.mu.RLock()
 	defer id.mu.RUnlock()
@@ -89,4 +92,6 @@ type PeerInfo struct {
 	PublicKey ed25519.PublicKey   `json:"public_key"`
 	Addrs     []types.PathAddr   `json:"addrs"`
 	LastSeen  int64              `json:"last_seen"` // Unix milliseconds
+	// Puzzle is the peer's dynamic puzzle solution; see VerifyPuzzle.
+	Puzzle    []byte             `json:"puzzle,omitempty"`
 }
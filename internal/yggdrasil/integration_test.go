@@ -1,8 +1,11 @@
 package yggdrasil_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
@@ -217,3 +220,445 @@ func TestDHTPutGet(t *testing.T) {
 		t.Error("publisher mismatch")
 	}
 }
+
+func TestConnectPeerDialsPathAddr(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transport := bifrost.NewTCPTransport()
+	ln, err := transport.Listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	id, _ := yggdrasil.GenerateIdentity()
+	peer, _ := yggdrasil.GenerateIdentity()
+	router := yggdrasil.NewRouter(id, yggdrasil.NewPeerTable(id.NodeID), yggdrasil.NewDHT(id.NodeID), nil)
+
+	// node.ConnectPeer stores "/tcp/host:port"; a bare TCP transport must
+	// still be able to dial it.
+	err = yggdrasil.ConnectPeer(ctx, transport, router, yggdrasil.PeerInfo{
+		NodeID:    peer.NodeID,
+		PublicKey: peer.PublicKey,
+		Addrs:     []types.PathAddr{types.NewPathAddr("tcp", ln.Addr())},
+	})
+	if err != nil {
+		t.Fatalf("ConnectPeer: %v", err)
+	}
+	if _, ok := router.GetConnection(peer.NodeID); !ok {
+		t.Error("router should hold a connection to the peer")
+	}
+}
+
+// msgAnnounce is a message type no router handles, used to introduce a
+// dialer to the node it connected to.
+const msgAnnounce types.ProtocolMessageType = 0x7f
+
+// TestSimulatedHubRouting routes between 150 nodes that each know only a
+// hub, over the in-memory SimNetwork instead of sockets.
+func TestSimulatedHubRouting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const numLeaves = 150
+	network := bifrost.NewSimNetwork(1)
+	network.SetDefaultLink(bifrost.LinkConfig{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	hubID, _ := yggdrasil.GenerateIdentity()
+	hub := yggdrasil.NewRouter(hubID, yggdrasil.NewPeerTable(hubID.NodeID), yggdrasil.NewDHT(hubID.NodeID), nil)
+	ln, err := network.Transport("hub").Listen(ctx, ":0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept(ctx)
+			if err != nil {
+				return
+			}
+			go func() {
+				frame, err := conn.Receive()
+				if err != nil {
+					return
+				}
+				var msg yggdrasil.Message
+				if err := json.Unmarshal(frame.Payload, &msg); err != nil {
+					return
+				}
+				hub.AddConnection(msg.From, conn)
+				hub.HandleIncoming(&msg)
+				hub.ReceiveLoop(ctx, msg.From, conn)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(numLeaves)
+	leaves := make([]*yggdrasil.Router, numLeaves)
+	ids := make([]*yggdrasil.Identity, numLeaves)
+	for i := range leaves {
+		id, _ := yggdrasil.GenerateIdentity()
+		pt := yggdrasil.NewPeerTable(id.NodeID)
+		pt.AddPeer(yggdrasil.PeerInfo{NodeID: hubID.NodeID, PublicKey: hubID.PublicKey})
+		router := yggdrasil.NewRouter(id, pt, yggdrasil.NewDHT(id.NodeID), nil)
+
+		var once sync.Once
+		router.RegisterHandler(types.MsgPing, func(*yggdrasil.Message) (*yggdrasil.Message, error) {
+			once.Do(wg.Done)
+			return nil, nil
+		})
+
+		conn, err := network.Transport(fmt.Sprintf("leaf-%d", i)).Dial(ctx, ln.Addr())
+		if err != nil {
+			t.Fatalf("leaf %d dial: %v", i, err)
+		}
+		defer conn.Close()
+		router.AddConnection(hubID.NodeID, conn)
+		go router.ReceiveLoop(ctx, hubID.NodeID, conn)
+
+		// Announce ourselves so the hub can map the connection.
+		if err := router.SendMessage(ctx, &yggdrasil.Message{Type: msgAnnounce, To: hubID.NodeID}); err != nil {
+			t.Fatalf("leaf %d announce: %v", i, err)
+		}
+		leaves[i], ids[i] = router, id
+	}
+
+	// Wait until the hub has a connection to every leaf.
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < numLeaves; i++ {
+		for {
+			if _, ok := hub.GetConnection(ids[i].NodeID); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("hub never registered leaf %d", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Every leaf pings the next one; each message takes two hops via the hub.
+	for i, router := range leaves {
+		msg := &yggdrasil.Message{Type: types.MsgPing, To: ids[(i+1)%numLeaves].NodeID, TTL: 4}
+		if err := router.SendMessage(ctx, msg); err != nil {
+			t.Fatalf("leaf %d send: %v", i, err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("not every leaf received its ping")
+	}
+}
+
+func TestRouterRequestResponse(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 2)
+	client, server := nodes[1].router, nodes[0]
+
+	if rtt, err := client.Ping(ctx, server.id.NodeID); err != nil || rtt <= 0 {
+		t.Fatalf("Ping = %v, %v", rtt, err)
+	}
+
+	const (
+		msgEcho   types.ProtocolMessageType = 0x70
+		msgFail   types.ProtocolMessageType = 0x71
+		msgSilent types.ProtocolMessageType = 0x72
+	)
+	server.router.RegisterHandler(msgEcho, func(m *yggdrasil.Message) (*yggdrasil.Message, error) {
+		return &yggdrasil.Message{Payload: append([]byte("echo:"), m.Payload...)}, nil
+	})
+	server.router.RegisterHandler(msgFail, func(*yggdrasil.Message) (*yggdrasil.Message, error) {
+		return nil, fmt.Errorf("no such thing")
+	})
+	server.router.RegisterHandler(msgSilent, func(*yggdrasil.Message) (*yggdrasil.Message, error) {
+		return nil, nil
+	})
+
+	resp, err := client.Request(ctx, server.id.NodeID, msgEcho, []byte("hi"))
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if string(resp.Payload) != "echo:hi" || !resp.Response || resp.From != server.id.NodeID {
+		t.Fatalf("response = %+v", resp)
+	}
+
+	if _, err := client.Request(ctx, server.id.NodeID, msgFail, nil); !errors.Is(err, yggdrasil.ErrRemote) {
+		t.Fatalf("failing handler: %v, want ErrRemote", err)
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	if _, err := client.Request(short, server.id.NodeID, msgSilent, nil); !errors.Is(err, yggdrasil.ErrRequestTimeout) {
+		t.Fatalf("silent handler: %v, want ErrRequestTimeout", err)
+	}
+}
+
+// simChain links n sim nodes in a line, each connected only to its
+// neighbours.
+func simChain(t *testing.T, ctx context.Context, n int) []*simNode {
+	t.Helper()
+	network := bifrost.NewSimNetwork(1)
+	network.SetDefaultLink(bifrost.LinkConfig{Latency: 2 * time.Millisecond})
+	nodes := make([]*simNode, n)
+	for i := range nodes {
+		nodes[i] = startSimNode(t, ctx, network, fmt.Sprintf("c%d", i))
+		if i > 0 {
+			if _, err := nodes[i].router.Connect(ctx, nodes[i-1].addr, nodes[i-1].id.NodeID); err != nil {
+				t.Fatalf("connect %d-%d: %v", i-1, i, err)
+			}
+		}
+	}
+	return nodes
+}
+
+func TestRouterMultiHopPreservesOrigin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes := simChain(t, ctx, 5)
+	first, last := nodes[0], nodes[len(nodes)-1]
+
+	// The reply can only come back if relays keep From intact.
+	if _, err := first.router.Ping(ctx, last.id.NodeID); err != nil {
+		t.Fatalf("Ping across 4 hops: %v", err)
+	}
+
+	// Each hop costs exactly one unit of TTL: 4 hops need TTL 4.
+	const msgProbe types.ProtocolMessageType = 0x73
+	got := make(chan int, 2)
+	last.router.RegisterHandler(msgProbe, func(msg *yggdrasil.Message) (*yggdrasil.Message, error) {
+		got <- len(msg.Via)
+		return nil, nil
+	})
+	for _, ttl := range []int{3, 4} {
+		msg := &yggdrasil.Message{Type: msgProbe, To: last.id.NodeID, TTL: ttl}
+		if err := first.router.SendMessage(ctx, msg); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+	}
+	select {
+	case relays := <-got:
+		if relays != 3 {
+			t.Errorf("message passed %d relays, want 3", relays)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TTL 4 message did not arrive")
+	}
+	select {
+	case <-got:
+		t.Error("TTL 3 message arrived across 4 hops")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRouterTraceroute(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes := simChain(t, ctx, 4)
+
+	hops, err := nodes[0].router.Traceroute(ctx, nodes[3].id.NodeID)
+	if err != nil {
+		t.Fatalf("Traceroute: %v", err)
+	}
+	if len(hops) != 3 {
+		t.Fatalf("got %d hops, want 3: %v", len(hops), hops)
+	}
+	for i, hop := range hops {
+		if want := nodes[i+1].id.NodeID; hop.NodeID != want {
+			t.Errorf("hop %d = %s, want %s", i+1, hop.NodeID.Short(), want.Short())
+		}
+		// Each link adds 2ms each way.
+		if floor := time.Duration(4*(i+1)) * time.Millisecond; hop.RTT < floor {
+			t.Errorf("hop %d RTT %v, below the %v the links impose", i+1, hop.RTT, floor)
+		}
+	}
+}
+
+func TestRouterRejectsLoops(t *testing.T) {
+	self, _ := yggdrasil.GenerateIdentity()
+	other, _ := yggdrasil.GenerateIdentity()
+	target, _ := yggdrasil.GenerateIdentity()
+	router := yggdrasil.NewRouter(self, yggdrasil.NewPeerTable(self.NodeID), nil, nil)
+
+	tests := []struct {
+		name string
+		msg  *yggdrasil.Message
+	}{
+		{"revisits a relay", &yggdrasil.Message{From: other.NodeID, To: target.NodeID, TTL: 5, Via: []types.NodeID{self.NodeID}}},
+		{"returns to its sender", &yggdrasil.Message{From: self.NodeID, To: target.NodeID, TTL: 5, Via: []types.NodeID{other.NodeID}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := router.HandleIncoming(tt.msg); !errors.Is(err, yggdrasil.ErrRoutingLoop) {
+				t.Errorf("HandleIncoming = %v, want ErrRoutingLoop", err)
+			}
+		})
+	}
+}
+
+func TestRouterLearnsRouteLatency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes := simChain(t, ctx, 3)
+	first, last := nodes[0], nodes[2]
+
+	// The first reply teaches the route; the second measures it.
+	for i := 0; i < 2; i++ {
+		if _, err := first.router.Ping(ctx, last.id.NodeID); err != nil {
+			t.Fatalf("Ping %d: %v", i, err)
+		}
+	}
+	var route *yggdrasil.Route
+	for _, rt := range first.router.Routes() {
+		if rt.Dest == last.id.NodeID {
+			route = &rt
+		}
+	}
+	if route == nil {
+		t.Fatalf("no route to %s in %+v", last.id.NodeID.Short(), first.router.Routes())
+	}
+	if route.NextHop != nodes[1].id.NodeID || route.Hops != 2 {
+		t.Errorf("route = %+v, want 2 hops via %s", route, nodes[1].id.NodeID.Short())
+	}
+	// Two links at 2ms each way.
+	if route.RTT < 8*time.Millisecond {
+		t.Errorf("route RTT %v, below the 8ms the links impose", route.RTT)
+	}
+}
+
+func TestRouterDropsSilentPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	network := bifrost.NewSimNetwork(1)
+	node := startSimNode(t, ctx, network, "node")
+	live := startSimNode(t, ctx, network, "live")
+	keepalive := bifrost.KeepaliveConfig{Interval: 50 * time.Millisecond, IdleTimeout: 200 * time.Millisecond}
+	node.router.SetKeepalive(keepalive)
+	live.router.SetKeepalive(keepalive)
+
+	if _, err := live.router.Connect(ctx, node.addr, node.id.NodeID); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	// The silent peer proves its identity and then never reads again, so
+	// it answers no keepalive probes.
+	silent, _ := yggdrasil.GenerateIdentity()
+	reg := bifrost.NewRegistry()
+	reg.Register("mem", network.Transport("silent"))
+	conn, err := reg.Dial(ctx, string(node.addr))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := yggdrasil.ExchangeIdentity(ctx, silent, nil, conn); err != nil {
+		t.Fatalf("ExchangeIdentity: %v", err)
+	}
+	waitConnected(t, ctx, node, &simNode{id: silent})
+	registered := time.Now()
+
+	for {
+		if _, ok := node.router.GetConnection(silent.NodeID); !ok {
+			break
+		}
+		if time.Since(registered) > time.Second {
+			t.Fatal("silent peer still connected a second after registering")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := node.router.GetConnection(live.id.NodeID); !ok {
+		t.Error("peer answering keepalives was dropped too")
+	}
+}
+
+func TestRouterRedialReplacesConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	network := bifrost.NewSimNetwork(1)
+	a := startSimNode(t, ctx, network, "a")
+	b := startSimNode(t, ctx, network, "b")
+
+	if _, err := a.router.Connect(ctx, b.addr, b.id.NodeID); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	first, _ := a.router.GetConnection(b.id.NodeID)
+	if _, err := a.router.Connect(ctx, b.addr, b.id.NodeID); err != nil {
+		t.Fatalf("redial: %v", err)
+	}
+	if conn, _ := a.router.GetConnection(b.id.NodeID); conn == first {
+		t.Fatal("redial did not replace the connection")
+	}
+	if err := first.Send(&types.BifrostFrame{Type: types.FrameData}); err == nil {
+		t.Error("replaced connection is still open")
+	}
+	if _, err := a.router.Ping(ctx, b.id.NodeID); err != nil {
+		t.Errorf("Ping over the new connection: %v", err)
+	}
+}
+
+func TestRouterSimultaneousDialsSettle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	network := bifrost.NewSimNetwork(1)
+	a := startSimNode(t, ctx, network, "a")
+	b := startSimNode(t, ctx, network, "b")
+
+	errs := make(chan error, 2)
+	go func() { _, err := a.router.Connect(ctx, b.addr, b.id.NodeID); errs <- err }()
+	go func() { _, err := b.router.Connect(ctx, a.addr, a.id.NodeID); errs <- err }()
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+	}
+
+	// Both sides settle on the connection the lower NodeID opened: the
+	// lower node dialed the higher one's listener, and the higher node
+	// does not keep the connection it dialed to the lower one's.
+	lower, higher := a, b
+	if bytes.Compare(b.id.NodeID[:], a.id.NodeID[:]) < 0 {
+		lower, higher = b, a
+	}
+	lowerListen, _ := types.ParsePathAddr(lower.addr)
+	higherListen, _ := types.ParsePathAddr(higher.addr)
+	for {
+		out, ok := lower.router.GetConnection(higher.id.NodeID)
+		in, back := higher.router.GetConnection(lower.id.NodeID)
+		if ok && back && out.RemoteAddr() == higherListen.HostPort() && in.RemoteAddr() != lowerListen.HostPort() {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("nodes never settled on the lower NodeID's connection")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	for _, pair := range [][2]*simNode{{a, b}, {b, a}} {
+		if _, err := pair[0].router.Ping(ctx, pair[1].id.NodeID); err != nil {
+			t.Errorf("Ping %s -> %s: %v", pair[0].id.NodeID.Short(), pair[1].id.NodeID.Short(), err)
+		}
+	}
+}
+
+func TestRouterRefusesSelfConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	network := bifrost.NewSimNetwork(1)
+	a := startSimNode(t, ctx, network, "a")
+
+	if _, err := a.router.Connect(ctx, a.addr, types.NodeID{}); !errors.Is(err, yggdrasil.ErrSelfConnection) {
+		t.Fatalf("Connect to ourselves = %v, want ErrSelfConnection", err)
+	}
+	if _, ok := a.router.GetConnection(a.id.NodeID); ok {
+		t.Error("router registered a connection to itself")
+	}
+}
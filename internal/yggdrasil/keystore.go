@@ -0,0 +1,268 @@
+package yggdrasil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/valhalla/valhalla/internal/types"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keystoreVersion = 1
+	keystoreKDF     = "scrypt"
+	keystoreCipher  = "xchacha20-poly1305"
+	// keystoreDomain is bound into the ciphertext as associated data,
+	// along with the NodeID and public key stored beside it.
+	keystoreDomain = "valhalla-keystore-v1"
+	// maxScryptN bounds the work factor accepted from a keystore file.
+	maxScryptN = 1 << 22
+
+	// PassphraseEnv is the environment variable EnvPassphrase reads by
+	// default.
+	PassphraseEnv = "VALHALLA_PASSPHRASE"
+)
+
+var (
+	ErrWrongPassphrase = errors.New("yggdrasil: wrong passphrase or corrupted keystore")
+	ErrInvalidKeystore = errors.New("yggdrasil: invalid keystore")
+	ErrNoPassphrase    = errors.New("yggdrasil: no passphrase")
+)
+
+// ScryptParams are the scrypt cost parameters deriving a keystore's
+// encryption key from its passphrase.
+type ScryptParams struct {
+	N int `json:"n"`
+	R int `json:"r"`
+	P int `json:"p"`
+}
+
+// DefaultScryptParams returns the interactive-login costs recommended by
+// the scrypt paper: N=2^15, r=8, p=1.
+func DefaultScryptParams() ScryptParams {
+	return ScryptParams{N: 1 << 15, R: 8, P: 1}
+}
+
+// Keystore is an identity whose private key is encrypted under a
+// passphrase: scrypt derives a key that seals the Ed25519 seed with
+// XChaCha20-Poly1305. The NodeID, public key and puzzle solution are
+// public and stored in the clear.
+type Keystore struct {
+	Version    int               `json:"version"`
+	NodeID     types.NodeID      `json:"node_id"`
+	PublicKey  ed25519.PublicKey `json:"public_key"`
+	Puzzle     []byte            `json:"puzzle,omitempty"`
+	KDF        string            `json:"kdf"`
+	KDFParams  ScryptParams      `json:"kdf_params"`
+	Salt       []byte            `json:"salt"`
+	Cipher     string            `json:"cipher"`
+	Nonce      []byte            `json:"nonce"`
+	Ciphertext []byte            `json:"ciphertext"`
+}
+
+// NewKeystore encrypts id under passphrase with DefaultScryptParams.
+func NewKeystore(id *Identity, passphrase []byte) (*Keystore, error) {
+	return NewKeystoreWithParams(id, passphrase, DefaultScryptParams())
+}
+
+// NewKeystoreWithParams encrypts id under passphrase with custom scrypt
+// costs. Zero fields fall back to DefaultScryptParams.
+func NewKeystoreWithParams(id *Identity, passphrase []byte, params ScryptParams) (*Keystore, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrNoPassphrase
+	}
+	defaults := DefaultScryptParams()
+	if params.N <= 0 {
+		params.N = defaults.N
+	}
+	if params.R <= 0 {
+		params.R = defaults.R
+	}
+	if params.P <= 0 {
+		params.P = defaults.P
+	}
+
+	id.mu.RLock()
+	ks := &Keystore{
+		Version:   keystoreVersion,
+		NodeID:    id.NodeID,
+		PublicKey: id.PublicKey,
+		Puzzle:    id.Puzzle,
+		KDF:       keystoreKDF,
+		KDFParams: params,
+		Cipher:    keystoreCipher,
+		Salt:      make([]byte, 32),
+		Nonce:     make([]byte, chacha20poly1305.NonceSizeX),
+	}
+	seed := id.PrivateKey.Seed()
+	id.mu.RUnlock()
+
+	if _, err := rand.Read(ks.Salt); err != nil {
+		return nil, fmt.Errorf("yggdrasil: keystore salt: %w", err)
+	}
+	if _, err := rand.Read(ks.Nonce); err != nil {
+		return nil, fmt.Errorf("yggdrasil: keystore nonce: %w", err)
+	}
+	aead, err := ks.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ks.Ciphertext = aead.Seal(nil, ks.Nonce, seed, ks.associatedData())
+	return ks, nil
+}
+
+// Open decrypts the keystore and returns the identity, checking that the
+// key matches the stored NodeID.
+func (ks *Keystore) Open(passphrase []byte) (*Identity, error) {
+	if ks.Version != keystoreVersion || ks.KDF != keystoreKDF || ks.Cipher != keystoreCipher {
+		return nil, fmt.Errorf("%w: unsupported format %d/%s/%s", ErrInvalidKeystore, ks.Version, ks.KDF, ks.Cipher)
+	}
+	if len(ks.Nonce) != chacha20poly1305.NonceSizeX || len(ks.Salt) == 0 {
+		return nil, fmt.Errorf("%w: bad nonce or salt", ErrInvalidKeystore)
+	}
+	aead, err := ks.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := aead.Open(nil, ks.Nonce, ks.Ciphertext, ks.associatedData())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%w: bad seed", ErrInvalidKeystore)
+	}
+
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := priv.Public().(ed25519.PublicKey)
+	if !bytes.Equal(pub, ks.PublicKey) || types.NodeIDFromPublicKey(pub) != ks.NodeID {
+		return nil, fmt.Errorf("%w: key does not match NodeID", ErrInvalidKeystore)
+	}
+	return &Identity{PrivateKey: priv, PublicKey: pub, NodeID: ks.NodeID, Puzzle: ks.Puzzle}, nil
+}
+
+func (ks *Keystore) aead(passphrase []byte) (interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}, error) {
+	p := ks.KDFParams
+	if p.N <= 1 || p.N > maxScryptN || p.N&(p.N-1) != 0 || p.R <= 0 || p.P <= 0 || p.R*p.P >= 1<<30 {
+		return nil, fmt.Errorf("%w: scrypt parameters %+v", ErrInvalidKeystore, p)
+	}
+	key, err := scrypt.Key(passphrase, ks.Salt, p.N, p.R, p.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("yggdrasil: keystore key: %w", err)
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+func (ks *Keystore) associatedData() []byte {
+	data := make([]byte, 0, len(keystoreDomain)+len(ks.NodeID)+len(ks.PublicKey))
+	data = append(data, keystoreDomain...)
+	data = append(data, ks.NodeID[:]...)
+	return append(data, ks.PublicKey...)
+}
+
+// Save writes the keystore as JSON with mode 0600.
+func (ks *Keystore) Save(path string) error {
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("yggdrasil: marshal keystore: %w", err)
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadKeystore reads a keystore written by Save.
+func LoadKeystore(path string) (*Keystore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("yggdrasil: read keystore: %w", err)
+	}
+	var ks Keystore
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeystore, err)
+	}
+	return &ks, nil
+}
+
+// SaveEncrypted persists the identity to an encrypted keystore file.
+func (id *Identity) SaveEncrypted(path string, passphrase []byte) error {
+	ks, err := NewKeystore(id, passphrase)
+	if err != nil {
+		return err
+	}
+	return ks.Save(path)
+}
+
+// LoadEncryptedIdentity loads an identity from a keystore file written by
+// SaveEncrypted.
+func LoadEncryptedIdentity(path string, passphrase []byte) (*Identity, error) {
+	ks, err := LoadKeystore(path)
+	if err != nil {
+		return nil, err
+	}
+	return ks.Open(passphrase)
+}
+
+// PassphraseSource supplies a keystore passphrase, returning
+// ErrNoPassphrase if it has none.
+type PassphraseSource func() ([]byte, error)
+
+// EnvPassphrase reads the passphrase from the environment variable name,
+// or PassphraseEnv if name is empty.
+func EnvPassphrase(name string) PassphraseSource {
+	if name == "" {
+		name = PassphraseEnv
+	}
+	return func() ([]byte, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return nil, fmt.Errorf("%w: %s is not set", ErrNoPassphrase, name)
+		}
+		return []byte(v), nil
+	}
+}
+
+// PromptPassphrase writes prompt to out and reads one line from in.
+// Input is echoed unless in is a terminal the caller has put in no-echo
+// mode.
+func PromptPassphrase(prompt string, in io.Reader, out io.Writer) PassphraseSource {
+	return func() ([]byte, error) {
+		if _, err := io.WriteString(out, prompt); err != nil {
+			return nil, fmt.Errorf("yggdrasil: passphrase prompt: %w", err)
+		}
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, fmt.Errorf("%w: %v", ErrNoPassphrase, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return nil, ErrNoPassphrase
+		}
+		return []byte(line), nil
+	}
+}
+
+// FirstPassphrase tries each source in turn, moving on while they return
+// ErrNoPassphrase. For example, EnvPassphrase("") then PromptPassphrase
+// on the terminal.
+func FirstPassphrase(sources ...PassphraseSource) PassphraseSource {
+	return func() ([]byte, error) {
+		for _, src := range sources {
+			p, err := src()
+			if errors.Is(err, ErrNoPassphrase) {
+				continue
+			}
+			return p, err
+		}
+		return nil, ErrNoPassphrase
+	}
+}
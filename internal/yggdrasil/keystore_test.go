@@ -0,0 +1,114 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fastScrypt keeps key derivation cheap in tests.
+var fastScrypt = ScryptParams{N: 1 << 10, R: 8, P: 1}
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	id, _ := GenerateIdentity()
+	id.Puzzle = bytes.Repeat([]byte{7}, 32)
+	pass := []byte("correct horse")
+
+	ks, err := NewKeystoreWithParams(id, pass, fastScrypt)
+	if err != nil {
+		t.Fatalf("NewKeystoreWithParams: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "identity.key")
+	if err := ks.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("file permissions: got %o, want 0600", perm)
+	}
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, id.PrivateKey.Seed()) || strings.Contains(string(data), "private_key") {
+		t.Error("keystore file holds the private key in the clear")
+	}
+
+	loaded, err := LoadEncryptedIdentity(path, pass)
+	if err != nil {
+		t.Fatalf("LoadEncryptedIdentity: %v", err)
+	}
+	if loaded.NodeID != id.NodeID || !bytes.Equal(loaded.Puzzle, id.Puzzle) {
+		t.Error("loaded identity doesn't match original")
+	}
+	msg := []byte("keystore test")
+	if !id.Verify(msg, loaded.Sign(msg)) {
+		t.Error("loaded key doesn't sign for the original identity")
+	}
+}
+
+func TestKeystoreRejects(t *testing.T) {
+	id, _ := GenerateIdentity()
+	other, _ := GenerateIdentity()
+	pass := []byte("correct horse")
+
+	tests := []struct {
+		name   string
+		tamper func(*Keystore)
+		pass   []byte
+		want   error
+	}{
+		{"wrong passphrase", func(*Keystore) {}, []byte("battery staple"), ErrWrongPassphrase},
+		{"tampered ciphertext", func(ks *Keystore) { ks.Ciphertext[0] ^= 0xff }, pass, ErrWrongPassphrase},
+		{"swapped NodeID", func(ks *Keystore) { ks.NodeID = other.NodeID }, pass, ErrWrongPassphrase},
+		{"swapped public key", func(ks *Keystore) { ks.PublicKey = other.PublicKey }, pass, ErrWrongPassphrase},
+		{"unknown cipher", func(ks *Keystore) { ks.Cipher = "rot13" }, pass, ErrInvalidKeystore},
+		{"huge scrypt cost", func(ks *Keystore) { ks.KDFParams.N = 1 << 30 }, pass, ErrInvalidKeystore},
+		{"short nonce", func(ks *Keystore) { ks.Nonce = ks.Nonce[:12] }, pass, ErrInvalidKeystore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks, err := NewKeystoreWithParams(id, pass, fastScrypt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(ks)
+			if _, err := ks.Open(tt.pass); !errors.Is(err, tt.want) {
+				t.Errorf("Open = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewKeystore(id, nil); !errors.Is(err, ErrNoPassphrase) {
+		t.Errorf("NewKeystore with empty passphrase = %v, want ErrNoPassphrase", err)
+	}
+}
+
+func TestPassphraseSources(t *testing.T) {
+	t.Setenv(PassphraseEnv, "from-env")
+	if p, err := EnvPassphrase("")(); err != nil || string(p) != "from-env" {
+		t.Errorf("EnvPassphrase = %q, %v", p, err)
+	}
+
+	var out bytes.Buffer
+	prompt := PromptPassphrase("Passphrase: ", strings.NewReader("typed\r\nignored\n"), &out)
+	if p, err := prompt(); err != nil || string(p) != "typed" {
+		t.Errorf("PromptPassphrase = %q, %v", p, err)
+	}
+	if out.String() != "Passphrase: " {
+		t.Errorf("prompt wrote %q", out.String())
+	}
+
+	unset := EnvPassphrase("VALHALLA_TEST_UNSET_PASSPHRASE")
+	first := FirstPassphrase(unset, PromptPassphrase("", strings.NewReader("fallback"), &out))
+	if p, err := first(); err != nil || string(p) != "fallback" {
+		t.Errorf("FirstPassphrase = %q, %v, want the prompt's answer", p, err)
+	}
+	none := FirstPassphrase(unset, PromptPassphrase("", strings.NewReader("\n"), &out))
+	if _, err := none(); !errors.Is(err, ErrNoPassphrase) {
+		t.Errorf("FirstPassphrase with no answers = %v, want ErrNoPassphrase", err)
+	}
+}
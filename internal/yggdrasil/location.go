@@ -0,0 +1,353 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+const (
+	// DefaultLocationTTL is how long a published location stays valid.
+	DefaultLocationTTL = time.Hour
+	// DefaultRepublishInterval is how often a LocationPublisher refreshes
+	// its record when nothing changes; well inside DefaultLocationTTL.
+	DefaultRepublishInterval = DefaultLocationTTL / 2
+	// MaxLocationAddrs bounds the addresses in one LocationRecord.
+	MaxLocationAddrs = 32
+)
+
+// locationMagic opens every encoded LocationRecord, so a location
+// signature cannot be passed off as a signature over any other value.
+const (
+	locationMagic   = "VLOC"
+	locationVersion = 1
+	// magic, version, node ID, public key, sequence, timestamp, expires,
+	// address count
+	locationFixedSize = len(locationMagic) + 1 + 32 + ed25519.PublicKeySize + 8 + 8 + 8 + 1
+)
+
+var (
+	ErrInvalidLocation = errors.New("yggdrasil: invalid location record")
+	ErrLocationExpired = errors.New("yggdrasil: location record expired")
+)
+
+// LocationRecord maps a NodeID to its current PathAddrs. It is published
+// in the DHT under the NodeID, signed by the node's own key.
+type LocationRecord struct {
+	NodeID    types.NodeID      `json:"node_id"`
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	Addrs     []types.PathAddr  `json:"addrs"`
+	Sequence  uint64            `json:"sequence"`
+	Timestamp int64             `json:"timestamp"`
+	Expires   int64             `json:"expires"`
+	Signature []byte            `json:"signature"`
+}
+
+// SignLocation builds a location record for id valid for ttl and signs it.
+func SignLocation(id *Identity, addrs []types.PathAddr, seq uint64, ttl time.Duration) (*LocationRecord, error) {
+	now := time.Now()
+	loc := &LocationRecord{
+		NodeID:    id.NodeID,
+		PublicKey: id.PublicKey,
+		Addrs:     addrs,
+		Sequence:  seq,
+		Timestamp: now.UnixMilli(),
+		Expires:   now.Add(ttl).UnixMilli(),
+	}
+	data, err := loc.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	loc.Signature = id.Sign(data)
+	return loc, nil
+}
+
+// MarshalBinary returns the canonical encoding of the record, which is
+// what its signature covers:
+//
+//	"VLOC" [version:1] [node_id:32] [public_key:32] [sequence:8]
+//	[timestamp:8] [expires:8] [addr_count:1] ([addr_len:2] [addr])...
+//
+// Integers are big-endian.
+func (l *LocationRecord) MarshalBinary() ([]byte, error) {
+	if len(l.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: bad public key", ErrInvalidLocation)
+	}
+	if len(l.Addrs) > MaxLocationAddrs {
+		return nil, fmt.Errorf("%w: %d addresses (max %d)", ErrInvalidLocation, len(l.Addrs), MaxLocationAddrs)
+	}
+
+	buf := make([]byte, 0, locationFixedSize+16*len(l.Addrs))
+	buf = append(buf, locationMagic...)
+	buf = append(buf, locationVersion)
+	buf = append(buf, l.NodeID[:]...)
+	buf = append(buf, l.PublicKey...)
+	buf = binary.BigEndian.AppendUint64(buf, l.Sequence)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(l.Timestamp))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(l.Expires))
+	buf = append(buf, byte(len(l.Addrs)))
+	for _, a := range l.Addrs {
+		if len(a) > 0xffff {
+			return nil, fmt.Errorf("%w: address too long", ErrInvalidLocation)
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(a)))
+		buf = append(buf, a...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the encoding produced by MarshalBinary. Every
+// address must parse as a PathAddr, and trailing bytes are rejected so
+// each record has exactly one encoding. Signature is left unchanged.
+func (l *LocationRecord) UnmarshalBinary(data []byte) error {
+	if !isLocationValue(data) || len(data) < locationFixedSize {
+		return fmt.Errorf("%w: not a location encoding", ErrInvalidLocation)
+	}
+	if v := data[len(locationMagic)]; v != locationVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrInvalidLocation, v)
+	}
+
+	p := data[len(locationMagic)+1:]
+	var loc LocationRecord
+	copy(loc.NodeID[:], p[:32])
+	loc.PublicKey = ed25519.PublicKey(bytes.Clone(p[32:64]))
+	loc.Sequence = binary.BigEndian.Uint64(p[64:72])
+	loc.Timestamp = int64(binary.BigEndian.Uint64(p[72:80]))
+	loc.Expires = int64(binary.BigEndian.Uint64(p[80:88]))
+	n := int(p[88])
+	p = p[89:]
+	if n > MaxLocationAddrs {
+		return fmt.Errorf("%w: %d addresses (max %d)", ErrInvalidLocation, n, MaxLocationAddrs)
+	}
+
+	for i := 0; i < n; i++ {
+		if len(p) < 2 {
+			return fmt.Errorf("%w: truncated", ErrInvalidLocation)
+		}
+		size := int(binary.BigEndian.Uint16(p))
+		if len(p) < 2+size {
+			return fmt.Errorf("%w: truncated", ErrInvalidLocation)
+		}
+		addr := types.PathAddr(p[2 : 2+size])
+		if _, err := types.ParsePathAddr(addr); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidLocation, err)
+		}
+		loc.Addrs = append(loc.Addrs, addr)
+		p = p[2+size:]
+	}
+	if len(p) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidLocation, len(p))
+	}
+
+	loc.Signature = l.Signature
+	*l = loc
+	return nil
+}
+
+// Verify checks that the record is signed by the key its NodeID is
+// derived from and has not expired.
+func (l *LocationRecord) Verify() error {
+	if len(l.PublicKey) != ed25519.PublicKeySize || types.NodeIDFromPublicKey(l.PublicKey) != l.NodeID {
+		return fmt.Errorf("%w: NodeID does not match public key", ErrInvalidLocation)
+	}
+	data, err := l.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if !VerifyWithKey(l.PublicKey, data, l.Signature) {
+		return fmt.Errorf("%w: bad signature", ErrInvalidLocation)
+	}
+	if time.Now().UnixMilli() >= l.Expires {
+		return ErrLocationExpired
+	}
+	return nil
+}
+
+// dhtRecord wraps the location for storage under its NodeID. The value
+// is the canonical encoding followed by [signature:64]; the caller signs
+// the record itself.
+func (l *LocationRecord) dhtRecord() (*DHTRecord, error) {
+	data, err := l.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.Signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidLocation)
+	}
+	return &DHTRecord{
+		Key:       l.NodeID,
+		Value:     append(data, l.Signature...),
+		Sequence:  l.Sequence,
+		Timestamp: l.Timestamp,
+	}, nil
+}
+
+// LocationFromRecord decodes and verifies the location held in a DHT
+// record, including that the record is keyed and published by the node
+// it locates.
+func LocationFromRecord(rec *DHTRecord) (*LocationRecord, error) {
+	if len(rec.Value) < ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: not a location encoding", ErrInvalidLocation)
+	}
+	data, sig := rec.Value[:len(rec.Value)-ed25519.SignatureSize], rec.Value[len(rec.Value)-ed25519.SignatureSize:]
+	loc := &LocationRecord{Signature: bytes.Clone(sig)}
+	if err := loc.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if rec.Key != loc.NodeID || rec.Publisher != loc.NodeID ||
+		!bytes.Equal(rec.PubKey, loc.PublicKey) || rec.Sequence != loc.Sequence {
+		return nil, fmt.Errorf("%w: record does not match its contents", ErrInvalidLocation)
+	}
+	if err := loc.Verify(); err != nil {
+		return nil, err
+	}
+	return loc, nil
+}
+
+func isLocationValue(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(locationMagic))
+}
+
+// PutLocation stores a signed location record for a NodeID, valid for
+// DefaultLocationTTL.
+func (d *DHT) PutLocation(id *Identity, addrs []types.PathAddr, seq uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLookupTimeout)
+	defer cancel()
+	return d.publishLocation(ctx, id, addrs, seq, DefaultLocationTTL)
+}
+
+func (d *DHT) publishLocation(ctx context.Context, id *Identity, addrs []types.PathAddr, seq uint64, ttl time.Duration) error {
+	loc, err := SignLocation(id, addrs, seq, ttl)
+	if err != nil {
+		return err
+	}
+	record, err := loc.dhtRecord()
+	if err != nil {
+		return err
+	}
+	record.Sign(id)
+	return d.PutContext(ctx, record)
+}
+
+// GetLocation retrieves the location record for a NodeID.
+func (d *DHT) GetLocation(nodeID types.NodeID) (*DHTRecord, bool) {
+	return d.Get(nodeID)
+}
+
+// ResolveLocation returns the verified, unexpired addresses nodeID last
+// published. It uses the local store if it holds a valid record and
+// otherwise looks the record up. Lookup results are not cached, so a
+// node that moves is found at its new addresses.
+func (d *DHT) ResolveLocation(ctx context.Context, nodeID types.NodeID) ([]types.PathAddr, error) {
+	if rec, ok := d.getLocal(nodeID); ok {
+		if loc, err := LocationFromRecord(rec); err == nil && loc.NodeID == nodeID {
+			return loc.Addrs, nil
+		}
+	}
+
+	rec, err := d.findValue(ctx, nodeID, func(rec *DHTRecord) bool {
+		loc, err := LocationFromRecord(rec)
+		return err == nil && loc.NodeID == nodeID
+	})
+	if err != nil {
+		return nil, err
+	}
+	loc, err := LocationFromRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	return loc.Addrs, nil
+}
+
+// LocationPublisher keeps a node's location record in the DHT current. It
+// republishes periodically, before the record expires, and immediately
+// when the node's addresses change, with a higher sequence number each
+// time.
+type LocationPublisher struct {
+	dht      *DHT
+	identity *Identity
+	interval time.Duration
+	ttl      time.Duration
+	changed  chan struct{}
+
+	mu    sync.Mutex
+	addrs []types.PathAddr
+	seq   uint64
+}
+
+// NewLocationPublisher creates a publisher for identity's location. Zero
+// interval and ttl select DefaultRepublishInterval and DefaultLocationTTL.
+func NewLocationPublisher(dht *DHT, identity *Identity, interval, ttl time.Duration) *LocationPublisher {
+	if ttl <= 0 {
+		ttl = DefaultLocationTTL
+	}
+	if interval <= 0 {
+		interval = min(DefaultRepublishInterval, ttl/2)
+	}
+	return &LocationPublisher{
+		dht:      dht,
+		identity: identity,
+		interval: interval,
+		ttl:      ttl,
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// SetAddrs updates the addresses to publish. A running publisher
+// republishes at once if they differ from the current set.
+func (p *LocationPublisher) SetAddrs(addrs []types.PathAddr) {
+	p.mu.Lock()
+	same := slices.Equal(p.addrs, addrs)
+	p.addrs = slices.Clone(addrs)
+	p.mu.Unlock()
+	if same {
+		return
+	}
+	select {
+	case p.changed <- struct{}{}:
+	default: // a republish is already pending
+	}
+}
+
+// Sequence returns the sequence number of the last published record.
+func (p *LocationPublisher) Sequence() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seq
+}
+
+// Publish signs and stores the current addresses under the next sequence
+// number. Sequence numbers follow the wall clock in milliseconds, so a
+// restarted node still supersedes the records it published before.
+func (p *LocationPublisher) Publish(ctx context.Context) error {
+	p.mu.Lock()
+	p.seq = max(p.seq+1, uint64(time.Now().UnixMilli()))
+	seq, addrs := p.seq, p.addrs
+	p.mu.Unlock()
+	return p.dht.publishLocation(ctx, p.identity, addrs, seq, p.ttl)
+}
+
+// Run publishes once, then republishes every interval and whenever the
+// addresses change, until ctx is done.
+func (p *LocationPublisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.Publish(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.changed:
+			ticker.Reset(p.interval)
+		}
+	}
+}
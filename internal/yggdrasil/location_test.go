@@ -0,0 +1,228 @@
+package yggdrasil_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+)
+
+func TestLocationRecordRoundTrip(t *testing.T) {
+	id, _ := yggdrasil.GenerateIdentity()
+	addrs := []types.PathAddr{"/tcp/10.0.0.1:9000", "/ws/example.com:443/bifrost"}
+	loc, err := yggdrasil.SignLocation(id, addrs, 7, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loc.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	data, err := loc.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &yggdrasil.LocationRecord{Signature: loc.Signature}
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if got.NodeID != id.NodeID || got.Sequence != 7 || got.Expires != loc.Expires || !slices.Equal(got.Addrs, addrs) {
+		t.Errorf("decoded %+v, want %+v", got, loc)
+	}
+	if err := got.Verify(); err != nil {
+		t.Errorf("decoded record fails Verify: %v", err)
+	}
+}
+
+func TestLocationRecordRejects(t *testing.T) {
+	id, _ := yggdrasil.GenerateIdentity()
+	other, _ := yggdrasil.GenerateIdentity()
+	sign := func(ttl time.Duration) *yggdrasil.LocationRecord {
+		loc, err := yggdrasil.SignLocation(id, []types.PathAddr{"/tcp/10.0.0.1:9000"}, 1, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(loc *yggdrasil.LocationRecord)
+		wantErr error
+	}{
+		{
+			name:    "redirected address",
+			mutate:  func(loc *yggdrasil.LocationRecord) { loc.Addrs = []types.PathAddr{"/tcp/6.6.6.6:9000"} },
+			wantErr: yggdrasil.ErrInvalidLocation,
+		},
+		{
+			name:    "bumped sequence",
+			mutate:  func(loc *yggdrasil.LocationRecord) { loc.Sequence++ },
+			wantErr: yggdrasil.ErrInvalidLocation,
+		},
+		{
+			name:    "NodeID of another key",
+			mutate:  func(loc *yggdrasil.LocationRecord) { loc.NodeID = other.NodeID },
+			wantErr: yggdrasil.ErrInvalidLocation,
+		},
+		{
+			name: "re-signed by another key",
+			mutate: func(loc *yggdrasil.LocationRecord) {
+				loc.PublicKey = other.PublicKey
+				data, _ := loc.MarshalBinary()
+				loc.Signature = other.Sign(data)
+			},
+			wantErr: yggdrasil.ErrInvalidLocation,
+		},
+		{
+			name:    "expired",
+			mutate:  func(loc *yggdrasil.LocationRecord) { *loc = *sign(-time.Second) },
+			wantErr: yggdrasil.ErrLocationExpired,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := sign(time.Hour)
+			tt.mutate(loc)
+			if err := loc.Verify(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLocationRecordDecodeRejectsMalformed(t *testing.T) {
+	id, _ := yggdrasil.GenerateIdentity()
+	loc, _ := yggdrasil.SignLocation(id, []types.PathAddr{"/tcp/10.0.0.1:9000"}, 1, time.Hour)
+	data, _ := loc.MarshalBinary()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"wrong magic", append([]byte("XLOC"), data[4:]...)},
+		{"unknown version", append(append([]byte("VLOC"), 9), data[5:]...)},
+		{"truncated", data[:len(data)-3]},
+		{"trailing bytes", append(slices.Clone(data), 0)},
+		{"bad address", bytes.Replace(data, []byte(":9000"), []byte(":9z00"), 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got yggdrasil.LocationRecord
+			if err := got.UnmarshalBinary(tt.data); !errors.Is(err, yggdrasil.ErrInvalidLocation) {
+				t.Errorf("UnmarshalBinary = %v, want ErrInvalidLocation", err)
+			}
+		})
+	}
+}
+
+func TestDHTRejectsForgedLocation(t *testing.T) {
+	victim, _ := yggdrasil.GenerateIdentity()
+	mallory, _ := yggdrasil.GenerateIdentity()
+	dht := yggdrasil.NewDHT(victim.NodeID)
+
+	// Mallory signs a location claiming the victim's NodeID with its own
+	// key and a sequence number that would supersede the real record.
+	forged := &yggdrasil.LocationRecord{
+		NodeID:    victim.NodeID,
+		PublicKey: mallory.PublicKey,
+		Addrs:     []types.PathAddr{"/tcp/6.6.6.6:9000"},
+		Sequence:  1 << 40,
+		Expires:   time.Now().Add(time.Hour).UnixMilli(),
+	}
+	data, _ := forged.MarshalBinary()
+	rec := &yggdrasil.DHTRecord{
+		Key:       victim.NodeID,
+		Value:     append(data, mallory.Sign(data)...),
+		Sequence:  forged.Sequence,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	rec.Sign(mallory)
+	if err := dht.Put(rec); !errors.Is(err, yggdrasil.ErrInvalidLocation) {
+		t.Fatalf("Put(forged) = %v, want ErrInvalidLocation", err)
+	}
+	if _, err := dht.ResolveLocation(context.Background(), victim.NodeID); err == nil {
+		t.Fatal("forged location resolved")
+	}
+}
+
+func TestResolveLocationAcrossDHT(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 30)
+	for _, n := range nodes[1:] {
+		n.dht.LookupNode(ctx, n.id.NodeID)
+	}
+
+	publisher := nodes[3]
+	if err := publisher.dht.PutLocation(publisher.id, []types.PathAddr{publisher.addr}, 1); err != nil {
+		t.Fatalf("PutLocation: %v", err)
+	}
+
+	far := farthestNode(nodes, publisher)
+	addrs, err := far.dht.ResolveLocation(ctx, publisher.id.NodeID)
+	if err != nil {
+		t.Fatalf("ResolveLocation: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != publisher.addr {
+		t.Errorf("resolved %v, want [%s]", addrs, publisher.addr)
+	}
+
+	unknown, _ := yggdrasil.GenerateIdentity()
+	if _, err := far.dht.ResolveLocation(ctx, unknown.NodeID); !errors.Is(err, yggdrasil.ErrNotFound) {
+		t.Errorf("ResolveLocation(unknown) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocationPublisherRepublishesOnChange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 20)
+	for _, n := range nodes[1:] {
+		n.dht.LookupNode(ctx, n.id.NodeID)
+	}
+
+	publisher := nodes[2]
+	pub := yggdrasil.NewLocationPublisher(publisher.dht, publisher.id, time.Hour, 0)
+	pub.SetAddrs([]types.PathAddr{"/tcp/10.0.0.1:9000"})
+	go pub.Run(ctx)
+
+	far := farthestNode(nodes, publisher)
+	waitResolves(t, ctx, far, publisher.id.NodeID, "/tcp/10.0.0.1:9000")
+	first := pub.Sequence()
+
+	pub.SetAddrs([]types.PathAddr{"/tcp/10.0.0.2:9000"})
+	waitResolves(t, ctx, far, publisher.id.NodeID, "/tcp/10.0.0.2:9000")
+	if pub.Sequence() <= first {
+		t.Errorf("sequence did not increase: %d -> %d", first, pub.Sequence())
+	}
+}
+
+// farthestNode returns the node farthest from target's NodeID, which is
+// outside the replica set for target's location.
+func farthestNode(nodes []*simNode, target *simNode) *simNode {
+	sorted := closestNodes(nodes, target.id.NodeID, len(nodes))
+	return sorted[len(sorted)-1]
+}
+
+func waitResolves(t *testing.T, ctx context.Context, n *simNode, id types.NodeID, want types.PathAddr) {
+	t.Helper()
+	for {
+		addrs, err := n.dht.ResolveLocation(ctx, id)
+		if err == nil && len(addrs) == 1 && addrs[0] == want {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("never resolved to %s: last %v, %v", want, addrs, err)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
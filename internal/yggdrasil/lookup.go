@@ -0,0 +1,430 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+const (
+	// Alpha is the number of nodes queried in parallel per lookup round.
+	Alpha = 3
+	// DefaultLookupTimeout bounds Put replication and Get lookups.
+	DefaultLookupTimeout = 10 * time.Second
+	// queryTimeout bounds a single RPC within a lookup, so one dead node
+	// does not stall a round.
+	queryTimeout = 2 * time.Second
+)
+
+var (
+	ErrNotFound    = errors.New("yggdrasil: value not found")
+	ErrNoPeers     = errors.New("yggdrasil: no peers to query")
+	ErrDHTDetached = errors.New("yggdrasil: DHT is not attached to a router")
+)
+
+// RPC payloads, JSON-encoded in Message.Payload. Requests carry the
+// sender's contact so the responder can add it to its peer table, as in
+// Kademlia.
+type findNodeRequest struct {
+	Target types.NodeID `json:"target"`
+	Sender PeerInfo     `json:"sender"`
+}
+
+type findValueRequest struct {
+	Key    [32]byte `json:"key"`
+	Sender PeerInfo `json:"sender"`
+}
+
+type storeRequest struct {
+	Record *DHTRecord `json:"record"`
+	Sender PeerInfo   `json:"sender"`
+}
+
+// lookupResponse answers FIND_NODE and FIND_VALUE. Record is set only by
+// FIND_VALUE when the responder holds the key.
+type lookupResponse struct {
+	Peers  []PeerInfo `json:"peers,omitempty"`
+	Record *DHTRecord `json:"record,omitempty"`
+}
+
+// attach registers the DHT's RPC handlers on r.
+func (d *DHT) attach(r *Router) {
+	d.mu.Lock()
+	d.router = r
+	d.mu.Unlock()
+
+	r.handlers[types.MsgFindNode] = d.handleFindNode
+	r.handlers[types.MsgFindValue] = d.handleFindValue
+	r.handlers[types.MsgStore] = d.handleStore
+}
+
+// learnSender adds a requester to the peer table if its contact matches
+// the message it sent. A sender the table refuses is still answered, but
+// not remembered.
+func (d *DHT) learnSender(msg *Message, sender PeerInfo) {
+	if sender.NodeID != msg.From || types.NodeIDFromPublicKey(sender.PublicKey) != sender.NodeID {
+		return
+	}
+	sender.LastSeen = time.Now().UnixMilli()
+	if err := d.router.peers.AddPeer(sender); err != nil {
+		d.router.emitEvent("peer_refused", map[string]string{
+			"peer":  sender.NodeID.Short(),
+			"error": err.Error(),
+		})
+	}
+}
+
+func (d *DHT) handleFindNode(msg *Message) (*Message, error) {
+	var req findNodeRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return nil, fmt.Errorf("dht: bad FIND_NODE: %w", err)
+	}
+	d.learnSender(msg, req.Sender)
+	return lookupReply(lookupResponse{Peers: d.router.peers.FindClosest(req.Target, KBucketSize)})
+}
+
+func (d *DHT) handleFindValue(msg *Message) (*Message, error) {
+	var req findValueRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return nil, fmt.Errorf("dht: bad FIND_VALUE: %w", err)
+	}
+	d.learnSender(msg, req.Sender)
+	if rec, ok := d.getLocal(req.Key); ok {
+		return lookupReply(lookupResponse{Record: rec})
+	}
+	return lookupReply(lookupResponse{Peers: d.router.peers.FindClosest(req.Key, KBucketSize)})
+}
+
+func (d *DHT) handleStore(msg *Message) (*Message, error) {
+	var req storeRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.Record == nil {
+		return nil, fmt.Errorf("dht: bad STORE")
+	}
+	d.learnSender(msg, req.Sender)
+	if err := d.store(req.Record); err != nil {
+		return nil, err
+	}
+	return &Message{}, nil
+}
+
+func lookupReply(resp lookupResponse) (*Message, error) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Payload: data}, nil
+}
+
+// LookupNode runs an iterative FIND_NODE lookup and returns up to k
+// responsive nodes closest to target, nearest first.
+func (d *DHT) LookupNode(ctx context.Context, target types.NodeID) ([]PeerInfo, error) {
+	peers, _, _, err := d.lookup(ctx, target, nil)
+	return peers, err
+}
+
+// RefreshBuckets looks up a random ID in each bucket that has gone maxAge
+// without a lookup, and returns how many buckets it refreshed.
+func (d *DHT) RefreshBuckets(ctx context.Context, maxAge time.Duration) int {
+	r := d.getRouter()
+	if r == nil {
+		return 0
+	}
+	refreshed := 0
+	for _, idx := range r.peers.staleBuckets(maxAge) {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, err := d.LookupNode(ctx, r.peers.randomIDInBucket(idx)); err == nil {
+			refreshed++
+		}
+	}
+	return refreshed
+}
+
+// RefreshLoop refreshes buckets idle for longer than interval, checking
+// once per interval, until ctx is done.
+func (d *DHT) RefreshLoop(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.RefreshBuckets(ctx, interval)
+		}
+	}
+}
+
+// FindValue runs an iterative FIND_VALUE lookup for key, ignoring the
+// local store.
+func (d *DHT) FindValue(ctx context.Context, key [32]byte) (*DHTRecord, error) {
+	return d.findValue(ctx, key, func(*DHTRecord) bool { return true })
+}
+
+// findValue is FindValue restricted to records valid accepts; others are
+// skipped as if the responder did not hold the key.
+func (d *DHT) findValue(ctx context.Context, key [32]byte, valid func(*DHTRecord) bool) (*DHTRecord, error) {
+	rec, _, err := d.findValueReport(ctx, key, valid)
+	return rec, err
+}
+
+// LookupValue is FindValue that also reports what each disjoint path
+// found and which disagreed with the record returned. The report is
+// returned with ErrNoPathAgreement too, so poisoning can be traced.
+func (d *DHT) LookupValue(ctx context.Context, key [32]byte) (*DHTRecord, *LookupReport, error) {
+	return d.findValueReport(ctx, key, func(*DHTRecord) bool { return true })
+}
+
+func (d *DHT) findValueReport(ctx context.Context, key [32]byte, valid func(*DHTRecord) bool) (*DHTRecord, *LookupReport, error) {
+	_, rec, report, err := d.lookup(ctx, key, valid)
+	if err != nil {
+		return nil, report, err
+	}
+	if rec == nil {
+		return nil, report, ErrNotFound
+	}
+	return rec, report, nil
+}
+
+// replicate sends STORE to the k nodes closest to the record's key and
+// returns how many accepted it.
+func (d *DHT) replicate(ctx context.Context, record *DHTRecord) int {
+	closest, err := d.LookupNode(ctx, record.Key)
+	if err != nil {
+		return 0
+	}
+	payload, err := json.Marshal(storeRequest{Record: record, Sender: d.router.Self()})
+	if err != nil {
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	for _, peer := range closest {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+			defer cancel()
+			if _, err := d.router.requestPeer(qctx, peer, types.MsgStore, payload); err == nil {
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return stored
+}
+
+// lookup is the iterative Kademlia lookup shared by FIND_NODE and
+// FIND_VALUE. A nil valid runs FIND_NODE. The k closest known peers seed
+// DHTConfig.DisjointPaths paths that never query the same node (see
+// lookupPaths); their closest nodes are merged, and a record is returned
+// only once enough paths agree on it.
+func (d *DHT) lookup(ctx context.Context, target types.NodeID, valid func(*DHTRecord) bool) ([]PeerInfo, *DHTRecord, *LookupReport, error) {
+	r := d.getRouter()
+	if r == nil {
+		return nil, nil, nil, ErrDHTDetached
+	}
+
+	r.peers.markRefreshed(target)
+	seeds := r.peers.FindClosest(target, KBucketSize)
+	if len(seeds) == 0 {
+		return nil, nil, nil, ErrNoPeers
+	}
+	return d.lookupPaths(ctx, r, target, valid, seeds)
+}
+
+// walk runs one lookup path over sl. Each round queries the Alpha closest
+// unqueried candidates in parallel and merges the peers they return; it
+// ends when the k closest candidates have all been queried, or, for
+// FIND_VALUE, when a valid record turns up. It returns the record and the
+// nodes it queried.
+func (d *DHT) walk(ctx context.Context, r *Router, sl *shortlist, valid func(*DHTRecord) bool) (*DHTRecord, []types.NodeID, error) {
+	findValue := valid != nil
+	type result struct {
+		peer PeerInfo
+		resp lookupResponse
+		err  error
+	}
+
+	var queried []types.NodeID
+	for {
+		batch := sl.next(Alpha)
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan result, len(batch))
+		for _, peer := range batch {
+			queried = append(queried, peer.NodeID)
+			go func() {
+				resp, err := d.query(ctx, peer, sl.target, findValue)
+				results <- result{peer, resp, err}
+			}()
+		}
+
+		for range batch {
+			res := <-results
+			if res.err != nil {
+				sl.remove(res.peer.NodeID)
+				continue
+			}
+			// A peer the table refuses does not steer the lookup either.
+			res.peer.LastSeen = time.Now().UnixMilli()
+			if err := r.peers.AddPeer(res.peer); err != nil {
+				sl.remove(res.peer.NodeID)
+				continue
+			}
+			sl.responded(res.peer.NodeID)
+
+			if rec := res.resp.Record; findValue && rec != nil {
+				if rec.Key == sl.target && rec.Verify() == nil &&
+					d.checkPublisher(rec) == nil && valid(rec) {
+					return rec, queried, nil
+				}
+			}
+			for _, p := range res.resp.Peers {
+				if r.peers.admits(p) == nil {
+					sl.add(p)
+				}
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, queried, err
+		}
+	}
+	return nil, queried, nil
+}
+
+func (d *DHT) query(ctx context.Context, to PeerInfo, target types.NodeID, findValue bool) (lookupResponse, error) {
+	msgType := types.MsgFindNode
+	var req any = findNodeRequest{Target: target, Sender: d.router.Self()}
+	if findValue {
+		msgType = types.MsgFindValue
+		req = findValueRequest{Key: target, Sender: d.router.Self()}
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return lookupResponse{}, err
+	}
+
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	msg, err := d.router.requestPeer(qctx, to, msgType, payload)
+	if err != nil {
+		return lookupResponse{}, err
+	}
+
+	var resp lookupResponse
+	if err := json.Unmarshal(msg.Payload, &resp); err != nil {
+		return lookupResponse{}, fmt.Errorf("dht: bad lookup response: %w", err)
+	}
+	return resp, nil
+}
+
+// closerTo reports whether a is strictly closer to target than b.
+func closerTo(target, a, b types.NodeID) bool {
+	da := types.XORDistance(a, target)
+	db := types.XORDistance(b, target)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// shortlist holds lookup candidates ordered by distance to the target.
+// If claim is set, next skips candidates it refuses, which another path
+// has already queried.
+type shortlist struct {
+	target  types.NodeID
+	self    types.NodeID
+	entries []*candidate
+	claim   func(types.NodeID) bool
+}
+
+type candidate struct {
+	peer      PeerInfo
+	queried   bool
+	responded bool
+}
+
+func newShortlist(target, self types.NodeID) *shortlist {
+	return &shortlist{target: target, self: self}
+}
+
+// add merges peers not already present, keeping the list sorted.
+func (s *shortlist) add(peers ...PeerInfo) {
+	for _, p := range peers {
+		if p.NodeID == s.self || s.find(p.NodeID) >= 0 {
+			continue
+		}
+		s.entries = append(s.entries, &candidate{peer: p})
+	}
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		return closerTo(s.target, s.entries[i].peer.NodeID, s.entries[j].peer.NodeID)
+	})
+}
+
+func (s *shortlist) find(id types.NodeID) int {
+	for i, c := range s.entries {
+		if c.peer.NodeID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// next marks and returns up to n unqueried candidates among the k closest.
+func (s *shortlist) next(n int) []PeerInfo {
+	var batch []PeerInfo
+	for i, c := range s.entries {
+		if i >= KBucketSize || len(batch) == n {
+			break
+		}
+		if !c.queried {
+			c.queried = true
+			if s.claim == nil || s.claim(c.peer.NodeID) {
+				batch = append(batch, c.peer)
+			}
+		}
+	}
+	return batch
+}
+
+func (s *shortlist) responded(id types.NodeID) {
+	if i := s.find(id); i >= 0 {
+		s.entries[i].responded = true
+	}
+}
+
+func (s *shortlist) remove(id types.NodeID) {
+	if i := s.find(id); i >= 0 {
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	}
+}
+
+// closest returns up to k candidates that answered, nearest first.
+func (s *shortlist) closest(k int) []PeerInfo {
+	var out []PeerInfo
+	for _, c := range s.entries {
+		if c.responded {
+			out = append(out, c.peer)
+			if len(out) == k {
+				break
+			}
+		}
+	}
+	return out
+}
@@ -1,8 +1,13 @@
 package yggdrasil
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/netip"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/valhalla/valhalla/internal/types"
 )
@@ -12,18 +17,81 @@ const (
 	KBucketSize = 20
 	// NumBuckets is the number of k-buckets (one per bit of NodeID).
 	NumBuckets = 256
+	// ReplacementCacheSize is the max number of standby peers kept per
+	// bucket for when a bucket entry is evicted.
+	ReplacementCacheSize = KBucketSize
+	// DefaultRefreshInterval is how long a bucket may go without a lookup
+	// before RefreshLoop refreshes it.
+	DefaultRefreshInterval = time.Hour
+	// DefaultMaxPeersPerSubnet is how many peers from one public IPv4
+	// /24 or IPv6 /48 a bucket admits, so one network cannot fill it.
+	DefaultMaxPeersPerSubnet = 2
+	// evictionPingTimeout bounds the liveness check of a bucket's least
+	// recently seen peer.
+	evictionPingTimeout = 5 * time.Second
 )
 
-// PeerTable is a Kademlia-style k-bucket peer table.
+// ErrSubnetLimit is returned by AddPeer when the peer's bucket already
+// holds the maximum number of peers from its subnet.
+var ErrSubnetLimit = errors.New("yggdrasil: too many peers from one subnet in bucket")
+
+// Pinger checks whether a peer is alive, returning nil if it answered.
+type Pinger func(ctx context.Context, peer PeerInfo) error
+
+// PeerTable is a Kademlia-style k-bucket peer table. Each bucket is kept
+// in least-recently-seen order; when a bucket is full, newcomers wait in a
+// replacement cache while the oldest entry is pinged, and take its place
+// only if it fails to answer. A bucket admits at most a few peers from
+// any one subnet; see SetSubnetLimit.
 type PeerTable struct {
-	self    types.NodeID
-	buckets [NumBuckets][]PeerInfo
-	mu      sync.RWMutex
+	self         types.NodeID
+	buckets      [NumBuckets][]PeerInfo
+	replacements [NumBuckets][]PeerInfo
+	pinging      [NumBuckets]bool
+	refreshed    [NumBuckets]time.Time
+	created      time.Time
+	pinger       Pinger
+	minPuzzle    PuzzleDifficulty
+	perSubnet    int
+	mu           sync.RWMutex
 }
 
 // NewPeerTable creates a peer table centered on the given NodeID.
 func NewPeerTable(self types.NodeID) *PeerTable {
-	return &PeerTable{self: self}
+	return &PeerTable{self: self, created: time.Now(), perSubnet: DefaultMaxPeersPerSubnet}
+}
+
+// SetSubnetLimit sets how many peers from one subnet a bucket admits;
+// 0 removes the limit. Peers already in the table are kept.
+func (pt *PeerTable) SetSubnetLimit(n int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.perSubnet = n
+}
+
+// SetPinger sets the liveness check used before evicting a peer from a
+// full bucket. Without one, full buckets keep their entries and newcomers
+// only enter the replacement cache.
+func (pt *PeerTable) SetPinger(p Pinger) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.pinger = p
+}
+
+// SetMinDifficulty makes AddPeer refuse peers whose NodeID does not meet
+// d; see VerifyPuzzle. Peers already in the table are kept.
+func (pt *PeerTable) SetMinDifficulty(d PuzzleDifficulty) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.minPuzzle = d
+}
+
+// admits checks a peer against the table's puzzle difficulty.
+func (pt *PeerTable) admits(peer PeerInfo) error {
+	pt.mu.RLock()
+	required := pt.minPuzzle
+	pt.mu.RUnlock()
+	return VerifyPuzzle(peer, required)
 }
 
 // bucketIndex returns the k-bucket index for a given NodeID.
@@ -40,48 +108,188 @@ func (pt *PeerTable) bucketIndex(target types.NodeID) int {
 	return NumBuckets - 1 // same node
 }
 
-// AddPeer adds or updates a peer in the table.
-func (pt *PeerTable) AddPeer(peer PeerInfo) {
+// AddPeer records a peer we have heard from. A known peer is updated and
+// moved to the tail of its bucket. A new peer is appended if the bucket
+// has room; otherwise it goes to the replacement cache and the bucket's
+// least recently seen peer is pinged. Peers that fail the table's puzzle
+// difficulty are refused with ErrPuzzleUnsolved, and peers from a subnet
+// their bucket is full of with ErrSubnetLimit.
+func (pt *PeerTable) AddPeer(peer PeerInfo) error {
 	if peer.NodeID == pt.self {
-		return // don't add self
+		return nil // don't add self
+	}
+	if peer.LastSeen == 0 {
+		peer.LastSeen = time.Now().UnixMilli()
 	}
 	pt.mu.Lock()
 	defer pt.mu.Unlock()
+	if err := VerifyPuzzle(peer, pt.minPuzzle); err != nil {
+		return err
+	}
 
 	idx := pt.bucketIndex(peer.NodeID)
 	bucket := pt.buckets[idx]
+	if !pt.fitsSubnet(bucket, peer) {
+		return ErrSubnetLimit
+	}
 
-	// Check if peer already exists, update if so
-	for i, existing := range bucket {
-		if existing.NodeID == peer.NodeID {
-			pt.buckets[idx][i] = peer
-			return
-		}
+	if i := indexOf(bucket, peer.NodeID); i >= 0 {
+		peer.LastSeen = max(peer.LastSeen, bucket[i].LastSeen)
+		pt.buckets[idx] = append(append(bucket[:i:i], bucket[i+1:]...), peer)
+		return nil
 	}
 
-	// Add new peer if bucket not full
 	if len(bucket) < KBucketSize {
 		pt.buckets[idx] = append(bucket, peer)
+		return nil
+	}
+
+	pt.addReplacement(idx, peer)
+	if pt.pinger != nil && !pt.pinging[idx] {
+		pt.pinging[idx] = true
+		go pt.checkOldest(idx, bucket[0], pt.pinger)
 	}
-	// If full, Kademlia would ping least-recently-seen; PoC just drops
+	return nil
 }
 
-// RemovePeer removes a peer from the table.
-func (pt *PeerTable) RemovePeer(id types.NodeID) {
+// addReplacement puts peer at the tail of the bucket's replacement cache,
+// dropping the oldest standby if the cache is full.
+func (pt *PeerTable) addReplacement(idx int, peer PeerInfo) {
+	cache := pt.replacements[idx]
+	if i := indexOf(cache, peer.NodeID); i >= 0 {
+		cache = append(cache[:i], cache[i+1:]...)
+	}
+	if len(cache) >= ReplacementCacheSize {
+		cache = cache[1:]
+	}
+	pt.replacements[idx] = append(cache, peer)
+}
+
+// checkOldest pings a bucket's least recently seen peer. If it answers it
+// moves to the tail; otherwise it is evicted in favour of the most
+// recently seen replacement.
+func (pt *PeerTable) checkOldest(idx int, oldest PeerInfo, ping Pinger) {
+	ctx, cancel := context.WithTimeout(context.Background(), evictionPingTimeout)
+	err := ping(ctx, oldest)
+	cancel()
+
 	pt.mu.Lock()
 	defer pt.mu.Unlock()
+	pt.pinging[idx] = false
+	if err == nil {
+		pt.markSeen(idx, oldest.NodeID)
+		return
+	}
+	if i := indexOf(pt.buckets[idx], oldest.NodeID); i >= 0 {
+		pt.removeAt(idx, i)
+	}
+}
 
-	idx := pt.bucketIndex(id)
+// MarkSeen records that a known peer was just heard from, moving it to
+// the tail of its bucket. It reports whether the peer is in the table.
+func (pt *PeerTable) MarkSeen(id types.NodeID) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.markSeen(pt.bucketIndex(id), id)
+}
+
+func (pt *PeerTable) markSeen(idx int, id types.NodeID) bool {
 	bucket := pt.buckets[idx]
+	i := indexOf(bucket, id)
+	if i < 0 {
+		return false
+	}
+	peer := bucket[i]
+	peer.LastSeen = time.Now().UnixMilli()
+	pt.buckets[idx] = append(append(bucket[:i:i], bucket[i+1:]...), peer)
+	return true
+}
 
-	for i, peer := range bucket {
-		if peer.NodeID == id {
-			pt.buckets[idx] = append(bucket[:i], bucket[i+1:]...)
+// removeAt drops bucket entry i and promotes the most recently seen
+// replacement that fits the subnet limit into the freed slot.
+func (pt *PeerTable) removeAt(idx, i int) {
+	bucket := pt.buckets[idx]
+	pt.buckets[idx] = append(bucket[:i:i], bucket[i+1:]...)
+	cache := pt.replacements[idx]
+	for j := len(cache) - 1; j >= 0; j-- {
+		if pt.fitsSubnet(pt.buckets[idx], cache[j]) {
+			pt.buckets[idx] = append(pt.buckets[idx], cache[j])
+			pt.replacements[idx] = append(cache[:j], cache[j+1:]...)
 			return
 		}
 	}
 }
 
+// fitsSubnet reports whether bucket has room for peer under the subnet
+// limit, not counting peer itself.
+func (pt *PeerTable) fitsSubnet(bucket []PeerInfo, peer PeerInfo) bool {
+	subnet, ok := subnetOf(peer)
+	if pt.perSubnet <= 0 || !ok {
+		return true
+	}
+	n := 0
+	for _, p := range bucket {
+		if s, ok := subnetOf(p); ok && s == subnet && p.NodeID != peer.NodeID {
+			n++
+		}
+	}
+	return n < pt.perSubnet
+}
+
+// subnetOf returns the /24 (IPv4) or /48 (IPv6) of the first IP address
+// a peer advertises. Loopback, link-local and private (RFC 1918, ULA)
+// addresses belong to no subnet: peers on one LAN or test network share
+// them legitimately, and they say nothing about who runs a node.
+func subnetOf(peer PeerInfo) (netip.Prefix, bool) {
+	for _, addr := range peer.Addrs {
+		parts, err := types.ParsePathAddr(addr)
+		if err != nil {
+			continue
+		}
+		ip, err := netip.ParseAddr(parts.Host)
+		if err != nil {
+			continue
+		}
+		ip = ip.Unmap()
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsPrivate() {
+			return netip.Prefix{}, false
+		}
+		bits := 48
+		if ip.Is4() {
+			bits = 24
+		}
+		prefix, _ := ip.Prefix(bits)
+		return prefix, true
+	}
+	return netip.Prefix{}, false
+}
+
+func indexOf(peers []PeerInfo, id types.NodeID) int {
+	for i, p := range peers {
+		if p.NodeID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// RemovePeer removes a peer from the table, promoting a replacement if
+// one is waiting.
+func (pt *PeerTable) RemovePeer(id types.NodeID) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	idx := pt.bucketIndex(id)
+	if i := indexOf(pt.buckets[idx], id); i >= 0 {
+		pt.removeAt(idx, i)
+		return
+	}
+	if i := indexOf(pt.replacements[idx], id); i >= 0 {
+		cache := pt.replacements[idx]
+		pt.replacements[idx] = append(cache[:i], cache[i+1:]...)
+	}
+}
+
 // FindClosest returns up to k peers closest to the target NodeID.
 func (pt *PeerTable) FindClosest(target types.NodeID, k int) []PeerInfo {
 	pt.mu.RLock()
@@ -95,14 +303,7 @@ func (pt *PeerTable) FindClosest(target types.NodeID, k int) []PeerInfo {
 
 	// Sort by XOR distance to target
 	sort.Slice(all, func(i, j int) bool {
-		di := types.XORDistance(all[i].NodeID, target)
-		dj := types.XORDistance(all[j].NodeID, target)
-		for b := 0; b < 32; b++ {
-			if di[b] != dj[b] {
-				return di[b] < dj[b]
-			}
-		}
-		return false
+		return closerTo(target, all[i].NodeID, all[j].NodeID)
 	})
 
 	if len(all) > k {
@@ -148,3 +349,62 @@ func (pt *PeerTable) Size() int {
 	}
 	return count
 }
+
+// Replacements returns the standby peers cached for the bucket target
+// falls in, most recently seen last.
+func (pt *PeerTable) Replacements(target types.NodeID) []PeerInfo {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+	return append([]PeerInfo(nil), pt.replacements[pt.bucketIndex(target)]...)
+}
+
+// markRefreshed records a lookup for target, which refreshes its bucket.
+func (pt *PeerTable) markRefreshed(target types.NodeID) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.refreshed[pt.bucketIndex(target)] = time.Now()
+}
+
+// staleBuckets returns the buckets with no lookup in maxAge, among those
+// from the farthest bucket down to the nearest non-empty one; buckets
+// nearer than that cannot hold any peer we could find.
+func (pt *PeerTable) staleBuckets(maxAge time.Duration) []int {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	nearest := -1
+	for i := NumBuckets - 1; i >= 0; i-- {
+		if len(pt.buckets[i]) > 0 {
+			nearest = i
+			break
+		}
+	}
+	cutoff := time.Now().Add(-maxAge)
+	var stale []int
+	for i := 0; i <= nearest; i++ {
+		last := pt.refreshed[i]
+		if last.IsZero() {
+			last = pt.created
+		}
+		if last.Before(cutoff) {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// randomIDInBucket returns a random NodeID that falls in bucket idx: it
+// shares the first idx bits with self and differs in the next one.
+func (pt *PeerTable) randomIDInBucket(idx int) types.NodeID {
+	var id types.NodeID
+	rand.Read(id[:])
+	for bit := 0; bit <= idx; bit++ {
+		byteIdx, mask := bit/8, byte(1)<<(7-bit%8)
+		if bit < idx {
+			id[byteIdx] = id[byteIdx]&^mask | pt.self[byteIdx]&mask
+		} else {
+			id[byteIdx] = id[byteIdx]&^mask | ^pt.self[byteIdx]&mask
+		}
+	}
+	return id
+}
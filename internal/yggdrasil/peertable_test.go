@@ -1,7 +1,10 @@
 package yggdrasil
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/valhalla/valhalla/internal/types"
 )
@@ -136,3 +139,215 @@ func TestPeerTableAllPeers(t *testing.T) {
 		t.Errorf("AllPeers: got %d, want 5", len(all))
 	}
 }
+
+// fillBucket adds n peers that all fall in bucket idx and returns them in
+// insertion order.
+func fillBucket(pt *PeerTable, idx, n int) []PeerInfo {
+	peers := make([]PeerInfo, n)
+	for i := range peers {
+		peers[i] = PeerInfo{NodeID: pt.randomIDInBucket(idx)}
+		pt.AddPeer(peers[i])
+	}
+	return peers
+}
+
+func bucketOrder(pt *PeerTable, idx int) []types.NodeID {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+	var ids []types.NodeID
+	for _, p := range pt.buckets[idx] {
+		ids = append(ids, p.NodeID)
+	}
+	return ids
+}
+
+func TestPeerTableLRUOrder(t *testing.T) {
+	self, _ := GenerateIdentity()
+	pt := NewPeerTable(self.NodeID)
+	peers := fillBucket(pt, 0, 3)
+
+	if !pt.MarkSeen(peers[0].NodeID) {
+		t.Fatal("MarkSeen did not find a known peer")
+	}
+	pt.AddPeer(peers[1])
+
+	want := []types.NodeID{peers[2].NodeID, peers[0].NodeID, peers[1].NodeID}
+	got := bucketOrder(pt, 0)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("bucket order = %v, want %v", got, want)
+		}
+	}
+	if p, _ := pt.GetPeer(peers[0].NodeID); p.LastSeen == 0 {
+		t.Error("MarkSeen did not set LastSeen")
+	}
+	if pt.MarkSeen(pt.randomIDInBucket(0)) {
+		t.Error("MarkSeen reported an unknown peer as known")
+	}
+}
+
+func TestPeerTableFullBucketPing(t *testing.T) {
+	tests := []struct {
+		name      string
+		alive     bool
+		wantEvict bool
+	}{
+		{name: "oldest answers", alive: true, wantEvict: false},
+		{name: "oldest is dead", alive: false, wantEvict: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			self, _ := GenerateIdentity()
+			pt := NewPeerTable(self.NodeID)
+			peers := fillBucket(pt, 0, KBucketSize)
+
+			pinged := make(chan types.NodeID, 1)
+			pt.SetPinger(func(ctx context.Context, p PeerInfo) error {
+				pinged <- p.NodeID
+				if tt.alive {
+					return nil
+				}
+				return errors.New("no answer")
+			})
+
+			newcomer := PeerInfo{NodeID: pt.randomIDInBucket(0)}
+			pt.AddPeer(newcomer)
+			if got := <-pinged; got != peers[0].NodeID {
+				t.Fatalf("pinged %s, want least recently seen %s", got.Short(), peers[0].NodeID.Short())
+			}
+
+			// The ping completes asynchronously.
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				pt.mu.RLock()
+				busy := pt.pinging[0]
+				pt.mu.RUnlock()
+				if !busy || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			_, oldKept := pt.GetPeer(peers[0].NodeID)
+			_, newAdded := pt.GetPeer(newcomer.NodeID)
+			if oldKept == tt.wantEvict || newAdded != tt.wantEvict {
+				t.Errorf("oldest kept = %v, newcomer added = %v; want evict = %v", oldKept, newAdded, tt.wantEvict)
+			}
+			if pt.Size() != KBucketSize {
+				t.Errorf("Size = %d, want %d", pt.Size(), KBucketSize)
+			}
+			if !tt.wantEvict {
+				if order := bucketOrder(pt, 0); order[len(order)-1] != peers[0].NodeID {
+					t.Error("answering peer was not moved to the tail")
+				}
+				if r := pt.Replacements(newcomer.NodeID); len(r) != 1 || r[0].NodeID != newcomer.NodeID {
+					t.Errorf("replacements = %v, want the newcomer", r)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerTableRemovePromotesReplacement(t *testing.T) {
+	self, _ := GenerateIdentity()
+	pt := NewPeerTable(self.NodeID)
+	peers := fillBucket(pt, 0, KBucketSize)
+
+	// No pinger: newcomers only wait in the replacement cache.
+	standby := fillBucket(pt, 0, 2)
+	if pt.Size() != KBucketSize {
+		t.Fatalf("Size = %d, want a full bucket of %d", pt.Size(), KBucketSize)
+	}
+
+	pt.RemovePeer(peers[5].NodeID)
+	if _, ok := pt.GetPeer(standby[1].NodeID); !ok {
+		t.Error("most recent replacement was not promoted")
+	}
+	if r := pt.Replacements(standby[0].NodeID); len(r) != 1 || r[0].NodeID != standby[0].NodeID {
+		t.Errorf("replacements = %v, want the remaining standby", r)
+	}
+}
+
+func TestPeerTableSubnetLimit(t *testing.T) {
+	self, _ := GenerateIdentity()
+	pt := NewPeerTable(self.NodeID)
+	peer := func(addr types.PathAddr) PeerInfo {
+		return PeerInfo{NodeID: pt.randomIDInBucket(0), Addrs: []types.PathAddr{addr}}
+	}
+
+	tests := []struct {
+		name string
+		peer PeerInfo
+		want error
+	}{
+		{"first from subnet", peer("/tcp/198.51.100.1:9000"), nil},
+		{"second from subnet", peer("/udp/198.51.100.2:9000"), nil},
+		{"subnet full", peer("/tcp/198.51.100.3:9000"), ErrSubnetLimit},
+		{"neighbouring subnet", peer("/tcp/198.51.101.1:9000"), nil},
+		{"first from IPv6 /48", peer("/tcp/[2001:db8:1::1]:9000"), nil},
+		{"IPv6 same /48", peer("/tcp/[2001:db8:1:2::1]:9000"), nil},
+		{"IPv6 /48 full", peer("/tcp/[2001:db8:1:3::1]:9000"), ErrSubnetLimit},
+		{"loopback unlimited", peer("/tcp/127.0.0.1:9001"), nil},
+		{"loopback unlimited again", peer("/tcp/127.0.0.1:9002"), nil},
+		{"loopback unlimited thrice", peer("/tcp/127.0.0.1:9003"), nil},
+		{"no IP address", peer("/mem/host:1"), nil},
+		{"RFC 1918 unlimited", peer("/tcp/192.168.1.1:9000"), nil},
+		{"RFC 1918 unlimited again", peer("/tcp/192.168.1.2:9000"), nil},
+		{"RFC 1918 unlimited thrice", peer("/tcp/192.168.1.3:9000"), nil},
+		{"ULA unlimited", peer("/tcp/[fd00::1]:9000"), nil},
+		{"ULA unlimited again", peer("/tcp/[fd00::2]:9000"), nil},
+		{"ULA unlimited thrice", peer("/tcp/[fd00::3]:9000"), nil},
+		{"link-local unlimited", peer("/udp/169.254.0.1:9000"), nil},
+		{"link-local unlimited again", peer("/udp/169.254.0.2:9000"), nil},
+		{"link-local unlimited thrice", peer("/udp/169.254.0.3:9000"), nil},
+	}
+	for _, tt := range tests {
+		if err := pt.AddPeer(tt.peer); !errors.Is(err, tt.want) {
+			t.Errorf("%s: AddPeer = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Another bucket has its own allowance.
+	other := PeerInfo{NodeID: pt.randomIDInBucket(1), Addrs: []types.PathAddr{"/tcp/198.51.100.4:9000"}}
+	if err := pt.AddPeer(other); err != nil {
+		t.Errorf("AddPeer in another bucket = %v", err)
+	}
+	pt.SetSubnetLimit(0)
+	if err := pt.AddPeer(peer("/tcp/198.51.100.5:9000")); err != nil {
+		t.Errorf("AddPeer with no limit = %v", err)
+	}
+}
+
+func TestPeerTableRandomIDInBucket(t *testing.T) {
+	self, _ := GenerateIdentity()
+	pt := NewPeerTable(self.NodeID)
+	for _, idx := range []int{0, 1, 7, 8, 63, 200, 255} {
+		if got := pt.bucketIndex(pt.randomIDInBucket(idx)); got != idx {
+			t.Errorf("randomIDInBucket(%d) fell in bucket %d", idx, got)
+		}
+	}
+}
+
+func TestPeerTableStaleBuckets(t *testing.T) {
+	self, _ := GenerateIdentity()
+	pt := NewPeerTable(self.NodeID)
+	if stale := pt.staleBuckets(0); len(stale) != 0 {
+		t.Errorf("empty table has stale buckets %v", stale)
+	}
+
+	fillBucket(pt, 3, 1)
+	if stale := pt.staleBuckets(time.Hour); len(stale) != 0 {
+		t.Errorf("new table has stale buckets %v", stale)
+	}
+	if stale := pt.staleBuckets(0); len(stale) != 4 {
+		t.Errorf("stale buckets = %v, want 0 through 3", stale)
+	}
+
+	pt.markRefreshed(pt.randomIDInBucket(2))
+	for _, idx := range pt.staleBuckets(time.Minute) {
+		if idx == 2 {
+			t.Error("bucket 2 is stale right after a lookup")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package yggdrasil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+const (
+	// punchTimeout bounds a hole punch, introduction included.
+	punchTimeout = 10 * time.Second
+	// punchRendezvousAttempts bounds how many neighbours ensureConnection
+	// asks to introduce us to a node it cannot dial.
+	punchRendezvousAttempts = 3
+)
+
+var (
+	ErrNoPuncher    = errors.New("yggdrasil: transport cannot hole punch")
+	ErrNotNeighbour = errors.New("yggdrasil: not directly connected")
+)
+
+// punchRequest asks a rendezvous peer to introduce us to Target.
+type punchRequest struct {
+	Target types.NodeID `json:"target"`
+}
+
+// punchIntro tells a node that Peer, reachable at Addrs, is about to
+// punch towards it. The rendezvous's reply to a punchRequest carries the
+// target's addresses the same way.
+type punchIntro struct {
+	Peer  types.NodeID `json:"peer"`
+	Addrs []string     `json:"addrs"`
+}
+
+// Punch connects to target, typically behind a NAT, through rendezvous, a
+// neighbour that target is also connected to. The rendezvous tells each
+// side the address it sees the other at, both punch towards it over UDP,
+// and we then dial target and run the identity exchange as Connect does.
+// The punched connection must share the socket the rendezvous observed, so
+// the router's transport needs a listening UDP transport.
+func (r *Router) Punch(ctx context.Context, target, rendezvous types.NodeID) (PeerInfo, error) {
+	puncher := r.puncher()
+	if puncher == nil {
+		return PeerInfo{}, ErrNoPuncher
+	}
+	if _, ok := r.GetConnection(rendezvous); !ok {
+		return PeerInfo{}, fmt.Errorf("yggdrasil punch: rendezvous %s: %w", rendezvous.Short(), ErrNotNeighbour)
+	}
+	ctx, cancel := context.WithTimeout(ctx, punchTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(punchRequest{Target: target})
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	resp, err := r.Request(ctx, rendezvous, types.MsgPunchRequest, data)
+	if err != nil {
+		return PeerInfo{}, fmt.Errorf("yggdrasil punch: %w", err)
+	}
+	var intro punchIntro
+	if err := json.Unmarshal(resp.Payload, &intro); err != nil || intro.Peer != target {
+		return PeerInfo{}, fmt.Errorf("yggdrasil punch: bad introduction from %s", rendezvous.Short())
+	}
+
+	addr, err := puncher.Punch(ctx, intro.Addrs)
+	if err != nil {
+		return PeerInfo{}, fmt.Errorf("yggdrasil punch: %w", err)
+	}
+	conn, err := puncher.Dial(ctx, addr)
+	if err != nil {
+		return PeerInfo{}, fmt.Errorf("yggdrasil punch: %w", err)
+	}
+	peer, err := r.handshake(ctx, conn, types.NewPathAddr("udp", addr), target)
+	if err != nil {
+		return PeerInfo{}, fmt.Errorf("yggdrasil punch: %w", err)
+	}
+	r.emitEvent("hole_punched", map[string]string{
+		"peer": target.Short(),
+		"via":  rendezvous.Short(),
+		"addr": addr,
+	})
+	return peer, nil
+}
+
+// punchViaNeighbours tries Punch through the connected neighbours closest
+// to target, which are the likeliest to be connected to it.
+func (r *Router) punchViaNeighbours(ctx context.Context, target types.NodeID) bool {
+	tried := 0
+	for _, p := range r.peers.FindClosest(target, KBucketSize) {
+		if tried == punchRendezvousAttempts || ctx.Err() != nil {
+			break
+		}
+		if p.NodeID == target {
+			continue
+		}
+		if _, ok := r.GetConnection(p.NodeID); !ok {
+			continue
+		}
+		tried++
+		if _, err := r.Punch(ctx, target, p.NodeID); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// puncher returns the transport used for hole punching: the router's own
+// transport, or its "udp" transport if it is a Registry.
+func (r *Router) puncher() bifrost.HolePuncher {
+	r.mu.RLock()
+	t := r.transport
+	r.mu.RUnlock()
+	if reg, ok := t.(*bifrost.Registry); ok {
+		t, _ = reg.Lookup("udp")
+	}
+	p, _ := t.(bifrost.HolePuncher)
+	return p
+}
+
+// handlePunchRequest introduces a neighbour to the target it asked for
+// and answers with where we see the target. Both must be directly
+// connected to us, since the addresses we hand out are those of our own
+// connections to them.
+func (r *Router) handlePunchRequest(msg *Message) (*Message, error) {
+	var req punchRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return nil, fmt.Errorf("yggdrasil: bad punch request: %w", err)
+	}
+	fromConn, ok := r.GetConnection(msg.From)
+	if !ok || len(msg.Via) != 0 {
+		return nil, fmt.Errorf("requester %s: %w", msg.From.Short(), ErrNotNeighbour)
+	}
+	targetConn, ok := r.GetConnection(req.Target)
+	if !ok {
+		return nil, fmt.Errorf("target %s: %w", req.Target.Short(), ErrNotNeighbour)
+	}
+
+	r.replyLater(msg, func(ctx context.Context) (*Message, error) {
+		data, err := json.Marshal(punchIntro{Peer: msg.From, Addrs: []string{fromConn.RemoteAddr()}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.Request(ctx, req.Target, types.MsgPunchIntro, data); err != nil {
+			return nil, fmt.Errorf("introduce %s: %w", req.Target.Short(), err)
+		}
+
+		data, err = json.Marshal(punchIntro{Peer: req.Target, Addrs: []string{targetConn.RemoteAddr()}})
+		if err != nil {
+			return nil, err
+		}
+		return &Message{Payload: data}, nil
+	})
+	return nil, nil
+}
+
+// handlePunchIntro starts punching towards a peer a neighbour introduced.
+// The peer dials us once its own punch succeeds and arrives like any
+// inbound connection, so the result of ours is only reported.
+func (r *Router) handlePunchIntro(msg *Message) (*Message, error) {
+	var intro punchIntro
+	if err := json.Unmarshal(msg.Payload, &intro); err != nil {
+		return nil, fmt.Errorf("yggdrasil: bad punch introduction: %w", err)
+	}
+	if _, ok := r.GetConnection(msg.From); !ok || len(msg.Via) != 0 {
+		return nil, fmt.Errorf("introducer %s: %w", msg.From.Short(), ErrNotNeighbour)
+	}
+	puncher := r.puncher()
+	if puncher == nil {
+		return nil, ErrNoPuncher
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), punchTimeout)
+		defer cancel()
+		if _, err := puncher.Punch(ctx, intro.Addrs); err != nil {
+			r.emitEvent("hole_punch_failed", map[string]string{
+				"peer":   intro.Peer.Short(),
+				"reason": err.Error(),
+			})
+		}
+	}()
+	return &Message{}, nil
+}
@@ -0,0 +1,170 @@
+package yggdrasil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+)
+
+// startNATNode runs a router over UDP on a host of a simulated packet
+// network, accepting peers on its listening socket.
+func startNATNode(t *testing.T, ctx context.Context, network *bifrost.SimPacketNetwork, ip string) *simNode {
+	t.Helper()
+	id, err := yggdrasil.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := bifrost.NewRegistry()
+	reg.Register("udp", bifrost.NewUDPTransportWithConfig(bifrost.UDPConfig{
+		Reliable:           true,
+		RetransmitInterval: 20 * time.Millisecond,
+		MaxRetransmits:     3,
+		PunchInterval:      10 * time.Millisecond,
+		ListenPacket:       network.Host(ip).ListenPacket,
+	}))
+	ln, err := reg.Listen(ctx, "/udp/"+ip+":0")
+	if err != nil {
+		t.Fatalf("%s listen: %v", ip, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	pt := yggdrasil.NewPeerTable(id.NodeID)
+	dht := yggdrasil.NewDHT(id.NodeID)
+	router := yggdrasil.NewRouter(id, pt, dht, nil)
+	router.SetTransport(reg)
+	router.SetAddrs([]types.PathAddr{types.PathAddr(ln.Addr())})
+
+	go func() {
+		for {
+			conn, err := ln.Accept(ctx)
+			if err != nil {
+				return
+			}
+			go router.AcceptPeer(ctx, conn)
+		}
+	}()
+	return &simNode{id: id, peers: pt, dht: dht, router: router, addr: types.PathAddr(ln.Addr())}
+}
+
+// natTriangle puts a and b behind separate NATs, both connected to a
+// public rendezvous node.
+func natTriangle(t *testing.T, ctx context.Context) (a, b, rendezvous *simNode) {
+	t.Helper()
+	network := bifrost.NewSimPacketNetwork()
+	network.AddNAT("203.0.113.1", "192.168.1.2")
+	network.AddNAT("203.0.113.2", "10.0.0.2")
+	a = startNATNode(t, ctx, network, "192.168.1.2")
+	b = startNATNode(t, ctx, network, "10.0.0.2")
+	rendezvous = startNATNode(t, ctx, network, "198.51.100.7")
+
+	for _, n := range []*simNode{a, b} {
+		if _, err := n.router.Connect(ctx, rendezvous.addr, rendezvous.id.NodeID); err != nil {
+			t.Fatalf("connect to rendezvous: %v", err)
+		}
+	}
+	waitConnected(t, ctx, rendezvous, a, b)
+	return a, b, rendezvous
+}
+
+func waitConnected(t *testing.T, ctx context.Context, n *simNode, peers ...*simNode) {
+	t.Helper()
+	for _, p := range peers {
+		for {
+			if _, ok := n.router.GetConnection(p.id.NodeID); ok {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("%s never connected to %s", n.id.NodeID.Short(), p.id.NodeID.Short())
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}
+}
+
+func TestRouterPunchThroughNAT(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, b, rendezvous := natTriangle(t, ctx)
+
+	if _, err := a.router.Connect(ctx, b.addr, b.id.NodeID); err == nil {
+		t.Fatal("dialed a node behind a NAT directly")
+	}
+
+	peer, err := a.router.Punch(ctx, b.id.NodeID, rendezvous.id.NodeID)
+	if err != nil {
+		t.Fatalf("Punch: %v", err)
+	}
+	if peer.NodeID != b.id.NodeID {
+		t.Fatalf("punched to %s, want %s", peer.NodeID.Short(), b.id.NodeID.Short())
+	}
+
+	// The path is direct now, not relayed through the rendezvous.
+	hops, err := a.router.Traceroute(ctx, b.id.NodeID)
+	if err != nil {
+		t.Fatalf("Traceroute: %v", err)
+	}
+	if len(hops) != 1 {
+		t.Errorf("traceroute took %d hops, want 1", len(hops))
+	}
+	waitConnected(t, ctx, b, a)
+	if _, err := b.router.Ping(ctx, a.id.NodeID); err != nil {
+		t.Errorf("Ping back over punched path: %v", err)
+	}
+}
+
+func TestRouterPunchFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, b, _ := natTriangle(t, ctx)
+
+	// a knows b only by its unreachable private address.
+	a.peers.AddPeer(b.router.Self())
+	if _, err := a.router.Ping(ctx, b.id.NodeID); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if _, ok := a.router.GetConnection(b.id.NodeID); !ok {
+		t.Error("no direct connection after Ping; hole punching was not tried")
+	}
+}
+
+func TestRouterPunchRequiresNeighbours(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, b, rendezvous := natTriangle(t, ctx)
+	stranger, _ := yggdrasil.GenerateIdentity()
+
+	if _, err := a.router.Punch(ctx, b.id.NodeID, stranger.NodeID); err == nil {
+		t.Error("Punch through a node we are not connected to succeeded")
+	}
+	if _, err := a.router.Punch(ctx, stranger.NodeID, rendezvous.id.NodeID); err == nil {
+		t.Error("rendezvous introduced us to a node it is not connected to")
+	}
+}
+
+func TestRouterPunchRequestDoesNotStallRendezvous(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, b, rendezvous := natTriangle(t, ctx)
+
+	// b sits on the introduction, so the rendezvous waits for its answer.
+	release := make(chan struct{})
+	defer close(release)
+	b.router.RegisterHandler(types.MsgPunchIntro, func(*yggdrasil.Message) (*yggdrasil.Message, error) {
+		<-release
+		return &yggdrasil.Message{}, nil
+	})
+	go a.router.Punch(ctx, b.id.NodeID, rendezvous.id.NodeID)
+	time.Sleep(50 * time.Millisecond)
+
+	// The rendezvous still serves a over the same connection meanwhile.
+	pctx, pcancel := context.WithTimeout(ctx, time.Second)
+	defer pcancel()
+	if _, err := a.router.Ping(pctx, rendezvous.id.NodeID); err != nil {
+		t.Fatalf("Ping rendezvous during a pending introduction: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package yggdrasil
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// MaxPuzzleBits bounds either puzzle difficulty; beyond it a puzzle could
+// not be solved in any reasonable time.
+const MaxPuzzleBits = 64
+
+// puzzleCheckInterval is how many attempts a solver makes between checks
+// of its context.
+const puzzleCheckInterval = 1024
+
+var (
+	ErrPuzzleUnsolved   = errors.New("yggdrasil: NodeID does not meet the puzzle difficulty")
+	ErrPuzzleDifficulty = errors.New("yggdrasil: invalid puzzle difficulty")
+)
+
+// PuzzleDifficulty is the work S/Kademlia's crypto puzzles demand of a
+// NodeID, in leading zero bits of a SHA-256 hash. The zero value demands
+// nothing.
+type PuzzleDifficulty struct {
+	// Static bits must lead SHA-256(NodeID). They are fixed by the key,
+	// so meeting them takes about 2^Static key generations.
+	Static int `json:"static"`
+	// Dynamic bits must lead SHA-256(NodeID XOR X) for the solution X the
+	// node presents. Raising them needs a new X, not a new key.
+	Dynamic int `json:"dynamic"`
+}
+
+// Validate checks that both difficulties are within [0, MaxPuzzleBits].
+func (d PuzzleDifficulty) Validate() error {
+	if d.Static < 0 || d.Static > MaxPuzzleBits || d.Dynamic < 0 || d.Dynamic > MaxPuzzleBits {
+		return fmt.Errorf("%w: %+v", ErrPuzzleDifficulty, d)
+	}
+	return nil
+}
+
+// Meets reports whether d is at least required in both puzzles.
+func (d PuzzleDifficulty) Meets(required PuzzleDifficulty) bool {
+	return d.Static >= required.Static && d.Dynamic >= required.Dynamic
+}
+
+// IsZero reports whether d demands no work.
+func (d PuzzleDifficulty) IsZero() bool {
+	return d == PuzzleDifficulty{}
+}
+
+// MeasurePuzzle returns the difficulty a NodeID and dynamic solution x
+// achieve. A solution that is not NodeID-sized achieves no dynamic bits.
+func MeasurePuzzle(id types.NodeID, x []byte) PuzzleDifficulty {
+	static := sha256.Sum256(id[:])
+	d := PuzzleDifficulty{Static: leadingZeroBits(static[:])}
+	if len(x) == len(id) {
+		d.Dynamic = dynamicBits(id, x)
+	}
+	return d
+}
+
+// VerifyPuzzle checks that a peer's NodeID is derived from its key and
+// that it and its solution meet required. A zero required passes anyone.
+func VerifyPuzzle(peer PeerInfo, required PuzzleDifficulty) error {
+	if required.IsZero() {
+		return nil
+	}
+	if len(peer.PublicKey) != ed25519.PublicKeySize || types.NodeIDFromPublicKey(peer.PublicKey) != peer.NodeID {
+		return fmt.Errorf("%w: %s is not derived from its key", ErrPuzzleUnsolved, peer.NodeID.Short())
+	}
+	if got := MeasurePuzzle(peer.NodeID, peer.Puzzle); !got.Meets(required) {
+		return fmt.Errorf("%w: %s has %+v, need %+v", ErrPuzzleUnsolved, peer.NodeID.Short(), got, required)
+	}
+	return nil
+}
+
+// GenerateIdentityWithPuzzle generates keys until the NodeID meets
+// d.Static, then solves the dynamic puzzle for d.Dynamic. Each static bit
+// doubles the expected work.
+func GenerateIdentityWithPuzzle(ctx context.Context, d PuzzleDifficulty) (*Identity, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		if i%puzzleCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("yggdrasil: static puzzle: %w", err)
+			}
+		}
+		id, err := GenerateIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if MeasurePuzzle(id.NodeID, nil).Static < d.Static {
+			continue
+		}
+		if err := id.SolvePuzzle(ctx, d.Dynamic); err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+}
+
+// SolvePuzzle finds a dynamic puzzle solution of at least difficulty
+// bits and keeps it in the identity, replacing any earlier one.
+func (id *Identity) SolvePuzzle(ctx context.Context, difficulty int) error {
+	if err := (PuzzleDifficulty{Dynamic: difficulty}).Validate(); err != nil {
+		return err
+	}
+	var x types.NodeID
+	if _, err := rand.Read(x[:]); err != nil {
+		return fmt.Errorf("yggdrasil: dynamic puzzle: %w", err)
+	}
+	for i := 0; dynamicBits(id.NodeID, x[:]) < difficulty; i++ {
+		if i%puzzleCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("yggdrasil: dynamic puzzle: %w", err)
+			}
+		}
+		incrementID(&x)
+	}
+
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.Puzzle = x[:]
+	return nil
+}
+
+// puzzle returns the identity's dynamic puzzle solution, if any.
+func (id *Identity) puzzle() []byte {
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	return id.Puzzle
+}
+
+func dynamicBits(id types.NodeID, x []byte) int {
+	var mixed types.NodeID
+	for i := range mixed {
+		mixed[i] = id[i] ^ x[i]
+	}
+	sum := sha256.Sum256(mixed[:])
+	return leadingZeroBits(sum[:])
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
+
+// incrementID adds one to x as a big-endian number, wrapping around.
+func incrementID(x *types.NodeID) {
+	for i := len(x) - 1; i >= 0; i-- {
+		x[i]++
+		if x[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package yggdrasil_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+)
+
+var testDifficulty = yggdrasil.PuzzleDifficulty{Static: 6, Dynamic: 10}
+
+func puzzleIdentity(t *testing.T, d yggdrasil.PuzzleDifficulty) *yggdrasil.Identity {
+	t.Helper()
+	id, err := yggdrasil.GenerateIdentityWithPuzzle(context.Background(), d)
+	if err != nil {
+		t.Fatalf("GenerateIdentityWithPuzzle: %v", err)
+	}
+	return id
+}
+
+func peerOf(id *yggdrasil.Identity) yggdrasil.PeerInfo {
+	return yggdrasil.PeerInfo{NodeID: id.NodeID, PublicKey: id.PublicKey, Puzzle: id.Puzzle}
+}
+
+func TestPuzzleIdentity(t *testing.T) {
+	id := puzzleIdentity(t, testDifficulty)
+	got := yggdrasil.MeasurePuzzle(id.NodeID, id.Puzzle)
+	if !got.Meets(testDifficulty) {
+		t.Fatalf("generated identity measures %+v, want at least %+v", got, testDifficulty)
+	}
+
+	other, _ := yggdrasil.GenerateIdentity()
+	tampered := append([]byte(nil), id.Puzzle...)
+	tampered[0] ^= 0xff
+	tests := []struct {
+		name     string
+		peer     yggdrasil.PeerInfo
+		required yggdrasil.PuzzleDifficulty
+		ok       bool
+	}{
+		{"meets", peerOf(id), testDifficulty, true},
+		{"zero difficulty admits anyone", peerOf(other), yggdrasil.PuzzleDifficulty{}, true},
+		{"static too low", peerOf(id), yggdrasil.PuzzleDifficulty{Static: got.Static + 1}, false},
+		{"dynamic too low", peerOf(id), yggdrasil.PuzzleDifficulty{Dynamic: got.Dynamic + 1}, false},
+		{"no solution", yggdrasil.PeerInfo{NodeID: id.NodeID, PublicKey: id.PublicKey}, yggdrasil.PuzzleDifficulty{Dynamic: 1}, false},
+		{"tampered solution", yggdrasil.PeerInfo{NodeID: id.NodeID, PublicKey: id.PublicKey, Puzzle: tampered}, testDifficulty, false},
+		{"NodeID not from key", yggdrasil.PeerInfo{NodeID: id.NodeID, PublicKey: other.PublicKey, Puzzle: id.Puzzle}, testDifficulty, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := yggdrasil.VerifyPuzzle(tt.peer, tt.required)
+			if tt.ok && err != nil {
+				t.Errorf("VerifyPuzzle = %v", err)
+			}
+			if !tt.ok && !errors.Is(err, yggdrasil.ErrPuzzleUnsolved) {
+				t.Errorf("VerifyPuzzle = %v, want ErrPuzzleUnsolved", err)
+			}
+		})
+	}
+}
+
+func TestPuzzleSolveRaisesDifficulty(t *testing.T) {
+	id, _ := yggdrasil.GenerateIdentity()
+	if err := id.SolvePuzzle(context.Background(), 12); err != nil {
+		t.Fatal(err)
+	}
+	if got := yggdrasil.MeasurePuzzle(id.NodeID, id.Puzzle); got.Dynamic < 12 {
+		t.Errorf("dynamic bits = %d, want >= 12", got.Dynamic)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := id.SolvePuzzle(ctx, yggdrasil.MaxPuzzleBits); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled SolvePuzzle = %v", err)
+	}
+	if err := id.SolvePuzzle(context.Background(), yggdrasil.MaxPuzzleBits+1); !errors.Is(err, yggdrasil.ErrPuzzleDifficulty) {
+		t.Errorf("SolvePuzzle beyond MaxPuzzleBits = %v", err)
+	}
+}
+
+func TestPeerTableRequiresPuzzle(t *testing.T) {
+	self, _ := yggdrasil.GenerateIdentity()
+	pt := yggdrasil.NewPeerTable(self.NodeID)
+	pt.SetMinDifficulty(testDifficulty)
+
+	cheap, _ := yggdrasil.GenerateIdentity()
+	if err := pt.AddPeer(peerOf(cheap)); !errors.Is(err, yggdrasil.ErrPuzzleUnsolved) {
+		t.Errorf("AddPeer without puzzle = %v", err)
+	}
+	solved := puzzleIdentity(t, testDifficulty)
+	if err := pt.AddPeer(peerOf(solved)); err != nil {
+		t.Errorf("AddPeer with puzzle = %v", err)
+	}
+	if pt.Size() != 1 {
+		t.Errorf("table holds %d peers, want 1", pt.Size())
+	}
+}
+
+func TestDHTRequiresPublisherPuzzle(t *testing.T) {
+	self, _ := yggdrasil.GenerateIdentity()
+	dht := yggdrasil.NewDHT(self.NodeID)
+	dht.SetMinDifficulty(testDifficulty)
+
+	record := func(id *yggdrasil.Identity) *yggdrasil.DHTRecord {
+		rec := signedRecord(t, id, id.NodeID, "hello", 1)
+		rec.Puzzle = id.Puzzle
+		return rec
+	}
+
+	cheap, _ := yggdrasil.GenerateIdentity()
+	if err := dht.Put(record(cheap)); !errors.Is(err, yggdrasil.ErrPuzzleUnsolved) {
+		t.Errorf("Put from unsolved publisher = %v", err)
+	}
+	solved := puzzleIdentity(t, testDifficulty)
+	if err := dht.Put(record(solved)); err != nil {
+		t.Errorf("Put from solved publisher = %v", err)
+	}
+	if err := dht.Put(record(self)); err != nil {
+		t.Errorf("Put of our own record = %v", err)
+	}
+	// Naming us as the publisher does not buy the exemption.
+	spoofed := record(cheap)
+	spoofed.Publisher = self.NodeID
+	if err := dht.Put(spoofed); err == nil {
+		t.Error("Put of a record claiming our NodeID succeeded")
+	}
+}
+
+func TestHandshakeEnforcesMinDifficulty(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	network := bifrost.NewSimNetwork(1)
+	strict := startSimNode(t, ctx, network, "strict")
+	newcomer := startSimNode(t, ctx, network, "newcomer")
+	required := yggdrasil.PuzzleDifficulty{Dynamic: 10}
+	if err := strict.router.SetMinDifficulty(required); err != nil {
+		t.Fatal(err)
+	}
+
+	// The newcomer learns the requirement from the hello and refuses to
+	// go on; strict refuses the newcomer's NodeID.
+	if _, err := newcomer.router.Connect(ctx, strict.addr, strict.id.NodeID); !errors.Is(err, yggdrasil.ErrPuzzleUnsolved) {
+		t.Fatalf("Connect without puzzle = %v, want ErrPuzzleUnsolved", err)
+	}
+	if _, ok := strict.router.GetConnection(newcomer.id.NodeID); ok {
+		t.Fatal("strict node registered an unsolved peer")
+	}
+
+	// Meeting the dynamic puzzle needs no new key.
+	if err := newcomer.id.SolvePuzzle(ctx, required.Dynamic); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newcomer.router.Connect(ctx, strict.addr, strict.id.NodeID); err != nil {
+		t.Fatalf("Connect with puzzle: %v", err)
+	}
+	waitConnected(t, ctx, strict, newcomer)
+	if _, ok := strict.peers.GetPeer(newcomer.id.NodeID); !ok {
+		t.Error("solved peer missing from strict node's table")
+	}
+	if _, err := newcomer.router.Ping(ctx, strict.id.NodeID); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+}
+
+func TestConnectRefusedByPeerTable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	network := bifrost.NewSimNetwork(1)
+	picky := startSimNode(t, ctx, network, "picky")
+	other := startSimNode(t, ctx, network, "other")
+	// Only the table is strict, so the handshake succeeds and
+	// registration is what refuses the peer.
+	picky.peers.SetMinDifficulty(testDifficulty)
+
+	if _, err := picky.router.Connect(ctx, other.addr, other.id.NodeID); !errors.Is(err, yggdrasil.ErrPuzzleUnsolved) {
+		t.Fatalf("Connect to a refused peer = %v, want ErrPuzzleUnsolved", err)
+	}
+	if _, ok := picky.router.GetConnection(other.id.NodeID); ok {
+		t.Error("dialer kept a connection to a peer its table refused")
+	}
+
+	if _, err := other.router.Connect(ctx, picky.addr, picky.id.NodeID); err != nil {
+		t.Fatalf("Connect from the refused peer: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, ok := other.router.GetConnection(picky.id.NodeID)
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refused peer's connection was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := picky.router.GetConnection(other.id.NodeID); ok {
+		t.Error("acceptor registered a peer its table refused")
+	}
+}
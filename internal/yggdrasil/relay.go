@@ -0,0 +1,538 @@
+package yggdrasil
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// relayProtocol is the PathAddr protocol of relayed addresses.
+const relayProtocol = "relay"
+
+// Relay data kinds, the byte after the circuit ID in a MsgRelayData
+// payload.
+const (
+	relayKindFrame byte = 0x00
+	relayKindClose byte = 0x01
+)
+
+// relayHeaderSize is [circuit:8] [kind:1] [frame type:1].
+const relayHeaderSize = 10
+
+// relayRecvBuffer is how many frames a circuit queues for its reader
+// before dropping, as a UDP socket would.
+const relayRecvBuffer = 256
+
+var (
+	ErrRelayDisabled = errors.New("yggdrasil: relay service not enabled")
+	ErrRelayFull     = errors.New("yggdrasil: relay has no free slots")
+	ErrNoReservation = errors.New("yggdrasil: no relay reservation")
+	ErrCircuitClosed = errors.New("yggdrasil: relay circuit closed")
+)
+
+// RelayConfig limits what a relay does for the nodes it serves.
+type RelayConfig struct {
+	// MaxReservations bounds how many nodes the relay serves at once.
+	MaxReservations int
+	// ReservationTTL is how long a reservation lasts unless renewed.
+	// Circuits end with their reservation.
+	ReservationTTL time.Duration
+	// MaxCircuits bounds the open circuits to each reserved node.
+	MaxCircuits int
+	// BytesPerSecond limits the data relayed for each reservation, both
+	// directions and all its circuits together. Frames over the limit are
+	// dropped; a second's worth may be sent in a burst.
+	BytesPerSecond int
+}
+
+// DefaultRelayConfig returns limits suited to a volunteer relay.
+func DefaultRelayConfig() RelayConfig {
+	return RelayConfig{
+		MaxReservations: 128,
+		ReservationTTL:  time.Hour,
+		MaxCircuits:     16,
+		BytesPerSecond:  128 * 1024,
+	}
+}
+
+// Reservation is a slot held at a relay. Addr reaches the reserving node
+// through the relay and is what it advertises.
+type Reservation struct {
+	Relay   types.NodeID
+	Addr    types.PathAddr
+	Expires time.Time
+}
+
+// RelayAddr returns the PathAddr that reaches target through relay.
+func RelayAddr(relay, target types.NodeID) types.PathAddr {
+	return types.PathAddr("/" + relayProtocol + "/" + hex.EncodeToString(relay[:]) + "/" + hex.EncodeToString(target[:]))
+}
+
+// ParseRelayAddr splits an address made by RelayAddr.
+func ParseRelayAddr(addr types.PathAddr) (relay, target types.NodeID, err error) {
+	rest, ok := strings.CutPrefix(string(addr), "/"+relayProtocol+"/")
+	relayHex, targetHex, found := strings.Cut(rest, "/")
+	if !ok || !found ||
+		hex.DecodedLen(len(relayHex)) != len(relay) || hex.DecodedLen(len(targetHex)) != len(target) {
+		return relay, target, fmt.Errorf("%w %q", types.ErrInvalidPathAddr, addr)
+	}
+	if _, err := hex.Decode(relay[:], []byte(relayHex)); err != nil {
+		return relay, target, fmt.Errorf("%w %q: %v", types.ErrInvalidPathAddr, addr, err)
+	}
+	if _, err := hex.Decode(target[:], []byte(targetHex)); err != nil {
+		return relay, target, fmt.Errorf("%w %q: %v", types.ErrInvalidPathAddr, addr, err)
+	}
+	return relay, target, nil
+}
+
+type relayReserveResponse struct {
+	Expires int64 `json:"expires"`
+}
+
+// relayConnectRequest asks a relay for a circuit to Target. The dialer
+// picks the circuit ID so it can listen on the circuit before the target
+// starts sending.
+type relayConnectRequest struct {
+	Target  types.NodeID `json:"target"`
+	Circuit uint64       `json:"circuit"`
+}
+
+// relayOpenRequest tells a reserved node that Peer is connecting to it.
+type relayOpenRequest struct {
+	Peer    types.NodeID `json:"peer"`
+	Circuit uint64       `json:"circuit"`
+}
+
+// relayService is a router's relay role, present once EnableRelay is
+// called.
+type relayService struct {
+	config       RelayConfig
+	reservations map[types.NodeID]*relayReservation
+	circuits     map[uint64]*relayCircuit
+	mu           sync.Mutex
+}
+
+type relayReservation struct {
+	expires  time.Time
+	circuits int
+	tokens   float64
+	refilled time.Time
+}
+
+type relayCircuit struct {
+	initiator, target types.NodeID
+}
+
+// EnableRelay makes the router a relay for nodes that cannot accept
+// inbound connections. Zero fields of config fall back to the defaults.
+func (r *Router) EnableRelay(config RelayConfig) {
+	def := DefaultRelayConfig()
+	if config.MaxReservations <= 0 {
+		config.MaxReservations = def.MaxReservations
+	}
+	if config.ReservationTTL <= 0 {
+		config.ReservationTTL = def.ReservationTTL
+	}
+	if config.MaxCircuits <= 0 {
+		config.MaxCircuits = def.MaxCircuits
+	}
+	if config.BytesPerSecond <= 0 {
+		config.BytesPerSecond = def.BytesPerSecond
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.relay = &relayService{
+		config:       config,
+		reservations: make(map[types.NodeID]*relayReservation),
+		circuits:     make(map[uint64]*relayCircuit),
+	}
+}
+
+func (r *Router) relayService() *relayService {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.relay
+}
+
+// Reserve reserves a slot at relay, a neighbour running the relay
+// service, so that peers can reach us at the returned reservation's Addr.
+// Call it again before the reservation expires to renew it.
+func (r *Router) Reserve(ctx context.Context, relay types.NodeID) (*Reservation, error) {
+	if _, ok := r.GetConnection(relay); !ok {
+		return nil, fmt.Errorf("yggdrasil reserve: relay %s: %w", relay.Short(), ErrNotNeighbour)
+	}
+	resp, err := r.Request(ctx, relay, types.MsgRelayReserve, nil)
+	if err != nil {
+		return nil, fmt.Errorf("yggdrasil reserve: %w", err)
+	}
+	var rr relayReserveResponse
+	if err := json.Unmarshal(resp.Payload, &rr); err != nil {
+		return nil, fmt.Errorf("yggdrasil reserve: bad response from %s", relay.Short())
+	}
+
+	res := &Reservation{
+		Relay:   relay,
+		Addr:    RelayAddr(relay, r.identity.NodeID),
+		Expires: time.UnixMilli(rr.Expires),
+	}
+	r.mu.Lock()
+	r.reserved[relay] = res.Expires
+	r.mu.Unlock()
+	return res, nil
+}
+
+// ReserveLoop holds a reservation at relay, renewing it halfway to each
+// expiry, until ctx is done or a renewal fails.
+func (r *Router) ReserveLoop(ctx context.Context, relay types.NodeID) error {
+	for {
+		res, err := r.Reserve(ctx, relay)
+		if err != nil {
+			return err
+		}
+		timer := time.NewTimer(time.Until(res.Expires) / 2)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// dialRelay opens a circuit to the node behind a relayed address.
+func (r *Router) dialRelay(ctx context.Context, addr types.PathAddr) (*relayConn, error) {
+	relay, target, err := ParseRelayAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := r.GetConnection(relay); !ok {
+		if peer, known := r.peers.GetPeer(relay); known {
+			r.ensureConnection(ctx, peer)
+		}
+	}
+
+	conn := r.newRelayConn(relay, rand.Uint64(), addr)
+	data, err := json.Marshal(relayConnectRequest{Target: target, Circuit: conn.circuit})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Request(ctx, relay, types.MsgRelayConnect, data); err != nil {
+		conn.shutdown()
+		return nil, fmt.Errorf("yggdrasil relay dial: %w", err)
+	}
+	return conn, nil
+}
+
+// handleRelayReserve grants or renews a neighbour's reservation.
+func (r *Router) handleRelayReserve(msg *Message) (*Message, error) {
+	s := r.relayService()
+	if s == nil {
+		return nil, ErrRelayDisabled
+	}
+	if _, ok := r.GetConnection(msg.From); !ok || len(msg.Via) != 0 {
+		return nil, fmt.Errorf("reserving node %s: %w", msg.From.Short(), ErrNotNeighbour)
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	res, ok := s.reservations[msg.From]
+	if !ok {
+		s.expireLocked(now)
+		if len(s.reservations) >= s.config.MaxReservations {
+			s.mu.Unlock()
+			return nil, ErrRelayFull
+		}
+		res = &relayReservation{tokens: float64(s.config.BytesPerSecond), refilled: now}
+		s.reservations[msg.From] = res
+	}
+	res.expires = now.Add(s.config.ReservationTTL)
+	expires := res.expires
+	s.mu.Unlock()
+
+	r.emitEvent("relay_reserved", map[string]string{"peer": msg.From.Short()})
+	data, err := json.Marshal(relayReserveResponse{Expires: expires.UnixMilli()})
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Payload: data}, nil
+}
+
+// handleRelayConnect sets up a circuit from the requester to a node that
+// holds a reservation here, once that node agrees.
+func (r *Router) handleRelayConnect(msg *Message) (*Message, error) {
+	s := r.relayService()
+	if s == nil {
+		return nil, ErrRelayDisabled
+	}
+	var req relayConnectRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return nil, fmt.Errorf("yggdrasil: bad relay connect: %w", err)
+	}
+
+	s.mu.Lock()
+	res, ok := s.reservations[req.Target]
+	switch {
+	case !ok || time.Now().After(res.expires):
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w for %s", ErrNoReservation, req.Target.Short())
+	case res.circuits >= s.config.MaxCircuits:
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s has %d circuits", ErrRelayFull, req.Target.Short(), res.circuits)
+	case s.circuits[req.Circuit] != nil:
+		s.mu.Unlock()
+		return nil, fmt.Errorf("yggdrasil: circuit %d in use", req.Circuit)
+	}
+	res.circuits++
+	s.circuits[req.Circuit] = &relayCircuit{initiator: msg.From, target: req.Target}
+	s.mu.Unlock()
+
+	r.replyLater(msg, func(ctx context.Context) (*Message, error) {
+		data, err := json.Marshal(relayOpenRequest{Peer: msg.From, Circuit: req.Circuit})
+		if err == nil {
+			_, err = r.Request(ctx, req.Target, types.MsgRelayOpen, data)
+		}
+		if err != nil {
+			s.closeCircuit(req.Circuit)
+			return nil, fmt.Errorf("open circuit at %s: %w", req.Target.Short(), err)
+		}
+		r.emitEvent("relay_circuit_opened", map[string]string{
+			"from": msg.From.Short(),
+			"to":   req.Target.Short(),
+		})
+		return &Message{}, nil
+	})
+	return nil, nil
+}
+
+// handleRelayOpen accepts a circuit from a relay we hold a reservation
+// at. The dialer runs the identity exchange over it like over any
+// inbound connection.
+func (r *Router) handleRelayOpen(msg *Message) (*Message, error) {
+	var req relayOpenRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return nil, fmt.Errorf("yggdrasil: bad relay open: %w", err)
+	}
+	r.mu.RLock()
+	expires, ok := r.reserved[msg.From]
+	r.mu.RUnlock()
+	if !ok || time.Now().After(expires) {
+		return nil, fmt.Errorf("%w at %s", ErrNoReservation, msg.From.Short())
+	}
+
+	conn := r.newRelayConn(msg.From, req.Circuit, RelayAddr(msg.From, req.Peer))
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+		defer cancel()
+		r.AcceptPeer(ctx, conn)
+	}()
+	return &Message{}, nil
+}
+
+// handleRelayData delivers circuit data to a local end, or forwards it if
+// we are the circuit's relay.
+func (r *Router) handleRelayData(msg *Message) (*Message, error) {
+	if len(msg.Payload) < relayHeaderSize {
+		return nil, nil
+	}
+	circuit := binary.BigEndian.Uint64(msg.Payload)
+
+	r.mu.RLock()
+	conn := r.circuits[circuitKey{relay: msg.From, id: circuit}]
+	r.mu.RUnlock()
+	if conn != nil {
+		conn.deliver(msg.Payload)
+		return nil, nil
+	}
+	if s := r.relayService(); s != nil {
+		r.forwardRelayData(s, msg, circuit)
+	}
+	return nil, nil
+}
+
+// forwardRelayData passes circuit data to the circuit's other end, within
+// the limits of the reserved node's reservation.
+func (r *Router) forwardRelayData(s *relayService, msg *Message, circuit uint64) {
+	s.mu.Lock()
+	c, ok := s.circuits[circuit]
+	if !ok || (msg.From != c.initiator && msg.From != c.target) {
+		s.mu.Unlock()
+		return
+	}
+	to := c.target
+	if msg.From == c.target {
+		to = c.initiator
+	}
+	res := s.reservations[c.target]
+	now := time.Now()
+	if res == nil || now.After(res.expires) || msg.Payload[8] == relayKindClose {
+		s.mu.Unlock()
+		s.closeCircuit(circuit)
+		r.sendRelayClose(c.initiator, circuit)
+		r.sendRelayClose(c.target, circuit)
+		return
+	}
+
+	rate := float64(s.config.BytesPerSecond)
+	res.tokens = min(rate, res.tokens+now.Sub(res.refilled).Seconds()*rate)
+	res.refilled = now
+	size := float64(len(msg.Payload) - relayHeaderSize)
+	if size > res.tokens {
+		s.mu.Unlock()
+		r.emitEvent("relay_throttled", map[string]string{"peer": c.target.Short()})
+		return
+	}
+	res.tokens -= size
+	s.mu.Unlock()
+
+	r.SendMessage(context.Background(), &Message{Type: types.MsgRelayData, To: to, Payload: msg.Payload})
+}
+
+func (r *Router) sendRelayClose(to types.NodeID, circuit uint64) {
+	payload := make([]byte, relayHeaderSize)
+	binary.BigEndian.PutUint64(payload, circuit)
+	payload[8] = relayKindClose
+	r.SendMessage(context.Background(), &Message{Type: types.MsgRelayData, To: to, Payload: payload})
+}
+
+// closeCircuit forgets a circuit and frees its slot.
+func (s *relayService) closeCircuit(circuit uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.circuits[circuit]
+	if !ok {
+		return
+	}
+	delete(s.circuits, circuit)
+	if res := s.reservations[c.target]; res != nil && res.circuits > 0 {
+		res.circuits--
+	}
+}
+
+// expireLocked drops lapsed reservations and their circuits. Called with
+// s.mu held.
+func (s *relayService) expireLocked(now time.Time) {
+	for id, res := range s.reservations {
+		if now.After(res.expires) {
+			delete(s.reservations, id)
+		}
+	}
+	for id, c := range s.circuits {
+		if _, ok := s.reservations[c.target]; !ok {
+			delete(s.circuits, id)
+		}
+	}
+}
+
+// circuitKey identifies a circuit at one of its ends. Relays pick or
+// accept IDs per circuit, so the relay is part of the key.
+type circuitKey struct {
+	relay types.NodeID
+	id    uint64
+}
+
+// relayConn is one end of a relay circuit, carrying frames as
+// MsgRelayData messages through the relay.
+type relayConn struct {
+	router  *Router
+	relay   types.NodeID
+	circuit uint64
+	remote  types.PathAddr
+	recvCh  chan *types.BifrostFrame
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (r *Router) newRelayConn(relay types.NodeID, circuit uint64, remote types.PathAddr) *relayConn {
+	c := &relayConn{
+		router:  r,
+		relay:   relay,
+		circuit: circuit,
+		remote:  remote,
+		recvCh:  make(chan *types.BifrostFrame, relayRecvBuffer),
+		closed:  make(chan struct{}),
+	}
+	r.mu.Lock()
+	r.circuits[circuitKey{relay: relay, id: circuit}] = c
+	r.mu.Unlock()
+	return c
+}
+
+func (c *relayConn) Send(frame *types.BifrostFrame) error {
+	select {
+	case <-c.closed:
+		return ErrCircuitClosed
+	default:
+	}
+	payload := make([]byte, relayHeaderSize, relayHeaderSize+len(frame.Payload))
+	binary.BigEndian.PutUint64(payload, c.circuit)
+	payload[8] = relayKindFrame
+	payload[9] = byte(frame.Type)
+	payload = append(payload, frame.Payload...)
+	return c.router.SendMessage(context.Background(), &Message{Type: types.MsgRelayData, To: c.relay, Payload: payload})
+}
+
+// deliver queues a frame from the relay, or closes the circuit.
+func (c *relayConn) deliver(payload []byte) {
+	if payload[8] == relayKindClose {
+		c.shutdown()
+		return
+	}
+	frame := &types.BifrostFrame{
+		Type:    types.FrameType(payload[9]),
+		Payload: append([]byte(nil), payload[relayHeaderSize:]...),
+	}
+	select {
+	case c.recvCh <- frame:
+	case <-c.closed:
+	default:
+	}
+}
+
+func (c *relayConn) Receive() (*types.BifrostFrame, error) {
+	select {
+	case f := <-c.recvCh:
+		return f, nil
+	case <-c.closed:
+		select {
+		case f := <-c.recvCh:
+			return f, nil
+		default:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (c *relayConn) RemoteAddr() string {
+	return string(c.remote)
+}
+
+// Close ends the circuit at both ends and at the relay.
+func (c *relayConn) Close() error {
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	c.router.sendRelayClose(c.relay, c.circuit)
+	c.shutdown()
+	return nil
+}
+
+func (c *relayConn) shutdown() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.router.mu.Lock()
+		delete(c.router.circuits, circuitKey{relay: c.relay, id: c.circuit})
+		c.router.mu.Unlock()
+	})
+}
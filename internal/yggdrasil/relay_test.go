@@ -0,0 +1,216 @@
+package yggdrasil_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+)
+
+// relayTriangle connects a hidden node and a dialer to a relay. The two
+// cannot reach each other directly.
+func relayTriangle(t *testing.T, ctx context.Context, config yggdrasil.RelayConfig) (hidden, dialer, relay *simNode) {
+	t.Helper()
+	network := bifrost.NewSimNetwork(1)
+	hidden = startSimNode(t, ctx, network, "hidden")
+	dialer = startSimNode(t, ctx, network, "dialer")
+	relay = startSimNode(t, ctx, network, "relay")
+	network.Partition([]string{"hidden"}, []string{"dialer"})
+	relay.router.EnableRelay(config)
+
+	for _, n := range []*simNode{hidden, dialer} {
+		if _, err := n.router.Connect(ctx, relay.addr, relay.id.NodeID); err != nil {
+			t.Fatalf("connect to relay: %v", err)
+		}
+	}
+	waitConnected(t, ctx, relay, hidden, dialer)
+	if _, err := dialer.router.Connect(ctx, hidden.addr, hidden.id.NodeID); err == nil {
+		t.Fatal("dialer reached the hidden node directly")
+	}
+	return hidden, dialer, relay
+}
+
+func TestRelayAddrRoundTrip(t *testing.T) {
+	relay, _ := yggdrasil.GenerateIdentity()
+	target, _ := yggdrasil.GenerateIdentity()
+	addr := yggdrasil.RelayAddr(relay.NodeID, target.NodeID)
+	if addr.Protocol() != "relay" {
+		t.Errorf("protocol = %q", addr.Protocol())
+	}
+	gotRelay, gotTarget, err := yggdrasil.ParseRelayAddr(addr)
+	if err != nil || gotRelay != relay.NodeID || gotTarget != target.NodeID {
+		t.Errorf("ParseRelayAddr = %s, %s, %v", gotRelay.Short(), gotTarget.Short(), err)
+	}
+
+	for _, bad := range []types.PathAddr{"/relay/abcd", "/tcp/1.2.3.4:5/x", addr[:len(addr)-2], addr + "00"} {
+		if _, _, err := yggdrasil.ParseRelayAddr(bad); !errors.Is(err, types.ErrInvalidPathAddr) {
+			t.Errorf("ParseRelayAddr(%q) = %v, want ErrInvalidPathAddr", bad, err)
+		}
+	}
+}
+
+func TestRelayCircuit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hidden, dialer, relay := relayTriangle(t, ctx, yggdrasil.RelayConfig{})
+
+	res, err := hidden.router.Reserve(ctx, relay.id.NodeID)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if res.Addr != yggdrasil.RelayAddr(relay.id.NodeID, hidden.id.NodeID) || !res.Expires.After(time.Now()) {
+		t.Fatalf("reservation = %+v", res)
+	}
+
+	peer, err := dialer.router.Connect(ctx, res.Addr, hidden.id.NodeID)
+	if err != nil {
+		t.Fatalf("Connect through relay: %v", err)
+	}
+	if peer.NodeID != hidden.id.NodeID {
+		t.Fatalf("connected to %s, want %s", peer.NodeID.Short(), hidden.id.NodeID.Short())
+	}
+	conn, ok := dialer.router.GetConnection(hidden.id.NodeID)
+	if !ok || conn.RemoteAddr() != string(res.Addr) {
+		t.Fatalf("dialer's connection to hidden node: %v, %v", conn, ok)
+	}
+	if _, err := dialer.router.Ping(ctx, hidden.id.NodeID); err != nil {
+		t.Errorf("Ping through circuit: %v", err)
+	}
+	waitConnected(t, ctx, hidden, dialer)
+	if _, err := hidden.router.Ping(ctx, dialer.id.NodeID); err != nil {
+		t.Errorf("Ping back through circuit: %v", err)
+	}
+}
+
+func TestRelayAddrIsDialedTransparently(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hidden, dialer, relay := relayTriangle(t, ctx, yggdrasil.RelayConfig{})
+
+	res, err := hidden.router.Reserve(ctx, relay.id.NodeID)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	hidden.router.SetAddrs([]types.PathAddr{res.Addr})
+
+	dialer.peers.AddPeer(hidden.router.Self())
+	if _, err := dialer.router.Ping(ctx, hidden.id.NodeID); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if conn, ok := dialer.router.GetConnection(hidden.id.NodeID); !ok || conn.RemoteAddr() != string(res.Addr) {
+		t.Error("Ping did not dial the advertised relay address")
+	}
+}
+
+func TestRelayRefusals(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hidden, dialer, relay := relayTriangle(t, ctx, yggdrasil.RelayConfig{})
+
+	// No reservation yet.
+	addr := yggdrasil.RelayAddr(relay.id.NodeID, hidden.id.NodeID)
+	if _, err := dialer.router.Connect(ctx, addr, hidden.id.NodeID); err == nil || !strings.Contains(err.Error(), "no relay reservation") {
+		t.Errorf("Connect without reservation = %v", err)
+	}
+	// The dialer is not a relay.
+	if _, err := hidden.router.Reserve(ctx, dialer.id.NodeID); err == nil {
+		t.Error("reserved at a node that is not a neighbour")
+	}
+	network := bifrost.NewSimNetwork(2)
+	plain := startSimNode(t, ctx, network, "plain")
+	other := startSimNode(t, ctx, network, "other")
+	if _, err := other.router.Connect(ctx, plain.addr, plain.id.NodeID); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, ctx, plain, other)
+	if _, err := other.router.Reserve(ctx, plain.id.NodeID); err == nil || !strings.Contains(err.Error(), "relay service not enabled") {
+		t.Errorf("Reserve at non-relay = %v", err)
+	}
+}
+
+func TestRelayEnforcesBandwidth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hidden, dialer, relay := relayTriangle(t, ctx, yggdrasil.RelayConfig{BytesPerSecond: 4096})
+
+	res, err := hidden.router.Reserve(ctx, relay.id.NodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.router.Connect(ctx, res.Addr, hidden.id.NodeID); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	big, cancelBig := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancelBig()
+	if _, err := dialer.router.Request(big, hidden.id.NodeID, types.MsgPing, make([]byte, 16*1024)); !errors.Is(err, yggdrasil.ErrRequestTimeout) {
+		t.Errorf("oversized request = %v, want ErrRequestTimeout", err)
+	}
+	if _, err := dialer.router.Ping(ctx, hidden.id.NodeID); err != nil {
+		t.Errorf("small Ping within limit: %v", err)
+	}
+}
+
+func TestRelayCircuitEndsWithReservation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hidden, dialer, relay := relayTriangle(t, ctx, yggdrasil.RelayConfig{ReservationTTL: 200 * time.Millisecond})
+
+	res, err := hidden.router.Reserve(ctx, relay.id.NodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.router.Connect(ctx, res.Addr, hidden.id.NodeID); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	time.Sleep(time.Until(res.Expires) + 50*time.Millisecond)
+
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	dialer.router.Ping(short, hidden.id.NodeID)
+	for {
+		if _, ok := dialer.router.GetConnection(hidden.id.NodeID); !ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("circuit outlived its reservation")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	if _, err := dialer.router.Connect(ctx, res.Addr, hidden.id.NodeID); err == nil {
+		t.Error("opened a circuit on an expired reservation")
+	}
+}
+
+func TestRelayConnectDoesNotStallRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hidden, dialer, relay := relayTriangle(t, ctx, yggdrasil.RelayConfig{})
+	res, err := hidden.router.Reserve(ctx, relay.id.NodeID)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	// The hidden node sits on the circuit, so the relay waits for it.
+	release := make(chan struct{})
+	defer close(release)
+	hidden.router.RegisterHandler(types.MsgRelayOpen, func(*yggdrasil.Message) (*yggdrasil.Message, error) {
+		<-release
+		return nil, errors.New("refused")
+	})
+	go dialer.router.Connect(ctx, res.Addr, hidden.id.NodeID)
+	time.Sleep(50 * time.Millisecond)
+
+	// The relay still serves the dialer over the same connection meanwhile.
+	pctx, pcancel := context.WithTimeout(ctx, time.Second)
+	defer pcancel()
+	if _, err := dialer.router.Ping(pctx, relay.id.NodeID); err != nil {
+		t.Fatalf("Ping relay during a pending circuit: %v", err)
+	}
+}
@@ -2,9 +2,14 @@ package yggdrasil
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"math/rand/v2"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/valhalla/valhalla/internal/bifrost"
 	"github.com/valhalla/valhalla/internal/types"
@@ -17,8 +22,36 @@ type Message struct {
 	To      types.NodeID              `json:"to"`
 	Payload []byte                    `json:"payload"`
 	TTL     int                       `json:"ttl"`
+
+	// ID is set on requests made with Router.Request and echoed in the
+	// response, which also sets Response. Error carries a handler failure.
+	ID       uint64 `json:"id,omitempty"`
+	Response bool   `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// Via lists the nodes that relayed the message, in order. A node
+	// drops a message that already passed through it.
+	Via []types.NodeID `json:"via,omitempty"`
+	// Trace marks a Traceroute probe: the relay at which its TTL runs out
+	// answers instead of silently dropping it.
+	Trace bool `json:"trace,omitempty"`
+
+	// PubKey, Nonce, Timestamp and Sig authenticate From: SendMessage signs
+	// every message and the destination verifies it before dispatch.
+	PubKey    ed25519.PublicKey `json:"pub_key"`
+	Nonce     uint64            `json:"nonce"`
+	Timestamp int64             `json:"timestamp"`
+	Sig       []byte            `json:"sig"`
 }
 
+// DefaultTTL is the hop limit of messages sent without one.
+const DefaultTTL = 10
+
+var (
+	ErrRoutingLoop = errors.New("yggdrasil: routing loop")
+	ErrTTLExpired  = errors.New("yggdrasil: TTL expired")
+)
+
 // Router handles message routing between Valhalla nodes.
 type Router struct {
 	identity  *Identity
@@ -27,22 +60,133 @@ type Router struct {
 	conns     map[types.NodeID]bifrost.Conn
 	handlers  map[types.ProtocolMessageType]MessageHandler
 	events    chan<- types.StackEvent
+	transport bifrost.Transport
+	addrs     []types.PathAddr
+	pending   map[uint64]*pendingRequest
+	nextID    atomic.Uint64
+	nonces    *nonceCache
+	routes    *routeTable
+	wire      map[types.NodeID]Encoding  // per connection; JSON if absent
+	dialed    map[types.NodeID]bool      // registered connections we opened
+	encoding  Encoding                   // preferred, offered to new peers
+	relay     *relayService              // nil unless EnableRelay
+	circuits  map[circuitKey]*relayConn  // relay circuits we are an end of
+	reserved  map[types.NodeID]time.Time // relays we hold reservations at
+	minPuzzle PuzzleDifficulty           // required of peers, advertised in hellos
+	keepalive bifrost.KeepaliveConfig    // for connections to verified peers
 	mu        sync.RWMutex
 }
 
-// MessageHandler processes an incoming routed message.
+// MessageHandler processes an incoming routed message. For requests, a
+// non-nil returned message is sent back to the requester as the response.
 type MessageHandler func(msg *Message) (*Message, error)
 
-// NewRouter creates a new message router.
+// NewRouter creates a new message router. It answers PING itself, pings
+// on behalf of peers' bucket maintenance, introduces neighbours for hole
+// punching, serves as a relay once EnableRelay is called and, if dht is
+// non-nil, serves the DHT's FIND_NODE, FIND_VALUE and STORE RPCs.
 func NewRouter(identity *Identity, peers *PeerTable, dht *DHT, events chan<- types.StackEvent) *Router {
-	return &Router{
+	r := &Router{
 		identity: identity,
 		peers:    peers,
 		dht:      dht,
 		conns:    make(map[types.NodeID]bifrost.Conn),
 		handlers: make(map[types.ProtocolMessageType]MessageHandler),
 		events:   events,
+		pending:  make(map[uint64]*pendingRequest),
+		nonces:   newNonceCache(),
+		routes:   newRouteTable(),
+		wire:     make(map[types.NodeID]Encoding),
+		dialed:   make(map[types.NodeID]bool),
+		encoding: EncodingBinary,
+		circuits: make(map[circuitKey]*relayConn),
+		reserved: make(map[types.NodeID]time.Time),
+	}
+	r.nextID.Store(rand.Uint64() >> 1)
+	r.handlers[types.MsgPing] = r.handlePing
+	r.handlers[types.MsgPunchRequest] = r.handlePunchRequest
+	r.handlers[types.MsgPunchIntro] = r.handlePunchIntro
+	r.handlers[types.MsgRelayReserve] = r.handleRelayReserve
+	r.handlers[types.MsgRelayConnect] = r.handleRelayConnect
+	r.handlers[types.MsgRelayOpen] = r.handleRelayOpen
+	r.handlers[types.MsgRelayData] = r.handleRelayData
+	peers.SetPinger(r.pingPeer)
+	if dht != nil {
+		dht.attach(r)
+	}
+	return r
+}
+
+// SetAddrs sets the addresses this node advertises to peers it contacts.
+func (r *Router) SetAddrs(addrs []types.PathAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs = addrs
+}
+
+// Self returns this node's contact information.
+func (r *Router) Self() PeerInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return PeerInfo{
+		NodeID:    r.identity.NodeID,
+		PublicKey: r.identity.PublicKey,
+		Addrs:     r.addrs,
+		Puzzle:    r.identity.puzzle(),
+	}
+}
+
+// SetMinDifficulty sets the network's minimum puzzle difficulty: it is
+// advertised to peers during the identity exchange, peers that fall short
+// of it are refused, and the peer table and DHT apply it too.
+func (r *Router) SetMinDifficulty(d PuzzleDifficulty) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.minPuzzle = d
+	r.mu.Unlock()
+	r.peers.SetMinDifficulty(d)
+	if r.dht != nil {
+		r.dht.SetMinDifficulty(d)
 	}
+	return nil
+}
+
+// SetTransport lets the router dial peers it has no connection to when
+// sending requests, using the addresses in the peer table.
+func (r *Router) SetTransport(t bifrost.Transport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transport = t
+}
+
+// SetKeepalive configures the keepalive probes and idle timeout wrapped
+// around connections to peers registered from now on. Zero fields fall
+// back to bifrost.DefaultKeepaliveConfig.
+func (r *Router) SetKeepalive(config bifrost.KeepaliveConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keepalive = config
+}
+
+// SetEncoding sets the wire encoding offered to peers connected from now
+// on. EncodingJSON makes traffic readable for debugging; the default is
+// EncodingBinary. Connections added with AddConnection always use JSON.
+func (r *Router) SetEncoding(enc Encoding) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.encoding = enc
+}
+
+// offeredEncodings lists the encodings we accept, preferred first.
+func (r *Router) offeredEncodings() []Encoding {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.encoding == EncodingJSON {
+		return []Encoding{EncodingJSON}
+	}
+	return []Encoding{EncodingBinary, EncodingJSON}
 }
 
 // RegisterHandler registers a handler for a protocol message type.
@@ -57,6 +201,8 @@ func (r *Router) AddConnection(nodeID types.NodeID, conn bifrost.Conn) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.conns[nodeID] = conn
+	delete(r.wire, nodeID)
+	delete(r.dialed, nodeID)
 }
 
 // RemoveConnection removes a peer connection.
@@ -64,6 +210,44 @@ func (r *Router) RemoveConnection(nodeID types.NodeID) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	delete(r.conns, nodeID)
+	delete(r.wire, nodeID)
+	delete(r.dialed, nodeID)
+	r.routes.forgetHop(nodeID)
+}
+
+// dropConnection removes conn if it is still nodeID's connection, so a
+// connection that has been replaced cannot remove its successor.
+func (r *Router) dropConnection(nodeID types.NodeID, conn bifrost.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns[nodeID] != conn {
+		return false
+	}
+	delete(r.conns, nodeID)
+	delete(r.wire, nodeID)
+	delete(r.dialed, nodeID)
+	r.routes.forgetHop(nodeID)
+	return true
+}
+
+// connectionLost drops a connection that failed or was closed, reporting
+// why unless it had already been replaced.
+func (r *Router) connectionLost(nodeID types.NodeID, conn bifrost.Conn, err error) {
+	if !r.dropConnection(nodeID, conn) {
+		return
+	}
+	reason := "closed"
+	var ce *bifrost.CloseError
+	switch {
+	case errors.Is(err, bifrost.ErrIdleTimeout):
+		reason = "idle timeout"
+	case errors.As(err, &ce) && ce.Remote:
+		reason = "closed by peer"
+	}
+	r.emitEvent("peer_disconnected", map[string]string{
+		"peer":   nodeID.Short(),
+		"reason": reason,
+	})
 }
 
 // GetConnection returns a direct connection to a peer if one exists.
@@ -74,82 +258,169 @@ func (r *Router) GetConnection(nodeID types.NodeID) (bifrost.Conn, bool) {
 	return conn, ok
 }
 
-// SendMessage routes a message to its destination.
+// SendMessage signs a message as this node and routes it to its
+// destination.
 func (r *Router) SendMessage(ctx context.Context, msg *Message) error {
 	if msg.TTL <= 0 {
-		msg.TTL = 10 // default TTL
+		msg.TTL = DefaultTTL
 	}
-	msg.From = r.identity.NodeID
+	msg.Via = nil
+	msg.sign(r.identity)
 
 	r.emitEvent("route_start", map[string]string{
 		"to": msg.To.Short(),
 	})
+	return r.route(msg)
+}
 
-	// Direct delivery if we have a connection to the target
-	if conn, ok := r.GetConnection(msg.To); ok {
-		return r.sendViaConn(conn, msg)
+// route delivers msg directly or forwards it towards msg.To, leaving
+// From untouched so replies reach the original sender. Each hop costs one
+// unit of TTL, and relays add themselves to Via. If a send fails, up to
+// maxSendAttempts next hops are tried in turn.
+func (r *Router) route(msg *Message) error {
+	if msg.TTL <= 0 {
+		return fmt.Errorf("%w routing to %s", ErrTTLExpired, msg.To.Short())
 	}
-
-	// Find closest peers to forward through
-	closest := r.peers.FindClosest(msg.To, 3)
-	if len(closest) == 0 {
-		return fmt.Errorf("yggdrasil: no route to %s", msg.To.Short())
+	next := *msg
+	next.TTL--
+	if msg.From != r.identity.NodeID {
+		next.Via = append(slices.Clip(msg.Via), r.identity.NodeID)
 	}
 
-	// Forward to the closest known peer
-	for _, peer := range closest {
-		if conn, ok := r.GetConnection(peer.NodeID); ok {
-			// Decrement TTL for forwarding
-			forward := *msg
-			forward.TTL--
-			if forward.TTL <= 0 {
-				return fmt.Errorf("yggdrasil: TTL expired routing to %s", msg.To.Short())
-			}
-
+	var failed []types.NodeID
+	var lastErr error
+	for len(failed) < maxSendAttempts {
+		hop, conn, ok := r.nextHop(&next, failed)
+		if !ok {
+			break
+		}
+		if hop != msg.To {
 			r.emitEvent("route_forward", map[string]string{
-				"via": peer.NodeID.Short(),
+				"via": hop.Short(),
 				"to":  msg.To.Short(),
 			})
+		}
+		err := r.sendViaConn(hop, conn, &next)
+		if err == nil {
+			r.routes.use(msg.To, hop)
+			return nil
+		}
+		r.routes.fail(msg.To, hop)
+		r.emitEvent("route_failover", map[string]string{
+			"via":   hop.Short(),
+			"to":    msg.To.Short(),
+			"error": err.Error(),
+		})
+		failed = append(failed, hop)
+		lastErr = err
+	}
+	if lastErr != nil {
+		return fmt.Errorf("yggdrasil: route to %s: %w", msg.To.Short(), lastErr)
+	}
+	return fmt.Errorf("yggdrasil: no route to %s", msg.To.Short())
+}
+
+// nextHop picks msg.To itself if it is a neighbour, then the cheapest
+// learned route to it, and otherwise the connected peer closest to
+// msg.To. Neighbours the message has already visited and those in
+// exclude are skipped.
+func (r *Router) nextHop(msg *Message, exclude []types.NodeID) (types.NodeID, bifrost.Conn, bool) {
+	skip := func(id types.NodeID) bool {
+		return id == msg.From || slices.Contains(msg.Via, id) || slices.Contains(exclude, id)
+	}
+	learned := r.routes.nextHops(msg.To)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-			return r.sendViaConn(conn, &forward)
+	if conn, ok := r.conns[msg.To]; ok && !slices.Contains(exclude, msg.To) {
+		return msg.To, conn, true
+	}
+	for _, via := range learned {
+		if conn, ok := r.conns[via]; ok && !skip(via) {
+			return via, conn, true
+		}
+	}
+
+	var best types.NodeID
+	var bestConn bifrost.Conn
+	for id, conn := range r.conns {
+		if skip(id) {
+			continue
+		}
+		if bestConn == nil || closerTo(msg.To, id, best) {
+			best, bestConn = id, conn
 		}
 	}
+	return best, bestConn, bestConn != nil
+}
 
-	return fmt.Errorf("yggdrasil: no connected peers near %s", msg.To.Short())
+// Routes returns the learned route table, ordered by destination and then
+// preference.
+func (r *Router) Routes() []Route {
+	return r.routes.snapshot()
 }
 
 // HandleIncoming processes an incoming message from a peer connection.
 func (r *Router) HandleIncoming(msg *Message) error {
 	// Is this message for us?
 	if msg.To == r.identity.NodeID {
+		if err := r.verifyMessage(msg); err != nil {
+			r.emitEvent("message_rejected", map[string]string{
+				"from":   msg.From.Short(),
+				"reason": err.Error(),
+			})
+			return err
+		}
 		r.emitEvent("message_received", map[string]string{
 			"from": msg.From.Short(),
 			"type": fmt.Sprintf("%d", msg.Type),
 		})
 
+		if msg.Response {
+			r.deliverResponse(msg)
+			return nil
+		}
+
 		r.mu.RLock()
 		handler, ok := r.handlers[msg.Type]
 		r.mu.RUnlock()
 
-		if ok {
-			_, err := handler(msg)
-			return err
+		if !ok {
+			return nil // no handler, drop silently
+		}
+		resp, err := handler(msg)
+		if msg.ID != 0 {
+			r.reply(msg, resp, err)
 		}
-		return nil // no handler, drop silently
+		return err
+	}
+
+	if msg.From == r.identity.NodeID || slices.Contains(msg.Via, r.identity.NodeID) {
+		r.emitEvent("route_loop", map[string]string{
+			"from": msg.From.Short(),
+			"to":   msg.To.Short(),
+		})
+		return ErrRoutingLoop
 	}
 
 	// Forward if TTL allows
 	if msg.TTL <= 0 {
+		if msg.Trace && msg.ID != 0 && !msg.Response {
+			return r.replyHop(msg)
+		}
 		return nil // TTL expired, drop
 	}
-
-	forward := *msg
-	forward.TTL--
-	return r.SendMessage(context.Background(), &forward)
+	return r.route(msg)
 }
 
-func (r *Router) sendViaConn(conn bifrost.Conn, msg *Message) error {
-	data, err := json.Marshal(msg)
+// sendViaConn encodes msg in the encoding agreed with the neighbour peer.
+func (r *Router) sendViaConn(peer types.NodeID, conn bifrost.Conn, msg *Message) error {
+	r.mu.RLock()
+	enc := r.wire[peer]
+	r.mu.RUnlock()
+
+	data, err := encodeMessage(msg, enc)
 	if err != nil {
 		return fmt.Errorf("yggdrasil: marshal message: %w", err)
 	}
@@ -172,21 +443,42 @@ func (r *Router) ReceiveLoop(ctx context.Context, peerID types.NodeID, conn bifr
 
 		frame, err := conn.Receive()
 		if err != nil {
-			r.RemoveConnection(peerID)
+			r.connectionLost(peerID, conn, err)
 			return
 		}
 
+		if frame.Type == types.FrameClose {
+			r.connectionLost(peerID, conn, &bifrost.CloseError{Remote: true})
+			conn.Close()
+			return
+		}
 		if frame.Type != types.FrameData {
 			continue // skip non-data frames for now
 		}
 
-		var msg Message
-		if err := json.Unmarshal(frame.Payload, &msg); err != nil {
+		msg, err := decodeMessage(frame.Payload)
+		if err != nil {
 			continue // skip malformed messages
 		}
+		r.peers.MarkSeen(peerID)
+		r.learnRoute(peerID, msg)
 
-		r.HandleIncoming(&msg)
+		r.HandleIncoming(msg)
+	}
+}
+
+// learnRoute records that messages from msg.From arrive through the
+// neighbour peerID, so replies and later traffic can retrace a path greedy
+// routing may not find. Only signed messages teach or refresh routes, so
+// a neighbour cannot keep a route alive with forged traffic.
+func (r *Router) learnRoute(peerID types.NodeID, msg *Message) {
+	if msg.From == peerID || msg.From == r.identity.NodeID {
+		return
+	}
+	if msg.verifySignature() != nil {
+		return
 	}
+	r.routes.learn(msg.From, peerID, len(msg.Via)+1)
 }
 
 func (r *Router) emitEvent(eventType string, data interface{}) {
@@ -0,0 +1,255 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+const (
+	// maxRouteDests bounds the destinations in the route table; the
+	// stalest is evicted to make room.
+	maxRouteDests = 4096
+	// maxPathsPerDest bounds the alternative next hops kept for one
+	// destination.
+	maxPathsPerDest = 3
+	// routeTTL is how long a route is used without being confirmed by
+	// traffic from its destination.
+	routeTTL = 10 * time.Minute
+	// maxRouteFailures is how many sends in a row may fail through a route
+	// before it is dropped.
+	maxRouteFailures = 3
+	// maxSendAttempts bounds the next hops route tries for one message.
+	maxSendAttempts = 3
+	// defaultHopCost is the latency assumed for a hop nothing has measured.
+	defaultHopCost = 50 * time.Millisecond
+)
+
+// Route is a path to Dest through the neighbour NextHop, learned from
+// traffic that arrived from Dest through it.
+type Route struct {
+	Dest    types.NodeID `json:"dest"`
+	NextHop types.NodeID `json:"next_hop"`
+	// Hops is the path length seen on the last message from Dest.
+	Hops int `json:"hops"`
+	// RTT is the smoothed round trip of requests sent along the route, or
+	// zero if none has been measured.
+	RTT time.Duration `json:"rtt"`
+	// Failures counts consecutive sends through NextHop that failed.
+	Failures int       `json:"failures"`
+	Updated  time.Time `json:"updated"`
+}
+
+// routeTable caches routes learned from traffic and the latencies
+// measured over them. Lower cost wins; see costLocked.
+type routeTable struct {
+	routes map[types.NodeID][]*Route
+	links  map[types.NodeID]time.Duration // smoothed RTT to each neighbour
+	inUse  map[types.NodeID]types.NodeID  // dest -> next hop last sent through
+	mu     sync.Mutex
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		routes: make(map[types.NodeID][]*Route),
+		links:  make(map[types.NodeID]time.Duration),
+		inUse:  make(map[types.NodeID]types.NodeID),
+	}
+}
+
+// learn records that a message from dest arrived through via after hops
+// hops.
+func (t *routeTable) learn(dest, via types.NodeID, hops int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if rt := t.findLocked(dest, via); rt != nil {
+		rt.Hops = hops
+		rt.Updated = now
+		return
+	}
+
+	paths, known := t.routes[dest]
+	if !known && len(t.routes) >= maxRouteDests {
+		t.evictLocked()
+	}
+	rt := &Route{Dest: dest, NextHop: via, Hops: hops, Updated: now}
+	if len(paths) < maxPathsPerDest {
+		t.routes[dest] = append(paths, rt)
+		return
+	}
+	stalest := 0
+	for i, p := range paths {
+		if p.Updated.Before(paths[stalest].Updated) {
+			stalest = i
+		}
+	}
+	paths[stalest] = rt
+}
+
+// evictLocked drops the destination heard from least recently.
+func (t *routeTable) evictLocked() {
+	var victim types.NodeID
+	var oldest time.Time
+	for dest, paths := range t.routes {
+		newest := paths[0].Updated
+		for _, p := range paths[1:] {
+			if p.Updated.After(newest) {
+				newest = p.Updated
+			}
+		}
+		if oldest.IsZero() || newest.Before(oldest) {
+			victim, oldest = dest, newest
+		}
+	}
+	delete(t.routes, victim)
+	delete(t.inUse, victim)
+}
+
+func (t *routeTable) findLocked(dest, via types.NodeID) *Route {
+	for _, rt := range t.routes[dest] {
+		if rt.NextHop == via {
+			return rt
+		}
+	}
+	return nil
+}
+
+// use records the next hop a message to dest was sent through, which a
+// response's round trip is then credited to.
+func (t *routeTable) use(dest, via types.NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.inUse[dest]; !ok && len(t.inUse) >= maxRouteDests {
+		clear(t.inUse)
+	}
+	t.inUse[dest] = via
+}
+
+// observeRTT folds a measured round trip to dest into the route last used
+// for it, or into the link RTT if dest is a neighbour.
+func (t *routeTable) observeRTT(dest types.NodeID, rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	via, ok := t.inUse[dest]
+	if !ok {
+		return
+	}
+	if via == dest {
+		t.links[dest] = smoothRTT(t.links[dest], rtt)
+		return
+	}
+	if rt := t.findLocked(dest, via); rt != nil {
+		rt.RTT = smoothRTT(rt.RTT, rtt)
+		rt.Failures = 0
+	}
+}
+
+// smoothRTT is an exponentially weighted moving average giving a new
+// sample a quarter of the weight, as TCP does.
+func smoothRTT(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return avg + (sample-avg)/4
+}
+
+// fail records a send through via that errored, dropping the route after
+// maxRouteFailures in a row.
+func (t *routeTable) fail(dest, via types.NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rt := t.findLocked(dest, via)
+	if rt == nil {
+		return
+	}
+	rt.Failures++
+	if rt.Failures >= maxRouteFailures {
+		t.removeLocked(dest, via)
+	}
+}
+
+func (t *routeTable) removeLocked(dest, via types.NodeID) {
+	paths := slices.DeleteFunc(t.routes[dest], func(rt *Route) bool { return rt.NextHop == via })
+	if len(paths) == 0 {
+		delete(t.routes, dest)
+	} else {
+		t.routes[dest] = paths
+	}
+	if t.inUse[dest] == via {
+		delete(t.inUse, dest)
+	}
+}
+
+// forgetHop drops every route through a neighbour we lost.
+func (t *routeTable) forgetHop(via types.NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.links, via)
+	for dest := range t.routes {
+		t.removeLocked(dest, via)
+	}
+}
+
+// nextHops returns the next hops of fresh routes to dest, cheapest
+// first.
+func (t *routeTable) nextHops(dest types.NodeID) []types.NodeID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var fresh []*Route
+	for _, rt := range t.routes[dest] {
+		if time.Since(rt.Updated) < routeTTL {
+			fresh = append(fresh, rt)
+		}
+	}
+	slices.SortStableFunc(fresh, func(a, b *Route) int {
+		return cmp.Compare(t.costLocked(a), t.costLocked(b))
+	})
+	hops := make([]types.NodeID, len(fresh))
+	for i, rt := range fresh {
+		hops[i] = rt.NextHop
+	}
+	return hops
+}
+
+// costLocked estimates a route's latency: its measured RTT if any, else
+// the link RTT to the next hop plus defaultHopCost for each further hop.
+// Each recent failure doubles it again.
+func (t *routeTable) costLocked(rt *Route) time.Duration {
+	cost := rt.RTT
+	if cost == 0 {
+		cost = t.links[rt.NextHop]
+		if cost == 0 {
+			cost = defaultHopCost
+		}
+		cost += time.Duration(max(rt.Hops-1, 0)) * defaultHopCost
+	}
+	return cost << rt.Failures
+}
+
+// snapshot returns a copy of every route, ordered by destination and
+// then cost.
+func (t *routeTable) snapshot() []Route {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []Route
+	dests := make([]types.NodeID, 0, len(t.routes))
+	for dest := range t.routes {
+		dests = append(dests, dest)
+	}
+	slices.SortFunc(dests, func(a, b types.NodeID) int { return bytes.Compare(a[:], b[:]) })
+	for _, dest := range dests {
+		paths := slices.Clone(t.routes[dest])
+		slices.SortStableFunc(paths, func(a, b *Route) int {
+			return cmp.Compare(t.costLocked(a), t.costLocked(b))
+		})
+		for _, rt := range paths {
+			out = append(out, *rt)
+		}
+	}
+	return out
+}
@@ -0,0 +1,192 @@
+package yggdrasil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// stubConn records the frames sent on it, or fails every Send with err.
+type stubConn struct {
+	err  error
+	mu   sync.Mutex
+	sent []*types.BifrostFrame
+}
+
+func (c *stubConn) Send(frame *types.BifrostFrame) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, frame)
+	return nil
+}
+
+func (c *stubConn) Receive() (*types.BifrostFrame, error) { select {} }
+func (c *stubConn) RemoteAddr() string                    { return "stub" }
+func (c *stubConn) Close() error                          { return nil }
+
+func (c *stubConn) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sent)
+}
+
+func newTestNodeIDs(t *testing.T, n int) []types.NodeID {
+	t.Helper()
+	ids := make([]types.NodeID, n)
+	for i := range ids {
+		id, err := GenerateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id.NodeID
+	}
+	return ids
+}
+
+func TestRouteTablePrefersCheaperRoutes(t *testing.T) {
+	ids := newTestNodeIDs(t, 3)
+	dest, near, far := ids[0], ids[1], ids[2]
+
+	tests := []struct {
+		name  string
+		setup func(rt *routeTable)
+		want  types.NodeID
+	}{
+		{
+			name:  "fewer hops",
+			setup: func(rt *routeTable) {},
+			want:  near,
+		},
+		{
+			name: "measured latency beats hop count",
+			setup: func(rt *routeTable) {
+				rt.use(dest, far)
+				rt.observeRTT(dest, 5*time.Millisecond)
+			},
+			want: far,
+		},
+		{
+			name: "slow link to next hop",
+			setup: func(rt *routeTable) {
+				rt.use(near, near)
+				rt.observeRTT(near, time.Second)
+			},
+			want: far,
+		},
+		{
+			name: "failures demote",
+			setup: func(rt *routeTable) {
+				rt.fail(dest, near)
+				rt.fail(dest, near)
+			},
+			want: far,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRouteTable()
+			rt.learn(dest, near, 2)
+			rt.learn(dest, far, 4)
+			tt.setup(rt)
+			if hops := rt.nextHops(dest); len(hops) == 0 || hops[0] != tt.want {
+				t.Errorf("nextHops = %v, want %s first", hops, tt.want.Short())
+			}
+		})
+	}
+}
+
+func TestRouteTableBounds(t *testing.T) {
+	ids := newTestNodeIDs(t, 6)
+	dest, hops := ids[0], ids[1:]
+	rt := newRouteTable()
+	for _, via := range hops[:maxPathsPerDest+1] {
+		rt.learn(dest, via, 2)
+		time.Sleep(time.Millisecond)
+	}
+	got := rt.nextHops(dest)
+	if len(got) != maxPathsPerDest {
+		t.Fatalf("kept %d paths, want %d", len(got), maxPathsPerDest)
+	}
+	for _, via := range got {
+		if via == hops[0] {
+			t.Error("stalest path was not replaced")
+		}
+	}
+
+	for i := 0; i < maxRouteFailures; i++ {
+		rt.fail(dest, hops[1])
+	}
+	rt.forgetHop(hops[2])
+	if got := rt.nextHops(dest); len(got) != 1 || got[0] != hops[3] {
+		t.Errorf("after failures and a lost neighbour, nextHops = %v", got)
+	}
+}
+
+func TestRouterFailsOverToAlternateHop(t *testing.T) {
+	self, _ := GenerateIdentity()
+	ids := newTestNodeIDs(t, 3)
+	dest, broken, working := ids[0], ids[1], ids[2]
+	events := make(chan types.StackEvent, 64)
+	r := NewRouter(self, NewPeerTable(self.NodeID), nil, events)
+
+	bad := &stubConn{err: errors.New("link down")}
+	good := &stubConn{}
+	r.AddConnection(broken, bad)
+	r.AddConnection(working, good)
+	r.routes.learn(dest, broken, 2)
+	r.routes.learn(dest, working, 3)
+
+	if err := r.SendMessage(context.Background(), &Message{Type: types.MsgPing, To: dest}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if good.count() != 1 {
+		t.Fatalf("alternate hop got %d frames, want 1", good.count())
+	}
+	routes := r.Routes()
+	if len(routes) != 2 || routes[0].NextHop != working || routes[1].Failures != 1 {
+		t.Errorf("routes after failover = %+v", routes)
+	}
+
+	var failover bool
+	for len(events) > 0 {
+		if evt := <-events; evt.Type == "route_failover" {
+			failover = true
+		}
+	}
+	if !failover {
+		t.Error("no route_failover event")
+	}
+
+	r.AddConnection(working, &stubConn{err: errors.New("link down")})
+	if err := r.SendMessage(context.Background(), &Message{Type: types.MsgPing, To: dest}); err == nil {
+		t.Error("SendMessage succeeded with every hop down")
+	}
+}
+
+func TestRouterLearnsRoutesOnlyFromSignedMessages(t *testing.T) {
+	self, _ := GenerateIdentity()
+	dest, _ := GenerateIdentity()
+	via := newTestNodeIDs(t, 1)[0]
+	r := NewRouter(self, NewPeerTable(self.NodeID), nil, nil)
+
+	signed := &Message{Type: types.MsgPing, From: dest.NodeID, To: self.NodeID, TTL: 8}
+	signed.sign(dest)
+	r.learnRoute(via, signed)
+	if routes := r.Routes(); len(routes) != 1 || routes[0].Hops != 1 {
+		t.Fatalf("routes after a signed message = %+v", routes)
+	}
+
+	// A forged message cannot refresh the known route either.
+	forged := &Message{Type: types.MsgPing, From: dest.NodeID, To: self.NodeID, TTL: 8, Via: []types.NodeID{via, via}}
+	r.learnRoute(via, forged)
+	if routes := r.Routes(); len(routes) != 1 || routes[0].Hops != 1 {
+		t.Errorf("forged message changed the route: %+v", routes)
+	}
+}
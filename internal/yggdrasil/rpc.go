@@ -0,0 +1,182 @@
+package yggdrasil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// DefaultRequestTimeout bounds a Request whose context has no deadline.
+const DefaultRequestTimeout = 5 * time.Second
+
+var (
+	ErrRequestTimeout = errors.New("yggdrasil: request timed out")
+	ErrRemote         = errors.New("yggdrasil: remote error")
+)
+
+// pendingRequest is a Request awaiting its response. anyFrom accepts a
+// response from any node, as Traceroute probes are answered by relays.
+type pendingRequest struct {
+	to      types.NodeID
+	anyFrom bool
+	ch      chan *Message
+}
+
+// Request sends a request to a node and waits for its response. The
+// request is routed like any message; if the router has a transport and
+// no connection to the target, it dials the target's known addresses
+// first.
+func (r *Router) Request(ctx context.Context, to types.NodeID, msgType types.ProtocolMessageType, payload []byte) (*Message, error) {
+	peer, ok := r.peers.GetPeer(to)
+	if !ok {
+		peer = PeerInfo{NodeID: to}
+	}
+	return r.requestPeer(ctx, peer, msgType, payload)
+}
+
+// requestPeer is Request for a peer whose addresses may not be in the
+// peer table yet, such as a lookup candidate.
+func (r *Router) requestPeer(ctx context.Context, peer PeerInfo, msgType types.ProtocolMessageType, payload []byte) (*Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	r.ensureConnection(ctx, peer)
+	resp, err := r.roundTrip(ctx, &Message{Type: msgType, To: peer.NodeID, Payload: payload}, false)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%w from %s: %s", ErrRemote, peer.NodeID.Short(), resp.Error)
+	}
+	return resp, nil
+}
+
+// roundTrip sends msg with a fresh request ID and waits for the response.
+func (r *Router) roundTrip(ctx context.Context, msg *Message, anyFrom bool) (*Message, error) {
+	id := r.nextID.Add(1)
+	ch := make(chan *Message, 1)
+	r.mu.Lock()
+	r.pending[id] = &pendingRequest{to: msg.To, anyFrom: anyFrom, ch: ch}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+	}()
+
+	msg.ID = id
+	start := time.Now()
+	if err := r.SendMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.From == msg.To {
+			r.routes.observeRTT(msg.To, time.Since(start))
+		}
+		return resp, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: type %d to %s", ErrRequestTimeout, msg.Type, msg.To.Short())
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Ping sends a PING and returns the round-trip time.
+func (r *Router) Ping(ctx context.Context, to types.NodeID) (time.Duration, error) {
+	start := time.Now()
+	if _, err := r.Request(ctx, to, types.MsgPing, nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// pingPeer is the PeerTable's Pinger.
+func (r *Router) pingPeer(ctx context.Context, peer PeerInfo) error {
+	_, err := r.requestPeer(ctx, peer, types.MsgPing, nil)
+	return err
+}
+
+func (r *Router) handlePing(msg *Message) (*Message, error) {
+	return &Message{}, nil
+}
+
+// ensureConnection dials a peer we know addresses for but have no
+// connection to, then tries hole punching through our neighbours if the
+// transport supports it. Failures are left for routing to report.
+func (r *Router) ensureConnection(ctx context.Context, peer PeerInfo) {
+	if _, ok := r.GetConnection(peer.NodeID); ok {
+		return
+	}
+	r.mu.RLock()
+	transport := r.transport
+	r.mu.RUnlock()
+	if transport == nil {
+		return
+	}
+	for _, addr := range peer.Addrs {
+		if _, err := r.Connect(ctx, addr, peer.NodeID); err == nil {
+			return
+		}
+	}
+	if r.puncher() != nil {
+		r.punchViaNeighbours(ctx, peer.NodeID)
+	}
+}
+
+// reply sends the response to a request. A handler error is reported in
+// the response's Error field.
+func (r *Router) reply(req, resp *Message, err error) {
+	if resp == nil && err == nil {
+		return
+	}
+	if resp == nil {
+		resp = &Message{}
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Type = req.Type
+	resp.To = req.From
+	resp.ID = req.ID
+	resp.Response = true
+	resp.TTL = 0
+	r.SendMessage(context.Background(), resp)
+}
+
+// replyLater runs the slow part of a handler, such as a Request to
+// another peer, off the receive loop and replies once it finishes. The
+// handler returns nil, nil so HandleIncoming does not reply itself.
+func (r *Router) replyLater(req *Message, fn func(ctx context.Context) (*Message, error)) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+		defer cancel()
+		resp, err := fn(ctx)
+		if req.ID != 0 {
+			r.reply(req, resp, err)
+		}
+	}()
+}
+
+// deliverResponse hands a response to the Request waiting for it. Replies
+// from anyone but the node asked are ignored, except for trace probes.
+func (r *Router) deliverResponse(msg *Message) {
+	r.mu.RLock()
+	p, ok := r.pending[msg.ID]
+	r.mu.RUnlock()
+	if !ok || (!p.anyFrom && p.to != msg.From) {
+		return
+	}
+	select {
+	case p.ch <- msg:
+	default: // duplicate response
+	}
+}
@@ -0,0 +1,208 @@
+package yggdrasil
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Store holds a node's DHT records. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Get returns the record for key, or false if there is none.
+	Get(key [32]byte) (*DHTRecord, bool)
+	// Put stores rec, replacing any record with the same key.
+	Put(rec *DHTRecord) error
+	// Delete removes the record for key, if any.
+	Delete(key [32]byte) error
+	// Range calls fn for each record until fn returns false.
+	Range(fn func(rec *DHTRecord) bool)
+	// Len returns the number of records.
+	Len() int
+	Close() error
+}
+
+// MemoryStore is a Store that keeps records in memory only.
+type MemoryStore struct {
+	records map[[32]byte]*DHTRecord
+	mu      sync.RWMutex
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[[32]byte]*DHTRecord)}
+}
+
+func (s *MemoryStore) Get(key [32]byte) (*DHTRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.records[key]
+	return rec, ok
+}
+
+func (s *MemoryStore) Put(rec *DHTRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.Key] = rec
+	return nil
+}
+
+func (s *MemoryStore) Delete(key [32]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *MemoryStore) Range(fn func(rec *DHTRecord) bool) {
+	s.mu.RLock()
+	recs := make([]*DHTRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		recs = append(recs, rec)
+	}
+	s.mu.RUnlock()
+
+	for _, rec := range recs {
+		if !fn(rec) {
+			return
+		}
+	}
+}
+
+func (s *MemoryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.records)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// FileStore is a Store that persists each record as a JSON file in a
+// directory, so a restarted node keeps serving the records it held.
+// Records are also cached in memory; reads never touch the disk.
+type FileStore struct {
+	dir string
+	mem *MemoryStore
+	mu  sync.Mutex // serializes writes
+}
+
+// recordFileExt is the extension of record files in a FileStore.
+const recordFileExt = ".json"
+
+// NewFileStore opens the store in dir, creating the directory if needed
+// and loading every record already in it. Files that do not decode to a
+// validly signed record for their key are skipped.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("yggdrasil: file store: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("yggdrasil: file store: %w", err)
+	}
+
+	s := &FileStore{dir: dir, mem: NewMemoryStore()}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, recordFileExt) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		var rec DHTRecord
+		if err := json.Unmarshal(data, &rec); err != nil || s.fileName(rec.Key) != name {
+			continue
+		}
+		if rec.Verify() != nil {
+			continue
+		}
+		s.mem.Put(&rec)
+	}
+	return s, nil
+}
+
+func (s *FileStore) fileName(key [32]byte) string {
+	return hex.EncodeToString(key[:]) + recordFileExt
+}
+
+func (s *FileStore) Get(key [32]byte) (*DHTRecord, bool) {
+	return s.mem.Get(key)
+}
+
+// Put writes rec to a temporary file, syncs it and renames it into place,
+// then syncs the directory, so a crash never leaves a torn record behind
+// and a returned Put survives one.
+func (s *FileStore) Put(rec *DHTRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("yggdrasil: file store: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp, err := os.CreateTemp(s.dir, "record-*.tmp")
+	if err != nil {
+		return fmt.Errorf("yggdrasil: file store: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(s.dir, s.fileName(rec.Key)))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("yggdrasil: file store: %w", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		return fmt.Errorf("yggdrasil: file store: %w", err)
+	}
+	return s.mem.Put(rec)
+}
+
+// syncDir flushes dir's entries, making a rename in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *FileStore) Delete(key [32]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(filepath.Join(s.dir, s.fileName(key)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("yggdrasil: file store: %w", err)
+	}
+	return s.mem.Delete(key)
+}
+
+func (s *FileStore) Range(fn func(rec *DHTRecord) bool) {
+	s.mem.Range(fn)
+}
+
+func (s *FileStore) Len() int {
+	return s.mem.Len()
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package yggdrasil_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+)
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	self, _ := yggdrasil.GenerateIdentity()
+	pub, _ := yggdrasil.GenerateIdentity()
+
+	store, err := yggdrasil.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht := yggdrasil.NewDHTWithConfig(self.NodeID, yggdrasil.DHTConfig{Store: store})
+	if err := dht.Put(signedRecord(t, pub, [32]byte{1}, "kept", 1)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := dht.Put(signedRecord(t, pub, [32]byte{2}, "gone", 1)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := store.Delete([32]byte{2}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	dht.Close()
+
+	// Stray and corrupt files are ignored on load, as are records whose
+	// signature no longer checks out.
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hi"), 0600)
+	os.WriteFile(filepath.Join(dir, "00ff.json"), []byte("{"), 0600)
+	forged := signedRecord(t, pub, [32]byte{3}, "forged", 1)
+	forged.Value = []byte("tampered")
+	data, _ := json.Marshal(forged)
+	os.WriteFile(filepath.Join(dir, hex.EncodeToString(forged.Key[:])+".json"), data, 0600)
+
+	store, err = yggdrasil.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 1 {
+		t.Errorf("reopened store has %d records, want 1", store.Len())
+	}
+	dht = yggdrasil.NewDHTWithConfig(self.NodeID, yggdrasil.DHTConfig{Store: store})
+	defer dht.Close()
+	rec, ok := dht.Get([32]byte{1})
+	if !ok || string(rec.Value) != "kept" {
+		t.Fatalf("record not served after restart: %v, %v", rec, ok)
+	}
+	if _, ok := dht.Get([32]byte{2}); ok {
+		t.Error("deleted record came back")
+	}
+	if _, ok := dht.Get([32]byte{3}); ok {
+		t.Error("record with a bad signature was loaded")
+	}
+}
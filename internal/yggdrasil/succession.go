@@ -0,0 +1,303 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// successionMagic opens every encoded SuccessionStatement, so neither of
+// its signatures can be passed off as a signature over any other value.
+const (
+	successionMagic   = "VSUC"
+	successionVersion = 1
+	// magic, version, old ID, old key, new ID, new key, timestamp
+	successionBodySize = len(successionMagic) + 1 + 2*(32+ed25519.PublicKeySize) + 8
+	successionSize     = successionBodySize + ed25519.SignatureSize
+	// MaxSuccessionHops bounds the statements FollowSuccession walks.
+	MaxSuccessionHops = 16
+)
+
+var (
+	ErrInvalidSuccession = errors.New("yggdrasil: invalid succession statement")
+	ErrSuccessionLoop    = errors.New("yggdrasil: succession chain loops or is too long")
+)
+
+// SuccessionStatement hands an identity over to a new key: the old key
+// names its successor and signs, after the successor has countersigned to
+// prove it holds the new key. Peers store statements in the DHT under
+// SuccessionKey(OldID) so anything bound to the old NodeID can follow it.
+// An old key is succeeded once; the DHT keeps the first statement it sees.
+type SuccessionStatement struct {
+	OldID     types.NodeID      `json:"old_id"`
+	OldKey    ed25519.PublicKey `json:"old_key"`
+	NewID     types.NodeID      `json:"new_id"`
+	NewKey    ed25519.PublicKey `json:"new_key"`
+	Timestamp int64             `json:"timestamp"`
+	// NewSignature is the new key's signature over the statement.
+	NewSignature []byte `json:"new_signature"`
+	// Signature is the old key's signature over the statement and
+	// NewSignature, i.e. over MarshalBinary.
+	Signature []byte `json:"signature"`
+}
+
+// SignSuccession makes next the successor of id.
+func (id *Identity) SignSuccession(next *Identity) (*SuccessionStatement, error) {
+	if next.NodeID == id.NodeID {
+		return nil, fmt.Errorf("%w: identity succeeds itself", ErrInvalidSuccession)
+	}
+	s := &SuccessionStatement{
+		OldID:     id.NodeID,
+		OldKey:    id.PublicKey,
+		NewID:     next.NodeID,
+		NewKey:    next.PublicKey,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	s.NewSignature = next.Sign(s.body())
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	s.Signature = id.Sign(data)
+	return s, nil
+}
+
+// Rotate generates a new identity and the statement making it the
+// successor of id. Identities that must meet a puzzle difficulty should
+// instead generate theirs with GenerateIdentityWithPuzzle and call
+// SignSuccession.
+func (id *Identity) Rotate() (*Identity, *SuccessionStatement, error) {
+	next, err := GenerateIdentity()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := id.SignSuccession(next)
+	if err != nil {
+		return nil, nil, err
+	}
+	return next, s, nil
+}
+
+// body is the encoding NewSignature covers:
+//
+//	"VSUC" [version:1] [old_id:32] [old_key:32] [new_id:32] [new_key:32]
+//	[timestamp:8]
+func (s *SuccessionStatement) body() []byte {
+	buf := make([]byte, 0, successionSize)
+	buf = append(buf, successionMagic...)
+	buf = append(buf, successionVersion)
+	buf = append(buf, s.OldID[:]...)
+	buf = append(buf, s.OldKey...)
+	buf = append(buf, s.NewID[:]...)
+	buf = append(buf, s.NewKey...)
+	return binary.BigEndian.AppendUint64(buf, uint64(s.Timestamp))
+}
+
+// MarshalBinary returns the canonical encoding, which Signature covers:
+// the body followed by [new_signature:64]. Integers are big-endian.
+func (s *SuccessionStatement) MarshalBinary() ([]byte, error) {
+	if len(s.OldKey) != ed25519.PublicKeySize || len(s.NewKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: bad public key", ErrInvalidSuccession)
+	}
+	if len(s.NewSignature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: bad successor signature", ErrInvalidSuccession)
+	}
+	return append(s.body(), s.NewSignature...), nil
+}
+
+// UnmarshalBinary decodes the encoding produced by MarshalBinary.
+// Signature is left unchanged.
+func (s *SuccessionStatement) UnmarshalBinary(data []byte) error {
+	if !isSuccessionValue(data) || len(data) != successionSize {
+		return fmt.Errorf("%w: not a succession encoding", ErrInvalidSuccession)
+	}
+	if v := data[len(successionMagic)]; v != successionVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrInvalidSuccession, v)
+	}
+
+	p := data[len(successionMagic)+1:]
+	st := SuccessionStatement{Signature: s.Signature}
+	copy(st.OldID[:], p[:32])
+	st.OldKey = ed25519.PublicKey(bytes.Clone(p[32:64]))
+	copy(st.NewID[:], p[64:96])
+	st.NewKey = ed25519.PublicKey(bytes.Clone(p[96:128]))
+	st.Timestamp = int64(binary.BigEndian.Uint64(p[128:136]))
+	st.NewSignature = bytes.Clone(p[136:])
+	*s = st
+	return nil
+}
+
+// Verify checks that both NodeIDs are derived from their keys and that
+// both keys signed the statement.
+func (s *SuccessionStatement) Verify() error {
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if types.NodeIDFromPublicKey(s.OldKey) != s.OldID || types.NodeIDFromPublicKey(s.NewKey) != s.NewID {
+		return fmt.Errorf("%w: NodeID does not match public key", ErrInvalidSuccession)
+	}
+	if s.OldID == s.NewID {
+		return fmt.Errorf("%w: identity succeeds itself", ErrInvalidSuccession)
+	}
+	if err := s.VerifySuccessor(); err != nil {
+		return err
+	}
+	if !VerifyWithKey(s.OldKey, data, s.Signature) {
+		return fmt.Errorf("%w: bad signature", ErrInvalidSuccession)
+	}
+	return nil
+}
+
+// VerifySuccessor checks only the new key's countersignature, which shows
+// the successor agreed to take over the identity. Verify includes it.
+func (s *SuccessionStatement) VerifySuccessor() error {
+	if len(s.NewKey) != ed25519.PublicKeySize || types.NodeIDFromPublicKey(s.NewKey) != s.NewID {
+		return fmt.Errorf("%w: NodeID does not match public key", ErrInvalidSuccession)
+	}
+	if !VerifyWithKey(s.NewKey, s.body(), s.NewSignature) {
+		return fmt.Errorf("%w: bad successor signature", ErrInvalidSuccession)
+	}
+	return nil
+}
+
+// VerifySuccessionChain checks that chain hands from over to to, one
+// verified statement at a time. An empty chain links an identity to
+// itself.
+func VerifySuccessionChain(chain []*SuccessionStatement, from, to types.NodeID) error {
+	if len(chain) > MaxSuccessionHops {
+		return ErrSuccessionLoop
+	}
+	cur := from
+	for _, s := range chain {
+		if s.OldID != cur {
+			return fmt.Errorf("%w: chain breaks at %s", ErrInvalidSuccession, cur.Short())
+		}
+		if err := s.Verify(); err != nil {
+			return err
+		}
+		cur = s.NewID
+	}
+	if cur != to {
+		return fmt.Errorf("%w: chain ends at %s, not %s", ErrInvalidSuccession, cur.Short(), to.Short())
+	}
+	return nil
+}
+
+// SuccessionKey is the DHT key of the statement succeeding old.
+func SuccessionKey(old types.NodeID) [32]byte {
+	return sha256.Sum256(append([]byte(successionMagic), old[:]...))
+}
+
+// dhtRecord wraps the statement for storage under SuccessionKey(OldID).
+// The value is MarshalBinary followed by [signature:64], and the sequence
+// is always 1 so the first statement stored is never replaced; the caller
+// signs the record itself.
+func (s *SuccessionStatement) dhtRecord() (*DHTRecord, error) {
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidSuccession)
+	}
+	return &DHTRecord{
+		Key:       SuccessionKey(s.OldID),
+		Value:     append(data, s.Signature...),
+		Sequence:  1,
+		Timestamp: time.Now().UnixMilli(),
+	}, nil
+}
+
+// SuccessionFromRecord decodes and verifies the statement held in a DHT
+// record, including that the record is keyed by the old identity and
+// published by the old or the new one.
+func SuccessionFromRecord(rec *DHTRecord) (*SuccessionStatement, error) {
+	if len(rec.Value) != successionSize+ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: not a succession encoding", ErrInvalidSuccession)
+	}
+	s := &SuccessionStatement{Signature: bytes.Clone(rec.Value[successionSize:])}
+	if err := s.UnmarshalBinary(rec.Value[:successionSize]); err != nil {
+		return nil, err
+	}
+	byOld := rec.Publisher == s.OldID && bytes.Equal(rec.PubKey, s.OldKey)
+	byNew := rec.Publisher == s.NewID && bytes.Equal(rec.PubKey, s.NewKey)
+	if rec.Key != SuccessionKey(s.OldID) || rec.Sequence != 1 || !(byOld || byNew) {
+		return nil, fmt.Errorf("%w: record does not match its contents", ErrInvalidSuccession)
+	}
+	if err := s.Verify(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func isSuccessionValue(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(successionMagic))
+}
+
+// PublishSuccession stores a succession statement in the DHT, in a record
+// signed by id, which must be the statement's old or new identity. The
+// DHT republishes statements naming it as the successor, so a rotated
+// node keeps its statement alive.
+func (d *DHT) PublishSuccession(ctx context.Context, s *SuccessionStatement, id *Identity) error {
+	if err := s.Verify(); err != nil {
+		return err
+	}
+	if id.NodeID != s.OldID && id.NodeID != s.NewID {
+		return fmt.Errorf("%w: %s is not party to the statement", ErrInvalidSuccession, id.NodeID.Short())
+	}
+	record, err := s.dhtRecord()
+	if err != nil {
+		return err
+	}
+	record.Sign(id)
+	return d.PutContext(ctx, record)
+}
+
+// ResolveSuccession returns the statement succeeding old, or ErrNotFound
+// if old has not rotated.
+func (d *DHT) ResolveSuccession(ctx context.Context, old types.NodeID) (*SuccessionStatement, error) {
+	key := SuccessionKey(old)
+	matches := func(rec *DHTRecord) bool {
+		s, err := SuccessionFromRecord(rec)
+		return err == nil && s.OldID == old
+	}
+	if rec, ok := d.getLocal(key); ok && matches(rec) {
+		return SuccessionFromRecord(rec)
+	}
+	rec, err := d.findValue(ctx, key, matches)
+	if err != nil {
+		return nil, err
+	}
+	return SuccessionFromRecord(rec)
+}
+
+// FollowSuccession walks the statements succeeding id and returns them in
+// order; the last names id's current identity. The chain is empty if id
+// has not rotated.
+func (d *DHT) FollowSuccession(ctx context.Context, id types.NodeID) ([]*SuccessionStatement, error) {
+	var chain []*SuccessionStatement
+	seen := map[types.NodeID]bool{id: true}
+	for cur := id; ; {
+		s, err := d.ResolveSuccession(ctx, cur)
+		if errors.Is(err, ErrNotFound) {
+			return chain, nil
+		}
+		if err != nil {
+			return chain, err
+		}
+		if seen[s.NewID] || len(chain) == MaxSuccessionHops {
+			return chain, ErrSuccessionLoop
+		}
+		seen[s.NewID] = true
+		chain = append(chain, s)
+		cur = s.NewID
+	}
+}
@@ -0,0 +1,189 @@
+package yggdrasil_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/yggdrasil"
+)
+
+func TestSuccessionStatementVerify(t *testing.T) {
+	old, _ := yggdrasil.GenerateIdentity()
+	next, s, err := old.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if s.OldID != old.NodeID || s.NewID != next.NodeID {
+		t.Fatalf("statement hands %s to %s", s.OldID.Short(), s.NewID.Short())
+	}
+	if err := s.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &yggdrasil.SuccessionStatement{Signature: s.Signature}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if err := decoded.Verify(); err != nil {
+		t.Errorf("decoded statement: %v", err)
+	}
+
+	other, _ := yggdrasil.GenerateIdentity()
+	forged, _ := other.SignSuccession(next)
+	tests := []struct {
+		name   string
+		tamper func(*yggdrasil.SuccessionStatement)
+	}{
+		{"new key swapped", func(s *yggdrasil.SuccessionStatement) { s.NewID, s.NewKey = other.NodeID, other.PublicKey }},
+		{"old key swapped", func(s *yggdrasil.SuccessionStatement) { s.OldKey = other.PublicKey }},
+		{"timestamp changed", func(s *yggdrasil.SuccessionStatement) { s.Timestamp++ }},
+		{"successor did not sign", func(s *yggdrasil.SuccessionStatement) { s.NewSignature = other.Sign([]byte("x")) }},
+		{"signed by someone else", func(s *yggdrasil.SuccessionStatement) { s.Signature = forged.Signature }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := *s
+			tt.tamper(&bad)
+			if err := bad.Verify(); !errors.Is(err, yggdrasil.ErrInvalidSuccession) {
+				t.Errorf("Verify = %v, want ErrInvalidSuccession", err)
+			}
+		})
+	}
+
+	if _, err := old.SignSuccession(old); !errors.Is(err, yggdrasil.ErrInvalidSuccession) {
+		t.Errorf("SignSuccession(self) = %v", err)
+	}
+}
+
+func TestVerifySuccessionChain(t *testing.T) {
+	a, _ := yggdrasil.GenerateIdentity()
+	b, ab, _ := a.Rotate()
+	c, bc, _ := b.Rotate()
+	chain := []*yggdrasil.SuccessionStatement{ab, bc}
+
+	if err := yggdrasil.VerifySuccessionChain(chain, a.NodeID, c.NodeID); err != nil {
+		t.Errorf("full chain: %v", err)
+	}
+	if err := yggdrasil.VerifySuccessionChain(nil, a.NodeID, a.NodeID); err != nil {
+		t.Errorf("empty chain: %v", err)
+	}
+	if err := yggdrasil.VerifySuccessionChain(chain[:1], a.NodeID, c.NodeID); !errors.Is(err, yggdrasil.ErrInvalidSuccession) {
+		t.Errorf("short chain = %v", err)
+	}
+	if err := yggdrasil.VerifySuccessionChain([]*yggdrasil.SuccessionStatement{bc, ab}, a.NodeID, c.NodeID); !errors.Is(err, yggdrasil.ErrInvalidSuccession) {
+		t.Errorf("reordered chain = %v", err)
+	}
+}
+
+func TestDHTFollowsSuccession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes := newSimCluster(t, ctx, 12)
+	for _, n := range nodes[1:] {
+		n.dht.LookupNode(ctx, n.id.NodeID)
+	}
+
+	// Rotate twice and publish both statements from one node.
+	first, _ := yggdrasil.GenerateIdentity()
+	second, s1, _ := first.Rotate()
+	third, s2, _ := second.Rotate()
+	for _, st := range []struct {
+		s      *yggdrasil.SuccessionStatement
+		signer *yggdrasil.Identity
+	}{{s1, first}, {s2, third}} {
+		if err := nodes[3].dht.PublishSuccession(ctx, st.s, st.signer); err != nil {
+			t.Fatalf("PublishSuccession: %v", err)
+		}
+	}
+
+	far := nodes[len(nodes)-1]
+	chain, err := far.dht.FollowSuccession(ctx, first.NodeID)
+	if err != nil {
+		t.Fatalf("FollowSuccession: %v", err)
+	}
+	if err := yggdrasil.VerifySuccessionChain(chain, first.NodeID, third.NodeID); err != nil {
+		t.Errorf("followed chain: %v", err)
+	}
+	if chain, err := far.dht.FollowSuccession(ctx, third.NodeID); err != nil || len(chain) != 0 {
+		t.Errorf("FollowSuccession(current) = %d statements, %v", len(chain), err)
+	}
+
+	// A second statement for the same old key does not displace the first.
+	rival, _ := yggdrasil.GenerateIdentity()
+	s3, _ := first.SignSuccession(rival)
+	nodes[3].dht.PublishSuccession(ctx, s3, first)
+	if s, err := nodes[3].dht.ResolveSuccession(ctx, first.NodeID); err != nil || s.NewID != second.NodeID {
+		t.Errorf("ResolveSuccession after rival = %v, %v", s, err)
+	}
+}
+
+func TestDHTRejectsForgedSuccession(t *testing.T) {
+	self, _ := yggdrasil.GenerateIdentity()
+	dht := yggdrasil.NewDHT(self.NodeID)
+	old, _ := yggdrasil.GenerateIdentity()
+	_, s, _ := old.Rotate()
+
+	// A record under the statement's key whose value is a statement for a
+	// different old key.
+	other, _ := yggdrasil.GenerateIdentity()
+	_, wrong, _ := other.Rotate()
+	value, _ := wrong.MarshalBinary()
+	rec := &yggdrasil.DHTRecord{
+		Key:       yggdrasil.SuccessionKey(s.OldID),
+		Value:     append(value, wrong.Signature...),
+		Sequence:  1,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	rec.Sign(other)
+	if err := dht.Put(rec); !errors.Is(err, yggdrasil.ErrInvalidSuccession) {
+		t.Errorf("Put(mis-keyed statement) = %v, want ErrInvalidSuccession", err)
+	}
+}
+
+func TestDHTRepublishesSuccessionForSuccessor(t *testing.T) {
+	old, _ := yggdrasil.GenerateIdentity()
+	next, s, _ := old.Rotate()
+	stranger, _ := yggdrasil.GenerateIdentity()
+
+	for _, tt := range []struct {
+		self *yggdrasil.Identity
+		want int
+	}{
+		{next, 1},
+		{stranger, 0},
+	} {
+		dht := yggdrasil.NewDHT(tt.self.NodeID)
+		yggdrasil.NewRouter(tt.self, yggdrasil.NewPeerTable(tt.self.NodeID), dht, nil)
+		if err := dht.PublishSuccession(context.Background(), s, old); err != nil {
+			t.Fatalf("PublishSuccession: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond) // a refresh needs a later Timestamp
+		if n := dht.Republish(context.Background()); n != tt.want {
+			t.Errorf("Republish on %s = %d, want %d", tt.self.NodeID.Short(), n, tt.want)
+		}
+		if tt.want == 0 {
+			continue
+		}
+		// The successor re-signs the record with its own key.
+		rec, ok := dht.Get(yggdrasil.SuccessionKey(old.NodeID))
+		if !ok || rec.Publisher != next.NodeID {
+			t.Errorf("republished statement found=%v, want published by the successor", ok)
+		}
+	}
+}
+
+func TestPublishSuccessionRequiresParty(t *testing.T) {
+	old, _ := yggdrasil.GenerateIdentity()
+	_, s, _ := old.Rotate()
+	stranger, _ := yggdrasil.GenerateIdentity()
+	dht := yggdrasil.NewDHT(stranger.NodeID)
+	if err := dht.PublishSuccession(context.Background(), s, stranger); !errors.Is(err, yggdrasil.ErrInvalidSuccession) {
+		t.Errorf("PublishSuccession signed by a stranger = %v, want ErrInvalidSuccession", err)
+	}
+}
@@ -0,0 +1,77 @@
+package yggdrasil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// traceProbeTimeout bounds the wait for each Traceroute probe.
+const traceProbeTimeout = 2 * time.Second
+
+// ErrTraceIncomplete is returned when Traceroute runs out of hops before
+// reaching the target.
+var ErrTraceIncomplete = errors.New("yggdrasil: traceroute did not reach target")
+
+// Hop is one step on the path to a Traceroute target. NodeID is zero for
+// a hop that did not answer.
+type Hop struct {
+	NodeID types.NodeID
+	RTT    time.Duration
+}
+
+// Traceroute discovers the path messages take to target. Like IP
+// traceroute it sends PING probes with TTL 1, 2, ... up to DefaultTTL; the
+// relay at which a probe's TTL runs out answers it, and the final hop is
+// the target itself. The returned hops end with target unless an error is
+// returned.
+func (r *Router) Traceroute(ctx context.Context, target types.NodeID) ([]Hop, error) {
+	var hops []Hop
+	for ttl := 1; ttl <= DefaultTTL; ttl++ {
+		if err := ctx.Err(); err != nil {
+			return hops, err
+		}
+		probe := &Message{Type: types.MsgPing, To: target, TTL: ttl, Trace: true}
+		pctx, cancel := context.WithTimeout(ctx, traceProbeTimeout)
+		start := time.Now()
+		resp, err := r.roundTrip(pctx, probe, true)
+		rtt := time.Since(start)
+		cancel()
+
+		switch {
+		case err == nil:
+			hops = append(hops, Hop{NodeID: resp.From, RTT: rtt})
+			if resp.From == target {
+				return hops, nil
+			}
+		case errors.Is(err, ErrRequestTimeout):
+			hops = append(hops, Hop{})
+		default:
+			return hops, err
+		}
+	}
+	return hops, fmt.Errorf("%w: %s within %d hops", ErrTraceIncomplete, target.Short(), DefaultTTL)
+}
+
+// replyHop answers a trace probe whose TTL ran out here, once it checks
+// out: an unverified probe would let anyone aim our replies at a victim.
+func (r *Router) replyHop(probe *Message) error {
+	if err := r.verifyMessage(probe); err != nil {
+		r.emitEvent("message_rejected", map[string]string{
+			"from":   probe.From.Short(),
+			"reason": err.Error(),
+		})
+		return err
+	}
+	r.SendMessage(context.Background(), &Message{
+		Type:     probe.Type,
+		To:       probe.From,
+		ID:       probe.ID,
+		Response: true,
+		Trace:    true,
+	})
+	return nil
+}
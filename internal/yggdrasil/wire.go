@@ -0,0 +1,257 @@
+package yggdrasil
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+// Encoding is a wire format for routed messages. Peers agree on one per
+// connection during the identity exchange.
+type Encoding string
+
+const (
+	// EncodingBinary is the compact format of Message.MarshalBinary.
+	EncodingBinary Encoding = "binary"
+	// EncodingJSON is human-readable and understood by every peer, which
+	// makes it the fallback and the choice for debugging.
+	EncodingJSON Encoding = "json"
+)
+
+// binaryMessageVersion opens every binary-encoded message. JSON messages
+// open with '{', so a receiver can tell the two apart from the first byte.
+const binaryMessageVersion byte = 0x01
+
+// Message flag bits in the binary encoding.
+const (
+	flagResponse byte = 1 << 0
+	flagTrace    byte = 1 << 1
+)
+
+// maxVia bounds the relay list a binary message may carry, and maxTTL
+// the hop count.
+const (
+	maxVia = 255
+	maxTTL = 255
+)
+
+var ErrMalformedMessage = errors.New("yggdrasil: malformed message")
+
+// MarshalBinary encodes the message compactly:
+//
+//	[version:1] [type:1] [flags:1] [from:32] [to:32] [ttl:uvarint]
+//	[id:uvarint] [nonce:8] [timestamp:varint] [pub_key:bytes] [sig:bytes]
+//	[error:bytes] [via_count:uvarint] [via:32]... [payload:bytes]
+//
+// where bytes is a uvarint length followed by the data.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if m.TTL < 0 || m.TTL > maxTTL {
+		return nil, fmt.Errorf("%w: TTL %d out of range (0-%d)", ErrMalformedMessage, m.TTL, maxTTL)
+	}
+	if len(m.Via) > maxVia {
+		return nil, fmt.Errorf("%w: %d relays (max %d)", ErrMalformedMessage, len(m.Via), maxVia)
+	}
+
+	var flags byte
+	if m.Response {
+		flags |= flagResponse
+	}
+	if m.Trace {
+		flags |= flagTrace
+	}
+
+	size := 3 + 64 + 3*binary.MaxVarintLen64 + 8 + len(m.PubKey) + len(m.Sig) +
+		len(m.Error) + 32*len(m.Via) + len(m.Payload) + 5*binary.MaxVarintLen64
+	buf := make([]byte, 0, size)
+	buf = append(buf, binaryMessageVersion, byte(m.Type), flags)
+	buf = append(buf, m.From[:]...)
+	buf = append(buf, m.To[:]...)
+	buf = binary.AppendUvarint(buf, uint64(m.TTL))
+	buf = binary.AppendUvarint(buf, m.ID)
+	buf = binary.BigEndian.AppendUint64(buf, m.Nonce)
+	buf = binary.AppendVarint(buf, m.Timestamp)
+	buf = appendBytes(buf, m.PubKey)
+	buf = appendBytes(buf, m.Sig)
+	buf = appendBytes(buf, []byte(m.Error))
+	buf = binary.AppendUvarint(buf, uint64(len(m.Via)))
+	for _, id := range m.Via {
+		buf = append(buf, id[:]...)
+	}
+	return appendBytes(buf, m.Payload), nil
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// UnmarshalBinary decodes a message encoded by MarshalBinary.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	d := decoder{data: data}
+	if v := d.byte(); v != binaryMessageVersion {
+		return fmt.Errorf("%w: unknown version %#x", ErrMalformedMessage, v)
+	}
+
+	var msg Message
+	msg.Type = types.ProtocolMessageType(d.byte())
+	flags := d.byte()
+	msg.Response = flags&flagResponse != 0
+	msg.Trace = flags&flagTrace != 0
+	d.nodeID(&msg.From)
+	d.nodeID(&msg.To)
+	ttl := d.uvarint()
+	if ttl > maxTTL {
+		d.fail("TTL out of range")
+	}
+	msg.TTL = int(ttl)
+	msg.ID = d.uvarint()
+	msg.Nonce = d.uint64()
+	msg.Timestamp = d.varint()
+	msg.PubKey = d.bytes()
+	msg.Sig = d.bytes()
+	msg.Error = string(d.bytes())
+
+	n := d.uvarint()
+	if n > maxVia {
+		d.fail("too many relays")
+	} else if n > 0 {
+		msg.Via = make([]types.NodeID, n)
+		for i := range msg.Via {
+			d.nodeID(&msg.Via[i])
+		}
+	}
+	msg.Payload = d.bytes()
+
+	if d.err == nil && len(d.data) != 0 {
+		d.fail("trailing bytes")
+	}
+	if d.err != nil {
+		return d.err
+	}
+	*m = msg
+	return nil
+}
+
+// decoder reads the binary message format, recording the first error so
+// callers check once at the end.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(reason string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrMalformedMessage, reason)
+	}
+	d.data = nil
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.data) {
+		d.fail("truncated")
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) nodeID(id *types.NodeID) {
+	copy(id[:], d.take(len(id)))
+}
+
+// bytes reads a length-prefixed field. Empty fields decode as nil, as
+// they do from JSON.
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail("truncated")
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// encodeMessage encodes msg in enc.
+func encodeMessage(msg *Message, enc Encoding) ([]byte, error) {
+	if enc == EncodingBinary {
+		return msg.MarshalBinary()
+	}
+	return json.Marshal(msg)
+}
+
+// decodeMessage decodes a message in either encoding, telling them apart
+// by the first byte.
+func decodeMessage(data []byte) (*Message, error) {
+	var msg Message
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+		}
+		return &msg, nil
+	}
+	if err := msg.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// negotiateEncoding picks binary if both sides offer it, else JSON.
+func negotiateEncoding(ours, theirs []Encoding) Encoding {
+	for _, a := range ours {
+		if a != EncodingBinary {
+			continue
+		}
+		for _, b := range theirs {
+			if b == EncodingBinary {
+				return EncodingBinary
+			}
+		}
+	}
+	return EncodingJSON
+}
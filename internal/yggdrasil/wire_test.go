@@ -0,0 +1,234 @@
+package yggdrasil
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/valhalla/valhalla/internal/bifrost"
+	"github.com/valhalla/valhalla/internal/types"
+)
+
+func testMessage(t testing.TB) *Message {
+	t.Helper()
+	from, _ := GenerateIdentity()
+	to, _ := GenerateIdentity()
+	relay, _ := GenerateIdentity()
+	msg := &Message{
+		Type:     types.MsgFindNode,
+		To:       to.NodeID,
+		Payload:  []byte(`{"target":"0123456789abcdef"}`),
+		TTL:      DefaultTTL - 1,
+		ID:       42,
+		Response: true,
+		Error:    "boom",
+		Via:      []types.NodeID{relay.NodeID},
+		Trace:    true,
+	}
+	msg.sign(from)
+	return msg
+}
+
+func TestMessageEncodingRoundTrip(t *testing.T) {
+	msg := testMessage(t)
+	for _, enc := range []Encoding{EncodingBinary, EncodingJSON} {
+		t.Run(string(enc), func(t *testing.T) {
+			data, err := encodeMessage(msg, enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeMessage(data)
+			if err != nil {
+				t.Fatalf("decodeMessage: %v", err)
+			}
+			if !reflect.DeepEqual(got, msg) {
+				t.Errorf("decoded %+v, want %+v", got, msg)
+			}
+			if err := got.verifySignature(); err != nil {
+				t.Errorf("decoded message fails verification: %v", err)
+			}
+		})
+	}
+}
+
+func TestMessageBinaryIsSmaller(t *testing.T) {
+	msg := testMessage(t)
+	bin, _ := encodeMessage(msg, EncodingBinary)
+	js, _ := encodeMessage(msg, EncodingJSON)
+	if len(bin) >= len(js)/2 {
+		t.Errorf("binary %d bytes, JSON %d bytes", len(bin), len(js))
+	}
+}
+
+func TestMessageUnmarshalBinaryRejectsMalformed(t *testing.T) {
+	data, _ := testMessage(t).MarshalBinary()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown version", append([]byte{0x7f}, data[1:]...)},
+		{"truncated header", data[:40]},
+		{"truncated payload", data[:len(data)-1]},
+		{"trailing bytes", append(append([]byte(nil), data...), 0)},
+		{"huge length", append(append([]byte(nil), data[:3+64]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg Message
+			if err := msg.UnmarshalBinary(tt.data); !errors.Is(err, ErrMalformedMessage) {
+				t.Errorf("UnmarshalBinary = %v, want ErrMalformedMessage", err)
+			}
+		})
+	}
+}
+
+func TestMessageMarshalBinaryRejectsBadTTL(t *testing.T) {
+	for _, ttl := range []int{-1, maxTTL + 1} {
+		msg := testMessage(t)
+		msg.TTL = ttl
+		if _, err := msg.MarshalBinary(); !errors.Is(err, ErrMalformedMessage) {
+			t.Errorf("MarshalBinary with TTL %d = %v, want ErrMalformedMessage", ttl, err)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	both := []Encoding{EncodingBinary, EncodingJSON}
+	jsonOnly := []Encoding{EncodingJSON}
+
+	tests := []struct {
+		name         string
+		ours, theirs []Encoding
+		want         Encoding
+	}{
+		{"both binary", both, both, EncodingBinary},
+		{"we prefer JSON", jsonOnly, both, EncodingJSON},
+		{"they prefer JSON", both, jsonOnly, EncodingJSON},
+		{"peer predates negotiation", both, nil, EncodingJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateEncoding(tt.ours, tt.theirs); got != tt.want {
+				t.Errorf("negotiateEncoding = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterNegotiatesEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialer   Encoding
+		listener Encoding
+		want     Encoding
+	}{
+		{"binary", EncodingBinary, EncodingBinary, EncodingBinary},
+		{"dialer wants JSON", EncodingJSON, EncodingBinary, EncodingJSON},
+		{"listener wants JSON", EncodingBinary, EncodingJSON, EncodingJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			network := bifrost.NewSimNetwork(1)
+			a := newWireTestRouter(t, network, "a", tt.dialer)
+			b := newWireTestRouter(t, network, "b", tt.listener)
+
+			ln, err := network.Transport("b").Listen(ctx, "b:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				if conn, err := ln.Accept(ctx); err == nil {
+					b.AcceptPeer(ctx, conn)
+				}
+			}()
+
+			peer, err := a.Connect(ctx, types.PathAddr("/mem/"+ln.Addr()), types.NodeID{})
+			if err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			a.mu.RLock()
+			got := a.wire[peer.NodeID]
+			a.mu.RUnlock()
+			if got != tt.want {
+				t.Errorf("encoding = %s, want %s", got, tt.want)
+			}
+			if _, err := a.Ping(ctx, peer.NodeID); err != nil {
+				t.Errorf("Ping over %s: %v", got, err)
+			}
+		})
+	}
+}
+
+func newWireTestRouter(t *testing.T, network *bifrost.SimNetwork, host string, enc Encoding) *Router {
+	t.Helper()
+	id, _ := GenerateIdentity()
+	reg := bifrost.NewRegistry()
+	reg.Register("mem", network.Transport(host))
+	r := NewRouter(id, NewPeerTable(id.NodeID), NewDHT(id.NodeID), nil)
+	r.SetTransport(reg)
+	r.SetEncoding(enc)
+	return r
+}
+
+func FuzzMessageUnmarshalBinary(f *testing.F) {
+	data, _ := testMessage(f).MarshalBinary()
+	f.Add(data)
+	empty, _ := (&Message{}).MarshalBinary()
+	f.Add(empty)
+	f.Add([]byte{binaryMessageVersion})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg Message
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return
+		}
+		again, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("re-encoding a decoded message: %v", err)
+		}
+		var got Message
+		if err := got.UnmarshalBinary(again); err != nil {
+			t.Fatalf("decoding a re-encoded message: %v", err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Fatalf("round trip changed message: %+v -> %+v", msg, got)
+		}
+	})
+}
+
+func BenchmarkMessageEncode(b *testing.B) {
+	msg := testMessage(b)
+	for _, enc := range []Encoding{EncodingBinary, EncodingJSON} {
+		b.Run(string(enc), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := encodeMessage(msg, enc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMessageDecode(b *testing.B) {
+	msg := testMessage(b)
+	for _, enc := range []Encoding{EncodingBinary, EncodingJSON} {
+		data, _ := encodeMessage(msg, enc)
+		b.Run(string(enc), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeMessage(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
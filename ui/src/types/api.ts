@@ -43,4 +43,5 @@ export interface FullNodeState {
   trust_out: { attester: string; subject: string; claim: string; confidence: number }[];
   cache_size: number;
   pubsub_topics: string[];
+  routes: { dest: string; next_hop: string; hops: number; rtt_ms: number; failures: number }[] | null;
 }